@@ -0,0 +1,316 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/context"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+)
+
+const usage = `Usage: lbtds <command> [options]
+
+Commands:
+  serve    run load balancer (default, when no command given)
+  check    validate configuration file
+  switch   switch running instance to another color
+  status   show running instance status
+  version  show version
+
+Run "lbtds <command> -h" for command options.
+`
+
+// Exit codes
+const (
+	exitOK = iota
+	exitFailure
+	exitUsage
+)
+
+type statusResponse struct {
+	Version      string          `json:"version"`
+	CurrentColor string          `json:"current_color"`
+	ColorVersion uint64          `json:"color_version"`
+	Colors       []string        `json:"colors"`
+	StorageError string          `json:"storage_error"`
+	Services     []serviceStatus `json:"services"`
+}
+
+type serviceStatus struct {
+	Name         string   `json:"name"`
+	CurrentColor string   `json:"current_color"`
+	ColorVersion uint64   `json:"color_version"`
+	Colors       []string `json:"colors"`
+	StorageError string   `json:"storage_error"`
+}
+
+// runCommand parses command line and runs requested command. It returns
+// process exit code.
+func runCommand(args []string) int {
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		return serveCommand(args)
+	case "check":
+		return checkCommand(args)
+	case "switch":
+		return switchCommand(args)
+	case "status":
+		return statusCommand(args)
+	case "version":
+		fmt.Println("LBTDS v. " + context.VERSION)
+		return exitOK
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return exitOK
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n%s", command, usage)
+		return exitUsage
+	}
+}
+
+func newFlagSet(name string, arguments string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: lbtds %s [options]%s\n\nOptions:\n", name, arguments)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseFlags parses flags, which may come both before and after positional
+// arguments, e.g. "switch blue -service web". Exactly expected number of
+// positional arguments is returned.
+func parseFlags(flags *flag.FlagSet, args []string, expected int) ([]string, bool) {
+	var positional []string
+	for {
+		if flags.Parse(args) != nil {
+			return nil, false
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if len(positional) != expected {
+		if len(positional) > expected {
+			fmt.Fprintf(flags.Output(), "Unexpected argument: %s\n", positional[expected])
+		}
+		flags.Usage()
+		return nil, false
+	}
+	return positional, true
+}
+
+func serveCommand(args []string) int {
+	flags := newFlagSet("serve", "")
+	configPath := flags.String("c", "", "configuration file (default $LBTDS_CONFIG or ./lbtds.yaml)")
+	if _, ok := parseFlags(flags, args, 0); !ok {
+		return exitUsage
+	}
+
+	serve(*configPath)
+	return exitOK
+}
+
+func checkCommand(args []string) int {
+	flags := newFlagSet("check", "")
+	configPath := flags.String("c", "", "configuration file (default $LBTDS_CONFIG or ./lbtds.yaml)")
+	if _, ok := parseFlags(flags, args, 0); !ok {
+		return exitUsage
+	}
+
+	c := context.NewContext()
+	c.ConfigPath = *configPath
+	path := c.ConfigurationPath()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read configuration file: %s\n", err.Error())
+		return exitFailure
+	}
+
+	_, problems := config.Parse(data)
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", problem.Severity, problem.String())
+	}
+	if problems.HasErrors() {
+		fmt.Fprintf(os.Stderr, "Configuration %s is invalid\n", path)
+		return exitFailure
+	}
+
+	fmt.Printf("Configuration %s is valid\n", path)
+	return exitOK
+}
+
+func switchCommand(args []string) int {
+	flags := newFlagSet("switch", " <color>")
+	configPath, apiURL := apiFlags(flags)
+	service := flags.String("service", "", "service to switch (default is colors from top level of configuration)")
+	positional, ok := parseFlags(flags, args, 1)
+	if !ok {
+		return exitUsage
+	}
+
+	baseURL, err := resolveAPIURL(*configPath, *apiURL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitFailure
+	}
+
+	requestBody, _ := json.Marshal(&struct {
+		Color string `json:"color"`
+	}{Color: positional[0]})
+	colorURL := baseURL + "/api/v1/color/"
+	if *service != "" {
+		colorURL = baseURL + "/api/v1/services/" + url.PathEscape(*service) + "/color"
+	}
+	body, err := callAPI(http.MethodPost, colorURL, requestBody)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitFailure
+	}
+
+	fmt.Println(strings.TrimSpace(string(body)))
+	return exitOK
+}
+
+func statusCommand(args []string) int {
+	flags := newFlagSet("status", "")
+	configPath, apiURL := apiFlags(flags)
+	asJSON := flags.Bool("json", false, "print raw JSON response")
+	if _, ok := parseFlags(flags, args, 0); !ok {
+		return exitUsage
+	}
+
+	baseURL, err := resolveAPIURL(*configPath, *apiURL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitFailure
+	}
+
+	body, err := callAPI(http.MethodGet, baseURL+"/api/v1/status", nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitFailure
+	}
+	if *asJSON {
+		fmt.Println(strings.TrimSpace(string(body)))
+		return exitOK
+	}
+
+	var status statusResponse
+	err = json.Unmarshal(body, &status)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid status response: %s\n", err.Error())
+		return exitFailure
+	}
+	fmt.Printf("Version:       %s\n", status.Version)
+	// Older instances and configurations without services report single
+	// set of colors
+	if len(status.Services) <= 1 {
+		fmt.Printf("Current color: %s (version %d)\n", status.CurrentColor, status.ColorVersion)
+		fmt.Printf("Colors:        %s\n", strings.Join(status.Colors, ", "))
+		if status.StorageError != "" {
+			fmt.Printf("Storage error: %s\n", status.StorageError)
+		}
+		return exitOK
+	}
+
+	for _, service := range status.Services {
+		fmt.Printf("\nService:       %s\n", service.Name)
+		fmt.Printf("Current color: %s (version %d)\n", service.CurrentColor, service.ColorVersion)
+		fmt.Printf("Colors:        %s\n", strings.Join(service.Colors, ", "))
+		if service.StorageError != "" {
+			fmt.Printf("Storage error: %s\n", service.StorageError)
+		}
+	}
+	return exitOK
+}
+
+func apiFlags(flags *flag.FlagSet) (*string, *string) {
+	configPath := flags.String("c", "", "configuration file to take API address from (default $LBTDS_CONFIG or ./lbtds.yaml)")
+	apiURL := flags.String("api", "", "management API URL, e.g. http://127.0.0.1:4800 (overrides configuration)")
+	return configPath, apiURL
+}
+
+// resolveAPIURL returns management API base URL. If it isn't set
+// explicitly, it is taken from configuration file.
+func resolveAPIURL(configPath string, apiURL string) (string, error) {
+	if apiURL != "" {
+		return strings.TrimSuffix(apiURL, "/"), nil
+	}
+
+	c := context.NewContext()
+	c.ConfigPath = configPath
+	path := c.ConfigurationPath()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("can't determine API address, use -api or -c: %s", err.Error())
+	}
+	// Only API section matters here, so other problems are ignored
+	configuration, problems := config.Parse(data)
+	if configuration == nil {
+		return "", errors.New(problems.Error())
+	}
+
+	address := configuration.API.Address
+	if address == "" || address == "0.0.0.0" || address == "::" {
+		address = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(address, configuration.API.Port), nil
+}
+
+// callAPI sends request to management API and returns response body.
+// Non-2xx responses are returned as errors.
+func callAPI(method string, url string, body []byte) ([]byte, error) {
+	var requestBody io.Reader
+	if body != nil {
+		requestBody = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, url, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach management API: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read management API response: %s", err.Error())
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, fmt.Errorf("management API returned %d: %s", response.StatusCode, strings.TrimSpace(string(responseBody)))
+	}
+
+	return responseBody, nil
+}
@@ -0,0 +1,109 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/testshelpers"
+)
+
+/* cli.go */
+
+func TestCheckCommand(t *testing.T) {
+	testshelpers.InitializeConfiguration(".", "lbtds-invalid")
+	testshelpers.InitializeConfiguration(".", "lbtds-valid")
+
+	require.Equal(t, exitOK, runCommand([]string{"check"}))
+	require.Equal(t, exitFailure, runCommand([]string{"check", "-c", "/tmp/lbtds-test-lbtds-invalid.yaml"}))
+	require.Equal(t, exitFailure, runCommand([]string{"check", "-c", "/this/path/is/nonexistent.yaml"}))
+	require.Equal(t, exitUsage, runCommand([]string{"check", "-unknown"}))
+	require.Equal(t, exitUsage, runCommand([]string{"check", "lbtds.yaml"}))
+	require.Equal(t, exitUsage, runCommand([]string{"frobnicate"}))
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+	testshelpers.FlushConfiguration("lbtds-invalid")
+}
+
+func TestResolveAPIURL(t *testing.T) {
+	testshelpers.InitializeConfiguration(".", "lbtds-valid")
+	err := ioutil.WriteFile("/tmp/lbtds-test-cli-api.yaml", []byte("api:\n  address: \"0.0.0.0\"\n  port: \"4900\"\n"), 0644)
+	require.Nil(t, err)
+	defer os.Remove("/tmp/lbtds-test-cli-api.yaml")
+
+	// Explicit URL wins over any configuration
+	apiURL, err := resolveAPIURL("/tmp/lbtds-test-cli-api.yaml", "http://10.0.0.1:4800/")
+	require.Nil(t, err)
+	require.Equal(t, "http://10.0.0.1:4800", apiURL)
+
+	// Configuration from command line wins over environment, wildcard
+	// address is reached through loopback
+	apiURL, err = resolveAPIURL("/tmp/lbtds-test-cli-api.yaml", "")
+	require.Nil(t, err)
+	require.Equal(t, "http://127.0.0.1:4900", apiURL)
+
+	apiURL, err = resolveAPIURL("", "")
+	require.Nil(t, err)
+	require.Equal(t, "http://127.0.0.1:4800", apiURL)
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+
+	_, err = resolveAPIURL("/this/path/is/nonexistent.yaml", "")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "use -api or -c")
+}
+
+func TestSwitchAndStatusCommands(t *testing.T) {
+	var mutex sync.Mutex
+	var requests []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(body))
+		mutex.Unlock()
+
+		switch {
+		case r.URL.Path == "/api/v1/status":
+			w.Write([]byte(`{"version":"1","current_color":"green","color_version":3,"colors":["green","blue"]}`))
+		case r.URL.Path == "/broken/api/v1/status":
+			w.Write([]byte(`not json`))
+		case strings.Contains(r.URL.Path, "/missing/"):
+			http.Error(w, `{"error":"service not found"}`, http.StatusNotFound)
+		default:
+			w.Write([]byte(`{"result":"ok"}`))
+		}
+	}))
+	defer api.Close()
+	lastRequest := func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return requests[len(requests)-1]
+	}
+
+	require.Equal(t, exitOK, runCommand([]string{"switch", "-api", api.URL, "blue"}))
+	require.Equal(t, `POST /api/v1/color/ {"color":"blue"}`, lastRequest())
+
+	// Flags may follow color
+	require.Equal(t, exitOK, runCommand([]string{"switch", "blue", "-api", api.URL, "-service", "web"}))
+	require.Equal(t, `POST /api/v1/services/web/color {"color":"blue"}`, lastRequest())
+
+	require.Equal(t, exitUsage, runCommand([]string{"switch", "-api", api.URL}))
+	require.Equal(t, exitUsage, runCommand([]string{"switch", "blue", "green", "-api", api.URL}))
+	require.Equal(t, exitUsage, runCommand([]string{"switch", "blue", "-unknown"}))
+	require.Equal(t, exitFailure, runCommand([]string{"switch", "blue", "-service", "missing", "-api", api.URL}))
+
+	require.Equal(t, exitOK, runCommand([]string{"status", "-api", api.URL}))
+	require.Equal(t, "GET /api/v1/status ", lastRequest())
+	require.Equal(t, exitOK, runCommand([]string{"status", "-api", api.URL, "-json"}))
+	require.Equal(t, exitUsage, runCommand([]string{"status", "extra", "-api", api.URL}))
+	require.Equal(t, exitFailure, runCommand([]string{"status", "-api", api.URL + "/broken"}))
+	require.Equal(t, exitFailure, runCommand([]string{"status", "-api", "http://127.0.0.1:1"}))
+}
@@ -8,23 +8,29 @@ import (
 	ctx "context"
 	"net/http"
 	"time"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/access"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/metrics"
 )
 
 // InitAPIServer initializes API server mux
 func (c *Context) InitAPIServer() {
-	listenAddress := c.Config.API.Address + ":" + c.Config.API.Port
+	listenAddress := c.Config().API.Address + ":" + c.Config().API.Port
 	c.APIServer = &http.Server{
 		Addr: listenAddress,
 	}
 	c.APIServerMux = http.NewServeMux()
+	c.APIServerMux.HandleFunc("/api/v1/log/level/", c.ChangeLogLevel)
+	c.APIServerMux.HandleFunc("/metrics", metrics.Handler)
 }
 
 // StartAPIServer starts API server for listening
 func (c *Context) StartAPIServer() {
-	listenAddress := c.Config.API.Address + ":" + c.Config.API.Port
+	listenAddress := c.Config().API.Address + ":" + c.Config().API.Port
 	c.Logger.Info().Msg("Starting API server on http://" + listenAddress)
 
-	c.APIServer.Handler = c.APIServerMux
+	c.APIServer.Handler = c.apiAccessHandler(c.APIServerMux)
 	go func() {
 		err := c.APIServer.ListenAndServe()
 		// It will always throw an error on graceful shutdown so it's considered
@@ -69,7 +75,7 @@ func (c *Context) ShutdownAPIServer() {
 
 // checkAPIHealth sends request to API server
 func (c *Context) checkAPIHealth() error {
-	listenAddress := c.Config.API.Address + ":" + c.Config.API.Port
+	listenAddress := c.Config().API.Address + ":" + c.Config().API.Port
 	req, err := http.NewRequest("GET", "http://"+listenAddress+"/nonexistent/", nil)
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	if err != nil {
@@ -80,3 +86,65 @@ func (c *Context) checkAPIHealth() error {
 	_, err = client.Do(req)
 	return err
 }
+
+// apiAccess is compiled api.access with proxies, which are trusted to
+// tell client address
+type apiAccess struct {
+	rules          *access.Rules
+	trustedProxies access.Networks
+}
+
+// CheckAPIAccess checks api.access and proxy.trusted_proxies of
+// configuration without applying them
+func (c *Context) CheckAPIAccess(configuration *config.Struct) error {
+	_, err := newAPIAccess(configuration)
+	return err
+}
+
+// ReloadAPIAccess applies api.access and proxy.trusted_proxies of
+// configuration to API requests. Running rules are kept if new ones are
+// invalid.
+func (c *Context) ReloadAPIAccess(configuration *config.Struct) error {
+	current, err := newAPIAccess(configuration)
+	if err != nil {
+		return err
+	}
+	c.apiAccess.Store(current)
+	return nil
+}
+
+func newAPIAccess(configuration *config.Struct) (*apiAccess, error) {
+	rules, err := access.NewRules(configuration.API.Access)
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies, err := access.ParseNetworks(configuration.Proxy.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &apiAccess{rules: rules, trustedProxies: trustedProxies}, nil
+}
+
+// apiAccessHandler passes requests to API only from clients allowed by
+// api.access
+func (c *Context) apiAccessHandler(handler http.Handler) http.Handler {
+	err := c.ReloadAPIAccess(c.Config())
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("Invalid API access rules, API is closed")
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current, _ := c.apiAccess.Load().(*apiAccess)
+		if current == nil {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		clientIP := access.ClientIP(r, current.trustedProxies)
+		if !current.rules.Allowed(clientIP) {
+			c.Logger.Warn().Str("remote", r.RemoteAddr).Str("client", clientIP.String()).Str("path", r.URL.Path).Msg("API request denied by access rules")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -10,11 +10,9 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
-	"runtime"
 	"time"
 
 	"github.com/rs/zerolog"
-	"gopkg.in/yaml.v2"
 	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
 )
 
@@ -22,7 +20,11 @@ import (
 // Without these parts of the application we can't start at all
 func (c *Context) Init() {
 	c.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout}).With().Timestamp().Logger()
+	// Collect runtime statistics once, so log hook will have something to
+	// show until periodic collection starts
+	c.collectRuntimeStats()
 	c.Logger = c.Logger.Hook(zerolog.HookFunc(c.getMemoryUsage))
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
 
 	c.inShutdownMutex.Lock()
 	c.inShutdown = false
@@ -38,44 +40,66 @@ func (c *Context) Init() {
 func (c *Context) InitConfiguration() bool {
 	c.Logger.Info().Msg("Loading configuration files...")
 
-	configPath := os.Getenv("LBTDS_CONFIG")
-	if configPath == "" {
-		configPath = "./lbtds.yaml"
+	configuration, err := c.LoadConfiguration()
+	if configuration != nil {
+		c.SetConfig(configuration)
 	}
-	normalizedConfigPath, _ := filepath.Abs(configPath)
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("Configuration is invalid")
+		return false
+	}
+
+	c.Logger.Info().Msg("Configuration file parsed successfully")
+
+	return true
+}
+
+// Config returns running configuration. It shouldn't be changed, changed
+// copy is published with SetConfig instead.
+func (c *Context) Config() *config.Struct {
+	configuration, _ := c.configuration.Load().(*config.Struct)
+	return configuration
+}
+
+// SetConfig replaces running configuration
+func (c *Context) SetConfig(configuration *config.Struct) {
+	c.configuration.Store(configuration)
+}
+
+// LoadConfiguration reads and checks configuration file without applying
+// it. Returned configuration is nil if file can't be read or parsed, but it
+// is returned along with error if it fails checks.
+func (c *Context) LoadConfiguration() (*config.Struct, error) {
+	normalizedConfigPath := c.ConfigurationPath()
 	c.Logger.Debug().Msgf("Configuration file path: %s", normalizedConfigPath)
 
 	// Read configuration file into []byte.
 	fileData, err := ioutil.ReadFile(normalizedConfigPath)
 	if err != nil {
-		c.Logger.Error().Err(err).Msg("Failed to read configuration file")
-		return false
+		return nil, fmt.Errorf("failed to read configuration file: %s", err.Error())
 	}
 
-	c.Config = &config.Struct{}
-	err = yaml.Unmarshal(fileData, c.Config)
-	if err != nil {
-		c.Logger.Error().Err(err).Msg("Failed to parse configuration file")
-		return false
+	configuration, problems := config.Parse(fileData)
+	for _, problem := range problems.Warnings() {
+		c.Logger.Warn().Str("path", problem.Path).Msg(problem.Message)
 	}
-
-	c.Logger.Info().Msg("Configuration file parsed successfully")
-
-	if len(c.Config.Colors) == 0 {
-		c.Logger.Error().Err(err).Msg("There is no colors in configuration")
-		return false
+	if configuration == nil || problems.HasErrors() {
+		return configuration, problems
 	}
 
-	return true
+	return configuration, nil
 }
 
-// getMemoryUsage returns memory usage for logger.
-func (c *Context) getMemoryUsage(e *zerolog.Event, level zerolog.Level, message string) {
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-
-	e.Str("memalloc", fmt.Sprintf("%dMB", m.Alloc/1024/1024))
-	e.Str("memsys", fmt.Sprintf("%dMB", m.Sys/1024/1024))
-	e.Str("numgc", fmt.Sprintf("%d", m.NumGC))
+// ConfigurationPath returns absolute path to configuration file
+func (c *Context) ConfigurationPath() string {
+	configPath := c.ConfigPath
+	if configPath == "" {
+		configPath = os.Getenv("LBTDS_CONFIG")
+	}
+	if configPath == "" {
+		configPath = "./lbtds.yaml"
+	}
+	normalizedConfigPath, _ := filepath.Abs(configPath)
 
+	return normalizedConfigPath
 }
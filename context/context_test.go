@@ -4,11 +4,23 @@
 package context
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/require"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/metrics"
 )
 
 /* exported.go */
@@ -79,6 +91,337 @@ func TestInitConfigurationWithRightFilePath(t *testing.T) {
 	os.Unsetenv("LBTDS_CONFIG")
 }
 
+func TestConfigurationPath(t *testing.T) {
+	c := NewContext()
+	require.True(t, strings.HasSuffix(c.ConfigurationPath(), "/lbtds.yaml"))
+
+	os.Setenv("LBTDS_CONFIG", "/tmp/from-environment.yaml")
+	require.Equal(t, "/tmp/from-environment.yaml", c.ConfigurationPath())
+
+	// Command line has priority over environment
+	c.ConfigPath = "/tmp/from-command-line.yaml"
+	require.Equal(t, "/tmp/from-command-line.yaml", c.ConfigurationPath())
+	os.Unsetenv("LBTDS_CONFIG")
+}
+
+func TestLoadConfigurationWithInvalidFile(t *testing.T) {
+	os.Setenv("LBTDS_CONFIG", "../internal/testshelpers/config_templates/lbtds-invalid.yaml")
+	c := NewContext()
+	c.Init()
+
+	configuration, err := c.LoadConfiguration()
+	require.NotNil(t, configuration)
+	require.NotNil(t, err)
+
+	problems, ok := err.(config.Problems)
+	require.True(t, ok)
+	paths := make([]string, 0, len(problems))
+	for _, problem := range problems.Errors() {
+		paths = append(paths, problem.Path)
+	}
+
+	require.Contains(t, paths, "proxy.pid_fiel")
+	// Values of wrong types are reported with their paths too
+	require.Contains(t, paths, "proxy.storage_timeout")
+	require.NotContains(t, paths, "")
+	require.Contains(t, paths, "proxy.color_file")
+	require.Contains(t, paths, "colors[0].backends[0].destinations[1].weight")
+	require.Contains(t, paths, "colors[0].backends[0].destinations[1].wieght")
+	require.Contains(t, paths, "colors[0].backends[0].rate_limits[0].rate")
+	require.Contains(t, paths, "colors[0].backends[0].rate_limits[0].key")
+	require.Contains(t, paths, "colors[0].backends[0].access.deny[0]")
+	require.Contains(t, paths, "colors[0].backends[0].headers.request.remove[0]")
+	require.Contains(t, paths, "colors[0].backends[0].unavailable.content_type")
+	require.Contains(t, paths, "colors[0].backends[0].send_proxy_protocol")
+	require.Contains(t, paths, "colors[0].backends[1].accept_proxy_protocol")
+	require.Contains(t, paths, "colors[0].backends[0].tls.cert_file")
+	require.Contains(t, paths, "colors[0].backends[0].h2c")
+	require.Contains(t, paths, "colors[0].backends[1].tls")
+	require.Contains(t, paths, "colors[0].backends[0].tls.client_auth.mode")
+	require.Contains(t, paths, "colors[0].backends[0].tls.client_auth.ca_file")
+	require.Contains(t, paths, "colors[0].backends[0].tls.client_auth.allow[0]")
+	require.Contains(t, paths, "colors[0].backends[0].tls.client_auth.headers.subject")
+	require.Contains(t, paths, "colors[0].backends[0].upstream_tls.ca_file")
+	require.Contains(t, paths, "colors[0].backends[0].upstream_tls.key_file")
+	require.Contains(t, paths, "colors[0].backends[0].upstream_tls.min_version")
+	require.Contains(t, paths, "colors[0].backends[0].upstream_h2c")
+	require.Contains(t, paths, "colors[0].backends[0].grpc.health_check.interval")
+	require.Contains(t, paths, "colors[0].backends[0].grpc.routes[0].service")
+	require.Contains(t, paths, "colors[0].backends[0].grpc.routes[0].retry.statuses[0]")
+	require.Contains(t, paths, "api.access.allow[0]")
+	require.Contains(t, paths, "proxy.trusted_proxies[0]")
+	for _, problem := range problems.Errors() {
+		if problem.Path == "colors[0].backends[0].upstream_tls.min_version" {
+			require.Contains(t, problem.Message, "1.0, 1.1, 1.2, 1.3")
+		}
+	}
+	require.Contains(t, paths, "colors[0].backends[1].type")
+	require.Contains(t, paths, "colors[0].backends[1].listen_on")
+	require.Contains(t, paths, "colors[0].backends[1].destinations")
+	require.Contains(t, paths, "colors[1].name")
+	require.Contains(t, paths, "colors[1].backends[0].listen_on")
+	require.Contains(t, paths, "colors[1].backends[0].destinations[0]")
+	require.Contains(t, paths, "services[0].name")
+	require.Contains(t, paths, "services[0].colors")
+	require.Contains(t, paths, "services[1].name")
+	require.Contains(t, paths, "services[1].colors[0].backends[0].source")
+
+	require.False(t, c.InitConfiguration())
+	os.Unsetenv("LBTDS_CONFIG")
+}
+
+func TestLoadConfigurationWithMismatchedListeners(t *testing.T) {
+	os.Setenv("LBTDS_CONFIG", "../internal/testshelpers/config_templates/lbtds-different-backends.yaml")
+	c := NewContext()
+	c.Init()
+
+	// Colors with different listeners are allowed explicitly, but reported
+	configuration, err := c.LoadConfiguration()
+	require.NotNil(t, configuration)
+	require.Nil(t, err)
+
+	problems := configuration.Validate()
+	require.False(t, problems.HasErrors())
+	require.NotEmpty(t, problems.Warnings())
+
+	// ...and are an error otherwise
+	configuration.Proxy.AllowDifferentListeners = false
+	problems = configuration.Validate()
+	require.True(t, problems.HasErrors())
+	require.Equal(t, "colors[1].backends", problems.Errors()[0].Path)
+	require.Contains(t, problems.Errors()[0].Message, "allow_different_listeners")
+	os.Unsetenv("LBTDS_CONFIG")
+}
+
+func TestLoadConfigurationWithDestinationOptions(t *testing.T) {
+	os.Setenv("LBTDS_CONFIG", "../internal/testshelpers/config_templates/lbtds-destination-options.yaml")
+	c := NewContext()
+	c.Init()
+
+	// Plain addresses and destinations with options can be mixed
+	configuration, err := c.LoadConfiguration()
+	require.Nil(t, err)
+	require.Equal(t, []config.Destination{
+		{Address: "127.0.0.1:8223"},
+		{Address: "127.0.0.1:8224", Weight: 3, MaxConns: 100, SlowStart: 30 * time.Second},
+		{Address: "127.0.0.1:8225", Backup: true},
+	}, configuration.Colors[0].Backends[1].Destinations)
+	require.Equal(t, 150, configuration.Colors[0].Backends[1].MaxConns)
+	require.Equal(t, 20, configuration.Colors[0].Backends[1].QueueLimit())
+	require.Equal(t, 2*time.Second, configuration.Colors[0].Backends[1].EffectiveQueueTimeout())
+	require.Equal(t, 5*time.Second, configuration.Colors[0].Backends[1].EffectiveRetryAfter())
+	require.Equal(t, `{"error":"overloaded"}`, configuration.Colors[0].Backends[1].Unavailable.EffectiveBody())
+	require.Equal(t, "application/json", configuration.Colors[0].Backends[1].Unavailable.EffectiveContentType())
+	require.Equal(t, "Service unavailable\n", configuration.Colors[0].Backends[0].Unavailable.EffectiveBody())
+
+	// Passive health checks are on by default and can be turned off
+	require.Equal(t, time.Duration(0), configuration.Colors[0].Backends[1].EffectivePassiveDownTime())
+	require.Equal(t, 10*time.Second, configuration.Colors[1].Backends[0].EffectivePassiveDownTime())
+	require.Equal(t, 30*time.Second, configuration.Colors[1].Backends[1].EffectivePassiveDownTime())
+
+	// Turned off checks survive JSON form of backend
+	data, err := json.Marshal(configuration.Colors[0].Backends[1])
+	require.Nil(t, err)
+	require.Contains(t, string(data), `"passive_down_time":"0s"`)
+	var backend config.BackendConfig
+	require.Nil(t, json.Unmarshal(data, &backend))
+	require.Equal(t, configuration.Colors[0].Backends[1], backend)
+	os.Unsetenv("LBTDS_CONFIG")
+}
+
+/* logger.go */
+
+func TestInitLoggerJSONToFile(t *testing.T) {
+	os.Setenv("LBTDS_CONFIG", "../internal/testshelpers/config_templates/lbtds-valid.yaml")
+	os.Remove("/tmp/lbtds-test-app.log")
+	c := NewContext()
+	c.Init()
+
+	result := c.InitConfiguration()
+	require.True(t, result)
+
+	c.Config().Log.Level = "warn"
+	c.Config().Log.Format = "json"
+	c.Config().Log.Output.Type = "file"
+	c.Config().Log.Output.Path = "/tmp/lbtds-test-app.log"
+	result = c.InitLogger()
+	require.True(t, result)
+	require.Equal(t, zerolog.WarnLevel, zerolog.GlobalLevel())
+
+	c.Logger.Info().Msg("This should be filtered")
+	c.Logger.Warn().Msg("This should be written")
+
+	data, err := ioutil.ReadFile("/tmp/lbtds-test-app.log")
+	require.Nil(t, err)
+	require.NotContains(t, string(data), "filtered")
+	require.Contains(t, string(data), `"level":"warn"`)
+	require.Contains(t, string(data), `"message":"This should be written"`)
+	require.Contains(t, string(data), `"memalloc":"`)
+	// JSON logs shouldn't contain ANSI escape sequences
+	require.NotContains(t, string(data), "\x1b[")
+
+	c.ReopenLogOutput()
+	require.Nil(t, os.Remove("/tmp/lbtds-test-app.log"))
+	os.Unsetenv("LBTDS_CONFIG")
+}
+
+func TestInitLoggerJSONToSyslogOverTCP(t *testing.T) {
+	os.Setenv("LBTDS_CONFIG", "../internal/testshelpers/config_templates/lbtds-valid.yaml")
+	syslogServer, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer syslogServer.Close()
+
+	c := NewContext()
+	c.Init()
+
+	result := c.InitConfiguration()
+	require.True(t, result)
+
+	c.Config().Log.Format = "json"
+	c.Config().Log.Output.Type = "syslog"
+	c.Config().Log.Output.Syslog.Network = "tcp"
+	c.Config().Log.Output.Syslog.Address = syslogServer.Addr().String()
+	result = c.InitLogger()
+	require.True(t, result)
+
+	conn, err := syslogServer.Accept()
+	require.Nil(t, err)
+	defer conn.Close()
+
+	c.Logger.Error().Msg("Something bad happened")
+
+	reader := bufio.NewReader(conn)
+	// First message is about logger configuration
+	for i := 0; i < 2; i++ {
+		length, err := reader.ReadString(' ')
+		require.Nil(t, err)
+		size, err := strconv.Atoi(strings.TrimSpace(length))
+		require.Nil(t, err)
+		message := make([]byte, size)
+		_, err = io.ReadFull(reader, message)
+		require.Nil(t, err)
+		if i == 0 {
+			// daemon.info
+			require.True(t, strings.HasPrefix(string(message), "<30>1 "), string(message))
+			continue
+		}
+		// daemon.err
+		require.True(t, strings.HasPrefix(string(message), "<27>1 "), string(message))
+		require.Contains(t, string(message), `"message":"Something bad happened"`)
+	}
+
+	os.Unsetenv("LBTDS_CONFIG")
+}
+
+func TestInitLoggerWithInvalidConfiguration(t *testing.T) {
+	os.Setenv("LBTDS_CONFIG", "../internal/testshelpers/config_templates/lbtds-valid.yaml")
+	c := NewContext()
+	c.Init()
+
+	result := c.InitConfiguration()
+	require.True(t, result)
+
+	c.Config().Log.Level = "verbose"
+	require.False(t, c.InitLogger())
+
+	c.Config().Log.Level = "info"
+	c.Config().Log.Format = "xml"
+	require.False(t, c.InitLogger())
+
+	c.Config().Log.Format = "json"
+	c.Config().Log.Output.Type = "syslog"
+	c.Config().Log.Output.Syslog.Network = "carrier-pigeon"
+	require.False(t, c.InitLogger())
+
+	os.Unsetenv("LBTDS_CONFIG")
+}
+
+func TestChangeLogLevel(t *testing.T) {
+	c := NewContext()
+	c.Init()
+
+	rec := httptest.NewRecorder()
+	c.ChangeLogLevel(rec, httptest.NewRequest("POST", "/api/v1/log/level/", bytes.NewBufferString(`{"level": "error"}`)))
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "Log level changed\n", rec.Body.String())
+	require.Equal(t, zerolog.ErrorLevel, zerolog.GlobalLevel())
+
+	rec = httptest.NewRecorder()
+	c.ChangeLogLevel(rec, httptest.NewRequest("GET", "/api/v1/log/level/", nil))
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, `{"level":"error"}`, strings.TrimSpace(rec.Body.String()))
+
+	rec = httptest.NewRecorder()
+	c.ChangeLogLevel(rec, httptest.NewRequest("POST", "/api/v1/log/level/", bytes.NewBufferString(`{"level": "loud"}`)))
+	require.Equal(t, 400, rec.Code)
+	require.Equal(t, zerolog.ErrorLevel, zerolog.GlobalLevel())
+
+	rec = httptest.NewRecorder()
+	c.ChangeLogLevel(rec, httptest.NewRequest("PUT", "/api/v1/log/level/", nil))
+	require.Equal(t, 404, rec.Code)
+
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+}
+
+/* runtime_stats.go */
+
+func TestRuntimeStatsCollection(t *testing.T) {
+	os.Setenv("LBTDS_CONFIG", "../internal/testshelpers/config_templates/lbtds-valid.yaml")
+	c := NewContext()
+	c.Init()
+
+	result := c.InitConfiguration()
+	require.True(t, result)
+
+	firstStats, ok := c.runtimeStats.Load().(*runtimeStats)
+	require.True(t, ok)
+
+	c.Config().RuntimeStats.Interval = 50 * time.Millisecond
+	c.StartRuntimeStats()
+	time.Sleep(200 * time.Millisecond)
+	c.StopRuntimeStats()
+
+	lastStats := c.runtimeStats.Load().(*runtimeStats)
+	require.True(t, lastStats.collectedAt.After(firstStats.collectedAt))
+
+	rec := httptest.NewRecorder()
+	metrics.Handler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Contains(t, rec.Body.String(), "# TYPE lbtds_goroutines gauge\nlbtds_goroutines ")
+	require.Contains(t, rec.Body.String(), "lbtds_memory_alloc_bytes ")
+	require.Contains(t, rec.Body.String(), "# TYPE lbtds_gc_cycles_total counter\n")
+	require.Contains(t, rec.Body.String(), "# TYPE lbtds_gc_pause_seconds_total counter\n")
+
+	os.Unsetenv("LBTDS_CONFIG")
+}
+
+func TestRuntimeStatsLogHookDisabled(t *testing.T) {
+	os.Setenv("LBTDS_CONFIG", "../internal/testshelpers/config_templates/lbtds-valid.yaml")
+	os.Remove("/tmp/lbtds-test-app.log")
+	c := NewContext()
+	c.Init()
+
+	result := c.InitConfiguration()
+	require.True(t, result)
+
+	logHook := false
+	c.Config().RuntimeStats.LogHook = &logHook
+	c.Config().Log.Format = "json"
+	c.Config().Log.Output.Type = "file"
+	c.Config().Log.Output.Path = "/tmp/lbtds-test-app.log"
+	result = c.InitLogger()
+	require.True(t, result)
+
+	c.Logger.Info().Msg("No memory stats here")
+
+	data, err := ioutil.ReadFile("/tmp/lbtds-test-app.log")
+	require.Nil(t, err)
+	require.Contains(t, string(data), "No memory stats here")
+	require.NotContains(t, string(data), "memalloc")
+
+	require.Nil(t, os.Remove("/tmp/lbtds-test-app.log"))
+	os.Unsetenv("LBTDS_CONFIG")
+}
+
 /* pid_files.go */
 
 func TestCheckPIDFile(t *testing.T) {
@@ -282,6 +625,52 @@ func TestAPIServerStartAndShutdown(t *testing.T) {
 	os.Unsetenv("LBTDS_CONFIG")
 }
 
+func TestAPIServerAccessRules(t *testing.T) {
+	os.Setenv("LBTDS_CONFIG", "../internal/testshelpers/config_templates/lbtds-valid.yaml")
+	c := NewContext()
+	c.Init()
+	require.True(t, c.InitConfiguration())
+	c.Config().API.Access = config.AccessRules{Allow: []string{"10.0.0.0/8", "2001:db8::/32"}, Deny: []string{"10.0.0.13"}}
+	c.Config().Proxy.TrustedProxies = []string{"192.0.2.1"}
+	c.InitAPIServer()
+	handler := c.apiAccessHandler(c.APIServerMux)
+
+	apiRequest := func(remoteAddr string, forwardedFor string) int {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	require.Equal(t, 200, apiRequest("10.1.2.3:40000", ""))
+	require.Equal(t, 200, apiRequest("[2001:db8::1]:40000", ""))
+	require.Equal(t, 403, apiRequest("10.0.0.13:40000", ""))
+	require.Equal(t, 403, apiRequest("198.51.100.1:40000", ""))
+	// X-Forwarded-For is honored only from trusted proxy
+	require.Equal(t, 200, apiRequest("192.0.2.1:40000", "198.51.100.1, 10.1.2.3"))
+	require.Equal(t, 403, apiRequest("192.0.2.1:40000", "10.1.2.3, 198.51.100.1"))
+	require.Equal(t, 403, apiRequest("198.51.100.1:40000", "10.1.2.3"))
+
+	// Reloaded rules are applied to next requests
+	reloaded := *c.Config()
+	reloaded.API.Access = config.AccessRules{Allow: []string{"198.51.100.0/24"}}
+	reloaded.Proxy.TrustedProxies = nil
+	require.Nil(t, c.ReloadAPIAccess(&reloaded))
+	require.Equal(t, 200, apiRequest("198.51.100.1:40000", ""))
+	require.Equal(t, 403, apiRequest("10.1.2.3:40000", ""))
+	require.Equal(t, 403, apiRequest("192.0.2.1:40000", "198.51.100.1"))
+
+	// ...unless they are invalid
+	reloaded.API.Access = config.AccessRules{Allow: []string{"not a network"}}
+	require.NotNil(t, c.ReloadAPIAccess(&reloaded))
+	require.Equal(t, 200, apiRequest("198.51.100.1:40000", ""))
+	os.Unsetenv("LBTDS_CONFIG")
+}
+
 /* shutdown.go */
 
 func TestIsShuttingDown(t *testing.T) {
@@ -7,9 +7,10 @@ import (
 	"math/rand"
 	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"github.com/rs/zerolog"
-	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/output"
 )
 
 // VERSION is our current version
@@ -18,18 +19,32 @@ const VERSION = "0.1.0"
 // Context is the main application context. This struct handles operations
 // between all parts of the application
 type Context struct {
-	Config *config.Struct
-	Logger zerolog.Logger
+	// Running configuration (*config.Struct). It is replaced as a whole
+	// on reload and never changed in place, so it's read without locks.
+	configuration atomic.Value
+	// Configuration file path, set from command line. If it's empty,
+	// LBTDS_CONFIG environment variable or ./lbtds.yaml is used
+	ConfigPath string
+	Logger     zerolog.Logger
+	// Configured log destination, nil until InitLogger
+	logOutput *output.Writer
 
 	// API server
 	APIServer    *http.Server
 	APIServerMux *http.ServeMux
 	APIServerUp  bool
+	// Access rules of API requests (*apiAccess), replaced on reload
+	apiAccess atomic.Value
 
 	// Random source
 	// Needed for picking random exit for proxy
 	RandomSource *rand.Rand
 
+	// Last collected runtime statistics (*runtimeStats)
+	runtimeStats atomic.Value
+	// Closing this channel stops runtime statistics collection
+	runtimeStatsStop chan bool
+
 	// Are we shutting down?
 	inShutdown bool
 	// Even bools aren't goroutine-safe!
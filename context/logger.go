@@ -0,0 +1,111 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package context
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/rs/zerolog"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/output"
+)
+
+type logLevelRequestParams struct {
+	Level string `json:"level"`
+}
+
+// InitLogger reconfigures logger as stated in configuration. Until then
+// logger from Init is used.
+func (c *Context) InitLogger() bool {
+	level := zerolog.DebugLevel
+	if c.Config().Log.Level != "" {
+		var err error
+		level, err = zerolog.ParseLevel(c.Config().Log.Level)
+		if err != nil {
+			c.Logger.Error().Err(err).Msgf("Invalid log level: %s", c.Config().Log.Level)
+			return false
+		}
+	}
+
+	out, err := output.Open(c.Config().Log.Output)
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("Failed to open log output")
+		return false
+	}
+
+	var writer io.Writer
+	switch c.Config().Log.Format {
+	case "", "console":
+		writer = zerolog.ConsoleWriter{Out: out, NoColor: !out.IsStandardStream()}
+	case "json":
+		writer = out
+		if out.SyslogWriter() != nil {
+			// Pass zerolog levels as syslog severities
+			writer = out.SyslogWriter()
+		}
+	default:
+		_ = out.Close()
+		c.Logger.Error().Msgf("Unsupported log format: %s", c.Config().Log.Format)
+		return false
+	}
+
+	c.logOutput = out
+	c.Logger = zerolog.New(writer).With().Timestamp().Logger()
+	if c.Config().RuntimeStats.LogHook == nil || *c.Config().RuntimeStats.LogHook {
+		c.Logger = c.Logger.Hook(zerolog.HookFunc(c.getMemoryUsage))
+	}
+	// Global level is used so level can be changed at runtime for loggers,
+	// which were already derived from this one
+	zerolog.SetGlobalLevel(level)
+
+	c.Logger.Info().Str("level", level.String()).Msg("Logger configured")
+
+	return true
+}
+
+// ReopenLogOutput reopens log file or reconnects to syslog. Used for
+// logrotate.
+func (c *Context) ReopenLogOutput() {
+	if c.logOutput == nil {
+		return
+	}
+	err := c.logOutput.Reopen()
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("Failed to reopen log output")
+		return
+	}
+	c.Logger.Info().Msg("Log output reopened")
+}
+
+// ChangeLogLevel handles log level retrieving and changing at runtime
+func (c *Context) ChangeLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(&logLevelRequestParams{Level: zerolog.GlobalLevel().String()})
+		if err != nil {
+			c.Logger.Error().Err(err).Msg("Failed to write log level")
+		}
+	case http.MethodPost:
+		var requestParams logLevelRequestParams
+		err := json.NewDecoder(r.Body).Decode(&requestParams)
+		if err != nil {
+			c.Logger.Error().Err(err).Msg("Failed to unmarshal POST data")
+			http.Error(w, "Invalid request body", 400)
+			return
+		}
+		level, err := zerolog.ParseLevel(requestParams.Level)
+		if err != nil || requestParams.Level == "" {
+			http.Error(w, "Invalid log level", 400)
+			return
+		}
+		zerolog.SetGlobalLevel(level)
+		// Log it regardless of new level, it is important
+		c.Logger.WithLevel(zerolog.NoLevel).Str("level", level.String()).Msg("Log level changed")
+		http.Error(w, "Log level changed", 200)
+	default:
+		http.Error(w, "404 page not found", 404)
+	}
+}
@@ -70,8 +70,8 @@ func (c *Context) RemovePIDFile() bool {
 // getPIDFilePath returns PID file path based on config and OS
 func (c *Context) getPIDFilePath() string {
 	var pidFile string
-	if c.Config.Proxy.PIDFile != "" {
-		pidFile = c.Config.Proxy.PIDFile
+	if c.Config().Proxy.PIDFile != "" {
+		pidFile = c.Config().Proxy.PIDFile
 	} else {
 		switch runtime.GOOS {
 		case "windows":
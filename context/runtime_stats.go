@@ -0,0 +1,116 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package context
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/metrics"
+)
+
+// runtimeStats is a snapshot of Go runtime statistics
+type runtimeStats struct {
+	memAlloc    string
+	memSys      string
+	numGC       string
+	collectedAt time.Time
+}
+
+var (
+	memAllocGauge    = metrics.NewGauge("lbtds_memory_alloc_bytes", "Bytes of allocated heap objects.")
+	memSysGauge      = metrics.NewGauge("lbtds_memory_sys_bytes", "Bytes of memory obtained from the OS.")
+	heapObjectsGauge = metrics.NewGauge("lbtds_memory_heap_objects", "Number of allocated heap objects.")
+	goroutinesGauge  = metrics.NewGauge("lbtds_goroutines", "Number of goroutines that currently exist.")
+	numGCCounter     = metrics.NewCounter("lbtds_gc_cycles_total", "Number of completed GC cycles.")
+	gcPauseCounter   = metrics.NewCounter("lbtds_gc_pause_seconds_total", "Cumulative GC stop-the-world pause time.")
+
+	// GC totals of previous sample. Counters are global, so they are
+	// shared by every context.
+	lastNumGC        uint32
+	lastPauseTotalNs uint64
+	lastGCMutex      sync.Mutex
+)
+
+// StartRuntimeStats starts periodic runtime statistics collection. Values
+// are cached for log hook and exported as metrics.
+func (c *Context) StartRuntimeStats() {
+	c.StopRuntimeStats()
+
+	interval := c.Config().RuntimeStats.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	c.Logger.Debug().Msgf("Collecting runtime statistics every %s", interval)
+
+	stop := make(chan bool)
+	c.runtimeStatsStop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.collectRuntimeStats()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopRuntimeStats stops runtime statistics collection
+func (c *Context) StopRuntimeStats() {
+	if c.runtimeStatsStop != nil {
+		close(c.runtimeStatsStop)
+		c.runtimeStatsStop = nil
+	}
+}
+
+// collectRuntimeStats reads runtime statistics and caches them.
+// runtime.ReadMemStats stops the world, so it should never be called on
+// hot paths like logging.
+func (c *Context) collectRuntimeStats() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	stats := &runtimeStats{
+		memAlloc:    fmt.Sprintf("%dMB", m.Alloc/1024/1024),
+		memSys:      fmt.Sprintf("%dMB", m.Sys/1024/1024),
+		numGC:       fmt.Sprintf("%d", m.NumGC),
+		collectedAt: time.Now(),
+	}
+	c.runtimeStats.Store(stats)
+
+	memAllocGauge.Set(float64(m.Alloc))
+	memSysGauge.Set(float64(m.Sys))
+	heapObjectsGauge.Set(float64(m.HeapObjects))
+	goroutinesGauge.Set(float64(runtime.NumGoroutine()))
+
+	lastGCMutex.Lock()
+	if m.NumGC > lastNumGC {
+		numGCCounter.Add(float64(m.NumGC - lastNumGC))
+		lastNumGC = m.NumGC
+	}
+	if m.PauseTotalNs > lastPauseTotalNs {
+		gcPauseCounter.Add(time.Duration(m.PauseTotalNs - lastPauseTotalNs).Seconds())
+		lastPauseTotalNs = m.PauseTotalNs
+	}
+	lastGCMutex.Unlock()
+}
+
+// getMemoryUsage adds last collected memory usage to log event
+func (c *Context) getMemoryUsage(e *zerolog.Event, level zerolog.Level, message string) {
+	stats, ok := c.runtimeStats.Load().(*runtimeStats)
+	if !ok {
+		return
+	}
+
+	e.Str("memalloc", stats.memAlloc)
+	e.Str("memsys", stats.memSys)
+	e.Str("numgc", stats.numGC)
+}
@@ -20,6 +20,7 @@ func (c *Context) SetShutdown() {
 
 // Shutdown shutdowns context-related things.
 func (c *Context) Shutdown() {
+	c.StopRuntimeStats()
 	c.ShutdownAPIServer()
 	c.Logger.Info().Msg("Dropping PID file...")
 	c.RemovePIDFile()
@@ -0,0 +1,216 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package accesslogv1
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/output"
+)
+
+var (
+	accessLogModuleLog zerolog.Logger
+
+	accessLogOutput   *output.Writer
+	accessLogTemplate *template.Template
+	accessLogFormat   string
+	accessLogSampling map[string]float64
+	accessLogMutex    sync.RWMutex
+)
+
+// Entry represents single proxied request
+type Entry struct {
+	Time       time.Time     `json:"time"`
+	RemoteAddr string        `json:"-"`
+	RemoteIP   string        `json:"remote_ip"`
+	Host       string        `json:"host"`
+	Method     string        `json:"method"`
+	URI        string        `json:"uri"`
+	Protocol   string        `json:"protocol"`
+	Status     int           `json:"status"`
+	Bytes      int64         `json:"bytes"`
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+	Duration   time.Duration `json:"-"`
+	// Duration in seconds, for JSON and templates
+	DurationSeconds float64 `json:"duration"`
+	RequestID       string  `json:"request_id,omitempty"`
+	Service         string  `json:"service,omitempty"`
+	Color           string  `json:"color,omitempty"`
+	Upstream        string  `json:"upstream,omitempty"`
+}
+
+func initAccessLog() bool {
+	accessLogModuleLog = domainLog.With().Str("module", "accesslog").Logger()
+	accessLogModuleLog.Info().Msg("Initializing access log...")
+
+	cfg := c.Config().AccessLog
+
+	var tmpl *template.Template
+	switch cfg.Format {
+	case "", "combined", "json":
+	case "template":
+		var err error
+		tmpl, err = template.New("access_log").Parse(cfg.Template)
+		if err != nil {
+			accessLogModuleLog.Error().Err(err).Msg("Failed to parse access log template")
+			return false
+		}
+	default:
+		accessLogModuleLog.Error().Msgf("Unsupported access log format: %s", cfg.Format)
+		return false
+	}
+
+	for key, ratio := range cfg.Sampling {
+		if ratio < 0 || ratio > 1 {
+			accessLogModuleLog.Error().Msgf("Sampling ratio for %s should be between 0 and 1", key)
+			return false
+		}
+	}
+
+	out, err := output.Open(cfg.Output)
+	if err != nil {
+		accessLogModuleLog.Error().Err(err).Msg("Failed to open access log output")
+		return false
+	}
+
+	accessLogMutex.Lock()
+	// Initialize can be called more than once in tests
+	if accessLogOutput != nil {
+		_ = accessLogOutput.Close()
+	}
+	accessLogOutput = out
+	accessLogTemplate = tmpl
+	accessLogFormat = cfg.Format
+	accessLogSampling = cfg.Sampling
+	accessLogMutex.Unlock()
+
+	return true
+}
+
+// Log writes entry to access log, if it passes sampling
+func Log(entry *Entry) {
+	accessLogMutex.RLock()
+	defer accessLogMutex.RUnlock()
+
+	if accessLogOutput == nil || !sampled(entry.Status) {
+		return
+	}
+
+	entry.RemoteIP = entry.RemoteAddr
+	host, _, err := net.SplitHostPort(entry.RemoteAddr)
+	if err == nil {
+		entry.RemoteIP = host
+	}
+	entry.DurationSeconds = entry.Duration.Seconds()
+
+	line, err := formatEntry(entry)
+	if err != nil {
+		accessLogModuleLog.Error().Err(err).Msg("Failed to format access log entry")
+		return
+	}
+
+	_, err = accessLogOutput.Write(line)
+	if err != nil {
+		accessLogModuleLog.Error().Err(err).Msg("Failed to write access log entry")
+	}
+}
+
+// Reopen reopens access log output. Used for logrotate, which sends SIGUSR1
+// after moving files away.
+func Reopen() {
+	accessLogMutex.RLock()
+	defer accessLogMutex.RUnlock()
+
+	if accessLogOutput == nil {
+		return
+	}
+	err := accessLogOutput.Reopen()
+	if err != nil {
+		accessLogModuleLog.Error().Err(err).Msg("Failed to reopen access log")
+		return
+	}
+	accessLogModuleLog.Info().Msg("Access log reopened")
+}
+
+// Shutdown closes access log output
+func Shutdown() {
+	accessLogMutex.Lock()
+	defer accessLogMutex.Unlock()
+
+	if accessLogOutput == nil {
+		return
+	}
+	err := accessLogOutput.Close()
+	if err != nil {
+		accessLogModuleLog.Error().Err(err).Msg("Failed to close access log")
+	}
+	accessLogOutput = nil
+}
+
+// sampled decides if entry with given status should be logged
+func sampled(status int) bool {
+	code := strconv.Itoa(status)
+	ratio, ok := accessLogSampling[code]
+	if !ok {
+		ratio, ok = accessLogSampling[code[:1]+"xx"]
+	}
+	if !ok || ratio >= 1 {
+		return true
+	}
+
+	return rand.Float64() < ratio
+}
+
+func formatEntry(entry *Entry) ([]byte, error) {
+	switch accessLogFormat {
+	case "json":
+		line, err := json.Marshal(entry)
+		return append(line, '\n'), err
+	case "template":
+		var line bytes.Buffer
+		err := accessLogTemplate.Execute(&line, entry)
+		line.WriteByte('\n')
+		return line.Bytes(), err
+	}
+
+	return formatCombined(entry), nil
+}
+
+// formatCombined formats entry in Apache combined log format
+func formatCombined(entry *Entry) []byte {
+	bytesSent := "-"
+	if entry.Bytes > 0 {
+		bytesSent = strconv.FormatInt(entry.Bytes, 10)
+	}
+
+	return []byte(fmt.Sprintf(
+		"%s - - [%s] \"%s %s %s\" %d %s %q %q\n",
+		entry.RemoteIP,
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method,
+		entry.URI,
+		entry.Protocol,
+		entry.Status,
+		bytesSent,
+		dashIfEmpty(entry.Referer),
+		dashIfEmpty(entry.UserAgent),
+	))
+}
+
+func dashIfEmpty(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
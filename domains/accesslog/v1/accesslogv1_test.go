@@ -0,0 +1,209 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package accesslogv1
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/testshelpers"
+)
+
+const accessLogPath = "/tmp/lbtds-test-access.log"
+
+func testEntry(status int) *Entry {
+	return &Entry{
+		Time:       time.Date(2018, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		RemoteAddr: "127.0.0.1:54321",
+		Host:       "web.host",
+		Method:     "GET",
+		URI:        "/index.html?a=b",
+		Protocol:   "HTTP/1.1",
+		Status:     status,
+		Bytes:      2326,
+		UserAgent:  "curl/7.61.0",
+		Duration:   1500 * time.Millisecond,
+		RequestID:  "deploy-42",
+		Color:      "green",
+		Upstream:   "127.0.0.1:8123",
+	}
+}
+
+func removeAccessLogs() {
+	for _, path := range []string{accessLogPath, accessLogPath + ".1"} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Println("Failed to erase files from previous test: " + err.Error())
+		}
+	}
+}
+
+/* exported.go */
+
+func TestInitialize(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+
+	result := Initialize(c)
+	require.True(t, result)
+	require.NotNil(t, accessLogOutput)
+	require.Equal(t, "", accessLogFormat)
+
+	Shutdown()
+	require.Nil(t, accessLogOutput)
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+func TestInitializeWithInvalidConfiguration(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+
+	c.Config().AccessLog.Format = "xml"
+	require.False(t, Initialize(c))
+
+	c.Config().AccessLog.Format = "template"
+	c.Config().AccessLog.Template = "{{.Status"
+	require.False(t, Initialize(c))
+
+	c.Config().AccessLog.Format = "combined"
+	c.Config().AccessLog.Sampling = map[string]float64{"2xx": 1.5}
+	require.False(t, Initialize(c))
+
+	c.Config().AccessLog.Sampling = nil
+	c.Config().AccessLog.Output.Type = "file"
+	c.Config().AccessLog.Output.Path = "/this/path/is/nonexistent/access.log"
+	require.False(t, Initialize(c))
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* accesslog.go */
+
+func TestJSONFormatAndSampling(t *testing.T) {
+	removeAccessLogs()
+	testshelpers.InitializeConfiguration("../../../", "lbtds-access-log")
+	c := testshelpers.InitializeContext()
+	require.True(t, Initialize(c))
+
+	Log(testEntry(200))
+	// 4xx are sampled out, except 404
+	Log(testEntry(403))
+	Log(testEntry(404))
+	Shutdown()
+
+	data, err := ioutil.ReadFile(accessLogPath)
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Equal(t, 2, len(lines))
+
+	var entry map[string]interface{}
+	err = json.Unmarshal([]byte(lines[0]), &entry)
+	require.Nil(t, err)
+	require.Equal(t, "127.0.0.1", entry["remote_ip"])
+	require.Equal(t, float64(200), entry["status"])
+	require.Equal(t, 1.5, entry["duration"])
+	require.Equal(t, "deploy-42", entry["request_id"])
+	require.Equal(t, "green", entry["color"])
+	require.Contains(t, lines[1], `"status":404`)
+
+	removeAccessLogs()
+	testshelpers.FlushConfiguration("lbtds-access-log")
+}
+
+func TestCombinedFormat(t *testing.T) {
+	line := string(formatCombined(&Entry{
+		Time:      time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		RemoteIP:  "127.0.0.1",
+		Method:    "GET",
+		URI:       "/apache_pb.gif",
+		Protocol:  "HTTP/1.0",
+		Status:    200,
+		Bytes:     2326,
+		Referer:   "http://www.example.com/start.html",
+		UserAgent: "Mozilla/4.08 [en] (Win98; I ;Nav)",
+	}))
+	require.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"`+"\n", line)
+
+	line = string(formatCombined(&Entry{RemoteIP: "::1", Status: 502}))
+	require.Contains(t, line, `502 - "-" "-"`)
+}
+
+func TestTemplateFormatAndReopen(t *testing.T) {
+	removeAccessLogs()
+	testshelpers.InitializeConfiguration("../../../", "lbtds-access-log")
+	c := testshelpers.InitializeContext()
+	c.Config().AccessLog.Format = "template"
+	c.Config().AccessLog.Template = "{{.RemoteIP}} {{.Method}} {{.URI}} {{.Status}} {{.Color}} {{.Upstream}}"
+	require.True(t, Initialize(c))
+
+	Log(testEntry(200))
+
+	// This is what logrotate does
+	err := os.Rename(accessLogPath, accessLogPath+".1")
+	require.Nil(t, err)
+	Reopen()
+	Log(testEntry(201))
+	Shutdown()
+
+	data, err := ioutil.ReadFile(accessLogPath + ".1")
+	require.Nil(t, err)
+	require.Equal(t, "127.0.0.1 GET /index.html?a=b 200 green 127.0.0.1:8123\n", string(data))
+	data, err = ioutil.ReadFile(accessLogPath)
+	require.Nil(t, err)
+	require.Equal(t, "127.0.0.1 GET /index.html?a=b 201 green 127.0.0.1:8123\n", string(data))
+
+	removeAccessLogs()
+	testshelpers.FlushConfiguration("lbtds-access-log")
+}
+
+func TestSyslogOutput(t *testing.T) {
+	syslogServer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer syslogServer.Close()
+
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	c.Config().AccessLog.Output.Type = "syslog"
+	c.Config().AccessLog.Output.Syslog.Network = "udp"
+	c.Config().AccessLog.Output.Syslog.Address = syslogServer.LocalAddr().String()
+	c.Config().AccessLog.Output.Syslog.Facility = "local0"
+	require.True(t, Initialize(c))
+
+	Log(testEntry(200))
+
+	buf := make([]byte, 4096)
+	err = syslogServer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	require.Nil(t, err)
+	n, _, err := syslogServer.ReadFrom(buf)
+	require.Nil(t, err)
+	message := string(buf[:n])
+	// local0.info
+	require.True(t, strings.HasPrefix(message, "<134>1 "), message)
+	require.Contains(t, message, fmt.Sprintf(" lbtds %d - - 127.0.0.1 - - [10/Oct/2018:13:55:36 -0700]", os.Getpid()))
+	require.False(t, strings.HasSuffix(message, "\n"))
+
+	Shutdown()
+
+	// Every facility, which passes configuration check, can be used
+	c.Config().AccessLog.Output.Syslog.Facility = "authpriv"
+	require.Empty(t, c.Config().Validate().Errors())
+	require.True(t, Initialize(c))
+	Log(testEntry(200))
+	n, _, err = syslogServer.ReadFrom(buf)
+	require.Nil(t, err)
+	// authpriv.info
+	require.True(t, strings.HasPrefix(string(buf[:n]), "<86>1 "), string(buf[:n]))
+
+	Shutdown()
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
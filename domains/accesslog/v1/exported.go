@@ -0,0 +1,29 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package accesslogv1
+
+import (
+	"github.com/rs/zerolog"
+	"lab.wtfteam.pro/wtfteam/lbtds/context"
+)
+
+var (
+	c *context.Context
+
+	// Package-wide logger, with "domain" parameter defined
+	domainLog zerolog.Logger
+)
+
+// Initialize initializes package
+func Initialize(cc *context.Context) bool {
+	c = cc
+	domainLog = c.Logger.With().Str("domain", "accesslog").Int("version", 1).Logger()
+
+	if !initAccessLog() {
+		return false
+	}
+
+	domainLog.Info().Msg("Domain «accesslog» initialized")
+	return true
+}
@@ -6,9 +6,13 @@ package colorsv1
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
+	"lab.wtfteam.pro/wtfteam/lbtds/context"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
 )
 
 var (
@@ -19,18 +23,209 @@ type colorRequestParams struct {
 	Color string `json:"color"`
 }
 
+// backendRequestParams identify backend of color and, optionally, its
+// destination. Destination is either address or object with options.
+type backendRequestParams struct {
+	ListenOn    string             `json:"listen_on"`
+	Source      string             `json:"source"`
+	Destination config.Destination `json:"destination"`
+}
+
+// statusResponse describes running instance. Color fields describe the
+// default service.
+type statusResponse struct {
+	Version      string   `json:"version"`
+	CurrentColor string   `json:"current_color"`
+	ColorVersion uint64   `json:"color_version"`
+	Colors       []string `json:"colors"`
+	// Problem with stored color, e.g. corrupted color file
+	StorageError string          `json:"storage_error,omitempty"`
+	Services     []serviceStatus `json:"services"`
+}
+
+type serviceStatus struct {
+	Name         string   `json:"name"`
+	CurrentColor string   `json:"current_color"`
+	ColorVersion uint64   `json:"color_version"`
+	Colors       []string `json:"colors"`
+	StorageError string   `json:"storage_error,omitempty"`
+}
+
 func initAPI() {
 	apiModuleLog = domainLog.With().Str("module", "api").Logger()
 	apiModuleLog.Info().Msg("Initializing API...")
 
 	c.APIServerMux.HandleFunc("/api/v1/color/", ChangeColor)
+	c.APIServerMux.HandleFunc("/api/v1/colors", Colors)
+	c.APIServerMux.HandleFunc("/api/v1/colors/", Colors)
+	c.APIServerMux.HandleFunc("/api/v1/status", Status)
+	c.APIServerMux.HandleFunc("/api/v1/status/", Status)
+	c.APIServerMux.HandleFunc("/api/v1/services", Services)
+	c.APIServerMux.HandleFunc("/api/v1/services/", Services)
+	c.APIServerMux.HandleFunc("/api/v1/config/reload", ReloadConfig)
+	c.APIServerMux.HandleFunc("/api/v1/config/reload/", ReloadConfig)
 }
 
-// ChangeColor handles color changing for application context
+// ChangeColor handles color changing of the default service
 func ChangeColor(w http.ResponseWriter, r *http.Request) {
+	changeServiceColor(w, r, defaultService().name)
+}
+
+// Colors handles requests to colors configuration of the default service
+func Colors(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/colors"), "/")
+	serviceColors(w, r, defaultService().name, splitPath(path))
+}
+
+// Services handles services list requests, color changing of single
+// service at /api/v1/services/{name}/color and requests to its colors
+// configuration at /api/v1/services/{name}/colors
+func Services(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/services"), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "404 page not found", 404)
+			return
+		}
+		writeJSON(w, servicesStatus())
+		return
+	}
+
+	parts := splitPath(path)
+	if len(parts) < 2 || (parts[1] != "color" && parts[1] != "colors") || (parts[1] == "color" && len(parts) != 2) {
+		http.Error(w, "404 page not found", 404)
+		return
+	}
+	if findService(parts[0]) == nil {
+		http.Error(w, "Unknown service", 404)
+		return
+	}
+	if parts[1] == "colors" {
+		serviceColors(w, r, parts[0], parts[2:])
+		return
+	}
+	changeServiceColor(w, r, parts[0])
+}
+
+// serviceColors handles requests to colors configuration of service. Color
+// is read with GET, created or replaced with PUT and removed with DELETE
+// at {color}; its backends and destinations are added with POST and
+// removed with DELETE at {color}/backends and {color}/destinations.
+// Changes of current color require force=true query parameter.
+func serviceColors(w http.ResponseWriter, r *http.Request, name string, parts []string) {
 	start := time.Now()
-	defer apiModuleLog.Info().Str("remote", r.RemoteAddr).TimeDiff("request time (s)", time.Now(), start).Msg("Received color switch HTTP request")
+	defer apiModuleLog.Info().Str("remote", r.RemoteAddr).Str("service", name).Str("method", r.Method).Strs("path", parts).TimeDiff("request time (s)", time.Now(), start).Msg("Received colors configuration HTTP request")
+
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	var (
+		diff *config.Diff
+		err  error
+	)
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, findService(name).colors())
+		return
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		color, err := findColor(name, parts[0])
+		if err != nil {
+			writeColorsError(w, err)
+			return
+		}
+		writeJSON(w, &color)
+		return
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		var color config.Color
+		if !decodeRequest(w, r, &color) {
+			return
+		}
+		if color.Name != "" && color.Name != parts[0] {
+			http.Error(w, "Color name doesn't match URL", 400)
+			return
+		}
+		color.Name = parts[0]
+		diff, err = setColor(name, color, force)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		diff, err = deleteColor(name, parts[0], force)
+	case len(parts) == 2 && parts[1] == "backends" && r.Method == http.MethodPost:
+		var backend config.BackendConfig
+		if !decodeRequest(w, r, &backend) {
+			return
+		}
+		diff, err = addBackend(name, parts[0], backend, force)
+	case len(parts) == 2 && parts[1] == "backends" && r.Method == http.MethodDelete:
+		var params backendRequestParams
+		if !decodeRequest(w, r, &params) {
+			return
+		}
+		diff, err = removeBackend(name, parts[0], params.ListenOn, params.Source, force)
+	case len(parts) == 2 && parts[1] == "destinations" && r.Method == http.MethodPost:
+		var params backendRequestParams
+		if !decodeRequest(w, r, &params) {
+			return
+		}
+		diff, err = addDestination(name, parts[0], params.ListenOn, params.Source, params.Destination, force)
+	case len(parts) == 2 && parts[1] == "destinations" && r.Method == http.MethodDelete:
+		var params backendRequestParams
+		if !decodeRequest(w, r, &params) {
+			return
+		}
+		diff, err = removeDestination(name, parts[0], params.ListenOn, params.Source, params.Destination.Address, force)
+	default:
+		http.Error(w, "404 page not found", 404)
+		return
+	}
+
+	if err != nil {
+		writeColorsError(w, err)
+		return
+	}
+	writeJSON(w, diff)
+}
+
+func writeColorsError(w http.ResponseWriter, err error) {
+	if problems, ok := err.(config.Problems); ok {
+		http.Error(w, "Invalid configuration: "+problems.Error(), 400)
+		return
+	}
+
+	switch err {
+	case errUnknownService, errUnknownColor, errUnknownBackend, errUnknownDestination:
+		http.Error(w, err.Error(), 404)
+	case errCurrentColor, errRuntimeColorsDisabled:
+		http.Error(w, err.Error(), 409)
+	default:
+		http.Error(w, "Failed to save colors: "+err.Error(), 500)
+	}
+}
+
+// decodeRequest decodes request body. Unknown keys are refused, as they
+// are in configuration file.
+func decodeRequest(w http.ResponseWriter, r *http.Request, data interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(data)
+	if err != nil {
+		apiModuleLog.Error().Err(err).Msg("Failed to unmarshal request data")
+		http.Error(w, "Invalid request body: "+strings.TrimPrefix(err.Error(), "json: "), 400)
+		return false
+	}
+	return true
+}
+
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func changeServiceColor(w http.ResponseWriter, r *http.Request, name string) {
+	start := time.Now()
+	defer apiModuleLog.Info().Str("remote", r.RemoteAddr).Str("service", name).TimeDiff("request time (s)", time.Now(), start).Msg("Received color switch HTTP request")
 	switch r.Method {
+	case http.MethodGet:
+		state, _ := GetServiceColorState(name)
+		writeJSON(w, &colorRequestParams{Color: state.Color})
 	case http.MethodPost:
 		var requestParams colorRequestParams
 		err := json.NewDecoder(r.Body).Decode(&requestParams)
@@ -39,13 +234,89 @@ func ChangeColor(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Invalid request body", 400)
 			return
 		}
-		err = SetCurrentColor(requestParams.Color)
-		if err != nil {
+		err = SetServiceColor(name, requestParams.Color)
+		switch {
+		case err == errInvalidColor:
 			http.Error(w, "Invalid color", 404)
-		} else {
+		case err != nil:
+			http.Error(w, "Failed to save color: "+err.Error(), 500)
+		default:
 			http.Error(w, "Color changed", 200)
 		}
 	default:
 		http.Error(w, "404 page not found", 404)
 	}
 }
+
+// ReloadConfig handles configuration reload requests
+func ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	defer apiModuleLog.Info().Str("remote", r.RemoteAddr).TimeDiff("request time (s)", time.Now(), start).Msg("Received configuration reload HTTP request")
+	switch r.Method {
+	case http.MethodPost:
+		diff, err := ReloadConfiguration()
+		if err != nil {
+			http.Error(w, "Invalid configuration: "+err.Error(), 400)
+			return
+		}
+		writeJSON(w, diff)
+	default:
+		http.Error(w, "404 page not found", 404)
+	}
+}
+
+// Status handles running instance status requests
+func Status(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		status := statusResponse{
+			Version:  context.VERSION,
+			Colors:   []string{},
+			Services: servicesStatus(),
+		}
+		// Top level fields describe the default service
+		if s := defaultService(); s != nil {
+			for _, serviceStatus := range status.Services {
+				if serviceStatus.Name == s.name {
+					status.CurrentColor = serviceStatus.CurrentColor
+					status.ColorVersion = serviceStatus.ColorVersion
+					status.Colors = serviceStatus.Colors
+					status.StorageError = serviceStatus.StorageError
+				}
+			}
+		}
+		writeJSON(w, &status)
+	default:
+		http.Error(w, "404 page not found", 404)
+	}
+}
+
+func servicesStatus() []serviceStatus {
+	statuses := make([]serviceStatus, 0, len(services))
+	for _, s := range services {
+		s.mutex.Lock()
+		status := serviceStatus{
+			Name:         s.name,
+			CurrentColor: s.currentColor,
+			ColorVersion: s.currentVersion,
+			StorageError: s.storageProblem,
+		}
+		s.mutex.Unlock()
+
+		colors := s.colors()
+		status.Colors = make([]string, 0, len(colors))
+		for i := range colors {
+			status.Colors = append(status.Colors, colors[i].Name)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		apiModuleLog.Error().Err(err).Msg("Failed to write API response")
+	}
+}
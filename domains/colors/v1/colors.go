@@ -5,9 +5,7 @@ package colorsv1
 
 import (
 	"errors"
-	"io/ioutil"
-	"os"
-	"path/filepath"
+	"time"
 
 	"github.com/rs/zerolog"
 	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
@@ -15,40 +13,97 @@ import (
 
 var (
 	colorsModuleLog zerolog.Logger
+
+	errInvalidColor = errors.New("Invalid color name")
 )
 
-func initColors() {
+func initColors() bool {
 	colorsModuleLog = domainLog.With().Str("module", "colors").Logger()
 	colorsModuleLog.Info().Msg("Initializing Colors storage...")
 
 	ColorChanged = make(chan bool)
+	StateChanged = make(chan bool, 1)
+
+	closeServices()
+	if !loadRuntimeColors() {
+		return false
+	}
+	return openServices()
 }
 
-func fallbackToFirstColor() {
-	if len(c.Config.Colors) > 0 {
-		err := SetCurrentColor(c.Config.Colors[0].Name)
-		if err != nil {
-			colorsModuleLog.Warn().Err(err).Msgf("Failed to change color to %s", c.Config.Colors[0].Name)
+// fallbackToFirstColor chooses first color with zero version, so any color
+// chosen explicitly, e.g. on another instance, overrides it. If there was
+// problem with stored color, fallback color isn't saved: stored one is kept
+// for investigation. Proxies are signalled by caller.
+func (s *service) fallbackToFirstColor(problem error) {
+	colors := s.colors()
+	if len(colors) == 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state := ColorState{Service: s.name, Color: colors[0].Name, Node: NodeID(), ChangedAt: time.Now()}
+	if problem == nil {
+		err := s.applyState(state, true)
+		if err == nil {
+			return
 		}
+		s.log.Warn().Err(err).Msgf("Failed to change color to %s", state.Color)
+	} else {
+		s.storageProblem = problem.Error()
 	}
+
+	// Serve traffic anyway, color will be saved on next switch
+	s.setState(state)
 }
 
-func colorExists(color string) bool {
-	for i := range c.Config.Colors {
-		if c.Config.Colors[i].Name == color {
-			return true
-		}
+// load reads current color from storage, if it isn't known yet. It returns
+// true if color was loaded.
+func (s *service) load() bool {
+	if s.currentColorName() != "" {
+		return false
 	}
 
-	return false
+	state, err := s.storage.Load()
+	if err == nil && !s.colorExists(state.Color) {
+		err = &CorruptedError{Reason: "there is no such color in configuration", Content: state.Color}
+	}
+	_, corrupted := err.(*CorruptedError)
+
+	switch {
+	case err == nil:
+		s.mutex.Lock()
+		state.Service = s.name
+		s.setState(state)
+		s.mutex.Unlock()
+	case err == ErrColorNotStored:
+		s.fallbackToFirstColor(nil)
+	case corrupted:
+		s.log.Error().Err(err).Msg("Using first color until color is switched explicitly, stored one is left untouched")
+		s.fallbackToFirstColor(err)
+	default:
+		s.log.Error().Err(err).Msg("Failed to load current color from storage, using first color")
+		s.fallbackToFirstColor(err)
+	}
+
+	return true
 }
 
-// GetCurrentColorConfiguration gets configuration for current color
-func GetCurrentColorConfiguration() *config.Color {
-	if currentColor != "" {
-		for i := range c.Config.Colors {
-			if c.Config.Colors[i].Name == currentColor {
-				return &c.Config.Colors[i]
+func (s *service) currentColorName() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.currentColor
+}
+
+func (s *service) currentColorConfiguration() *config.Color {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.currentColor != "" {
+		colors := s.colors()
+		for i := range colors {
+			if colors[i].Name == s.currentColor {
+				return &colors[i]
 			}
 		}
 	}
@@ -56,69 +111,69 @@ func GetCurrentColorConfiguration() *config.Color {
 	return nil
 }
 
-// GetCurrentColorName returns current color name
+func colorExists(color string) bool {
+	return defaultService().colorExists(color)
+}
+
+// GetCurrentColorConfiguration gets configuration for current color of the
+// default service
+func GetCurrentColorConfiguration() *config.Color {
+	return defaultService().currentColorConfiguration()
+}
+
+// GetCurrentColorName returns current color name of the default service
 func GetCurrentColorName() string {
-	currentColorMutex.Lock()
-	defer currentColorMutex.Unlock()
-	return currentColor
+	return defaultService().currentColorName()
 }
 
-// GetCurrentColor gets current color for application
+// GetCurrentColor loads current colors of all services, if they aren't
+// loaded yet, and returns current color of the default service
 func GetCurrentColor() string {
-	if currentColor == "" {
-		normalizedColorsPath, _ := filepath.Abs(c.Config.Proxy.ColorFile)
-		c.Logger.Debug().Msgf("Current color file path: %s", normalizedColorsPath)
-
-		colorsData, err := ioutil.ReadFile(normalizedColorsPath)
-		if err != nil {
-			fallbackToFirstColor()
-		} else {
-			if colorExists(string(colorsData)) {
-				currentColor = string(colorsData)
-			} else {
-				colorsModuleLog.Warn().Msgf("Unexpected color in current colors file: %s", string(colorsData))
-				fallbackToFirstColor()
-			}
+	loaded := false
+	for _, s := range services {
+		if s.load() {
+			loaded = true
 		}
+	}
+	if loaded {
 		ColorChanged <- true
 	}
-	return currentColor
+	return GetCurrentColorName()
 }
 
-// SetCurrentColor sets current color for application
-func SetCurrentColor(color string) error {
-	var err error
-	currentColorMutex.Lock()
-	defer currentColorMutex.Unlock()
-	if colorExists(color) {
-		currentColor = color
-
-		normalizedColorsPath, _ := filepath.Abs(c.Config.Proxy.ColorFile)
-
-		colorsFile, err := os.OpenFile(normalizedColorsPath, os.O_RDWR|os.O_CREATE, os.ModePerm)
-		if err != nil {
-			colorsModuleLog.Panic().Err(err).Msg("Failed to open current color file or create one")
-			return err
-		}
-		defer colorsFile.Close()
-		err = colorsFile.Truncate(0)
-		if err != nil {
-			colorsModuleLog.Panic().Err(err).Msg("Failed to truncate current color file")
-			return err
-		}
-		_, err = colorsFile.Write([]byte(color))
-		if err != nil {
-			colorsModuleLog.Warn().Err(err).Msg("Failed to write current color to file")
-			return err
-		}
+// GetStorageProblem returns problem with stored color of the default
+// service, found on startup, or empty string
+func GetStorageProblem() string {
+	return GetServiceStorageProblem(defaultService().name)
+}
 
-		colorsModuleLog.Info().Msgf("Current color changed to %s", currentColor)
+// SetCurrentColor sets current color of the default service
+func SetCurrentColor(color string) error {
+	return defaultService().switchColor(color, true)
+}
 
-		ColorChanged <- true
-	} else {
-		colorsModuleLog.Warn().Msgf("There is no such color in configuration: %s", color)
-		err = errors.New("Invalid color name")
+// switchColor changes current color, increasing its version, and signals
+// proxies about it. Color is saved to storage unless it came from there.
+func (s *service) switchColor(color string, save bool) error {
+	s.mutex.Lock()
+	err := s.applyState(s.nextState(color), save)
+	s.mutex.Unlock()
+	if err != nil {
+		return err
 	}
 
-	return err
+	ColorChanged <- true
+	return nil
+}
+
+// nextState returns state of switch to given color made by this instance.
+// It should be called with service mutex locked.
+func (s *service) nextState(color string) ColorState {
+	return ColorState{
+		Service:   s.name,
+		Color:     color,
+		Version:   s.currentVersion + 1,
+		Node:      NodeID(),
+		ChangedAt: time.Now(),
+	}
 }
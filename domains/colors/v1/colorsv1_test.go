@@ -6,12 +6,20 @@ package colorsv1
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/kvstore"
 	"lab.wtfteam.pro/wtfteam/lbtds/internal/testshelpers"
 )
 
@@ -37,7 +45,7 @@ func TestInitialize(t *testing.T) {
 	Initialize(c)
 
 	require.NotNil(t, ColorChanged)
-	require.Empty(t, currentColor)
+	require.Empty(t, GetCurrentColorName())
 
 	testshelpers.FlushConfiguration("lbtds-other-color-path")
 }
@@ -50,7 +58,7 @@ func TestColorExist(t *testing.T) {
 	Initialize(c)
 
 	require.NotNil(t, ColorChanged)
-	require.Empty(t, currentColor)
+	require.Empty(t, GetCurrentColorName())
 
 	mockupDispatch()
 
@@ -68,23 +76,21 @@ func TestGetCurrentColorWhenColorFileAbsent(t *testing.T) {
 	Initialize(c)
 
 	require.NotNil(t, ColorChanged)
-	require.Empty(t, currentColor)
+	require.Empty(t, GetCurrentColorName())
 
 	mockupDispatch()
 
 	// In this configuration, when no color file exists, first color will be
 	// chosen. It is "green"
 	GetCurrentColor()
-	require.Equal(t, "green", currentColor)
-	require.Equal(t, currentColor, GetCurrentColorName())
+	require.Equal(t, "green", GetCurrentColorName())
 
 	c.SetShutdown()
 	c.Shutdown()
 
 	// Clear cache for other tests
-	err := os.Remove(c.Config.Proxy.ColorFile)
+	err := os.Remove(c.Config().Proxy.ColorFile)
 	require.Nil(t, err)
-	currentColor = ""
 
 	testshelpers.FlushConfiguration("lbtds-valid")
 }
@@ -95,26 +101,24 @@ func TestGetCurrentColorConfiguration(t *testing.T) {
 	Initialize(c)
 
 	require.NotNil(t, ColorChanged)
-	require.Empty(t, currentColor)
+	require.Empty(t, GetCurrentColorName())
 
 	mockupDispatch()
 
 	// In this configuration, when no color file exists, first color will be
 	// chosen. It is "green"
 	GetCurrentColor()
-	require.Equal(t, "green", currentColor)
-	require.Equal(t, currentColor, GetCurrentColorName())
+	require.Equal(t, "green", GetCurrentColorName())
 
 	result := GetCurrentColorConfiguration()
-	require.Equal(t, currentColor, result.Name)
+	require.Equal(t, GetCurrentColorName(), result.Name)
 
 	c.SetShutdown()
 	c.Shutdown()
 
 	// Clear cache for other tests
-	err := os.Remove(c.Config.Proxy.ColorFile)
+	err := os.Remove(c.Config().Proxy.ColorFile)
 	require.Nil(t, err)
-	currentColor = ""
 
 	testshelpers.FlushConfiguration("lbtds-valid")
 }
@@ -126,9 +130,9 @@ func TestGetCurrentColorWhenColorFileExist(t *testing.T) {
 	Initialize(c)
 
 	require.NotNil(t, ColorChanged)
-	require.Empty(t, currentColor)
+	require.Empty(t, GetCurrentColorName())
 
-	normalizedColorsPath, _ := filepath.Abs(c.Config.Proxy.ColorFile)
+	normalizedColorsPath, _ := filepath.Abs(c.Config().Proxy.ColorFile)
 	colorsFile, err := os.OpenFile(normalizedColorsPath, os.O_RDWR|os.O_CREATE, os.ModePerm)
 	if err != nil {
 		t.Fatal(err.Error())
@@ -146,12 +150,11 @@ func TestGetCurrentColorWhenColorFileExist(t *testing.T) {
 	mockupDispatch()
 
 	GetCurrentColor()
-	require.Equal(t, neededColor, currentColor)
+	require.Equal(t, neededColor, GetCurrentColorName())
 
 	// Clear cache for other tests
-	err = os.Remove(c.Config.Proxy.ColorFile)
+	err = os.Remove(c.Config().Proxy.ColorFile)
 	require.Nil(t, err)
-	currentColor = ""
 
 	testshelpers.FlushConfiguration("lbtds-valid")
 }
@@ -163,9 +166,9 @@ func TestGetCurrentColorWhenColorFileExistWithWrongValue(t *testing.T) {
 	Initialize(c)
 
 	require.NotNil(t, ColorChanged)
-	require.Empty(t, currentColor)
+	require.Empty(t, GetCurrentColorName())
 
-	normalizedColorsPath, _ := filepath.Abs(c.Config.Proxy.ColorFile)
+	normalizedColorsPath, _ := filepath.Abs(c.Config().Proxy.ColorFile)
 	colorsFile, err := os.OpenFile(normalizedColorsPath, os.O_RDWR|os.O_CREATE, os.ModePerm)
 	if err != nil {
 		t.Fatal(err.Error())
@@ -183,15 +186,14 @@ func TestGetCurrentColorWhenColorFileExistWithWrongValue(t *testing.T) {
 	mockupDispatch()
 
 	GetCurrentColor()
-	require.Equal(t, "green", currentColor)
+	require.Equal(t, "green", GetCurrentColorName())
 
 	c.SetShutdown()
 	c.Shutdown()
 
 	// Clear cache for other tests
-	err = os.Remove(c.Config.Proxy.ColorFile)
+	err = os.Remove(c.Config().Proxy.ColorFile)
 	require.Nil(t, err)
-	currentColor = ""
 
 	testshelpers.FlushConfiguration("lbtds-valid")
 }
@@ -204,12 +206,12 @@ func TestReceiveColorChangeRequest(t *testing.T) {
 	Initialize(c)
 
 	require.NotNil(t, ColorChanged)
-	require.Empty(t, currentColor)
+	require.Empty(t, GetCurrentColorName())
 
 	mockupDispatch()
 
 	GetCurrentColor()
-	require.Equal(t, "green", currentColor)
+	require.Equal(t, "green", GetCurrentColorName())
 
 	newColorRequest := &colorRequestParams{
 		Color: "blue",
@@ -221,15 +223,65 @@ func TestReceiveColorChangeRequest(t *testing.T) {
 	assert.Equal(t, "Color changed\n", string(replyBody))
 	require.Equal(t, 200, replyCode)
 
-	require.Equal(t, "blue", currentColor)
+	require.Equal(t, "blue", GetCurrentColorName())
 
 	c.SetShutdown()
 	c.Shutdown()
 
 	// Clear cache for other tests
-	err := os.Remove(c.Config.Proxy.ColorFile)
+	err := os.Remove(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+func TestReceiveCurrentColorRequest(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	Initialize(c)
+
+	mockupDispatch()
+
+	GetCurrentColor()
+	require.Equal(t, "green", GetCurrentColorName())
+
+	replyBody, replyCode := testshelpers.HTTPTestRequest(t, c, nil, nil, "GET", "v1", "/color", ChangeColor)
+	require.Equal(t, 200, replyCode)
+	var reply colorRequestParams
+	err := json.Unmarshal(replyBody, &reply)
+	require.Nil(t, err)
+	require.Equal(t, "green", reply.Color)
+
+	replyBody, replyCode = testshelpers.HTTPTestRequest(t, c, nil, nil, "GET", "v1", "/status", Status)
+	require.Equal(t, 200, replyCode)
+	var status statusResponse
+	err = json.Unmarshal(replyBody, &status)
+	require.Nil(t, err)
+	require.Equal(t, "green", status.CurrentColor)
+	require.Equal(t, []string{"green", "blue"}, status.Colors)
+	require.NotEmpty(t, status.Version)
+
+	_, replyCode = testshelpers.HTTPTestRequest(t, c, nil, nil, "POST", "v1", "/status", Status)
+	require.Equal(t, 404, replyCode)
+
+	// Status is reported even if storages failed to open
+	openedServices := services
+	services = nil
+	replyBody, replyCode = testshelpers.HTTPTestRequest(t, c, nil, nil, "GET", "v1", "/status", Status)
+	services = openedServices
+	require.Equal(t, 200, replyCode)
+	status = statusResponse{}
+	err = json.Unmarshal(replyBody, &status)
+	require.Nil(t, err)
+	require.Empty(t, status.CurrentColor)
+	require.Empty(t, status.Services)
+
+	c.SetShutdown()
+	c.Shutdown()
+
+	// Clear cache for other tests
+	err = os.Remove(c.Config().Proxy.ColorFile)
 	require.Nil(t, err)
-	currentColor = ""
 
 	testshelpers.FlushConfiguration("lbtds-valid")
 }
@@ -240,12 +292,12 @@ func TestReceiveColorChangeRequestWithWrongBody(t *testing.T) {
 	Initialize(c)
 
 	require.NotNil(t, ColorChanged)
-	require.Empty(t, currentColor)
+	require.Empty(t, GetCurrentColorName())
 
 	mockupDispatch()
 
 	GetCurrentColor()
-	require.Equal(t, "green", currentColor)
+	require.Equal(t, "green", GetCurrentColorName())
 
 	newColorRequestData := []byte("abraquadabra")
 
@@ -254,15 +306,14 @@ func TestReceiveColorChangeRequestWithWrongBody(t *testing.T) {
 	assert.Equal(t, "Invalid request body\n", string(replyBody))
 	require.Equal(t, 400, replyCode)
 
-	require.Equal(t, "green", currentColor)
+	require.Equal(t, "green", GetCurrentColorName())
 
 	c.SetShutdown()
 	c.Shutdown()
 
 	// Clear cache for other tests
-	err := os.Remove(c.Config.Proxy.ColorFile)
+	err := os.Remove(c.Config().Proxy.ColorFile)
 	require.Nil(t, err)
-	currentColor = ""
 
 	testshelpers.FlushConfiguration("lbtds-valid")
 }
@@ -273,12 +324,12 @@ func TestReceiveColorChangeRequestWithWrongColor(t *testing.T) {
 	Initialize(c)
 
 	require.NotNil(t, ColorChanged)
-	require.Empty(t, currentColor)
+	require.Empty(t, GetCurrentColorName())
 
 	mockupDispatch()
 
 	GetCurrentColor()
-	require.Equal(t, "green", currentColor)
+	require.Equal(t, "green", GetCurrentColorName())
 
 	newColorRequest := &colorRequestParams{
 		Color: "velvet",
@@ -290,15 +341,14 @@ func TestReceiveColorChangeRequestWithWrongColor(t *testing.T) {
 	assert.Equal(t, "Invalid color\n", string(replyBody))
 	require.Equal(t, 404, replyCode)
 
-	require.Equal(t, "green", currentColor)
+	require.Equal(t, "green", GetCurrentColorName())
 
 	c.SetShutdown()
 	c.Shutdown()
 
 	// Clear cache for other tests
-	err := os.Remove(c.Config.Proxy.ColorFile)
+	err := os.Remove(c.Config().Proxy.ColorFile)
 	require.Nil(t, err)
-	currentColor = ""
 
 	testshelpers.FlushConfiguration("lbtds-valid")
 }
@@ -309,12 +359,12 @@ func TestReceiveColorChangeRequestWithWrongMethod(t *testing.T) {
 	Initialize(c)
 
 	require.NotNil(t, ColorChanged)
-	require.Empty(t, currentColor)
+	require.Empty(t, GetCurrentColorName())
 
 	mockupDispatch()
 
 	GetCurrentColor()
-	require.Equal(t, "green", currentColor)
+	require.Equal(t, "green", GetCurrentColorName())
 
 	newColorRequest := &colorRequestParams{
 		Color: "blue",
@@ -326,15 +376,14 @@ func TestReceiveColorChangeRequestWithWrongMethod(t *testing.T) {
 	assert.Equal(t, "404 page not found\n", string(replyBody))
 	require.Equal(t, 404, replyCode)
 
-	require.Equal(t, "green", currentColor)
+	require.Equal(t, "green", GetCurrentColorName())
 
 	c.SetShutdown()
 	c.Shutdown()
 
 	// Clear cache for other tests
-	err := os.Remove(c.Config.Proxy.ColorFile)
+	err := os.Remove(c.Config().Proxy.ColorFile)
 	require.Nil(t, err)
-	currentColor = ""
 
 	testshelpers.FlushConfiguration("lbtds-valid")
 }
@@ -345,27 +394,1015 @@ func TestReceiveColorChangeRequestWithEmptyBody(t *testing.T) {
 	Initialize(c)
 
 	require.NotNil(t, ColorChanged)
-	require.Empty(t, currentColor)
+	require.Empty(t, GetCurrentColorName())
 
 	mockupDispatch()
 
 	GetCurrentColor()
-	require.Equal(t, "green", currentColor)
+	require.Equal(t, "green", GetCurrentColorName())
 
 	replyBody, replyCode := testshelpers.HTTPTestRequest(t, c, nil, nil, "POST", "v1", "/color", ChangeColor)
 	assert.NotEmpty(t, replyBody)
 	assert.Equal(t, "Invalid request body\n", string(replyBody))
 	require.Equal(t, 400, replyCode)
 
-	require.Equal(t, "green", currentColor)
+	require.Equal(t, "green", GetCurrentColorName())
+
+	c.SetShutdown()
+	c.Shutdown()
+
+	// Clear cache for other tests
+	err := os.Remove(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* reload.go */
+
+func TestReloadConfiguration(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	Initialize(c)
+
+	mockupDispatch()
+
+	GetCurrentColor()
+	require.Equal(t, "green", GetCurrentColorName())
+
+	testshelpers.RewriteConfiguration("lbtds-valid", func(configuration string) string {
+		configuration = strings.Replace(configuration, `"127.0.0.1:8124"`, `"127.0.0.1:8125"`, 1)
+		return configuration + `
+  - name: "release-2026-10-18"
+    backends:
+    - type: "http"
+      listen_on: "127.0.0.1:8100"
+      source: "web.host"
+      destinations:
+        - "127.0.0.1:10123"
+    - type: "http"
+      listen_on: "127.0.0.1:8200"
+      source: "web2.host"
+      destinations:
+        - "127.0.0.1:10223"
+`
+	})
+
+	diff, err := ReloadConfiguration()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(diff.Colors))
+	require.Equal(t, "green", diff.Colors[0].Name)
+	require.Equal(t, config.ChangeChanged, diff.Colors[0].Change)
+	require.Equal(t, "127.0.0.1:8100", diff.Colors[0].Backends[0].ListenOn)
+	require.Equal(t, []string{"127.0.0.1:8125"}, diff.Colors[0].Backends[0].AddedDestinations)
+	require.Equal(t, []string{"127.0.0.1:8124"}, diff.Colors[0].Backends[0].RemovedDestinations)
+	require.Equal(t, "release-2026-10-18", diff.Colors[1].Name)
+	require.Equal(t, config.ChangeAdded, diff.Colors[1].Change)
+
+	require.Equal(t, "green", GetCurrentColorName())
+	require.Contains(t, config.DestinationAddresses(GetCurrentColorConfiguration().Backends[0].Destinations), "127.0.0.1:8125")
+	require.True(t, colorExists("release-2026-10-18"))
+
+	// Nothing changed since last reload
+	diff, err = ReloadConfiguration()
+	require.Nil(t, err)
+	require.True(t, diff.IsEmpty())
+
+	// API access rules are applied without restart
+	c.StartAPIServer()
+	apiRequest := func() int {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.RemoteAddr = "198.51.100.1:40000"
+		rec := httptest.NewRecorder()
+		c.APIServer.Handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	require.Equal(t, 200, apiRequest())
+	testshelpers.RewriteConfiguration("lbtds-valid", func(configuration string) string {
+		return strings.Replace(configuration, `  port: "4800"`, "  port: \"4800\"\n  access:\n    allow:\n      - \"127.0.0.1\"", 1)
+	})
+	_, err = ReloadConfiguration()
+	require.Nil(t, err)
+	require.Equal(t, 403, apiRequest())
+	require.Equal(t, []string{"127.0.0.1"}, c.Config().API.Access.Allow)
+
+	c.SetShutdown()
+	c.Shutdown()
+
+	// Clear cache for other tests
+	err = os.Remove(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+func TestReloadConfigurationKeepsRunningOneOnErrors(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	Initialize(c)
+
+	mockupDispatch()
+
+	GetCurrentColor()
+	require.Equal(t, "green", GetCurrentColorName())
+	colorsBeforeReload := c.Config().Colors
+	running := c.Config()
+
+	// Broken YAML
+	testshelpers.RewriteConfiguration("lbtds-valid", func(configuration string) string {
+		return configuration + "\n\t- what is this"
+	})
+	_, err := ReloadConfiguration()
+	require.NotNil(t, err)
+	require.Equal(t, colorsBeforeReload, c.Config().Colors)
+
+	// Current color is gone
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	testshelpers.RewriteConfiguration("lbtds-valid", func(configuration string) string {
+		return strings.Replace(configuration, `name: "green"`, `name: "red"`, 1)
+	})
+	replyBody, replyCode := testshelpers.HTTPTestRequest(t, c, nil, nil, "POST", "v1", "/config/reload", ReloadConfig)
+	require.Equal(t, 400, replyCode)
+	require.Equal(t, "Invalid configuration: current color green is absent in new configuration\n", string(replyBody))
+	require.Equal(t, colorsBeforeReload, c.Config().Colors)
+	require.Equal(t, "green", GetCurrentColorName())
+	// Running configuration is never changed in place
+	require.True(t, running == c.Config())
+
+	// Changed colors aren't applied along with invalid access rules
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	testshelpers.RewriteConfiguration("lbtds-valid", func(configuration string) string {
+		configuration = strings.Replace(configuration, `name: "blue"`, `name: "violet"`, 1)
+		return strings.Replace(configuration, `  port: "4800"`, "  port: \"4800\"\n  access:\n    allow:\n      - \"not a network\"", 1)
+	})
+	_, err = ReloadConfiguration()
+	require.NotNil(t, err)
+	require.True(t, running == c.Config())
+	require.False(t, colorExists("violet"))
+
+	c.SetShutdown()
+	c.Shutdown()
+
+	// Clear cache for other tests
+	err = os.Remove(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+func TestReceiveConfigurationReloadRequest(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	Initialize(c)
+
+	mockupDispatch()
+
+	GetCurrentColor()
+	require.Equal(t, "green", GetCurrentColorName())
+
+	testshelpers.RewriteConfiguration("lbtds-valid", func(configuration string) string {
+		return strings.Replace(configuration, `name: "blue"`, `name: "violet"`, 1)
+	})
+
+	replyBody, replyCode := testshelpers.HTTPTestRequest(t, c, nil, nil, "POST", "v1", "/config/reload", ReloadConfig)
+	require.Equal(t, 200, replyCode)
+	var diff config.Diff
+	err := json.Unmarshal(replyBody, &diff)
+	require.Nil(t, err)
+	require.Equal(t, []config.ColorDiff{
+		{Name: "violet", Change: config.ChangeAdded},
+		{Name: "blue", Change: config.ChangeRemoved},
+	}, diff.Colors)
+
+	replyBody, replyCode = testshelpers.HTTPTestRequest(t, c, nil, nil, "GET", "v1", "/config/reload", ReloadConfig)
+	require.Equal(t, 404, replyCode)
+	require.Equal(t, "404 page not found\n", string(replyBody))
+
+	c.SetShutdown()
+	c.Shutdown()
+
+	// Clear cache for other tests
+	err = os.Remove(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* storage.go */
+
+func storedColor(t *testing.T, value string) string {
+	var state ColorState
+	err := json.Unmarshal([]byte(value), &state)
+	require.Nil(t, err)
+	return state.Color
+}
+
+func TestFileStorageFormat(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	c.Config().Peers.NodeID = "node-a"
+	require.True(t, Initialize(c))
+
+	mockupDispatch()
+
+	require.Nil(t, SetCurrentColor("blue"))
+
+	data, err := ioutil.ReadFile(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+	var state ColorState
+	err = json.Unmarshal(data, &state)
+	require.Nil(t, err)
+	require.Equal(t, "blue", state.Color)
+	require.Equal(t, "node-a", state.Node)
+	require.Equal(t, GetColorState().Version, state.Version)
+	require.False(t, state.ChangedAt.IsZero())
+
+	// Temporary files are cleaned up
+	temporaryFiles, _ := filepath.Glob(filepath.Join(filepath.Dir(c.Config().Proxy.ColorFile), ".lbtds-test-current.tmp-*"))
+	require.Empty(t, temporaryFiles)
+
+	// State is restored on restart
+	require.True(t, initColors())
+	mockupDispatch()
+	GetCurrentColor()
+	require.Equal(t, state.Color, GetColorState().Color)
+	require.Equal(t, state.Version, GetColorState().Version)
 
+	Shutdown()
 	c.SetShutdown()
 	c.Shutdown()
 
 	// Clear cache for other tests
-	err := os.Remove(c.Config.Proxy.ColorFile)
+	err = os.Remove(c.Config().Proxy.ColorFile)
 	require.Nil(t, err)
-	currentColor = ""
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+func TestGetCurrentColorWhenColorFileCorrupted(t *testing.T) {
+	for _, content := range []string{"", `{"color": "bl`, `{"version": 3}`, "blue\x00\x00"} {
+		testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+		c := testshelpers.InitializeContext()
+		require.True(t, Initialize(c))
+
+		err := ioutil.WriteFile(c.Config().Proxy.ColorFile, []byte(content), 0644)
+		require.Nil(t, err)
+
+		mockupDispatch()
+
+		GetCurrentColor()
+		require.Equal(t, "green", GetCurrentColorName())
+		require.Contains(t, GetStorageProblem(), "corrupted")
+
+		// Corrupted file is left for investigation
+		data, err := ioutil.ReadFile(c.Config().Proxy.ColorFile)
+		require.Nil(t, err)
+		require.Equal(t, content, string(data))
+
+		replyBody, replyCode := testshelpers.HTTPTestRequest(t, c, nil, nil, "GET", "v1", "/status", Status)
+		require.Equal(t, 200, replyCode)
+		var status statusResponse
+		err = json.Unmarshal(replyBody, &status)
+		require.Nil(t, err)
+		require.NotEmpty(t, status.StorageError)
+
+		// Explicit switch replaces it
+		require.Nil(t, SetCurrentColor("green"))
+		require.Empty(t, GetStorageProblem())
+
+		Shutdown()
+		c.SetShutdown()
+		c.Shutdown()
+
+		// Clear cache for other tests
+		err = os.Remove(c.Config().Proxy.ColorFile)
+		require.Nil(t, err)
+
+		testshelpers.FlushConfiguration("lbtds-valid")
+	}
+}
+
+func TestKVStorage(t *testing.T) {
+	databasePath := "/tmp/lbtds-test-colors.db"
+	_ = os.Remove(databasePath)
+
+	// Storage is configured like in real configuration file, which passes
+	// checks
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	testshelpers.RewriteConfiguration("lbtds-valid", func(data string) string {
+		return strings.Replace(data, `storage_type: "file"
+  color_file: "/tmp/lbtds-test-current"`, `storage_type: "kv"
+  color_file: "`+databasePath+`"`, 1)
+	})
+	c := testshelpers.InitializeContext()
+	_, err := c.LoadConfiguration()
+	require.Nil(t, err)
+	require.Equal(t, "kv", c.Config().Proxy.StorageType)
+	require.Equal(t, databasePath, c.Config().Proxy.ColorFile)
+	require.True(t, Initialize(c))
+
+	mockupDispatch()
+
+	GetCurrentColor()
+	require.Equal(t, "green", GetCurrentColorName())
+	require.Nil(t, SetCurrentColor("blue"))
+
+	// Database is locked while it's used
+	_, err = kvstore.Open(databasePath)
+	require.Equal(t, kvstore.ErrLocked, err)
+
+	Shutdown()
+
+	// Simulate crash in the middle of write
+	databaseFile, err := os.OpenFile(databasePath, os.O_WRONLY|os.O_APPEND, 0644)
+	require.Nil(t, err)
+	_, err = databaseFile.Write([]byte{0, 1, 2, 3, 4, 5})
+	require.Nil(t, err)
+	databaseFile.Close()
+
+	// Restart
+	require.True(t, initColors())
+	mockupDispatch()
+
+	GetCurrentColor()
+	require.Equal(t, "blue", GetCurrentColorName())
+
+	Shutdown()
+	c.SetShutdown()
+	c.Shutdown()
+
+	// Clear cache for other tests
+	err = os.Remove(databasePath)
+	require.Nil(t, err)
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+func TestKVStorageFailures(t *testing.T) {
+	databasePath := "/tmp/lbtds-test-colors-failures.db"
+	_ = os.Remove(databasePath)
+
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	testshelpers.RewriteConfiguration("lbtds-valid", func(data string) string {
+		return strings.Replace(data, `storage_type: "file"
+  color_file: "/tmp/lbtds-test-current"`, `storage_type: "kv"
+  color_file: "`+databasePath+`"`, 1)
+	})
+	c := testshelpers.InitializeContext()
+	_, err := c.LoadConfiguration()
+	require.Nil(t, err)
+
+	// Database opened by another process can't be used
+	db, err := kvstore.Open(databasePath)
+	require.Nil(t, err)
+	require.False(t, Initialize(c))
+
+	// Corrupted value is reported, but not replaced
+	err = db.Put(c.Config().AllServices()[0].StorageKey, []byte(`{"color": "bl`))
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+
+	require.True(t, Initialize(c))
+	mockupDispatch()
+
+	GetCurrentColor()
+	require.Equal(t, "green", GetCurrentColorName())
+	require.Contains(t, GetStorageProblem(), "corrupted")
+
+	// Many switches are compacted on next open and the last one survives
+	for i := 0; i < 10; i++ {
+		require.Nil(t, SetCurrentColor("blue"))
+		require.Nil(t, SetCurrentColor("green"))
+	}
+	require.Nil(t, SetCurrentColor("blue"))
+	require.Empty(t, GetStorageProblem())
+	Shutdown()
+
+	infoBefore, err := os.Stat(databasePath)
+	require.Nil(t, err)
+	require.True(t, initColors())
+	mockupDispatch()
+	infoAfter, err := os.Stat(databasePath)
+	require.Nil(t, err)
+	require.True(t, infoAfter.Size() < infoBefore.Size())
+
+	GetCurrentColor()
+	require.Equal(t, "blue", GetCurrentColorName())
+
+	Shutdown()
+	c.SetShutdown()
+	c.Shutdown()
+
+	// Clear cache for other tests
+	err = os.Remove(databasePath)
+	require.Nil(t, err)
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+func TestHTTPStorage(t *testing.T) {
+	var (
+		stored      = make(map[string]string)
+		storedMutex sync.Mutex
+		failWrites  bool
+	)
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		storedMutex.Lock()
+		defer storedMutex.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			value, ok := stored[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, value)
+		case http.MethodPut:
+			if failWrites {
+				http.Error(w, "read only", 503)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			stored[r.URL.Path] = string(body)
+		}
+	}))
+	defer stub.Close()
+
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	testshelpers.RewriteConfiguration("lbtds-valid", func(data string) string {
+		return strings.Replace(data, `storage_type: "file"`, `storage_type: "http"
+  storage_url: "`+stub.URL+`/v1/kv/lbtds"
+  storage_key: "production"
+  storage_timeout: 2s`, 1)
+	})
+	c := testshelpers.InitializeContext()
+	_, err := c.LoadConfiguration()
+	require.Nil(t, err)
+	require.Equal(t, "http", c.Config().Proxy.StorageType)
+	require.Equal(t, stub.URL+"/v1/kv/lbtds", c.Config().Proxy.StorageURL)
+	require.Equal(t, 2*time.Second, c.Config().Proxy.StorageTimeout)
+	require.True(t, Initialize(c))
+
+	mockupDispatch()
+
+	// Nothing is stored yet, so first color is chosen and saved
+	GetCurrentColor()
+	require.Equal(t, "green", GetCurrentColorName())
+	require.Equal(t, "green", storedColor(t, stored["/v1/kv/lbtds/production"]))
+
+	newColorRequestData, _ := json.Marshal(&colorRequestParams{Color: "blue"})
+	replyBody, replyCode := testshelpers.HTTPTestRequest(t, c, newColorRequestData, nil, "POST", "v1", "/color", ChangeColor)
+	require.Equal(t, 200, replyCode)
+	require.Equal(t, "Color changed\n", string(replyBody))
+	require.Equal(t, "blue", storedColor(t, stored["/v1/kv/lbtds/production"]))
+
+	// Color isn't changed if it can't be saved
+	storedMutex.Lock()
+	failWrites = true
+	storedMutex.Unlock()
+	_, replyCode = testshelpers.HTTPTestRequest(t, c, newColorRequestData, nil, "POST", "v1", "/color", ChangeColor)
+	require.Equal(t, 500, replyCode)
+	require.NotNil(t, SetCurrentColor("green"))
+	require.Equal(t, "blue", GetCurrentColorName())
+
+	// Another balancer sees the same color
+	require.True(t, initColors())
+	mockupDispatch()
+	GetCurrentColor()
+	require.Equal(t, "blue", GetCurrentColorName())
+
+	Shutdown()
+	c.SetShutdown()
+	c.Shutdown()
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* watch.go */
+
+func waitForColor(color string) bool {
+	for i := 0; i < 100; i++ {
+		if GetCurrentColorName() == color {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func TestWatchColorFile(t *testing.T) {
+	watchDebounce = 50 * time.Millisecond
+	defer func() { watchDebounce = 500 * time.Millisecond }()
+
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	require.True(t, Initialize(c))
+
+	mockupDispatch()
+
+	require.Nil(t, SetCurrentColor("green"))
+	require.Equal(t, "green", GetCurrentColor())
+
+	// Edited by hand
+	err := ioutil.WriteFile(c.Config().Proxy.ColorFile, []byte("blue\n"), 0644)
+	require.Nil(t, err)
+	require.True(t, waitForColor("blue"))
+
+	// Replaced by rename, with unknown color
+	temporaryPath := c.Config().Proxy.ColorFile + ".new"
+	err = ioutil.WriteFile(temporaryPath, []byte("violet"), 0644)
+	require.Nil(t, err)
+	err = os.Rename(temporaryPath, c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, "blue", GetCurrentColorName())
+
+	// Series of quick changes causes single switch to the last value
+	for _, color := range []string{"green", "violet", "green"} {
+		err = ioutil.WriteFile(c.Config().Proxy.ColorFile, []byte(color), 0644)
+		require.Nil(t, err)
+	}
+	require.True(t, waitForColor("green"))
+
+	Shutdown()
+	c.SetShutdown()
+	c.Shutdown()
+
+	// Clear cache for other tests
+	err = os.Remove(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+func TestWatchHTTPStorage(t *testing.T) {
+	watchDebounce = 50 * time.Millisecond
+	defer func() { watchDebounce = 500 * time.Millisecond }()
+
+	var (
+		stored      = "green"
+		version     = 1
+		storedMutex sync.Mutex
+	)
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		storedMutex.Lock()
+		defer storedMutex.Unlock()
+		etag := fmt.Sprintf(`"%d"`, version)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, stored)
+	}))
+	defer stub.Close()
+
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	c.Config().Proxy.StorageType = "http"
+	c.Config().Proxy.StorageURL = stub.URL
+	c.Config().Proxy.StoragePollInterval = 20 * time.Millisecond
+	require.True(t, Initialize(c))
+
+	mockupDispatch()
+
+	require.Equal(t, "green", GetCurrentColor())
+
+	// Changed by another instance
+	storedMutex.Lock()
+	stored = "blue"
+	version++
+	storedMutex.Unlock()
+	require.True(t, waitForColor("blue"))
+
+	// State of another instance is applied as it is, so instances sharing
+	// storage agree on it
+	local := GetColorState()
+	store := func(state ColorState) {
+		storedMutex.Lock()
+		stored = string(encodeState(state))
+		version++
+		storedMutex.Unlock()
+	}
+	waitForState := func(expected ColorState) bool {
+		for i := 0; i < 50; i++ {
+			state := GetColorState()
+			if state.Color == expected.Color && state.Version == expected.Version && state.Node == expected.Node {
+				return true
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false
+	}
+	remote := ColorState{Color: "green", Version: local.Version + 5, Node: "node-z", ChangedAt: time.Now()}
+	store(remote)
+	require.True(t, waitForState(remote))
+
+	// Newer version of the same color is applied too
+	remote.Version++
+	remote.Node = "node-y"
+	store(remote)
+	require.True(t, waitForState(remote))
+
+	// Older one is ignored
+	store(ColorState{Color: "blue", Version: remote.Version - 1, Node: "node-z"})
+	time.Sleep(200 * time.Millisecond)
+	require.True(t, waitForState(remote))
+
+	Shutdown()
+	c.SetShutdown()
+	c.Shutdown()
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* state.go */
+
+func TestApplyPeerState(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	c.Config().Peers.NodeID = "node-b"
+	require.True(t, Initialize(c))
+
+	mockupDispatch()
+
+	require.Nil(t, SetCurrentColor("green"))
+	state := GetColorState()
+	require.Equal(t, "green", state.Color)
+	require.Equal(t, "node-b", state.Node)
+
+	// Older state is ignored
+	applied, err := ApplyPeerState(ColorState{Color: "blue", Version: state.Version - 1, Node: "node-z"})
+	require.Nil(t, err)
+	require.False(t, applied)
+
+	// Same version from node with lower name is ignored too
+	applied, err = ApplyPeerState(ColorState{Color: "blue", Version: state.Version, Node: "node-a"})
+	require.Nil(t, err)
+	require.False(t, applied)
+	require.Equal(t, "green", GetCurrentColorName())
+
+	applied, err = ApplyPeerState(ColorState{Color: "blue", Version: state.Version, Node: "node-c"})
+	require.Nil(t, err)
+	require.True(t, applied)
+	require.Equal(t, "blue", GetCurrentColorName())
+
+	// Unknown colors are refused
+	applied, err = ApplyPeerState(ColorState{Color: "violet", Version: state.Version + 10, Node: "node-c"})
+	require.NotNil(t, err)
+	require.False(t, applied)
+
+	// Local change wins over any seen version
+	require.Nil(t, SetCurrentColor("green"))
+	require.Equal(t, state.Version+1, GetColorState().Version)
+
+	Shutdown()
+	c.SetShutdown()
+	c.Shutdown()
+
+	// Clear cache for other tests
+	err = os.Remove(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* services.go */
+
+func TestServicesSwitchIndependently(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-services")
+	c := testshelpers.InitializeContext()
+	require.True(t, Initialize(c))
+
+	mockupDispatch()
+
+	require.Equal(t, []string{config.DefaultService, "api"}, ServiceNames())
+	require.Equal(t, "green", GetCurrentColor())
+	apiState, err := GetServiceColorState("api")
+	require.Nil(t, err)
+	require.Equal(t, "green", apiState.Color)
+
+	// Switching one service doesn't touch another
+	newColorRequestData, _ := json.Marshal(&colorRequestParams{Color: "blue"})
+	request := httptest.NewRequest("POST", "/api/v1/services/api/color", strings.NewReader(string(newColorRequestData)))
+	recorder := httptest.NewRecorder()
+	Services(recorder, request)
+	require.Equal(t, 200, recorder.Code)
+	require.Equal(t, "Color changed\n", recorder.Body.String())
+
+	require.Equal(t, "green", GetCurrentColorName())
+	apiState, _ = GetServiceColorState("api")
+	require.Equal(t, "blue", apiState.Color)
+	require.Equal(t, "api", apiState.Service)
+
+	currentColors := GetCurrentColorConfigurations()
+	require.Equal(t, 2, len(currentColors))
+	require.Equal(t, "api", currentColors[1].Service)
+	require.Equal(t, "blue", currentColors[1].Color.Name)
+
+	// Each service has its own color file
+	data, err := ioutil.ReadFile(c.Config().Proxy.ColorFile + ".api")
+	require.Nil(t, err)
+	require.Equal(t, "blue", storedColor(t, string(data)))
+	data, err = ioutil.ReadFile(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+	require.Equal(t, "green", storedColor(t, string(data)))
+
+	request = httptest.NewRequest("GET", "/api/v1/services/api/color", nil)
+	recorder = httptest.NewRecorder()
+	Services(recorder, request)
+	require.Equal(t, 200, recorder.Code)
+	require.Equal(t, "{\"color\":\"blue\"}\n", recorder.Body.String())
+
+	request = httptest.NewRequest("GET", "/api/v1/services", nil)
+	recorder = httptest.NewRecorder()
+	Services(recorder, request)
+	require.Equal(t, 200, recorder.Code)
+	var services []serviceStatus
+	err = json.Unmarshal(recorder.Body.Bytes(), &services)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(services))
+	require.Equal(t, "api", services[1].Name)
+	require.Equal(t, "blue", services[1].CurrentColor)
+	require.Equal(t, []string{"green", "blue"}, services[1].Colors)
+
+	// Unknown service and color
+	request = httptest.NewRequest("POST", "/api/v1/services/admin/color", strings.NewReader(string(newColorRequestData)))
+	recorder = httptest.NewRecorder()
+	Services(recorder, request)
+	require.Equal(t, 404, recorder.Code)
+	require.Equal(t, "Unknown service\n", recorder.Body.String())
+	require.NotNil(t, SetServiceColor("api", "violet"))
+
+	// Colors of all services are restored on restart
+	require.True(t, initColors())
+	mockupDispatch()
+	require.Equal(t, "green", GetCurrentColor())
+	apiState, _ = GetServiceColorState("api")
+	require.Equal(t, "blue", apiState.Color)
+
+	Shutdown()
+	c.SetShutdown()
+	c.Shutdown()
+
+	// Clear cache for other tests
+	err = os.Remove(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+	err = os.Remove(c.Config().Proxy.ColorFile + ".api")
+	require.Nil(t, err)
+
+	testshelpers.FlushConfiguration("lbtds-services")
+}
+
+func TestReloadConfigurationWithServices(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-services")
+	c := testshelpers.InitializeContext()
+	require.True(t, Initialize(c))
+
+	mockupDispatch()
+
+	GetCurrentColor()
+	require.Nil(t, SetServiceColor("api", "blue"))
+
+	// Current color of service is gone
+	testshelpers.RewriteConfiguration("lbtds-services", func(configuration string) string {
+		return strings.Replace(configuration, `      - name: "blue"`, `      - name: "red"`, 1)
+	})
+	_, err := ReloadConfiguration()
+	require.NotNil(t, err)
+	require.Equal(t, "current color blue of service api is absent in new configuration", err.Error())
+
+	// Services can't be added on the fly
+	testshelpers.InitializeConfiguration("../../../", "lbtds-services")
+	testshelpers.RewriteConfiguration("lbtds-services", func(configuration string) string {
+		return strings.Replace(configuration, `name: "api"`, `name: "admin"`, 1)
+	})
+	_, err = ReloadConfiguration()
+	require.NotNil(t, err)
+
+	// Colors of services are reloaded
+	testshelpers.InitializeConfiguration("../../../", "lbtds-services")
+	testshelpers.RewriteConfiguration("lbtds-services", func(configuration string) string {
+		return strings.Replace(configuration, `"127.0.0.1:8124"`, `"127.0.0.1:8125"`, 2)
+	})
+	diff, err := ReloadConfiguration()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(diff.Colors))
+	require.Equal(t, "", diff.Colors[0].Service)
+	require.Equal(t, "api", diff.Colors[1].Service)
+	require.Equal(t, "api.host", diff.Colors[1].Backends[0].Source)
+	require.Equal(t, []string{"127.0.0.1:8125"}, config.DestinationAddresses(GetCurrentColorConfigurations()[1].Color.Backends[0].Destinations))
+
+	Shutdown()
+	c.SetShutdown()
+	c.Shutdown()
+
+	// Clear cache for other tests
+	err = os.Remove(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+	err = os.Remove(c.Config().Proxy.ColorFile + ".api")
+	require.Nil(t, err)
+
+	testshelpers.FlushConfiguration("lbtds-services")
+}
+
+/* runtime.go */
+
+func colorsRequest(method string, path string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	if strings.HasPrefix(path, "/api/v1/services") {
+		Services(recorder, request)
+	} else {
+		Colors(recorder, request)
+	}
+	return recorder
+}
+
+func TestRuntimeColors(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-services")
+	c := testshelpers.InitializeContext()
+	require.True(t, Initialize(c))
+
+	mockupDispatch()
+
+	require.Equal(t, "green", GetCurrentColor())
+
+	// New color is added after configured ones
+	recorder := colorsRequest("PUT", "/api/v1/colors/release-2026-10-18", `{"backends": [{"type": "http", "listen_on": "127.0.0.1:8100", "source": "web.host", "destinations": ["127.0.0.1:8125"]}]}`)
+	require.Equal(t, 200, recorder.Code)
+	var diff config.Diff
+	err := json.Unmarshal(recorder.Body.Bytes(), &diff)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(diff.Colors))
+	require.Equal(t, "release-2026-10-18", diff.Colors[0].Name)
+	require.Equal(t, config.ChangeAdded, diff.Colors[0].Change)
+	require.True(t, colorExists("release-2026-10-18"))
+	require.Nil(t, SetCurrentColor("release-2026-10-18"))
+	require.Equal(t, []string{"127.0.0.1:8125"}, config.DestinationAddresses(GetCurrentColorConfiguration().Backends[0].Destinations))
+	require.Nil(t, SetCurrentColor("green"))
+
+	recorder = colorsRequest("GET", "/api/v1/colors/release-2026-10-18", "")
+	require.Equal(t, 200, recorder.Code)
+	var color config.Color
+	err = json.Unmarshal(recorder.Body.Bytes(), &color)
+	require.Nil(t, err)
+	require.Equal(t, "release-2026-10-18", color.Name)
+	require.Equal(t, "web.host", color.Backends[0].Source)
+
+	data, err := ioutil.ReadFile(c.Config().Proxy.StateFile)
+	require.Nil(t, err)
+	require.Contains(t, string(data), "release-2026-10-18")
+
+	// Colors are checked like configuration file
+	recorder = colorsRequest("PUT", "/api/v1/colors/broken", `{"backends": [{"type": "http", "listen_on": "127.0.0.1:8100", "source": "web.host"}]}`)
+	require.Equal(t, 400, recorder.Code)
+	require.Contains(t, recorder.Body.String(), "Invalid configuration: ")
+	require.False(t, colorExists("broken"))
+	recorder = colorsRequest("PUT", "/api/v1/colors/broken", `{"name": "other"}`)
+	require.Equal(t, 400, recorder.Code)
+	recorder = colorsRequest("GET", "/api/v1/colors/broken", "")
+	require.Equal(t, 404, recorder.Code)
+
+	// Unknown keys are refused at any level
+	recorder = colorsRequest("PUT", "/api/v1/colors/broken", `{"backend": []}`)
+	require.Equal(t, 400, recorder.Code)
+	require.Contains(t, recorder.Body.String(), `unknown field "backend"`)
+	recorder = colorsRequest("POST", "/api/v1/colors/blue/backends", `{"type": "http", "listen_on": "127.0.0.1:8300", "source": "web.host", "destinations": ["127.0.0.1:8125"], "max_con": 10}`)
+	require.Equal(t, 400, recorder.Code)
+	require.Contains(t, recorder.Body.String(), `unknown field "max_con"`)
+	recorder = colorsRequest("POST", "/api/v1/colors/blue/destinations", `{"listen_on": "127.0.0.1:8100", "source": "web.host", "destination": {"address": "127.0.0.1:8127", "wieght": 2}}`)
+	require.Equal(t, 400, recorder.Code)
+	require.Contains(t, recorder.Body.String(), `unknown field "wieght"`)
+
+	// Current color isn't changed unless forced
+	destination := `{"listen_on": "127.0.0.1:8100", "source": "web.host", "destination": "127.0.0.1:8125"}`
+	recorder = colorsRequest("POST", "/api/v1/colors/green/destinations", destination)
+	require.Equal(t, 409, recorder.Code)
+	recorder = colorsRequest("POST", "/api/v1/colors/green/destinations?force=true", destination)
+	require.Equal(t, 200, recorder.Code)
+	require.Equal(t, []string{"127.0.0.1:8123", "127.0.0.1:8125"}, config.DestinationAddresses(GetCurrentColorConfiguration().Backends[0].Destinations))
+	recorder = colorsRequest("DELETE", "/api/v1/colors/blue/destinations", destination)
+	require.Equal(t, 404, recorder.Code)
+	require.Equal(t, "Unknown destination\n", recorder.Body.String())
+
+	// Destination can have balancing options
+	recorder = colorsRequest("POST", "/api/v1/colors/blue/destinations", `{"listen_on": "127.0.0.1:8100", "source": "web.host", "destination": {"address": "127.0.0.1:8126", "weight": 2, "slow_start": "10s"}}`)
+	require.Equal(t, 200, recorder.Code)
+	recorder = colorsRequest("GET", "/api/v1/colors/blue", "")
+	require.Contains(t, recorder.Body.String(), `{"address":"127.0.0.1:8126","weight":2,"slow_start":"10s"}`)
+
+	// Colors of named services are changed the same way
+	recorder = colorsRequest("DELETE", "/api/v1/services/api/colors/blue", "")
+	require.Equal(t, 200, recorder.Code)
+	recorder = colorsRequest("GET", "/api/v1/services/api/colors", "")
+	require.Equal(t, 200, recorder.Code)
+	var colors []config.Color
+	err = json.Unmarshal(recorder.Body.Bytes(), &colors)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(colors))
+	require.Equal(t, "green", colors[0].Name)
+	recorder = colorsRequest("POST", "/api/v1/services/api/colors/green/backends?force=true", `{"type": "http", "listen_on": "127.0.0.1:8100", "source": "api2.host", "destinations": ["127.0.0.1:8125"]}`)
+	require.Equal(t, 200, recorder.Code)
+
+	// Changes survive restart and reload
+	require.True(t, initColors())
+	mockupDispatch()
+	require.Equal(t, "green", GetCurrentColor())
+	require.True(t, colorExists("release-2026-10-18"))
+	require.Equal(t, []string{"127.0.0.1:8123", "127.0.0.1:8125"}, config.DestinationAddresses(GetCurrentColorConfiguration().Backends[0].Destinations))
+	require.Equal(t, 1, len(findService("api").colors()))
+	require.Equal(t, 2, len(findService("api").colors()[0].Backends))
+
+	reloadDiff, err := ReloadConfiguration()
+	require.Nil(t, err)
+	require.True(t, reloadDiff.IsEmpty())
+
+	// Nothing is changed if switch to the first remaining color fails
+	err = os.Remove(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+	err = os.Mkdir(c.Config().Proxy.ColorFile, 0755)
+	require.Nil(t, err)
+	recorder = colorsRequest("DELETE", "/api/v1/colors/green?force=true", "")
+	require.NotEqual(t, 200, recorder.Code)
+	require.Equal(t, "green", GetCurrentColorName())
+	require.True(t, colorExists("green"))
+	data, err = ioutil.ReadFile(c.Config().Proxy.StateFile)
+	require.Nil(t, err)
+	require.Contains(t, string(data), "127.0.0.1:8125")
+	err = os.Remove(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+
+	// Forced removal of current color switches to the first remaining one
+	recorder = colorsRequest("DELETE", "/api/v1/colors/green", "")
+	require.Equal(t, 409, recorder.Code)
+	recorder = colorsRequest("DELETE", "/api/v1/colors/green?force=true", "")
+	require.Equal(t, 200, recorder.Code)
+	require.Equal(t, "blue", GetCurrentColorName())
+	require.False(t, colorExists("green"))
+
+	Shutdown()
+	c.SetShutdown()
+	c.Shutdown()
+
+	// Clear cache for other tests
+	err = os.Remove(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+	err = os.Remove(c.Config().Proxy.StateFile)
+	require.Nil(t, err)
+	_ = os.Remove(c.Config().Proxy.ColorFile + ".api")
+
+	testshelpers.FlushConfiguration("lbtds-services")
+}
+
+func TestColorCopy(t *testing.T) {
+	downTime := 5 * time.Second
+	original := config.Color{Name: "green", Backends: []config.BackendConfig{{
+		Destinations:    []config.Destination{{Address: "127.0.0.1:8123"}},
+		PassiveDownTime: &downTime,
+		Access:          config.AccessRules{Allow: []string{"10.0.0.0/8"}},
+		Headers:         config.HeaderRules{Request: config.HeaderChanges{Set: map[string]string{"X-Color": "green"}}},
+		TLS:             &config.FrontendTLS{CertFile: "cert.pem", ClientAuth: &config.ClientAuth{Mode: "require"}},
+		GRPC:            &config.GRPC{Routes: []config.GRPCRoute{{Service: "shop.Orders", Retry: &config.GRPCRetry{Attempts: 1}}}},
+	}}}
+
+	// Changes of copy don't reach running configuration
+	color := original.Copy()
+	require.Equal(t, original, color)
+	backend := &color.Backends[0]
+	backend.Destinations[0].Address = "127.0.0.1:8124"
+	*backend.PassiveDownTime = time.Second
+	backend.Access.Allow[0] = "0.0.0.0/0"
+	backend.Headers.Request.Set["X-Color"] = "blue"
+	backend.TLS.ClientAuth.Mode = "request"
+	backend.GRPC.Routes[0].Retry.Attempts = 3
+
+	backend = &original.Backends[0]
+	require.Equal(t, "127.0.0.1:8123", backend.Destinations[0].Address)
+	require.Equal(t, 5*time.Second, *backend.PassiveDownTime)
+	require.Equal(t, "10.0.0.0/8", backend.Access.Allow[0])
+	require.Equal(t, "green", backend.Headers.Request.Set["X-Color"])
+	require.Equal(t, "require", backend.TLS.ClientAuth.Mode)
+	require.Equal(t, 1, backend.GRPC.Routes[0].Retry.Attempts)
+}
+
+func TestRuntimeColorsWithoutStateFile(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	require.True(t, Initialize(c))
+
+	mockupDispatch()
+
+	recorder := colorsRequest("PUT", "/api/v1/colors/release", `{"backends": [{"type": "http", "listen_on": "127.0.0.1:8100", "source": "web.host", "destinations": ["127.0.0.1:8125"]}]}`)
+	require.Equal(t, 409, recorder.Code)
+	require.False(t, colorExists("release"))
+
+	recorder = colorsRequest("GET", "/api/v1/colors", "")
+	require.Equal(t, 200, recorder.Code)
+
+	Shutdown()
+	c.SetShutdown()
+	c.Shutdown()
 
 	testshelpers.FlushConfiguration("lbtds-valid")
 }
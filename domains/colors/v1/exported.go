@@ -4,8 +4,6 @@
 package colorsv1
 
 import (
-	"sync"
-
 	"github.com/rs/zerolog"
 	"lab.wtfteam.pro/wtfteam/lbtds/context"
 )
@@ -16,22 +14,26 @@ var (
 	// Package-wide logger, with "domain" parameter defined
 	domainLog zerolog.Logger
 
-	// Current color
-	currentColor      string
-	currentColorMutex sync.Mutex
-
 	// ColorChanged — signaling channel
-	// There will be signal on each color change
+	// There will be signal on each color change of any service
 	ColorChanged chan bool
 )
 
 // Initialize initializes package
-func Initialize(cc *context.Context) {
+func Initialize(cc *context.Context) bool {
 	c = cc
 	domainLog = c.Logger.With().Str("domain", "colors").Int("version", 1).Logger()
 
-	initColors()
+	if !initColors() {
+		return false
+	}
 	initAPI()
 
 	domainLog.Info().Msg("Domain «colors» initialized")
+	return true
+}
+
+// Shutdown stops watching colors storages and closes them
+func Shutdown() {
+	closeServices()
 }
@@ -0,0 +1,176 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package colorsv1
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+)
+
+var (
+	// Only one reload at a time
+	reloadMutex sync.Mutex
+)
+
+// ReloadConfiguration re-reads configuration file and applies changes in
+// colors without restart. Colors from state file are applied on top of it.
+// If new configuration is invalid, running one is left untouched.
+func ReloadConfiguration() (*config.Diff, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	colorsModuleLog.Info().Msg("Reloading configuration...")
+
+	newConfig, err := c.LoadConfiguration()
+	if err == nil {
+		err = applyRuntimeColors(newConfig)
+	}
+	if err == nil {
+		// Access rules are checked before anything is applied, so running
+		// configuration is either replaced as a whole or left untouched
+		err = c.CheckAPIAccess(newConfig)
+	}
+	if err != nil {
+		colorsModuleLog.Error().Err(err).Msg("New configuration is invalid, keeping current one")
+		return nil, err
+	}
+
+	trustedProxiesChanged := !reflect.DeepEqual(c.Config().Proxy.TrustedProxies, newConfig.Proxy.TrustedProxies)
+	diff, err := applyReloadable(newConfig, nil)
+	if err != nil {
+		colorsModuleLog.Error().Err(err).Msg("New configuration is invalid, keeping current one")
+		return nil, err
+	}
+	err = c.ReloadAPIAccess(newConfig)
+	if err != nil {
+		// Rules are already checked, it can't happen
+		colorsModuleLog.Error().Err(err).Msg("Failed to apply new API access rules")
+	}
+
+	if diff.IsEmpty() && !trustedProxiesChanged {
+		colorsModuleLog.Info().Msg("Configuration reloaded, no changes in colors")
+		return diff, nil
+	}
+	logDiff(diff)
+
+	// Dispatcher will apply new configuration of current colors and
+	// trusted proxies
+	ColorChanged <- true
+
+	return diff, nil
+}
+
+func logDiff(diff *config.Diff) {
+	for _, colorDiff := range diff.Colors {
+		diffLog := colorsModuleLog.With().Str("color", colorDiff.Name).Logger()
+		if colorDiff.Service != "" {
+			diffLog = diffLog.With().Str("service", colorDiff.Service).Logger()
+		}
+		diffLog.Info().Msgf("Color %s", colorDiff.Change)
+		for _, backendDiff := range colorDiff.Backends {
+			diffLog.Info().Str("listen_on", backendDiff.ListenOn).Str("source", backendDiff.Source).Strs("added destinations", backendDiff.AddedDestinations).Strs("removed destinations", backendDiff.RemovedDestinations).Msgf("Backend %s", backendDiff.Change)
+		}
+	}
+}
+
+// applyReloadable publishes running configuration with colors of
+// services, access rules and trusted proxies of new one, unless current
+// color of some service is gone. Services from fallbacks, whose current
+// color is gone, are switched to given colors after that; if it fails,
+// running configuration is left untouched.
+func applyReloadable(newConfig *config.Struct, fallbacks map[string]string) (*config.Diff, error) {
+	for _, s := range services {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+
+	err := checkCurrentColors(newConfig, fallbacks)
+	if err != nil {
+		return nil, err
+	}
+
+	current := c.Config()
+	diff := config.DiffColors(current, newConfig)
+
+	// Only colors and access rules can be changed on the fly
+	if !reflect.DeepEqual(withoutReloadable(current), withoutReloadable(newConfig)) {
+		colorsModuleLog.Warn().Msg("Configuration changes outside of colors section require restart and will be ignored")
+	}
+
+	// Running configuration is replaced, not changed, so anyone who still
+	// holds old one can safely finish his work with it
+	reloaded := *current
+	reloaded.Colors = newConfig.Colors
+	reloaded.Services = make([]config.Service, len(current.Services))
+	for i := range current.Services {
+		reloaded.Services[i] = current.Services[i]
+		reloaded.Services[i].Colors = newConfig.FindService(reloaded.Services[i].Name).Colors
+	}
+	reloaded.API.Access = newConfig.API.Access
+	reloaded.Proxy.TrustedProxies = newConfig.Proxy.TrustedProxies
+	c.SetConfig(&reloaded)
+
+	for _, s := range services {
+		fallback, ok := fallbacks[s.name]
+		if !ok || s.currentColor == "" || colorExistsIn(newConfig, s.name, s.currentColor) {
+			continue
+		}
+		s.log.Warn().Msgf("Current color %s is removed, switching to %s", s.currentColor, fallback)
+		err = s.applyState(s.nextState(fallback), true)
+		if err != nil {
+			// Colors of other services aren't switched yet
+			c.SetConfig(current)
+			return nil, err
+		}
+	}
+
+	return diff, nil
+}
+
+// checkCurrentColors makes sure that new configuration has the same
+// services and current color of each one, except services with fallback
+// color. It should be called with services mutexes locked.
+func checkCurrentColors(newConfig *config.Struct, fallbacks map[string]string) error {
+	newServices := newConfig.AllServices()
+	if len(newServices) != len(services) {
+		return errors.New("services can't be added or removed without restart")
+	}
+
+	for i, s := range services {
+		if newServices[i].Name != s.name {
+			return errors.New("services can't be added or removed without restart")
+		}
+		if s.currentColor == "" || colorExistsIn(newConfig, s.name, s.currentColor) {
+			continue
+		}
+		if fallback, ok := fallbacks[s.name]; ok && colorExistsIn(newConfig, s.name, fallback) {
+			continue
+		}
+		if s.name == config.DefaultService {
+			return fmt.Errorf("current color %s is absent in new configuration", s.currentColor)
+		}
+		return fmt.Errorf("current color %s of service %s is absent in new configuration", s.currentColor, s.name)
+	}
+
+	return nil
+}
+
+// withoutReloadable returns copy of configuration without parts, which
+// are applied on reload: colors of services and access rules
+func withoutReloadable(configuration *config.Struct) config.Struct {
+	rest := *configuration
+	rest.Colors = nil
+	rest.API.Access = config.AccessRules{}
+	rest.Proxy.TrustedProxies = nil
+	rest.Services = make([]config.Service, len(configuration.Services))
+	for i := range configuration.Services {
+		rest.Services[i] = configuration.Services[i]
+		rest.Services[i].Colors = nil
+	}
+	return rest
+}
@@ -0,0 +1,241 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package colorsv1
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+)
+
+var (
+	// Colors, created or changed with API
+	runtimeColors *config.RuntimeColors
+
+	errRuntimeColorsDisabled = errors.New("Colors can't be changed at runtime without proxy.state_file")
+	errUnknownColor          = errors.New("Unknown color")
+	errUnknownBackend        = errors.New("Unknown backend")
+	errUnknownDestination    = errors.New("Unknown destination")
+	errCurrentColor          = errors.New("Color is current, use force=true to change it anyway")
+)
+
+// loadRuntimeColors reads state file and applies colors from it to running
+// configuration
+func loadRuntimeColors() bool {
+	runtimeColors = &config.RuntimeColors{}
+	if c.Config().Proxy.StateFile == "" {
+		return true
+	}
+
+	data, err := ioutil.ReadFile(c.Config().Proxy.StateFile)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err == nil {
+		runtimeColors, err = config.ParseRuntimeColors(data)
+	}
+	if err != nil {
+		colorsModuleLog.Error().Err(err).Str("path", c.Config().Proxy.StateFile).Msg("Failed to read colors state file")
+		return false
+	}
+
+	configuration := *c.Config()
+	err = applyRuntimeColors(&configuration)
+	if err != nil {
+		colorsModuleLog.Error().Err(err).Str("path", c.Config().Proxy.StateFile).Msg("Colors from state file don't fit configuration")
+		return false
+	}
+	c.SetConfig(&configuration)
+
+	return true
+}
+
+// applyRuntimeColors applies colors from state file to configuration and
+// checks result
+func applyRuntimeColors(configuration *config.Struct) error {
+	for _, name := range runtimeColors.Apply(configuration) {
+		colorsModuleLog.Warn().Str("service", name).Msg("State file has colors of service, which isn't configured, ignoring them")
+	}
+
+	problems := configuration.Validate()
+	if problems.HasErrors() {
+		return problems
+	}
+	return nil
+}
+
+func saveRuntimeColors(state *config.RuntimeColors) error {
+	data, err := state.Marshal()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(c.Config().Proxy.StateFile, data)
+}
+
+// updateColors changes colors of service at runtime and saves change to
+// state file. Changes of current color are refused unless forced. Forced
+// removal of current color switches service to its first remaining color.
+func updateColors(serviceName string, colorName string, force bool, change func(state *config.RuntimeColors)) (*config.Diff, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	if c.Config().Proxy.StateFile == "" {
+		return nil, errRuntimeColorsDisabled
+	}
+	s := findService(serviceName)
+	if s == nil {
+		return nil, errUnknownService
+	}
+	if !force && s.currentColorName() == colorName {
+		return nil, errCurrentColor
+	}
+
+	newState := runtimeColors.Copy()
+	change(newState)
+
+	// Runtime colors are already applied to running configuration, but
+	// applying them once more changes nothing
+	newConfig := *c.Config()
+	newState.Apply(&newConfig)
+	problems := newConfig.Validate()
+	if problems.HasErrors() {
+		return nil, problems
+	}
+
+	err := saveRuntimeColors(newState)
+	if err != nil {
+		colorsModuleLog.Error().Err(err).Msg("Failed to save colors state file")
+		return nil, err
+	}
+
+	// Service is switched only if new colors are applied
+	fallbacks := map[string]string{s.name: newConfig.FindService(s.name).Colors[0].Name}
+	diff, err := applyReloadable(&newConfig, fallbacks)
+	if err != nil {
+		return nil, restoreRuntimeColors(err)
+	}
+	runtimeColors = newState
+
+	logDiff(diff)
+	ColorChanged <- true
+
+	return diff, nil
+}
+
+// restoreRuntimeColors brings back state file after failed change
+func restoreRuntimeColors(err error) error {
+	saveErr := saveRuntimeColors(runtimeColors)
+	if saveErr != nil {
+		colorsModuleLog.Error().Err(saveErr).Msg("Failed to restore colors state file")
+	}
+	return err
+}
+
+// findColor returns copy of color configuration of service
+func findColor(serviceName string, colorName string) (config.Color, error) {
+	s := findService(serviceName)
+	if s == nil {
+		return config.Color{}, errUnknownService
+	}
+	colors := s.colors()
+	for i := range colors {
+		if colors[i].Name == colorName {
+			return colors[i].Copy(), nil
+		}
+	}
+	return config.Color{}, errUnknownColor
+}
+
+// setColor creates color of service or replaces existing one
+func setColor(serviceName string, color config.Color, force bool) (*config.Diff, error) {
+	return updateColors(serviceName, color.Name, force, func(state *config.RuntimeColors) {
+		state.SetColor(serviceName, color)
+	})
+}
+
+// deleteColor removes color of service
+func deleteColor(serviceName string, colorName string, force bool) (*config.Diff, error) {
+	_, err := findColor(serviceName, colorName)
+	if err != nil {
+		return nil, err
+	}
+	return updateColors(serviceName, colorName, force, func(state *config.RuntimeColors) {
+		state.DeleteColor(serviceName, colorName)
+	})
+}
+
+// modifyColor changes existing color of service
+func modifyColor(serviceName string, colorName string, force bool, modify func(color *config.Color) error) (*config.Diff, error) {
+	color, err := findColor(serviceName, colorName)
+	if err != nil {
+		return nil, err
+	}
+	err = modify(&color)
+	if err != nil {
+		return nil, err
+	}
+	return setColor(serviceName, color, force)
+}
+
+// findBackend returns index of color backend with given listener and
+// source
+func findBackend(color *config.Color, listenOn string, source string) (int, error) {
+	for i := range color.Backends {
+		if color.Backends[i].ListenOn == listenOn && color.Backends[i].Source == source {
+			return i, nil
+		}
+	}
+	return 0, errUnknownBackend
+}
+
+func addBackend(serviceName string, colorName string, backend config.BackendConfig, force bool) (*config.Diff, error) {
+	return modifyColor(serviceName, colorName, force, func(color *config.Color) error {
+		color.Backends = append(color.Backends, backend)
+		return nil
+	})
+}
+
+func removeBackend(serviceName string, colorName string, listenOn string, source string, force bool) (*config.Diff, error) {
+	return modifyColor(serviceName, colorName, force, func(color *config.Color) error {
+		i, err := findBackend(color, listenOn, source)
+		if err != nil {
+			return err
+		}
+		color.Backends = append(color.Backends[:i], color.Backends[i+1:]...)
+		return nil
+	})
+}
+
+func addDestination(serviceName string, colorName string, listenOn string, source string, destination config.Destination, force bool) (*config.Diff, error) {
+	return modifyColor(serviceName, colorName, force, func(color *config.Color) error {
+		i, err := findBackend(color, listenOn, source)
+		if err != nil {
+			return err
+		}
+		color.Backends[i].Destinations = append(color.Backends[i].Destinations, destination)
+		return nil
+	})
+}
+
+func removeDestination(serviceName string, colorName string, listenOn string, source string, destination string, force bool) (*config.Diff, error) {
+	return modifyColor(serviceName, colorName, force, func(color *config.Color) error {
+		i, err := findBackend(color, listenOn, source)
+		if err != nil {
+			return err
+		}
+		destinations := make([]config.Destination, 0, len(color.Backends[i].Destinations))
+		for _, d := range color.Backends[i].Destinations {
+			if d.Address != destination {
+				destinations = append(destinations, d)
+			}
+		}
+		if len(destinations) == len(color.Backends[i].Destinations) {
+			return errUnknownDestination
+		}
+		color.Backends[i].Destinations = destinations
+		return nil
+	})
+}
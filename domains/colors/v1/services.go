@@ -0,0 +1,184 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package colorsv1
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+)
+
+// service is a set of colors with its own current color and storage.
+// Colors from top level of configuration form the default service.
+type service struct {
+	name    string
+	storage Storage
+	log     zerolog.Logger
+
+	// Current color state. Color is empty until it's loaded from storage.
+	mutex            sync.Mutex
+	currentColor     string
+	currentVersion   uint64
+	currentNode      string
+	currentChangedAt time.Time
+	// Problem with stored color, found on startup. It's kept until color
+	// is saved again.
+	storageProblem string
+
+	watchStop chan bool
+	watchDone chan bool
+}
+
+// ServiceColor is a current color of service
+type ServiceColor struct {
+	Service string
+	Color   *config.Color
+}
+
+var (
+	// Configured services, the default one goes first
+	services []*service
+
+	errUnknownService = errors.New("Unknown service")
+)
+
+// openServices creates storage for every configured service and starts
+// watching it
+func openServices() bool {
+	for _, serviceConfig := range c.Config().AllServices() {
+		storage, err := NewStorage(&c.Config().Proxy, &serviceConfig)
+		if err != nil {
+			colorsModuleLog.Error().Err(err).Str("service", serviceConfig.Name).Msg("Failed to open colors storage")
+			closeServices()
+			return false
+		}
+
+		s := &service{
+			name:    serviceConfig.Name,
+			storage: storage,
+			log:     colorsModuleLog.With().Str("service", serviceConfig.Name).Logger(),
+		}
+		services = append(services, s)
+		s.startWatching()
+	}
+
+	return true
+}
+
+func closeServices() {
+	for _, s := range services {
+		s.stopWatching()
+		err := s.storage.Close()
+		if err != nil {
+			s.log.Warn().Err(err).Msg("Failed to close colors storage")
+		}
+	}
+	services = nil
+}
+
+func findService(name string) *service {
+	for _, s := range services {
+		if s.name == name {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// defaultService returns service, which is used when no service is given,
+// or nil if services aren't opened
+func defaultService() *service {
+	if len(services) == 0 {
+		return nil
+	}
+	return services[0]
+}
+
+// colors returns current configuration of service colors
+func (s *service) colors() []config.Color {
+	serviceConfig := c.Config().FindService(s.name)
+	if serviceConfig == nil {
+		return nil
+	}
+	return serviceConfig.Colors
+}
+
+func (s *service) colorExists(color string) bool {
+	return colorExistsIn(c.Config(), s.name, color)
+}
+
+func colorExistsIn(configuration *config.Struct, serviceName string, color string) bool {
+	serviceConfig := configuration.FindService(serviceName)
+	if serviceConfig == nil {
+		return false
+	}
+	for i := range serviceConfig.Colors {
+		if serviceConfig.Colors[i].Name == color {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ServiceNames returns names of configured services, the default one goes
+// first
+func ServiceNames() []string {
+	names := make([]string, 0, len(services))
+	for _, s := range services {
+		names = append(names, s.name)
+	}
+	return names
+}
+
+// GetServiceColorState returns current color state of service
+func GetServiceColorState(name string) (ColorState, error) {
+	s := findService(name)
+	if s == nil {
+		return ColorState{}, errUnknownService
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.currentState(), nil
+}
+
+// SetServiceColor sets current color of service
+func SetServiceColor(name string, color string) error {
+	s := findService(name)
+	if s == nil {
+		return errUnknownService
+	}
+	return s.switchColor(color, true)
+}
+
+// GetServiceStorageProblem returns problem with stored color of service,
+// found on startup, or empty string
+func GetServiceStorageProblem(name string) string {
+	s := findService(name)
+	if s == nil {
+		return ""
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.storageProblem
+}
+
+// GetCurrentColorConfigurations returns configurations of current colors
+// of all services, which have color chosen
+func GetCurrentColorConfigurations() []ServiceColor {
+	result := make([]ServiceColor, 0, len(services))
+	for _, s := range services {
+		color := s.currentColorConfiguration()
+		if color != nil {
+			result = append(result, ServiceColor{Service: s.name, Color: color})
+		}
+	}
+	return result
+}
@@ -0,0 +1,149 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package colorsv1
+
+import (
+	"os"
+	"time"
+)
+
+// ColorState describes current color along with its version. Each color
+// change increments version, so instances can find out, whose color is
+// the latest one (last writer wins).
+type ColorState struct {
+	// Service, which color is described. Empty service means the default
+	// one, as it was before services appeared.
+	Service string `json:"service,omitempty"`
+	Color   string `json:"color"`
+	Version uint64 `json:"version"`
+	// Instance, which made this change
+	Node      string    `json:"node"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+var (
+	// StateChanged receives signal on each color state change. Signals
+	// are never queued more than one, so slow reader sees latest state only.
+	StateChanged chan bool
+)
+
+// NewerThan returns true if state should replace other one. Higher version
+// wins, equal versions are ordered by node name, so every instance makes
+// the same choice.
+func (s ColorState) NewerThan(other ColorState) bool {
+	if s.Version != other.Version {
+		return s.Version > other.Version
+	}
+	return s.Node > other.Node
+}
+
+// GetColorState returns current color state of the default service
+func GetColorState() ColorState {
+	state, _ := GetServiceColorState(defaultService().name)
+	return state
+}
+
+// GetColorStates returns current color states of all services
+func GetColorStates() []ColorState {
+	states := make([]ColorState, 0, len(services))
+	for _, s := range services {
+		s.mutex.Lock()
+		states = append(states, s.currentState())
+		s.mutex.Unlock()
+	}
+	return states
+}
+
+// ApplyPeerState switches service to state, received from another
+// instance, if it is newer than current one. It returns true if state was
+// applied.
+func ApplyPeerState(state ColorState) (bool, error) {
+	s := defaultService()
+	if state.Service != "" {
+		s = findService(state.Service)
+	}
+	if s == nil {
+		return false, errUnknownService
+	}
+	return s.applyNewerState(state, true)
+}
+
+// NodeID returns name of this instance: configured one or hostname
+func NodeID() string {
+	if c.Config().Peers.NodeID != "" {
+		return c.Config().Peers.NodeID
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "lbtds"
+	}
+	return hostname
+}
+
+// currentState should be called with service mutex locked
+func (s *service) currentState() ColorState {
+	return ColorState{
+		Service:   s.name,
+		Color:     s.currentColor,
+		Version:   s.currentVersion,
+		Node:      s.currentNode,
+		ChangedAt: s.currentChangedAt,
+	}
+}
+
+// setState should be called with service mutex locked
+func (s *service) setState(state ColorState) {
+	s.currentColor = state.Color
+	s.currentVersion = state.Version
+	s.currentNode = state.Node
+	s.currentChangedAt = state.ChangedAt
+}
+
+// applyNewerState makes state current and signals proxies, if it's newer
+// than current one. It returns true if state was applied.
+func (s *service) applyNewerState(state ColorState, save bool) (bool, error) {
+	s.mutex.Lock()
+	if !state.NewerThan(s.currentState()) {
+		s.mutex.Unlock()
+		return false, nil
+	}
+	err := s.applyState(state, save)
+	s.mutex.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	ColorChanged <- true
+	return true, nil
+}
+
+// applyState makes state current and signals peers about it. It should be
+// called with service mutex locked. Proxies should be signalled by caller
+// after unlocking, because dispatcher reads colors of all services.
+func (s *service) applyState(state ColorState, save bool) error {
+	if !s.colorExists(state.Color) {
+		s.log.Warn().Msgf("There is no such color in configuration: %s", state.Color)
+		return errInvalidColor
+	}
+	state.Service = s.name
+
+	if save {
+		err := s.storage.Save(state)
+		if err != nil {
+			s.log.Error().Err(err).Msg("Failed to save current color to storage")
+			return err
+		}
+		s.storageProblem = ""
+	}
+
+	s.setState(state)
+	s.log.Info().Str("node", state.Node).Uint64("color_version", state.Version).Msgf("Current color changed to %s", s.currentColor)
+
+	select {
+	case StateChanged <- true:
+	default:
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package colorsv1
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+)
+
+// ErrColorNotStored is returned by storage when there is no saved color yet
+var ErrColorNotStored = errors.New("color is not stored")
+
+// CorruptedError is returned by storage when stored value can't be used
+type CorruptedError struct {
+	Reason  string
+	Content string
+}
+
+func (e *CorruptedError) Error() string {
+	content := e.Content
+	if len(content) > 64 {
+		content = content[:64] + "..."
+	}
+	return fmt.Sprintf("stored color is corrupted: %s (content: %q)", e.Reason, content)
+}
+
+// Storage keeps current color, so it survives restarts and can be shared
+// between several balancers
+type Storage interface {
+	// Load returns saved color state, ErrColorNotStored or *CorruptedError
+	Load() (ColorState, error)
+	// Save saves color state
+	Save(state ColorState) error
+	// Watch starts watching storage in background. Stored color state is
+	// sent to changes channel when it's changed, probably by someone else,
+	// until stop is closed.
+	Watch(changes chan<- ColorState, stop <-chan bool) error
+	// Close releases storage resources
+	Close() error
+}
+
+// NewStorage creates storage of service color. Storage type is configured
+// in proxy section of configuration, while location of color is service's.
+func NewStorage(proxyConfig *config.Proxy, serviceConfig *config.Service) (Storage, error) {
+	switch proxyConfig.StorageType {
+	case "", "file":
+		return newFileStorage(serviceConfig.ColorFile), nil
+	case "kv":
+		return newKVStorage(serviceConfig.ColorFile, serviceConfig.StorageKey)
+	case "http":
+		return newHTTPStorage(proxyConfig.StorageURL, serviceConfig.StorageKey, proxyConfig.StorageTimeout, proxyConfig.StoragePollInterval)
+	default:
+		return nil, fmt.Errorf("unsupported storage type %s", proxyConfig.StorageType)
+	}
+}
+
+// encodeState encodes color state for storing. JSON is used, so format can
+// be extended without breaking older files.
+func encodeState(state ColorState) []byte {
+	data, _ := json.Marshal(&state)
+	return append(data, '\n')
+}
+
+// decodeState decodes stored color state. Plain color name, written by
+// older versions or by hand, is accepted too.
+func decodeState(data []byte) (ColorState, error) {
+	var state ColorState
+	content := strings.TrimSpace(string(data))
+
+	switch {
+	case content == "":
+		return state, &CorruptedError{Reason: "value is empty", Content: string(data)}
+	case strings.HasPrefix(content, "{"):
+		err := json.Unmarshal([]byte(content), &state)
+		if err != nil {
+			return state, &CorruptedError{Reason: err.Error(), Content: string(data)}
+		}
+		if state.Color == "" {
+			return state, &CorruptedError{Reason: "color is missing", Content: string(data)}
+		}
+	case strings.ContainsAny(content, " \t\r\n\x00"):
+		return state, &CorruptedError{Reason: "unexpected characters in color name", Content: string(data)}
+	default:
+		state.Color = content
+	}
+
+	return state, nil
+}
@@ -0,0 +1,80 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package colorsv1
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// fileStorage keeps color state in file. File is never modified in place:
+// new state is written to temporary file, which then replaces old one, so
+// crash or full disk can't leave partially written state.
+type fileStorage struct {
+	path string
+}
+
+func newFileStorage(path string) *fileStorage {
+	normalizedColorsPath, _ := filepath.Abs(path)
+	return &fileStorage{path: normalizedColorsPath}
+}
+
+func (s *fileStorage) Load() (ColorState, error) {
+	c.Logger.Debug().Msgf("Current color file path: %s", s.path)
+
+	colorsData, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return ColorState{}, ErrColorNotStored
+	}
+	if err != nil {
+		return ColorState{}, err
+	}
+
+	return decodeState(colorsData)
+}
+
+func (s *fileStorage) Save(state ColorState) error {
+	return writeFileAtomically(s.path, encodeState(state))
+}
+
+func (s *fileStorage) Close() error {
+	return nil
+}
+
+// writeFileAtomically replaces file contents: data is written to temporary
+// file in the same directory, synced to disk and renamed over old file
+func writeFileAtomically(path string, data []byte) error {
+	directory := filepath.Dir(path)
+	temporary, err := ioutil.TempFile(directory, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = temporary.Write(data)
+	if err == nil {
+		err = temporary.Sync()
+	}
+	if closeErr := temporary.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temporary.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(temporary.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(temporary.Name())
+		return err
+	}
+
+	// Make rename itself durable
+	directoryFile, err := os.Open(directory)
+	if err != nil {
+		return nil
+	}
+	_ = directoryFile.Sync()
+	return directoryFile.Close()
+}
@@ -0,0 +1,85 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+//go:build linux
+// +build linux
+
+package colorsv1
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Watch watches color file with inotify. Directory is watched instead of
+// file itself, so file replacement by rename is noticed too.
+func (s *fileStorage) Watch(changes chan<- ColorState, stop <-chan bool) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	// Non-blocking descriptor is handled by runtime poller, so closing
+	// it interrupts blocked read
+	events := os.NewFile(uintptr(fd), "inotify")
+
+	_, err = syscall.InotifyAddWatch(fd, filepath.Dir(s.path), syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO)
+	if err != nil {
+		events.Close()
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+
+	go func() {
+		<-stop
+		events.Close()
+	}()
+	go s.readEvents(events, changes, stop)
+
+	return nil
+}
+
+func (s *fileStorage) readEvents(events *os.File, changes chan<- ColorState, stop <-chan bool) {
+	fileName := filepath.Base(s.path)
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := events.Read(buffer)
+		if err != nil {
+			select {
+			case <-stop:
+			default:
+				colorsModuleLog.Error().Err(err).Msg("Failed to read color file changes")
+			}
+			return
+		}
+
+		changed := false
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			if nameEnd > n {
+				break
+			}
+			if strings.TrimRight(string(buffer[nameStart:nameEnd]), "\x00") == fileName {
+				changed = true
+			}
+			offset = nameEnd
+		}
+		if !changed {
+			continue
+		}
+
+		state, err := s.Load()
+		if err != nil {
+			reportWatchError(err)
+			continue
+		}
+		select {
+		case changes <- state:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+//go:build !linux
+// +build !linux
+
+package colorsv1
+
+import (
+	"os"
+	"time"
+)
+
+const filePollInterval = time.Second
+
+// Watch polls color file modification time, as there is no inotify here
+func (s *fileStorage) Watch(changes chan<- ColorState, stop <-chan bool) error {
+	var lastModified time.Time
+	if info, err := os.Stat(s.path); err == nil {
+		lastModified = info.ModTime()
+	}
+
+	go s.poll(lastModified, changes, stop)
+	return nil
+}
+
+func (s *fileStorage) poll(lastModified time.Time, changes chan<- ColorState, stop <-chan bool) {
+	ticker := time.NewTicker(filePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(s.path)
+		if err != nil || !info.ModTime().After(lastModified) {
+			continue
+		}
+		lastModified = info.ModTime()
+
+		state, err := s.Load()
+		if err != nil {
+			reportWatchError(err)
+			continue
+		}
+		select {
+		case changes <- state:
+		case <-stop:
+			return
+		}
+	}
+}
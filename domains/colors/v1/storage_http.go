@@ -0,0 +1,184 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package colorsv1
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultStorageTimeout      = 5 * time.Second
+	defaultStoragePollInterval = 5 * time.Second
+	// How long storage may hold watch request, if it supports long polling
+	storageWatchWait = 30 * time.Second
+)
+
+var errNotModified = errors.New("value is not modified")
+
+// httpStorage keeps color in remote key-value storage. Value is read with
+// GET and written with PUT, 404 means there is no value yet. Credentials
+// can be passed in URL for basic authentication.
+//
+// Changes are watched by polling. Watch requests carry "wait" parameter
+// and If-None-Match header with last seen ETag, so storage can hold request
+// until value changes (long polling) or answer 304 Not Modified.
+type httpStorage struct {
+	url          string
+	timeout      time.Duration
+	pollInterval time.Duration
+	client       *http.Client
+}
+
+func newHTTPStorage(baseURL string, key string, timeout time.Duration, pollInterval time.Duration) (*httpStorage, error) {
+	_, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if timeout == 0 {
+		timeout = defaultStorageTimeout
+	}
+	if pollInterval == 0 {
+		pollInterval = defaultStoragePollInterval
+	}
+
+	return &httpStorage{
+		url:          strings.TrimSuffix(baseURL, "/") + "/" + url.PathEscape(key),
+		timeout:      timeout,
+		pollInterval: pollInterval,
+		// Timeouts are set per request, as watch requests are long
+		client: &http.Client{},
+	}, nil
+}
+
+func (s *httpStorage) Load() (ColorState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	state, _, err := s.read(ctx, s.url, "")
+	return state, err
+}
+
+// read reads value from storage. It returns errNotModified if storage
+// reports, that value still has given ETag.
+func (s *httpStorage) read(ctx context.Context, address string, etag string) (ColorState, string, error) {
+	var state ColorState
+	request, err := http.NewRequest(http.MethodGet, address, nil)
+	if err != nil {
+		return state, "", err
+	}
+	if etag != "" {
+		request.Header.Set("If-None-Match", etag)
+	}
+
+	response, err := s.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return state, "", err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return state, "", err
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		state, err = decodeState(body)
+		return state, response.Header.Get("ETag"), err
+	case http.StatusNotModified:
+		return state, etag, errNotModified
+	case http.StatusNotFound:
+		return state, "", ErrColorNotStored
+	default:
+		return state, "", fmt.Errorf("storage returned %d on read", response.StatusCode)
+	}
+}
+
+func (s *httpStorage) Save(state ColorState) error {
+	request, err := http.NewRequest(http.MethodPut, s.url, bytes.NewReader(encodeState(state)))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	response, err := s.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = ioutil.ReadAll(response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("storage returned %d on write", response.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *httpStorage) Watch(changes chan<- ColorState, stop <-chan bool) error {
+	go s.poll(changes, stop)
+	return nil
+}
+
+func (s *httpStorage) poll(changes chan<- ColorState, stop <-chan bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	watchURL := s.url + "?wait=" + storageWatchWait.String()
+	var etag string
+	var lastState ColorState
+	for {
+		started := time.Now()
+
+		requestCtx, requestCancel := context.WithTimeout(ctx, storageWatchWait+s.timeout)
+		state, newETag, err := s.read(requestCtx, watchURL, etag)
+		requestCancel()
+
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err == nil:
+			etag = newETag
+			if state != lastState {
+				lastState = state
+				select {
+				case changes <- state:
+				case <-stop:
+					return
+				}
+			}
+		case err != errNotModified && err != ErrColorNotStored:
+			reportWatchError(err)
+		}
+
+		// Don't hammer storage, which doesn't hold requests
+		wait := s.pollInterval - time.Since(started)
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+func (s *httpStorage) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,85 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package colorsv1
+
+import (
+	"path/filepath"
+	"sync"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/kvstore"
+)
+
+// sharedDB is a database, used by several services. Database can be opened
+// only once, so it's closed when the last service closes its storage.
+type sharedDB struct {
+	db    *kvstore.DB
+	users int
+}
+
+var (
+	openDatabases      = make(map[string]*sharedDB)
+	openDatabasesMutex sync.Mutex
+)
+
+// kvStorage keeps color in embedded key-value database
+type kvStorage struct {
+	path string
+	db   *kvstore.DB
+	key  string
+}
+
+func newKVStorage(path string, key string) (*kvStorage, error) {
+	normalizedPath, _ := filepath.Abs(path)
+
+	openDatabasesMutex.Lock()
+	defer openDatabasesMutex.Unlock()
+
+	shared, ok := openDatabases[normalizedPath]
+	if !ok {
+		db, err := kvstore.Open(normalizedPath)
+		if err != nil {
+			return nil, err
+		}
+		shared = &sharedDB{db: db}
+		openDatabases[normalizedPath] = shared
+	}
+	shared.users++
+
+	return &kvStorage{path: normalizedPath, db: shared.db, key: key}, nil
+}
+
+func (s *kvStorage) Load() (ColorState, error) {
+	value, ok := s.db.Get(s.key)
+	if !ok {
+		return ColorState{}, ErrColorNotStored
+	}
+
+	return decodeState(value)
+}
+
+func (s *kvStorage) Save(state ColorState) error {
+	return s.db.Put(s.key, encodeState(state))
+}
+
+// Watch does nothing: database is locked by this process, so nobody else
+// can change it
+func (s *kvStorage) Watch(changes chan<- ColorState, stop <-chan bool) error {
+	return nil
+}
+
+func (s *kvStorage) Close() error {
+	openDatabasesMutex.Lock()
+	defer openDatabasesMutex.Unlock()
+
+	shared, ok := openDatabases[s.path]
+	if !ok || shared.db != s.db {
+		return kvstore.ErrClosed
+	}
+	shared.users--
+	if shared.users > 0 {
+		return nil
+	}
+	delete(openDatabases, s.path)
+	return s.db.Close()
+}
@@ -0,0 +1,107 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package colorsv1
+
+import (
+	"time"
+)
+
+var (
+	// Storage changes are applied only after they stop coming for this
+	// long, so editor saving file in several steps causes single switch
+	watchDebounce = 500 * time.Millisecond
+)
+
+func (s *service) startWatching() {
+	s.watchStop = make(chan bool)
+	s.watchDone = make(chan bool)
+
+	changes := make(chan ColorState)
+	err := s.storage.Watch(changes, s.watchStop)
+	if err != nil {
+		s.log.Error().Err(err).Msg("Failed to watch colors storage, external changes will be ignored")
+		close(s.watchDone)
+		return
+	}
+	go s.debounceChanges(changes, s.watchStop, s.watchDone)
+}
+
+func (s *service) stopWatching() {
+	if s.watchStop == nil {
+		return
+	}
+	close(s.watchStop)
+	<-s.watchDone
+	s.watchStop = nil
+}
+
+func (s *service) debounceChanges(changes chan ColorState, stop chan bool, done chan bool) {
+	defer close(done)
+
+	var pending ColorState
+	debounce := time.NewTimer(watchDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case state := <-changes:
+			pending = state
+			debounce.Reset(watchDebounce)
+		case <-debounce.C:
+			s.applyStoredState(pending)
+		}
+	}
+}
+
+// applyStoredState applies color state, which was changed in storage.
+// State, saved by instance, keeps its version and node, so instances
+// sharing storage agree on it, and it's applied only if it's newer than
+// current one. Color name without version, written by hand, is a new
+// change of this instance, which is saved back with version.
+func (s *service) applyStoredState(state ColorState) {
+	current := s.currentColorName()
+	// Color isn't chosen yet
+	if current == "" {
+		return
+	}
+
+	if !s.colorExists(state.Color) {
+		s.log.Warn().Msgf("Ignoring unknown color %s from colors storage", state.Color)
+		return
+	}
+
+	if state.Version == 0 {
+		if state.Color == current {
+			return
+		}
+		s.log.Info().Msgf("Color changed to %s in colors storage", state.Color)
+		err := s.switchColor(state.Color, true)
+		if err != nil {
+			s.log.Warn().Err(err).Msgf("Failed to change color to %s", state.Color)
+		}
+		return
+	}
+
+	// Storage reports our own change, or state, which is already replaced
+	applied, err := s.applyNewerState(state, false)
+	if err != nil {
+		s.log.Warn().Err(err).Msgf("Failed to change color to %s", state.Color)
+		return
+	}
+	if applied {
+		s.log.Info().Str("node", state.Node).Uint64("color_version", state.Version).Msgf("Color changed to %s in colors storage", state.Color)
+	}
+}
+
+// reportWatchError logs storage read error, which happened while watching
+func reportWatchError(err error) {
+	if _, ok := err.(*CorruptedError); ok {
+		colorsModuleLog.Warn().Err(err).Msg("Ignoring corrupted color in colors storage")
+		return
+	}
+	colorsModuleLog.Debug().Err(err).Msg("Failed to check colors storage for changes")
+}
@@ -0,0 +1,132 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package peersv1
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"lab.wtfteam.pro/wtfteam/lbtds/domains/colors/v1"
+)
+
+var (
+	apiModuleLog zerolog.Logger
+)
+
+// Status describes color agreement between this instance and its peers
+type Status struct {
+	Enabled bool   `json:"enabled"`
+	Node    string `json:"node"`
+	// Color states of all services
+	States []colorsv1.ColorState `json:"states"`
+	// True if every peer is reachable and has the same color states
+	Agreement bool         `json:"agreement"`
+	Peers     []PeerStatus `json:"peers"`
+}
+
+func initAPI() {
+	apiModuleLog = domainLog.With().Str("module", "api").Logger()
+	apiModuleLog.Info().Msg("Initializing API...")
+
+	c.APIServerMux.HandleFunc(statePath, PeerState)
+	c.APIServerMux.HandleFunc(statePath+"/", PeerState)
+	c.APIServerMux.HandleFunc("/api/v1/peers/status", PeersStatus)
+	c.APIServerMux.HandleFunc("/api/v1/peers/status/", PeersStatus)
+}
+
+// PeerState handles color state exchange between peers
+func PeerState(w http.ResponseWriter, r *http.Request) {
+	if activeSyncer == nil {
+		http.Error(w, "404 page not found", 404)
+		return
+	}
+	activeSyncer.handleState(w, r)
+}
+
+// PeersStatus handles synchronization status requests
+func PeersStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "404 page not found", 404)
+		return
+	}
+
+	status := &Status{Peers: []PeerStatus{}}
+	if activeSyncer != nil {
+		status = activeSyncer.status()
+	} else {
+		status.States = colorsv1.GetColorStates()
+	}
+	writeJSON(w, status)
+}
+
+func (s *syncer) handleState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "404 page not found", 404)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxStateBodySize))
+	if err != nil {
+		http.Error(w, "Invalid request body", 400)
+		return
+	}
+	err = verifyRequest(r, body, s.secret)
+	if err != nil {
+		apiModuleLog.Warn().Err(err).Str("remote", r.RemoteAddr).Str("node", r.Header.Get(nodeHeader)).Msg("Rejected peer request")
+		http.Error(w, "Unauthorized", 401)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var states []colorsv1.ColorState
+		err = json.Unmarshal(body, &states)
+		if err != nil {
+			http.Error(w, "Invalid request body", 400)
+			return
+		}
+
+		var failures []string
+		for _, state := range states {
+			if state.Color == "" {
+				continue
+			}
+			applied, err := s.applyState(state)
+			if err != nil {
+				// Usually means that peers have different colors configured
+				apiModuleLog.Error().Err(err).Str("node", state.Node).Str("service", state.Service).Msgf("Failed to apply color %s from peer", state.Color)
+				failures = append(failures, state.Service+": "+err.Error())
+				continue
+			}
+			if applied {
+				apiModuleLog.Info().Str("node", state.Node).Str("service", state.Service).Uint64("color_version", state.Version).Msgf("Color %s received from peer", state.Color)
+			}
+		}
+		if len(failures) > 0 {
+			http.Error(w, "Failed to apply color: "+strings.Join(failures, "; "), 409)
+			return
+		}
+	}
+
+	// States are signed, so peer can trust them
+	body, err = json.Marshal(s.getStates())
+	if err != nil {
+		apiModuleLog.Error().Err(err).Msg("Failed to marshal color states")
+		http.Error(w, "Internal error", 500)
+		return
+	}
+	signResponse(w.Header(), r, body, s.node, s.secret)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		apiModuleLog.Error().Err(err).Msg("Failed to write API response")
+	}
+}
@@ -0,0 +1,150 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package peersv1
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Requests between peers are signed with HMAC-SHA256 of method, path, node,
+// timestamp, nonce and body, keyed by shared secret. Timestamp limits
+// replays to clock skew window and nonces, seen in that window, are
+// rejected. Responses are signed the same way with nonce of request they
+// answer, so they can't be forged or replayed either.
+const (
+	nodeHeader      = "X-LBTDS-Node"
+	timestampHeader = "X-LBTDS-Timestamp"
+	nonceHeader     = "X-LBTDS-Nonce"
+	signatureHeader = "X-LBTDS-Signature"
+
+	maxClockSkew = time.Minute
+)
+
+var (
+	errNotSigned      = errors.New("message is not signed")
+	errBadSignature   = errors.New("invalid message signature")
+	errStaleTimestamp = errors.New("message timestamp is too far from current time")
+	errReplayed       = errors.New("request nonce was already used")
+
+	// Nonces of accepted requests with time they can be forgotten at
+	seenNonces      = make(map[string]time.Time)
+	seenNoncesMutex sync.Mutex
+)
+
+func signRequest(request *http.Request, body []byte, node string, secret []byte) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	request.Header.Set(nodeHeader, node)
+	request.Header.Set(timestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	request.Header.Set(nonceHeader, hex.EncodeToString(nonce))
+	request.Header.Set(signatureHeader, requestSignature(secret, request, body))
+}
+
+func verifyRequest(request *http.Request, body []byte, secret []byte) error {
+	nonce := request.Header.Get(nonceHeader)
+	if nonce == "" {
+		return errNotSigned
+	}
+	expires, err := verifySignature(request.Header, requestSignature(secret, request, body))
+	if err != nil {
+		return err
+	}
+	return rememberNonce(nonce, expires)
+}
+
+// signResponse signs response body, which answers request
+func signResponse(header http.Header, request *http.Request, body []byte, node string, secret []byte) {
+	header.Set(nodeHeader, node)
+	header.Set(timestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	header.Set(signatureHeader, responseSignature(secret, header, request.Header.Get(nonceHeader), body))
+}
+
+// verifyResponse checks that response body comes from peer and answers
+// request with given nonce
+func verifyResponse(response *http.Response, nonce string, body []byte, secret []byte) error {
+	_, err := verifySignature(response.Header, responseSignature(secret, response.Header, nonce, body))
+	return err
+}
+
+// verifySignature compares signature of message with expected one and
+// checks its timestamp. It returns time, after which message is stale.
+func verifySignature(header http.Header, expected string) (time.Time, error) {
+	timestamp := header.Get(timestampHeader)
+	receivedSignature := header.Get(signatureHeader)
+	if timestamp == "" || receivedSignature == "" {
+		return time.Time{}, errNotSigned
+	}
+
+	if !hmac.Equal([]byte(expected), []byte(receivedSignature)) {
+		return time.Time{}, errBadSignature
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, errBadSignature
+	}
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return time.Time{}, errStaleTimestamp
+	}
+
+	return time.Unix(seconds, 0).Add(maxClockSkew), nil
+}
+
+// rememberNonce fails if nonce was already seen. Nonce is kept until its
+// request becomes stale, so it can't be replayed.
+func rememberNonce(nonce string, expires time.Time) error {
+	seenNoncesMutex.Lock()
+	defer seenNoncesMutex.Unlock()
+
+	now := time.Now()
+	for seen, seenExpires := range seenNonces {
+		if now.After(seenExpires) {
+			delete(seenNonces, seen)
+		}
+	}
+	if _, ok := seenNonces[nonce]; ok {
+		return errReplayed
+	}
+	seenNonces[nonce] = expires
+	return nil
+}
+
+func requestSignature(secret []byte, request *http.Request, body []byte) string {
+	return signature(secret, body,
+		request.Method,
+		request.URL.Path,
+		request.Header.Get(nodeHeader),
+		request.Header.Get(timestampHeader),
+		request.Header.Get(nonceHeader),
+	)
+}
+
+// responseSignature starts with word, which is never a method, so request
+// signature can't be passed off as response one
+func responseSignature(secret []byte, header http.Header, nonce string, body []byte) string {
+	return signature(secret, body,
+		"response",
+		header.Get(nodeHeader),
+		header.Get(timestampHeader),
+		nonce,
+	)
+}
+
+func signature(secret []byte, body []byte, values ...string) string {
+	mac := hmac.New(sha256.New, secret)
+	for _, value := range values {
+		mac.Write([]byte(value + "\n"))
+	}
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
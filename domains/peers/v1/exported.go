@@ -0,0 +1,42 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package peersv1
+
+import (
+	"github.com/rs/zerolog"
+	"lab.wtfteam.pro/wtfteam/lbtds/context"
+)
+
+var (
+	c *context.Context
+
+	// Package-wide logger, with "domain" parameter defined
+	domainLog zerolog.Logger
+)
+
+// Initialize initializes package
+func Initialize(cc *context.Context) {
+	c = cc
+	domainLog = c.Logger.With().Str("domain", "peers").Int("version", 1).Logger()
+
+	initSync()
+	initAPI()
+
+	domainLog.Info().Msg("Domain «peers» initialized")
+}
+
+// Start starts synchronization with peers. It should be called after
+// current color is chosen.
+func Start() {
+	if activeSyncer != nil {
+		activeSyncer.start(colorsStateChanges())
+	}
+}
+
+// Shutdown stops synchronization with peers
+func Shutdown() {
+	if activeSyncer != nil {
+		activeSyncer.shutdown()
+	}
+}
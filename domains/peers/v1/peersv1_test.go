@@ -0,0 +1,395 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package peersv1
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"lab.wtfteam.pro/wtfteam/lbtds/domains/colors/v1"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/testshelpers"
+)
+
+// fakeColors mimics colors domain of single instance
+type fakeColors struct {
+	node   string
+	state  colorsv1.ColorState
+	colors map[string]bool
+	mutex  sync.Mutex
+}
+
+func (f *fakeColors) get() colorsv1.ColorState {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.state
+}
+
+func (f *fakeColors) getStates() []colorsv1.ColorState {
+	return []colorsv1.ColorState{f.get()}
+}
+
+func (f *fakeColors) apply(state colorsv1.ColorState) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if state.Service != f.state.Service {
+		return false, errors.New("Unknown service")
+	}
+	if !state.NewerThan(f.state) {
+		return false, nil
+	}
+	if !f.colors[state.Color] {
+		return false, errors.New("Invalid color name")
+	}
+	f.state = state
+	return true, nil
+}
+
+func (f *fakeColors) switchTo(color string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.state = colorsv1.ColorState{Service: f.state.Service, Color: color, Version: f.state.Version + 1, Node: f.node, ChangedAt: time.Now()}
+}
+
+type testInstance struct {
+	colors *fakeColors
+	syncer *syncer
+	server *httptest.Server
+}
+
+// startCluster starts instances on loopback, each one knows all others
+func startCluster(t *testing.T, secrets ...string) []*testInstance {
+	instances := make([]*testInstance, len(secrets))
+	for i := range instances {
+		instance := &testInstance{
+			colors: &fakeColors{
+				node:   fmt.Sprintf("node-%d", i),
+				state:  colorsv1.ColorState{Service: "default", Color: "green"},
+				colors: map[string]bool{"green": true, "blue": true, "violet": true},
+			},
+		}
+		instance.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			instance.syncer.handleState(w, r)
+		}))
+		instances[i] = instance
+	}
+
+	for i, instance := range instances {
+		var addresses []string
+		for j := range instances {
+			if i != j {
+				addresses = append(addresses, instances[j].server.URL)
+			}
+		}
+		instance.syncer = newSyncer(instance.colors.node, secrets[i], addresses, time.Hour, time.Second, instance.colors.getStates, instance.colors.apply)
+	}
+
+	return instances
+}
+
+func stopCluster(instances []*testInstance) {
+	for _, instance := range instances {
+		instance.server.Close()
+	}
+}
+
+func initializeDomain() {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	Initialize(c)
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* sync.go */
+
+func TestPeersConvergeOnPush(t *testing.T) {
+	initializeDomain()
+	instances := startCluster(t, "secret", "secret", "secret")
+	defer stopCluster(instances)
+
+	instances[0].colors.switchTo("blue")
+	instances[0].syncer.pushAll()
+
+	for _, instance := range instances {
+		state := instance.colors.get()
+		require.Equal(t, "blue", state.Color)
+		require.Equal(t, uint64(1), state.Version)
+		require.Equal(t, "node-0", state.Node)
+	}
+	require.True(t, instances[0].syncer.status().Agreement)
+
+	// Others haven't talked to each other yet
+	require.False(t, instances[1].syncer.status().Agreement)
+	for _, instance := range instances {
+		instance.syncer.syncAll()
+	}
+	for _, instance := range instances {
+		require.True(t, instance.syncer.status().Agreement)
+	}
+}
+
+func TestPeersLastWriterWins(t *testing.T) {
+	initializeDomain()
+	instances := startCluster(t, "secret", "secret", "secret")
+	defer stopCluster(instances)
+
+	// Split brain: two instances changed color independently
+	instances[0].colors.switchTo("blue")
+	instances[2].colors.switchTo("violet")
+
+	for round := 0; round < 2; round++ {
+		for _, instance := range instances {
+			instance.syncer.syncAll()
+		}
+	}
+
+	for _, instance := range instances {
+		state := instance.colors.get()
+		require.Equal(t, "violet", state.Color)
+		require.Equal(t, "node-2", state.Node)
+	}
+
+	// Later change wins regardless of node name
+	instances[0].colors.switchTo("green")
+	instances[0].syncer.pushAll()
+	for _, instance := range instances {
+		require.Equal(t, "green", instance.colors.get().Color)
+		require.Equal(t, uint64(2), instance.colors.get().Version)
+	}
+}
+
+func TestPeersRejectWrongSecret(t *testing.T) {
+	initializeDomain()
+	instances := startCluster(t, "secret", "another secret")
+	defer stopCluster(instances)
+
+	instances[0].colors.switchTo("blue")
+	instances[0].syncer.pushAll()
+
+	require.Equal(t, "green", instances[1].colors.get().Color)
+
+	status := instances[0].syncer.status()
+	require.False(t, status.Agreement)
+	require.False(t, status.Peers[0].Reachable)
+	require.Contains(t, status.Peers[0].Error, "401")
+
+	// Unsigned request
+	response, err := http.Get(instances[1].server.URL + statePath)
+	require.Nil(t, err)
+	response.Body.Close()
+	require.Equal(t, 401, response.StatusCode)
+
+	// Huge body is rejected before it's read completely
+	response, err = http.Post(instances[1].server.URL+statePath, "application/json", bytes.NewReader(make([]byte, maxStateBodySize+1)))
+	require.Nil(t, err)
+	response.Body.Close()
+	require.Equal(t, 400, response.StatusCode)
+}
+
+func TestPeersUnknownColor(t *testing.T) {
+	initializeDomain()
+	instances := startCluster(t, "secret", "secret")
+	defer stopCluster(instances)
+
+	// Peer has no such color in configuration
+	delete(instances[1].colors.colors, "violet")
+	instances[0].colors.switchTo("violet")
+	instances[0].syncer.pushAll()
+
+	require.Equal(t, "green", instances[1].colors.get().Color)
+	status := instances[0].syncer.status()
+	require.False(t, status.Agreement)
+	require.Contains(t, status.Peers[0].Error, "409")
+}
+
+/* auth.go */
+
+func TestPeersRejectReplay(t *testing.T) {
+	initializeDomain()
+	instances := startCluster(t, "secret", "secret")
+	defer stopCluster(instances)
+
+	instances[0].colors.switchTo("blue")
+	body, _ := json.Marshal(instances[0].colors.getStates())
+	send := func(request *http.Request) int {
+		response, err := http.DefaultClient.Do(request)
+		require.Nil(t, err)
+		response.Body.Close()
+		return response.StatusCode
+	}
+	newRequest := func() *http.Request {
+		request, err := http.NewRequest("POST", instances[1].server.URL+statePath, bytes.NewReader(body))
+		require.Nil(t, err)
+		return request
+	}
+
+	request := newRequest()
+	signRequest(request, body, "node-0", []byte("secret"))
+	require.Equal(t, 200, send(request))
+	require.Equal(t, "blue", instances[1].colors.get().Color)
+
+	// Captured request can't be sent again
+	replayed := newRequest()
+	replayed.Header = request.Header.Clone()
+	require.Equal(t, 401, send(replayed))
+
+	// Nor under other node name
+	renamed := newRequest()
+	renamed.Header = request.Header.Clone()
+	renamed.Header.Set(nodeHeader, "node-2")
+	renamed.Header.Set(nonceHeader, "0123456789abcdef")
+	require.Equal(t, 401, send(renamed))
+	renamed = newRequest()
+	renamed.Header = request.Header.Clone()
+	renamed.Header.Set(nodeHeader, "node-2")
+	require.Equal(t, 401, send(renamed))
+}
+
+func TestPeersRejectForgedResponses(t *testing.T) {
+	initializeDomain()
+	instances := startCluster(t, "secret", "secret")
+	defer stopCluster(instances)
+
+	forgedStates, _ := json.Marshal([]colorsv1.ColorState{{Service: "default", Color: "blue", Version: 100, Node: "node-1"}})
+	// Anyone, who answers on peer address
+	unsigned := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(forgedStates)
+	}))
+	defer unsigned.Close()
+	// Man in the middle, who changes signed response of real peer
+	tampering := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := httptest.NewRecorder()
+		instances[1].syncer.handleState(recorder, r)
+		for header, values := range recorder.Header() {
+			w.Header()[header] = values
+		}
+		w.Write(forgedStates)
+	}))
+	defer tampering.Close()
+
+	local := instances[0].colors
+	s := newSyncer(local.node, "secret", []string{unsigned.URL, tampering.URL}, time.Hour, time.Second, local.getStates, local.apply)
+	s.syncAll()
+
+	require.Equal(t, "green", local.get().Color)
+	status := s.status()
+	require.False(t, status.Agreement)
+	require.False(t, status.Peers[0].Reachable)
+	require.Contains(t, status.Peers[0].Error, errNotSigned.Error())
+	require.False(t, status.Peers[1].Reachable)
+	require.Contains(t, status.Peers[1].Error, errBadSignature.Error())
+
+	// Signed response of real peer is accepted
+	s = newSyncer(local.node, "secret", []string{instances[1].server.URL}, time.Hour, time.Second, local.getStates, local.apply)
+	s.syncAll()
+	require.True(t, s.status().Peers[0].Reachable)
+}
+
+/* exported.go */
+
+func TestSyncWithColorsDomain(t *testing.T) {
+	peerColors := &fakeColors{
+		node:   "remote",
+		state:  colorsv1.ColorState{Service: "default", Color: "green"},
+		colors: map[string]bool{"green": true, "blue": true},
+	}
+	var peerSyncer *syncer
+	peerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerSyncer.handleState(w, r)
+	}))
+	defer peerServer.Close()
+	peerSyncer = newSyncer("remote", "secret", nil, time.Hour, time.Second, peerColors.getStates, peerColors.apply)
+
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	c.Config().Peers.NodeID = "local"
+	c.Config().Peers.Secret = "secret"
+	c.Config().Peers.Addresses = []string{peerServer.URL}
+	colorsv1.Initialize(c)
+	Initialize(c)
+	require.NotNil(t, activeSyncer)
+
+	go func() {
+		for <-colorsv1.ColorChanged {
+		}
+	}()
+
+	require.Nil(t, colorsv1.SetCurrentColor("green"))
+	Start()
+
+	// Local change is pushed to peer
+	require.Nil(t, colorsv1.SetCurrentColor("blue"))
+	for i := 0; i < 100 && peerColors.get().Color != "blue"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, "blue", peerColors.get().Color)
+	require.Equal(t, "local", peerColors.get().Node)
+
+	replyBody, replyCode := testshelpers.HTTPTestRequest(t, c, nil, nil, "GET", "v1", "/peers/status", PeersStatus)
+	require.Equal(t, 200, replyCode)
+	var status Status
+	err := json.Unmarshal(replyBody, &status)
+	require.Nil(t, err)
+	require.True(t, status.Enabled)
+	require.Equal(t, "local", status.Node)
+	require.Equal(t, "blue", status.States[0].Color)
+	require.Equal(t, 1, len(status.Peers))
+
+	// Change made on peer is received
+	peerColors.switchTo("green")
+	body, _ := json.Marshal(peerColors.getStates())
+	request := httptest.NewRequest("POST", statePath, bytes.NewReader(body))
+	signRequest(request, body, "remote", []byte("secret"))
+	recorder := httptest.NewRecorder()
+	PeerState(recorder, request)
+	require.Equal(t, 200, recorder.Code, recorder.Body.String())
+	require.Equal(t, "green", colorsv1.GetCurrentColorName())
+	require.Equal(t, "remote", colorsv1.GetColorState().Node)
+
+	Shutdown()
+	colorsv1.Shutdown()
+	c.SetShutdown()
+	c.Shutdown()
+
+	// Clear cache for other tests
+	err = os.Remove(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* api.go */
+
+func TestPeersStatusWhenDisabled(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+	require.Nil(t, activeSyncer)
+
+	replyBody, replyCode := testshelpers.HTTPTestRequest(t, c, nil, nil, "GET", "v1", "/peers/status", PeersStatus)
+	require.Equal(t, 200, replyCode)
+	var status Status
+	err := json.Unmarshal(replyBody, &status)
+	require.Nil(t, err)
+	require.False(t, status.Enabled)
+
+	_, replyCode = testshelpers.HTTPTestRequest(t, c, nil, nil, "GET", "v1", "/peers/state", PeerState)
+	require.Equal(t, 404, replyCode)
+
+	colorsv1.Shutdown()
+	c.SetShutdown()
+	c.Shutdown()
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
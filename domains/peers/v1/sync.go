@@ -0,0 +1,341 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package peersv1
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"lab.wtfteam.pro/wtfteam/lbtds/domains/colors/v1"
+)
+
+const (
+	defaultSyncInterval = 5 * time.Second
+	defaultPeerTimeout  = 2 * time.Second
+
+	statePath = "/api/v1/peers/state"
+	// Limit for bodies of state requests and responses. They are read
+	// before signature is checked, so they are kept small.
+	maxStateBodySize = 1 << 20
+)
+
+var (
+	syncModuleLog zerolog.Logger
+
+	// Synchronizer of this instance, nil if synchronization is disabled
+	activeSyncer *syncer
+)
+
+// PeerStatus describes what is known about peer
+type PeerStatus struct {
+	Address     string                `json:"address"`
+	Reachable   bool                  `json:"reachable"`
+	InAgreement bool                  `json:"in_agreement"`
+	States      []colorsv1.ColorState `json:"states,omitempty"`
+	LastSeen    *time.Time            `json:"last_seen,omitempty"`
+	Error       string                `json:"error,omitempty"`
+}
+
+type peer struct {
+	address string
+	mutex   sync.Mutex
+	status  PeerStatus
+}
+
+// syncer keeps color states of this instance in agreement with peers.
+// Every change is pushed to all peers at once, and states are compared
+// periodically to repair missed pushes. Newer state of service always
+// wins.
+type syncer struct {
+	node     string
+	secret   []byte
+	interval time.Duration
+	client   *http.Client
+	peers    []*peer
+
+	// Access to color states of this instance
+	getStates  func() []colorsv1.ColorState
+	applyState func(colorsv1.ColorState) (bool, error)
+
+	stop chan bool
+	done chan bool
+}
+
+func initSync() {
+	syncModuleLog = domainLog.With().Str("module", "sync").Logger()
+
+	peersConfig := &c.Config().Peers
+	if len(peersConfig.Addresses) == 0 {
+		syncModuleLog.Info().Msg("No peers configured, synchronization disabled")
+		activeSyncer = nil
+		return
+	}
+
+	activeSyncer = newSyncer(
+		colorsv1.NodeID(), peersConfig.Secret, peersConfig.Addresses,
+		peersConfig.SyncInterval, peersConfig.Timeout,
+		colorsv1.GetColorStates, colorsv1.ApplyPeerState,
+	)
+	syncModuleLog.Info().Str("node", activeSyncer.node).Msgf("Synchronizing color with peers: %s", strings.Join(peersConfig.Addresses, ", "))
+}
+
+func colorsStateChanges() <-chan bool {
+	return colorsv1.StateChanged
+}
+
+func newSyncer(node string, secret string, addresses []string, interval time.Duration, timeout time.Duration, getStates func() []colorsv1.ColorState, applyState func(colorsv1.ColorState) (bool, error)) *syncer {
+	if interval == 0 {
+		interval = defaultSyncInterval
+	}
+	if timeout == 0 {
+		timeout = defaultPeerTimeout
+	}
+
+	s := &syncer{
+		node:       node,
+		secret:     []byte(secret),
+		interval:   interval,
+		client:     &http.Client{Timeout: timeout},
+		getStates:  getStates,
+		applyState: applyState,
+	}
+	for _, address := range addresses {
+		address = strings.TrimSuffix(address, "/")
+		s.peers = append(s.peers, &peer{address: address, status: PeerStatus{Address: address}})
+	}
+
+	return s
+}
+
+func (s *syncer) start(changes <-chan bool) {
+	s.stop = make(chan bool)
+	s.done = make(chan bool)
+	go s.run(changes)
+}
+
+func (s *syncer) shutdown() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+}
+
+func (s *syncer) run(changes <-chan bool) {
+	defer close(s.done)
+
+	s.syncAll()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-changes:
+			s.pushAll()
+		case <-ticker.C:
+			s.syncAll()
+		}
+	}
+}
+
+// syncAll compares state with every peer and fixes differences
+func (s *syncer) syncAll() {
+	s.forEachPeer(s.syncPeer)
+}
+
+// pushAll sends state of this instance to every peer
+func (s *syncer) pushAll() {
+	s.forEachPeer(s.push)
+}
+
+func (s *syncer) forEachPeer(action func(p *peer)) {
+	var wg sync.WaitGroup
+	for _, p := range s.peers {
+		wg.Add(1)
+		go func(p *peer) {
+			defer wg.Done()
+			action(p)
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (s *syncer) syncPeer(p *peer) {
+	remote, err := s.fetch(p)
+	if err != nil {
+		p.failed(err)
+		return
+	}
+	p.seen(remote)
+
+	pushNeeded := false
+	remoteByService := statesByService(remote)
+	for _, local := range s.getStates() {
+		remoteState := remoteByService[local.Service]
+		switch {
+		case remoteState.Color != "" && remoteState.NewerThan(local):
+			s.adopt(p, remoteState)
+		case local.Color != "" && local.NewerThan(remoteState):
+			pushNeeded = true
+		}
+	}
+	if pushNeeded {
+		s.push(p)
+	}
+}
+
+func (s *syncer) push(p *peer) {
+	local := s.getStates()
+	body, _ := json.Marshal(local)
+	remote, err := s.call(p, http.MethodPost, body)
+	if err != nil {
+		p.failed(err)
+		return
+	}
+	p.seen(remote)
+
+	// Peer may know even newer states
+	remoteByService := statesByService(remote)
+	for _, localState := range local {
+		remoteState := remoteByService[localState.Service]
+		if remoteState.Color != "" && remoteState.NewerThan(localState) {
+			s.adopt(p, remoteState)
+		}
+	}
+}
+
+func (s *syncer) adopt(p *peer, state colorsv1.ColorState) {
+	applied, err := s.applyState(state)
+	if err != nil {
+		syncModuleLog.Error().Err(err).Str("peer", p.address).Str("service", state.Service).Msgf("Failed to apply color %s from peer", state.Color)
+		return
+	}
+	if applied {
+		syncModuleLog.Info().Str("peer", p.address).Str("service", state.Service).Str("node", state.Node).Uint64("color_version", state.Version).Msgf("Color %s received from peer", state.Color)
+	}
+}
+
+func (s *syncer) fetch(p *peer) ([]colorsv1.ColorState, error) {
+	return s.call(p, http.MethodGet, nil)
+}
+
+// call sends signed request to peer state endpoint and returns peer's
+// states. States are returned only if response is signed by peer.
+func (s *syncer) call(p *peer, method string, body []byte) ([]colorsv1.ColorState, error) {
+	var states []colorsv1.ColorState
+
+	request, err := http.NewRequest(method, p.address+statePath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	signRequest(request, body, s.node, s.secret)
+	nonce := request.Header.Get(nonceHeader)
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(http.MaxBytesReader(nil, response.Body, maxStateBodySize))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer returned %d: %s", response.StatusCode, strings.TrimSpace(string(responseBody)))
+	}
+
+	err = verifyResponse(response, nonce, responseBody, s.secret)
+	if err != nil {
+		return nil, fmt.Errorf("peer response rejected: %s", err.Error())
+	}
+
+	err = json.Unmarshal(responseBody, &states)
+	return states, err
+}
+
+func statesByService(states []colorsv1.ColorState) map[string]colorsv1.ColorState {
+	result := make(map[string]colorsv1.ColorState, len(states))
+	for _, state := range states {
+		result[state.Service] = state
+	}
+	return result
+}
+
+// status returns synchronization status of this instance
+func (s *syncer) status() *Status {
+	local := s.getStates()
+	status := &Status{
+		Enabled:   true,
+		Node:      s.node,
+		States:    local,
+		Agreement: true,
+		Peers:     make([]PeerStatus, 0, len(s.peers)),
+	}
+
+	for _, p := range s.peers {
+		p.mutex.Lock()
+		peerStatus := p.status
+		p.mutex.Unlock()
+
+		peerStatus.InAgreement = peerStatus.Reachable && sameStates(local, peerStatus.States)
+		if !peerStatus.InAgreement {
+			status.Agreement = false
+		}
+		status.Peers = append(status.Peers, peerStatus)
+	}
+
+	return status
+}
+
+// sameStates returns true if peer has the same color state of every local
+// service
+func sameStates(local []colorsv1.ColorState, remote []colorsv1.ColorState) bool {
+	if remote == nil {
+		return false
+	}
+	remoteByService := statesByService(remote)
+	for _, localState := range local {
+		remoteState, ok := remoteByService[localState.Service]
+		if !ok || remoteState.Color != localState.Color ||
+			remoteState.Version != localState.Version ||
+			remoteState.Node != localState.Node {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *peer) seen(states []colorsv1.ColorState) {
+	now := time.Now()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.status.Reachable = true
+	p.status.States = states
+	p.status.LastSeen = &now
+	p.status.Error = ""
+}
+
+func (p *peer) failed(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.status.Error != err.Error() {
+		syncModuleLog.Warn().Err(err).Str("peer", p.address).Msg("Failed to synchronize with peer")
+	}
+	p.status.Reachable = false
+	p.status.Error = err.Error()
+}
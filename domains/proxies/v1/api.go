@@ -0,0 +1,127 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package proxiesv1
+
+import (
+	ctx "context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var (
+	apiModuleLog zerolog.Logger
+)
+
+type destinationRequestParams struct {
+	State string `json:"state"`
+}
+
+func initAPI() {
+	apiModuleLog = domainLog.With().Str("module", "api").Logger()
+	apiModuleLog.Info().Msg("Initializing API...")
+
+	c.APIServerMux.HandleFunc("/api/v1/destinations", Destinations)
+	c.APIServerMux.HandleFunc("/api/v1/destinations/", Destinations)
+}
+
+// Destinations handles destinations list requests and state changes of
+// single destination at /api/v1/destinations/{address}. With wait query
+// parameter, e.g. wait=30s, response is sent when destination has no
+// active requests or when time is out.
+func Destinations(w http.ResponseWriter, r *http.Request) {
+	address := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/destinations"), "/")
+	if address == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "404 page not found", 404)
+			return
+		}
+		writeJSON(w, GetDestinationStatuses())
+		return
+	}
+	if !configuredDestination(address) {
+		http.Error(w, "Unknown destination", 404)
+		return
+	}
+
+	var wait time.Duration
+	if r.URL.Query().Get("wait") != "" {
+		var err error
+		wait, err = time.ParseDuration(r.URL.Query().Get("wait"))
+		if err != nil || wait < 0 {
+			http.Error(w, "Invalid wait duration", 400)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		start := time.Now()
+		defer apiModuleLog.Info().Str("remote", r.RemoteAddr).Str("destination", address).TimeDiff("request time (s)", time.Now(), start).Msg("Received destination state HTTP request")
+
+		var requestParams destinationRequestParams
+		err := json.NewDecoder(r.Body).Decode(&requestParams)
+		if err != nil {
+			apiModuleLog.Error().Err(err).Msg("Failed to unmarshal POST data")
+			http.Error(w, "Invalid request body", 400)
+			return
+		}
+		switch requestParams.State {
+		case DestinationActive, DestinationDraining, DestinationDisabled:
+			SetDestinationState(address, requestParams.State)
+		default:
+			http.Error(w, "Invalid state", 400)
+			return
+		}
+	default:
+		http.Error(w, "404 page not found", 404)
+		return
+	}
+
+	if wait > 0 {
+		waitContext, cancel := ctx.WithTimeout(r.Context(), wait)
+		defer cancel()
+		if !WaitDestinationIdle(waitContext, address) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}
+	}
+	writeJSON(w, GetDestinationStatus(address))
+}
+
+// configuredDestination checks that destination is used by some color or
+// is already known
+func configuredDestination(address string) bool {
+	destinationsMutex.Lock()
+	_, known := destinations[address]
+	destinationsMutex.Unlock()
+	if known {
+		return true
+	}
+
+	for _, service := range c.Config().AllServices() {
+		for _, color := range service.Colors {
+			for _, backend := range color.Backends {
+				for _, destination := range backend.AllDestinations() {
+					if destination.Address == address {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		apiModuleLog.Error().Err(err).Msg("Failed to write API response")
+	}
+}
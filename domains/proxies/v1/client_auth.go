@@ -0,0 +1,121 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package proxiesv1
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/access"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+)
+
+var (
+	errClientCertificateRequired   = errors.New("Client certificate is required")
+	errClientCertificateNotAllowed = errors.New("Client certificate isn't allowed by rules")
+)
+
+// clientAuth is a client certificate authentication of source
+type clientAuth struct {
+	required bool
+	roots    *x509.CertPool
+	rules    *access.CertificateRules
+	headers  config.ClientIdentityHeaders
+}
+
+// loadClientAuth reads certificate authorities of client certificates
+func loadClientAuth(options *config.ClientAuth) (*clientAuth, error) {
+	data, err := ioutil.ReadFile(options.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, errNoCACertificates
+	}
+	return &clientAuth{
+		required: options.Mode == "require",
+		roots:    roots,
+		rules:    access.NewCertificateRules(options.Allow),
+		headers:  options.Headers,
+	}, nil
+}
+
+// tlsConfig returns TLS configuration of handshake with clients of source
+func (a *clientAuth) tlsConfig(certificate *tls.Certificate) *tls.Config {
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{*certificate},
+		NextProtos:   []string{"h2", "http/1.1"},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    a.roots,
+	}
+	if a.required {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig
+}
+
+// verify returns verified client certificate of request, or nil if client
+// has none and it's allowed. Certificate is verified again, because
+// connection may be made for other source of listener.
+func (a *clientAuth) verify(r *http.Request) (*x509.Certificate, error) {
+	if a == nil {
+		return nil, nil
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		if a.required {
+			return nil, errClientCertificateRequired
+		}
+		return nil, nil
+	}
+
+	certificate := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(intermediate)
+	}
+	_, err := certificate.Verify(x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !a.rules.Allowed(certificate) {
+		return nil, errClientCertificateNotAllowed
+	}
+	return certificate, nil
+}
+
+// setIdentityHeaders replaces identity headers, which came from client,
+// with identity of verified certificate
+func (a *clientAuth) setIdentityHeaders(header http.Header, certificate *x509.Certificate) {
+	if a == nil {
+		return
+	}
+	identity := map[string]func() string{
+		a.headers.Subject: func() string { return certificate.Subject.String() },
+		a.headers.SAN:     func() string { return strings.Join(access.SubjectAlternativeNames(certificate), ",") },
+		a.headers.Fingerprint: func() string {
+			fingerprint := sha256.Sum256(certificate.Raw)
+			return hex.EncodeToString(fingerprint[:])
+		},
+	}
+	for name, value := range identity {
+		if name == "" {
+			continue
+		}
+		header.Del(name)
+		if certificate != nil {
+			header.Set(name, value())
+		}
+	}
+}
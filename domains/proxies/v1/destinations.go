@@ -0,0 +1,370 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package proxiesv1
+
+import (
+	ctx "context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/metrics"
+)
+
+// Destination states
+const (
+	// DestinationActive destination receives requests
+	DestinationActive = "active"
+	// DestinationDraining destination receives no new requests, active
+	// ones are allowed to finish
+	DestinationDraining = "draining"
+	// DestinationDisabled destination receives no requests, active ones
+	// are aborted
+	DestinationDisabled = "disabled"
+)
+
+// Slowly started destination gets at least this share of its weight
+const slowStartMinimumShare = 0.01
+
+var (
+	// Destinations by address. State is kept by address, not by color or
+	// backend, so it survives configuration reloads and color switches.
+	destinations      = make(map[string]*destination)
+	destinationsMutex sync.Mutex
+
+	activeRequestsGauge = metrics.NewGaugeVec("lbtds_destination_active_requests", "Number of requests, which are being proxied to destination.", "destination")
+
+	errNoDestinations = errors.New("No available destinations")
+)
+
+// destination is a single backend server
+type destination struct {
+	address string
+	state   string
+
+	// Cancel functions of active requests by request number
+	requests    map[uint64]ctx.CancelFunc
+	lastRequest uint64
+	// Closed when last active request finishes
+	idle chan struct{}
+
+	// Destination is used by current color of some service
+	inUse bool
+	// When destination became available last time, slow start begins here
+	availableSince time.Time
+	// Destination failed and is considered down until this time, unless
+	// there is nothing else to choose
+	downUntil time.Time
+	// Active health checks, which destination fails. It's considered down
+	// while there are any.
+	failedChecks map[string]bool
+}
+
+// DestinationStatus describes destination state
+type DestinationStatus struct {
+	Address        string `json:"address"`
+	State          string `json:"state"`
+	ActiveRequests int    `json:"active_requests"`
+	Unhealthy      bool   `json:"unhealthy,omitempty"`
+}
+
+// getDestination returns destination with given address, creating it if
+// needed. Caller should hold destinationsMutex.
+func getDestination(address string) *destination {
+	d, ok := destinations[address]
+	if !ok {
+		d = &destination{
+			address:        address,
+			state:          DestinationActive,
+			requests:       make(map[uint64]ctx.CancelFunc),
+			failedChecks:   make(map[string]bool),
+			availableSince: time.Now(),
+		}
+		destinations[address] = d
+	}
+	return d
+}
+
+// useDestinations marks destinations of current colors. Destinations,
+// which weren't used before, are started slowly.
+func useDestinations(addresses []string) {
+	destinationsMutex.Lock()
+	defer destinationsMutex.Unlock()
+
+	used := make(map[string]bool)
+	for _, address := range addresses {
+		used[address] = true
+	}
+	now := time.Now()
+	for _, address := range addresses {
+		d := getDestination(address)
+		if !d.inUse {
+			d.availableSince = now
+		}
+	}
+	for address, d := range destinations {
+		d.inUse = used[address]
+	}
+}
+
+func (d *destination) status() DestinationStatus {
+	return DestinationStatus{Address: d.address, State: d.state, ActiveRequests: len(d.requests), Unhealthy: len(d.failedChecks) > 0}
+}
+
+// weight returns current weight of destination, which is reduced during
+// slow start
+func (d *destination) weight(options *config.Destination, now time.Time) float64 {
+	weight := float64(options.EffectiveWeight())
+	if options.SlowStart <= 0 {
+		return weight
+	}
+	since := d.availableSince
+	if d.downUntil.After(since) {
+		since = d.downUntil
+	}
+	share := float64(now.Sub(since)) / float64(options.SlowStart)
+	switch {
+	case share >= 1:
+		return weight
+	case share < slowStartMinimumShare:
+		return weight * slowStartMinimumShare
+	default:
+		return weight * share
+	}
+}
+
+// candidates returns destinations, which can get request, with their
+// weights. Backup destinations are returned only if there is no primary
+// one, failed and unhealthy destinations only if there is nothing else.
+// Destinations, which reached their connections limit, aren't returned,
+// but make result busy. Caller should hold destinationsMutex.
+func candidates(configs []config.Destination, now time.Time) ([]*destination, []float64, bool) {
+	busy := false
+	for _, allowDown := range []bool{false, true} {
+		for _, backup := range []bool{false, true} {
+			var chosen []*destination
+			var weights []float64
+			for i := range configs {
+				d := getDestination(configs[i].Address)
+				if configs[i].Backup != backup || d.state != DestinationActive {
+					continue
+				}
+				if !allowDown && (d.downUntil.After(now) || len(d.failedChecks) > 0) {
+					continue
+				}
+				if configs[i].MaxConns > 0 && len(d.requests) >= configs[i].MaxConns {
+					busy = true
+					continue
+				}
+				chosen = append(chosen, d)
+				weights = append(weights, d.weight(&configs[i], now))
+			}
+			if len(chosen) > 0 {
+				return chosen, weights, false
+			}
+		}
+	}
+	return nil, nil, busy
+}
+
+// acquireDestination chooses destination by weight and registers request
+// to it. Returned context is cancelled when destination gets disabled,
+// release should be called when request is finished.
+func acquireDestination(parent ctx.Context, configs []config.Destination) (string, ctx.Context, func(), error) {
+	destinationsMutex.Lock()
+	defer destinationsMutex.Unlock()
+	return acquireDestinationLocked(parent, configs, nil, 0)
+}
+
+// acquireDestinationLocked is acquireDestination, which also counts
+// requests of backend queue, if there is one, and respects limit of its
+// simultaneous requests. Caller should hold destinationsMutex.
+func acquireDestinationLocked(parent ctx.Context, configs []config.Destination, queue *backendQueue, maxConns int) (string, ctx.Context, func(), error) {
+	if queue != nil && maxConns > 0 && queue.active >= maxConns {
+		return "", nil, nil, errDestinationsBusy
+	}
+	available, weights, busy := candidates(configs, time.Now())
+	if len(available) == 0 {
+		if busy {
+			return "", nil, nil, errDestinationsBusy
+		}
+		return "", nil, nil, errNoDestinations
+	}
+
+	total := 0.0
+	for _, weight := range weights {
+		total += weight
+	}
+	point := c.RandomSource.Float64() * total
+	d := available[len(available)-1]
+	for i, weight := range weights {
+		if point < weight {
+			d = available[i]
+			break
+		}
+		point -= weight
+	}
+
+	requestContext, cancel := ctx.WithCancel(parent)
+	d.lastRequest++
+	number := d.lastRequest
+	if len(d.requests) == 0 {
+		d.idle = make(chan struct{})
+	}
+	d.requests[number] = cancel
+	activeRequestsGauge.With(d.address).Set(float64(len(d.requests)))
+	if queue != nil {
+		queue.active++
+	}
+
+	release := func() {
+		cancel()
+		destinationsMutex.Lock()
+		defer destinationsMutex.Unlock()
+		delete(d.requests, number)
+		activeRequestsGauge.With(d.address).Set(float64(len(d.requests)))
+		if len(d.requests) == 0 {
+			close(d.idle)
+		}
+		if queue != nil {
+			queue.active--
+		}
+		notifySlotReleased()
+	}
+	return d.address, requestContext, release, nil
+}
+
+// reportDestinationResult is passive health check: destination, which
+// failed to respond, is considered down for downTime, and destination,
+// which responded, is up again. Zero downTime turns check off.
+func reportDestinationResult(address string, failed bool, downTime time.Duration) {
+	destinationsMutex.Lock()
+	defer destinationsMutex.Unlock()
+
+	d := getDestination(address)
+	now := time.Now()
+	switch {
+	case failed:
+		if downTime <= 0 {
+			return
+		}
+		if !d.downUntil.After(now) {
+			proxiesModuleLog.Warn().Str("destination", address).Msgf("Destination failed, it's considered down for %s", downTime)
+		}
+		d.downUntil = now.Add(downTime)
+	case d.downUntil.After(now):
+		// Destination was chosen because there was nothing else, and
+		// it's alive
+		d.downUntil = time.Time{}
+		d.availableSince = now
+	}
+}
+
+// untriedDestinations returns destinations, which weren't tried yet. If
+// every destination was tried, all of them are returned.
+func untriedDestinations(destinations []config.Destination, tried []string) []config.Destination {
+	result := make([]config.Destination, 0, len(destinations))
+	for _, destination := range destinations {
+		found := false
+		for _, address := range tried {
+			found = found || destination.Address == address
+		}
+		if !found {
+			result = append(result, destination)
+		}
+	}
+	if len(result) == 0 {
+		return destinations
+	}
+	return result
+}
+
+// setDestinationHealth records result of active health check. Destination,
+// which passes all of them again, is started slowly.
+func setDestinationHealth(address string, check string, healthy bool) {
+	destinationsMutex.Lock()
+	defer destinationsMutex.Unlock()
+
+	d := getDestination(address)
+	if !healthy {
+		d.failedChecks[check] = true
+		return
+	}
+	if d.failedChecks[check] {
+		delete(d.failedChecks, check)
+		if len(d.failedChecks) == 0 {
+			d.availableSince = time.Now()
+		}
+	}
+}
+
+// SetDestinationState changes state of destination. Disabling destination
+// aborts its active requests.
+func SetDestinationState(address string, state string) DestinationStatus {
+	destinationsMutex.Lock()
+	defer destinationsMutex.Unlock()
+
+	d := getDestination(address)
+	if d.state != state {
+		proxiesModuleLog.Info().Str("destination", address).Int("active requests", len(d.requests)).Msgf("Destination is %s now", state)
+		if state == DestinationActive {
+			d.availableSince = time.Now()
+		}
+	}
+	d.state = state
+	notifySlotReleased()
+	if state == DestinationDisabled {
+		for _, cancel := range d.requests {
+			cancel()
+		}
+	}
+	return d.status()
+}
+
+// GetDestinationStatus returns current state of destination
+func GetDestinationStatus(address string) DestinationStatus {
+	destinationsMutex.Lock()
+	defer destinationsMutex.Unlock()
+	return getDestination(address).status()
+}
+
+// GetDestinationStatuses returns states of all known destinations, sorted
+// by address
+func GetDestinationStatuses() []DestinationStatus {
+	destinationsMutex.Lock()
+	defer destinationsMutex.Unlock()
+
+	statuses := make([]DestinationStatus, 0, len(destinations))
+	for _, d := range destinations {
+		statuses = append(statuses, d.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Address < statuses[j].Address
+	})
+	return statuses
+}
+
+// WaitDestinationIdle waits until destination has no active requests or
+// context is done. It returns true if destination is idle.
+func WaitDestinationIdle(waitContext ctx.Context, address string) bool {
+	for {
+		destinationsMutex.Lock()
+		d := getDestination(address)
+		if len(d.requests) == 0 {
+			destinationsMutex.Unlock()
+			return true
+		}
+		idle := d.idle
+		destinationsMutex.Unlock()
+
+		select {
+		case <-idle:
+			// New request may have come, check again
+		case <-waitContext.Done():
+			return false
+		}
+	}
+}
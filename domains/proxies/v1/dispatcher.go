@@ -5,11 +5,15 @@ package proxiesv1
 
 import (
 	ctx "context"
+	"crypto/tls"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
 	"lab.wtfteam.pro/wtfteam/lbtds/domains/colors/v1"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/access"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
 )
 
 var (
@@ -29,7 +33,8 @@ func initDispatcher() {
 	}()
 }
 
-// awaitColorChanged listens to channel which fires up when color actually changes
+// awaitColorChanged listens to channel which fires up when color actually
+// changes or configuration reloads
 func awaitColorChanged() {
 	// First call of dispatchChange runs at start of the balancer
 	for <-colorsv1.ColorChanged {
@@ -37,16 +42,116 @@ func awaitColorChanged() {
 	}
 }
 
-// dispatchChanges restarts the whole bunch of proxies to new color scheme
+// dispatchChange brings running proxies in line with current colors of
+// all services. Listeners, which are still needed, are kept running and
+// get new handlers, so established connections aren't dropped.
 func dispatchChange() {
-	dispatcherModuleLog.Debug().Msgf("Color %s selected. Starting proxies...", colorsv1.GetCurrentColorName())
+	currentColors := colorsv1.GetCurrentColorConfigurations()
 
-	if len(httpProxies) > 0 {
-		Shutdown()
+	httpProxiesMutex.Lock()
+	defer httpProxiesMutex.Unlock()
+
+	trustedProxies, err := access.ParseNetworks(c.Config().Proxy.TrustedProxies)
+	if err != nil {
+		dispatcherModuleLog.Error().Err(err).Msg("Invalid trusted proxies, X-Forwarded-For is ignored")
 	}
 
-	for _, proxy := range colorsv1.GetCurrentColorConfiguration().Backends {
-		startHTTPProxy(proxy.ListenOn, proxy.Source, proxy.Destinations)
+	// Services can share listener, requests are routed by domain
+	neededRoutes := make(map[string]map[string]*HTTPProxy)
+	var usedDestinations []string
+	neededHealthCheckers := make(map[string]*healthChecker)
+	usedUpstreamTLS := make(map[*tls.Config]bool)
+	for _, current := range currentColors {
+		dispatcherModuleLog.Debug().Str("service", current.Service).Msgf("Color %s selected. Starting proxies...", current.Color.Name)
+		for _, backend := range current.Color.Backends {
+			usedDestinations = append(usedDestinations, config.DestinationAddresses(backend.AllDestinations())...)
+			proxy := newHTTPProxy(backend.Source, backend.Destinations)
+			proxy.Service = current.Service
+			proxy.Color = current.Color.Name
+			proxy.ListenOn = backend.ListenOn
+			proxy.MaxConns = backend.MaxConns
+			proxy.QueueLimit = backend.QueueLimit()
+			proxy.QueueTimeout = backend.EffectiveQueueTimeout()
+			proxy.RetryAfter = backend.EffectiveRetryAfter()
+			proxy.Unavailable = backend.Unavailable
+			proxy.PassiveDownTime = backend.EffectivePassiveDownTime()
+			proxy.Headers = backend.Headers
+			proxy.AcceptProxyProtocol = backend.AcceptProxyProtocol
+			proxy.SendProxyProtocol = backend.SendProxyProtocol
+			proxy.H2C = backend.H2C
+			proxy.UpstreamH2C = backend.UpstreamH2C
+			proxy.GRPC = backend.GRPC
+			proxy.queue = getBackendQueue(backend.ListenOn, backend.Source)
+			proxy.rateLimiters = getRateLimiters(&backend)
+			proxy.trustedProxies = trustedProxies
+			proxy.accessRules, err = access.NewRules(backend.Access)
+			if err != nil {
+				// Backend, which can't be protected, isn't started at all
+				dispatcherModuleLog.Error().Err(err).Str("service", current.Service).Str("source", backend.Source).Msg("Invalid access rules, backend is skipped")
+				continue
+			}
+			if backend.TLS != nil {
+				certificate, err := tls.LoadX509KeyPair(backend.TLS.CertFile, backend.TLS.KeyFile)
+				if err != nil {
+					dispatcherModuleLog.Error().Err(err).Str("service", current.Service).Str("source", backend.Source).Msg("Failed to load certificate, backend is skipped")
+					continue
+				}
+				proxy.certificate = &certificate
+				if backend.TLS.ClientAuth != nil {
+					proxy.clientAuth, err = loadClientAuth(backend.TLS.ClientAuth)
+					if err != nil {
+						dispatcherModuleLog.Error().Err(err).Str("service", current.Service).Str("source", backend.Source).Msg("Failed to load client certificate authorities, backend is skipped")
+						continue
+					}
+				}
+			}
+			if backend.UpstreamTLSEnabled() {
+				proxy.upstreamTLS, err = loadUpstreamTLS(*backend.UpstreamTLS)
+				if err != nil {
+					dispatcherModuleLog.Error().Err(err).Str("service", current.Service).Str("source", backend.Source).Msg("Failed to load upstream TLS configuration, backend is skipped")
+					continue
+				}
+				usedUpstreamTLS[proxy.upstreamTLS] = true
+			}
+			for key, checker := range healthCheckersOf(current.Service, &backend, proxy) {
+				neededHealthCheckers[key] = checker
+			}
+
+			routes, ok := neededRoutes[backend.ListenOn]
+			if !ok {
+				routes = make(map[string]*HTTPProxy)
+				neededRoutes[backend.ListenOn] = routes
+			}
+			// Hostnames are case insensitive, SNI and Host are compared in
+			// lower case
+			routes[strings.ToLower(backend.Source)] = proxy
+		}
+	}
+
+	useDestinations(usedDestinations)
+	updateHealthCheckers(neededHealthCheckers)
+	forgetUpstreamTLS(usedUpstreamTLS)
+
+	for listenOn, routes := range neededRoutes {
+		listener, ok := httpProxies[listenOn]
+		if ok && listener.options == listenerOptionsOf(routes) {
+			dispatcherModuleLog.Debug().Msgf("Updating proxy on %s...", listenOn)
+			listener.setRoutes(routes)
+			continue
+		}
+		if ok {
+			// E.g. TLS was turned on, server should be restarted
+			dispatcherModuleLog.Info().Msgf("Options of proxy on %s are changed, restarting it...", listenOn)
+			stopHTTPProxy(listener)
+		}
+		startHTTPProxy(listenOn, routes)
+	}
+
+	for listenOn, listener := range httpProxies {
+		if _, ok := neededRoutes[listenOn]; !ok {
+			stopHTTPProxy(listener)
+			delete(httpProxies, listenOn)
+		}
 	}
 }
 
@@ -54,14 +159,21 @@ func dispatchChange() {
 func Shutdown() {
 	httpProxiesMutex.Lock()
 	defer httpProxiesMutex.Unlock()
-	for i, proxy := range httpProxies {
-		dispatcherModuleLog.Debug().Msgf("Stopping proxy on %s...", proxy.Addr)
-		closedownContext, closedownCancel := ctx.WithTimeout(ctx.Background(), 5*time.Second)
-		defer closedownCancel()
-		err := proxy.Shutdown(closedownContext)
-		if err != nil {
-			dispatcherModuleLog.Error().Err(err).Msg("Failed to shut down proxy")
-		}
-		delete(httpProxies, i)
+	for listenOn, listener := range httpProxies {
+		stopHTTPProxy(listener)
+		delete(httpProxies, listenOn)
+	}
+	updateHealthCheckers(make(map[string]*healthChecker))
+	forgetUpstreamTLS(make(map[*tls.Config]bool))
+}
+
+// stopHTTPProxy gracefully stops listener, waiting for active requests
+func stopHTTPProxy(listener *httpListener) {
+	dispatcherModuleLog.Debug().Msgf("Stopping proxy on %s...", listener.server.Addr)
+	closedownContext, closedownCancel := ctx.WithTimeout(ctx.Background(), 5*time.Second)
+	defer closedownCancel()
+	err := listener.server.Shutdown(closedownContext)
+	if err != nil {
+		dispatcherModuleLog.Error().Err(err).Msg("Failed to shut down proxy")
 	}
 }
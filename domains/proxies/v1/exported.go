@@ -22,6 +22,7 @@ func Initialize(cc *context.Context) {
 
 	initProxies()
 	initDispatcher()
+	initAPI()
 
 	domainLog.Info().Msg("Domain «proxies» initialized")
 }
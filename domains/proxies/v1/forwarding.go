@@ -0,0 +1,126 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package proxiesv1
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/access"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+)
+
+// setForwardingHeaders tells destination who sent request and how. Chains
+// of X-Forwarded-For and Forwarded are continued only if request came from
+// trusted proxy, otherwise they start with client address, as anyone can
+// forge them. The same is true for X-Forwarded-Proto and X-Forwarded-Host.
+func setForwardingHeaders(header http.Header, r *http.Request, trusted access.Networks, clientIP net.IP, forwarded bool) {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	fromTrusted := trusted.Contains(net.ParseIP(remote))
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	forwardedFor := remote
+	if fromTrusted && len(r.Header["X-Forwarded-For"]) > 0 {
+		forwardedFor = strings.Join(r.Header["X-Forwarded-For"], ", ") + ", " + remote
+	}
+	header.Set("X-Forwarded-For", forwardedFor)
+	if !fromTrusted || r.Header.Get("X-Forwarded-Proto") == "" {
+		header.Set("X-Forwarded-Proto", proto)
+	}
+	if !fromTrusted || r.Header.Get("X-Forwarded-Host") == "" {
+		header.Set("X-Forwarded-Host", r.Host)
+	}
+	header.Del("X-Real-IP")
+	if clientIP != nil {
+		header.Set("X-Real-IP", clientIP.String())
+	}
+
+	header.Del("Forwarded")
+	if !forwarded {
+		return
+	}
+	element := "for=" + forwardedNode(remote) + ";host=" + forwardedValue(r.Host) + ";proto=" + proto
+	if fromTrusted && len(r.Header["Forwarded"]) > 0 {
+		element = strings.Join(r.Header["Forwarded"], ", ") + ", " + element
+	}
+	header.Set("Forwarded", element)
+}
+
+// forwardedNode formats address for Forwarded header: IPv6 addresses are
+// bracketed and quoted
+func forwardedNode(address string) string {
+	if strings.Contains(address, ":") {
+		return `"[` + address + `]"`
+	}
+	return forwardedValue(address)
+}
+
+// forwardedValue quotes value, unless it's a token
+func forwardedValue(value string) string {
+	for _, r := range value {
+		if r > 0x7e || r <= 0x20 || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	return value
+}
+
+// Headers, which describe single connection, not request
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes headers, which shouldn't be passed through
+// proxy. "TE: trailers" is kept, gRPC requires it.
+func removeHopByHopHeaders(header http.Header) {
+	for _, connectionHeader := range header["Connection"] {
+		for _, name := range strings.Split(connectionHeader, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	trailers := false
+	for _, value := range header["Te"] {
+		for _, coding := range strings.Split(value, ",") {
+			trailers = trailers || strings.EqualFold(strings.TrimSpace(coding), "trailers")
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+	if trailers {
+		header.Set("Te", "trailers")
+	}
+}
+
+// applyHeaderChanges removes, sets and adds configured headers
+func applyHeaderChanges(header http.Header, changes *config.HeaderChanges) {
+	for _, name := range changes.Remove {
+		header.Del(name)
+	}
+	for name, value := range changes.Set {
+		header.Set(name, value)
+	}
+	for name, value := range changes.Add {
+		header.Add(name, value)
+	}
+}
@@ -0,0 +1,219 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package proxiesv1
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+)
+
+// isGRPCRequest checks if request is a gRPC call
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// writeError responds with error, which LBTDS generated itself. gRPC
+// clients get it as status in Trailers-Only response, others get plain
+// text.
+func writeError(w http.ResponseWriter, r *http.Request, message string, code int) {
+	if !isGRPCRequest(r) {
+		http.Error(w, message, code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(grpcStatusOf(code)))
+	w.Header().Set("Grpc-Message", encodeGRPCMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcStatusOf returns gRPC status code of LBTDS error with given HTTP
+// status
+func grpcStatusOf(code int) int {
+	switch code {
+	case http.StatusBadRequest:
+		return config.GRPCStatusCodes["INVALID_ARGUMENT"]
+	case http.StatusForbidden:
+		return config.GRPCStatusCodes["PERMISSION_DENIED"]
+	case http.StatusTooManyRequests:
+		return config.GRPCStatusCodes["RESOURCE_EXHAUSTED"]
+	case http.StatusInternalServerError:
+		return config.GRPCStatusCodes["INTERNAL"]
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return config.GRPCStatusCodes["UNAVAILABLE"]
+	case http.StatusGatewayTimeout:
+		return config.GRPCStatusCodes["DEADLINE_EXCEEDED"]
+	default:
+		return config.GRPCStatusCodes["UNKNOWN"]
+	}
+}
+
+// grpcStatusOfResponse returns status of gRPC response, which has no
+// messages: status is in headers, or HTTP status tells what happened.
+// It returns false if response may have messages.
+func grpcStatusOfResponse(response *http.Response) (int, bool) {
+	if response.StatusCode != http.StatusOK {
+		// Mapping of HTTP statuses from gRPC over HTTP/2 specification
+		switch response.StatusCode {
+		case http.StatusBadRequest:
+			return config.GRPCStatusCodes["INTERNAL"], true
+		case http.StatusUnauthorized:
+			return config.GRPCStatusCodes["UNAUTHENTICATED"], true
+		case http.StatusForbidden:
+			return config.GRPCStatusCodes["PERMISSION_DENIED"], true
+		case http.StatusNotFound:
+			return config.GRPCStatusCodes["UNIMPLEMENTED"], true
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return config.GRPCStatusCodes["UNAVAILABLE"], true
+		default:
+			return config.GRPCStatusCodes["UNKNOWN"], true
+		}
+	}
+	status := response.Header.Get("Grpc-Status")
+	if status == "" {
+		return 0, false
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return config.GRPCStatusCodes["UNKNOWN"], true
+	}
+	return code, true
+}
+
+// encodeGRPCMessage percent-encodes status message as gRPC requires
+func encodeGRPCMessage(message string) string {
+	var result strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&result, "%%%02X", c)
+			continue
+		}
+		result.WriteByte(c)
+	}
+	return result.String()
+}
+
+// grpcRoute returns route of gRPC call, if some matches
+func (p *HTTPProxy) grpcRoute(r *http.Request) *config.GRPCRoute {
+	if p.GRPC == nil || !isGRPCRequest(r) {
+		return nil
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(parts) != 2 {
+		return nil
+	}
+	for i := range p.GRPC.Routes {
+		route := &p.GRPC.Routes[i]
+		if route.Service == parts[0] && (route.Method == "" || route.Method == parts[1]) {
+			return route
+		}
+	}
+	return nil
+}
+
+// grpcBody is a body of gRPC call, which can be retried. It's kept in
+// memory while destination reads it, up to size limit, so it can be sent
+// to other destination. Nothing is read in advance, so calls, which
+// stream messages from client, aren't held.
+type grpcBody struct {
+	body  io.ReadCloser
+	limit int
+
+	mutex sync.Mutex
+	data  []byte
+	// Body is bigger than limit, so it isn't kept
+	overflow bool
+	// Client closed stream and all of body was read
+	complete bool
+}
+
+// newGRPCBody returns body of call, if call can be retried
+func newGRPCBody(r *http.Request, retry *config.GRPCRetry) *grpcBody {
+	if retry == nil || retry.Attempts == 0 || !isGRPCRequest(r) {
+		return nil
+	}
+	return &grpcBody{body: r.Body, limit: retry.EffectiveMaxBodySize()}
+}
+
+// attempt returns body for next attempt: kept part is sent again, then
+// the rest is read from client
+func (b *grpcBody) attempt() io.ReadCloser {
+	b.mutex.Lock()
+	kept := b.data
+	b.mutex.Unlock()
+	return ioutil.NopCloser(io.MultiReader(bytes.NewReader(kept), b))
+}
+
+// Read reads body from client and keeps it
+func (b *grpcBody) Read(data []byte) (int, error) {
+	n, err := b.body.Read(data)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.overflow {
+		if len(b.data)+n > b.limit {
+			b.overflow = true
+			b.data = nil
+		} else {
+			b.data = append(b.data, data[:n]...)
+		}
+	}
+	if err == io.EOF {
+		b.complete = true
+	}
+	return n, err
+}
+
+// kept checks if whole body is in memory
+func (b *grpcBody) kept() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.complete && !b.overflow
+}
+
+// untouched checks if nothing was read from client yet
+func (b *grpcBody) untouched() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.data) == 0 && !b.complete && !b.overflow
+}
+
+// shouldRetry checks if failed gRPC call can be sent to other destination
+// and body can be sent again. Call, which failed in transport, is retried
+// as UNAVAILABLE only if connection wasn't established, otherwise call
+// could reach destination. Call, which destination responded to, is
+// retried if status is one of retried ones and there were no messages.
+func shouldRetry(retry *config.GRPCRetry, body *grpcBody, response *http.Response, err error) bool {
+	var code int
+	if err != nil {
+		var opError *net.OpError
+		if !errors.As(err, &opError) || opError.Op != "dial" || !(body.untouched() || body.kept()) {
+			return false
+		}
+		code = config.GRPCStatusCodes["UNAVAILABLE"]
+	} else {
+		var ok bool
+		code, ok = grpcStatusOfResponse(response)
+		// Destination may still read body, unless it was read completely
+		if !ok || !body.kept() {
+			return false
+		}
+	}
+	for _, retried := range retry.EffectiveStatuses() {
+		if code == retried {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package proxiesv1
+
+import (
+	"bytes"
+	ctx "context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"time"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+)
+
+const (
+	// HealthCheckResponse.ServingStatus.SERVING
+	grpcHealthServing = 1
+)
+
+var (
+	// Running health checkers by destination and service. Guarded by
+	// httpProxiesMutex, as they are started and stopped by dispatcher.
+	healthCheckers = make(map[string]*healthChecker)
+
+	errNotServing = errors.New("Destination isn't serving")
+)
+
+// healthChecker checks single destination with grpc.health.v1
+type healthChecker struct {
+	key     string
+	address string
+	scheme  string
+	host    string
+	config  config.GRPCHealthCheck
+	// Connections are made the same way as for requests
+	transport     http.RoundTripper
+	proxyProtocol string
+
+	cancel      ctx.CancelFunc
+	lastFailure string
+}
+
+// updateHealthCheckers starts health checkers of destinations of current
+// colors and stops ones, which aren't needed anymore. Caller should hold
+// httpProxiesMutex.
+func updateHealthCheckers(needed map[string]*healthChecker) {
+	for key, checker := range healthCheckers {
+		running, ok := needed[key]
+		if ok && reflect.DeepEqual(running.config, checker.config) && running.transport == checker.transport && running.scheme == checker.scheme && running.proxyProtocol == checker.proxyProtocol {
+			needed[key] = checker
+			continue
+		}
+		checker.stop()
+		delete(healthCheckers, key)
+	}
+	for key, checker := range needed {
+		if _, ok := healthCheckers[key]; !ok {
+			healthCheckers[key] = checker
+			checker.start()
+		}
+	}
+}
+
+// healthCheckersOf returns health checkers of backend destinations, keyed
+// by destination address and service of backend
+func healthCheckersOf(service string, backend *config.BackendConfig, proxy *HTTPProxy) map[string]*healthChecker {
+	checkers := make(map[string]*healthChecker)
+	if backend.GRPC == nil || backend.GRPC.HealthCheck == nil {
+		return checkers
+	}
+	for _, destination := range backend.AllDestinations() {
+		key := service + " " + destination.Address
+		checkers[key] = &healthChecker{
+			key:           key,
+			address:       destination.Address,
+			scheme:        proxy.upstreamScheme(),
+			host:          backend.Source,
+			config:        *backend.GRPC.HealthCheck,
+			transport:     proxy.healthCheckTransport(),
+			proxyProtocol: proxy.SendProxyProtocol,
+		}
+	}
+	return checkers
+}
+
+// start runs checks in background. Results are reported only by checking
+// goroutine, so stopped checker doesn't change destination health.
+func (h *healthChecker) start() {
+	checkContext, cancel := ctx.WithCancel(ctx.Background())
+	h.cancel = cancel
+	go func() {
+		// Destination isn't checked anymore, it's healthy as far as this
+		// checker knows
+		defer setDestinationHealth(h.address, h.key, true)
+
+		ticker := time.NewTicker(h.config.EffectiveInterval())
+		defer ticker.Stop()
+		for {
+			err := h.check(checkContext)
+			if checkContext.Err() != nil {
+				return
+			}
+			h.report(err)
+			select {
+			case <-ticker.C:
+			case <-checkContext.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stop cancels checks of destination
+func (h *healthChecker) stop() {
+	h.cancel()
+}
+
+// report marks destination as healthy or not, logging only changes
+func (h *healthChecker) report(err error) {
+	if err != nil {
+		if h.lastFailure != err.Error() {
+			proxiesModuleLog.Warn().Err(err).Str("destination", h.address).Str("service", h.config.Service).Msg("gRPC health check failed")
+		}
+		h.lastFailure = err.Error()
+		setDestinationHealth(h.address, h.key, false)
+		return
+	}
+	if h.lastFailure != "" {
+		proxiesModuleLog.Info().Str("destination", h.address).Str("service", h.config.Service).Msg("gRPC health check passed")
+	}
+	h.lastFailure = ""
+	setDestinationHealth(h.address, h.key, true)
+}
+
+// check calls grpc.health.v1.Health/Check of destination
+func (h *healthChecker) check(parent ctx.Context) error {
+	checkContext, cancel := ctx.WithTimeout(parent, h.config.EffectiveTimeout())
+	defer cancel()
+	if h.proxyProtocol != "" {
+		// Check is made by LBTDS itself, not on behalf of client
+		checkContext = ctx.WithValue(checkContext, proxyProtocolHeaderKey{}, proxyProtocolHeader(h.proxyProtocol, nil, nil))
+	}
+
+	request, err := http.NewRequestWithContext(checkContext, http.MethodPost, h.scheme+"://"+h.address+"/grpc.health.v1.Health/Check", bytes.NewReader(grpcFrame(encodeHealthCheckRequest(h.config.Service))))
+	if err != nil {
+		return err
+	}
+	request.Host = h.host
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("Te", "trailers")
+
+	response, err := (&http.Client{Transport: h.transport}).Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	status := response.Header.Get("Grpc-Status")
+	if status == "" {
+		status = response.Trailer.Get("Grpc-Status")
+	}
+	if response.StatusCode != http.StatusOK || status != "0" {
+		return fmt.Errorf("Health check failed with HTTP status %d, gRPC status %q", response.StatusCode, status)
+	}
+	message, err := grpcMessage(body)
+	if err != nil {
+		return err
+	}
+	if decodeHealthCheckResponse(message) != grpcHealthServing {
+		return errNotServing
+	}
+	return nil
+}
+
+// grpcFrame prefixes uncompressed message with its length
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// grpcMessage returns the only message of response body
+func grpcMessage(body []byte) ([]byte, error) {
+	if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		return nil, errors.New("Invalid gRPC health check response")
+	}
+	return body[5:], nil
+}
+
+// encodeHealthCheckRequest encodes HealthCheckRequest{service} protobuf
+// message
+func encodeHealthCheckRequest(service string) []byte {
+	if service == "" {
+		return nil
+	}
+	message := []byte{0x0a}
+	message = appendVarint(message, uint64(len(service)))
+	return append(message, service...)
+}
+
+// decodeHealthCheckResponse returns status field of HealthCheckResponse
+// protobuf message. Unknown fields are skipped, status is 0 (UNKNOWN) if
+// message is malformed.
+func decodeHealthCheckResponse(message []byte) uint64 {
+	status := uint64(0)
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return 0
+		}
+		message = message[n:]
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(message)
+			if n <= 0 {
+				return 0
+			}
+			message = message[n:]
+			if key>>3 == 1 {
+				status = value
+			}
+		case 1:
+			if len(message) < 8 {
+				return 0
+			}
+			message = message[8:]
+		case 2:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < length {
+				return 0
+			}
+			message = message[n+int(length):]
+		case 5:
+			if len(message) < 4 {
+				return 0
+			}
+			message = message[4:]
+		default:
+			return 0
+		}
+	}
+	return status
+}
+
+func appendVarint(data []byte, value uint64) []byte {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	return append(data, buffer[:binary.PutUvarint(buffer, value)]...)
+}
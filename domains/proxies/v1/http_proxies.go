@@ -4,47 +4,237 @@
 package proxiesv1
 
 import (
+	ctx "context"
+	"crypto/tls"
+	"errors"
 	"io"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
+	"lab.wtfteam.pro/wtfteam/lbtds/domains/accesslog/v1"
+	"lab.wtfteam.pro/wtfteam/lbtds/domains/tracing/v1"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/access"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/metrics"
 )
 
 var (
 	proxiesModuleLog zerolog.Logger
 
-	// bunch of http.Server, which represents current proxy list
-	httpProxies      map[string]*http.Server
+	// bunch of listeners, which represents current proxy list
+	httpProxies      map[string]*httpListener
 	httpProxiesMutex sync.Mutex
+
+	errNoCertificate = errors.New("No certificate for TLS listener")
+
+	deniedCounter = metrics.NewCounterVec("lbtds_denied_requests_total", "Number of requests, rejected by access rules.", "listen_on", "source")
 )
 
+// httpListener is a running HTTP server, which passes requests to proxies
+// by hostname. Several services can share listener. Proxies can be
+// replaced without server restart.
+type httpListener struct {
+	server *http.Server
+	// Proxies by domain they serve, map[string]*HTTPProxy
+	routes atomic.Value
+	// Connections start with PROXY protocol header, 1 or 0
+	acceptProxyProtocol int32
+	// Proxies, which may send PROXY protocol header, access.Networks
+	trustedProxies atomic.Value
+	// Options of server, which can't be changed without restart
+	options listenerOptions
+}
+
+// listenerOptions are options of listener, on which all its backends agree
+type listenerOptions struct {
+	tls bool
+	h2c bool
+}
+
 // HTTPProxy handles ServeHTTP function for passing data inside proxy
 type HTTPProxy struct {
+	Service      string
+	Color        string
+	ListenOn     string
 	Domain       string
-	Destinations []string
+	Destinations []config.Destination
+
+	// Limits of backend: simultaneous requests to all destinations and
+	// requests waiting for free destination
+	MaxConns     int
+	QueueLimit   int
+	QueueTimeout time.Duration
+	// Retry-After and body of responses to requests, which got no
+	// destination
+	RetryAfter  time.Duration
+	Unavailable config.UnavailableResponse
+	// How long failed destination gets no requests, passive health
+	// checks are off if it's zero
+	PassiveDownTime time.Duration
+	// Changes of request and response headers
+	Headers config.HeaderRules
+	// Listener expects PROXY protocol, and version of it, which is sent
+	// to destinations
+	AcceptProxyProtocol bool
+	SendProxyProtocol   string
+	// Listener serves cleartext HTTP/2, and destinations get it
+	H2C         bool
+	UpstreamH2C bool
+	// gRPC routes and retries
+	GRPC *config.GRPC
+	// Certificate of source, if listener serves HTTPS
+	certificate *tls.Certificate
+	// Client certificate authentication, if source asks for certificates
+	clientAuth *clientAuth
+	// TLS configuration of connections to destinations, if they use HTTPS
+	upstreamTLS  *tls.Config
+	queue        *backendQueue
+	rateLimiters []*rateLimiter
+	// Clients, which may send requests, and proxies, which are trusted to
+	// tell client address
+	accessRules    *access.Rules
+	trustedProxies access.Networks
 }
 
 func initProxies() {
 	proxiesModuleLog = domainLog.With().Str("module", "proxies").Logger()
 	proxiesModuleLog.Info().Msg("Initializing proxies...")
 
-	httpProxies = make(map[string]*http.Server)
+	httpProxies = make(map[string]*httpListener)
+}
+
+func (l *httpListener) setRoutes(routes map[string]*HTTPProxy) {
+	l.routes.Store(routes)
+
+	accept := int32(0)
+	trustedProxies := access.Networks{}
+	for _, proxy := range routes {
+		if proxy.AcceptProxyProtocol {
+			accept = 1
+		}
+		// Proxies of single dispatch trust the same ones
+		trustedProxies = proxy.trustedProxies
+	}
+	l.trustedProxies.Store(trustedProxies)
+	atomic.StoreInt32(&l.acceptProxyProtocol, accept)
+}
+
+func (l *httpListener) acceptsProxyProtocol() bool {
+	return atomic.LoadInt32(&l.acceptProxyProtocol) == 1
 }
 
-// startHTTPProxy starts proxy with desired configuration and adds it to proxies array
-func startHTTPProxy(listenOn string, domain string, dst []string) {
-	proxiesModuleLog.Debug().Msgf("Starting proxying on %s for domain %s to %s...", listenOn, domain, strings.Join(dst, ", "))
+func (l *httpListener) proxyProtocolPeers() access.Networks {
+	return l.trustedProxies.Load().(access.Networks)
+}
+
+// tlsRouteOf chooses proxy, which makes handshake with client, by SNI.
+// Clients without SNI get the first source with certificate in
+// alphabetical order.
+func (l *httpListener) tlsRouteOf(serverName string) *HTTPProxy {
+	routes := l.routes.Load().(map[string]*HTTPProxy)
+	proxy, ok := routes[strings.ToLower(serverName)]
+	if ok && proxy.certificate != nil {
+		return proxy
+	}
+
+	domains := make([]string, 0, len(routes))
+	for domain := range routes {
+		if routes[domain].certificate != nil {
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) == 0 {
+		return nil
+	}
+	sort.Strings(domains)
+	return routes[domains[0]]
+}
+
+// getCertificate chooses certificate by SNI
+func (l *httpListener) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	proxy := l.tlsRouteOf(hello.ServerName)
+	if proxy == nil {
+		return nil, errNoCertificate
+	}
+	return proxy.certificate, nil
+}
+
+// getConfigForClient asks for client certificate, if source chosen by SNI
+// authenticates clients. Otherwise listener configuration is used.
+func (l *httpListener) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	proxy := l.tlsRouteOf(hello.ServerName)
+	if proxy == nil || proxy.clientAuth == nil {
+		return nil, nil
+	}
+	return proxy.clientAuth.tlsConfig(proxy.certificate), nil
+}
+
+// listenerOptionsOf returns options of listener, which serves given routes
+func listenerOptionsOf(routes map[string]*HTTPProxy) listenerOptions {
+	var options listenerOptions
+	for _, proxy := range routes {
+		options.tls = options.tls || proxy.certificate != nil
+		options.h2c = options.h2c || proxy.H2C
+	}
+	return options
+}
+
+func (l *httpListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	routes := l.routes.Load().(map[string]*HTTPProxy)
+	proxy, ok := routes[requestDomain(r)]
+	if !ok {
+		// Proxy without domain rejects request, so it still gets into
+		// access log
+		proxy = &HTTPProxy{}
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// startHTTPProxy starts listener with desired proxies and adds it to
+// proxies array. Caller should hold httpProxiesMutex.
+func startHTTPProxy(listenOn string, routes map[string]*HTTPProxy) {
+	for domain, proxy := range routes {
+		proxiesModuleLog.Debug().Msgf("Starting proxying on %s for domain %s to %s...", listenOn, domain, strings.Join(config.DestinationAddresses(proxy.Destinations), ", "))
+	}
+
+	listener := &httpListener{options: listenerOptionsOf(routes)}
+	listener.setRoutes(routes)
 
 	srv := &http.Server{
 		Addr:    listenOn,
-		Handler: newHTTPProxy(domain, dst),
+		Handler: listener,
+	}
+	if listener.options.tls {
+		srv.TLSConfig = &tls.Config{
+			GetCertificate:     listener.getCertificate,
+			GetConfigForClient: listener.getConfigForClient,
+			NextProtos:         []string{"h2", "http/1.1"},
+		}
 	}
+	if listener.options.h2c {
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	listener.server = srv
 
 	go func() {
-		err := srv.ListenAndServe()
+		tcpListener, err := net.Listen("tcp", listenOn)
+		if err == nil {
+			// PROXY protocol header comes before TLS handshake
+			var netListener net.Listener = newProxyProtocolListener(tcpListener, listener.acceptsProxyProtocol, listener.proxyProtocolPeers)
+			if srv.TLSConfig != nil {
+				netListener = tls.NewListener(netListener, srv.TLSConfig)
+			}
+			err = srv.Serve(netListener)
+		}
 		if err != nil {
 			// It will always throw an error on graceful shutdown so it's
 			// considered warning
@@ -52,10 +242,31 @@ func startHTTPProxy(listenOn string, domain string, dst []string) {
 		}
 	}()
 
-	httpProxies[listenOn] = srv
+	httpProxies[listenOn] = listener
 }
 
-func newHTTPProxy(domain string, dst []string) *HTTPProxy {
+// requestDomain returns host of request without port in lower case, as
+// sources are routed by it
+func requestDomain(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		// Host has no port
+		host = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+	}
+	return strings.ToLower(host)
+}
+
+// retryAfterSeconds formats Retry-After header value, which is whole
+// number of seconds
+func retryAfterSeconds(retryAfter time.Duration) string {
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
+func newHTTPProxy(domain string, dst []config.Destination) *HTTPProxy {
 	proxy := HTTPProxy{
 		Domain:       domain,
 		Destinations: dst,
@@ -67,69 +278,312 @@ func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	// ToDo: strict or not strict domain forwarding. For now we will
 	// forward only domain name, without port.
-	domainToForward := strings.Split(r.Host, ":")[0]
-	var proxifiedBytesCount int64
+	domainToForward := requestDomain(r)
 	var responseCode int
+	var upstream string
 
 	defer r.Body.Close()
 
+	// Server span covers whole request processing, including response
+	// copying. It is nil when tracing is disabled.
+	span := tracingv1.StartServerSpan(r.Method+" "+p.Domain, r.Header)
+	defer span.End()
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("server.address", domainToForward)
+	span.SetAttribute("client.address", r.RemoteAddr)
+	span.SetAttribute("lbtds.service", p.Service)
+	span.SetAttribute("lbtds.color", p.Color)
+
+	// Request ID is passed to backend, returned to client and attached to
+	// every log event of this request
+	requestID := getRequestID(r)
+	requestLog := proxiesModuleLog.With().Str("request_id", requestID).Logger()
+	w.Header().Set(requestIDHeader(), requestID)
+	span.SetAttribute("lbtds.request_id", requestID)
+
+	// Every request ends up in access log, including failed ones
+	rw := &responseWriter{ResponseWriter: w}
+	w = rw
+	defer func() {
+		accesslogv1.Log(&accesslogv1.Entry{
+			Time:       start,
+			RemoteAddr: r.RemoteAddr,
+			Host:       r.Host,
+			Method:     r.Method,
+			URI:        r.RequestURI,
+			Protocol:   r.Proto,
+			Status:     rw.status,
+			Bytes:      rw.bytes,
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+			Duration:   time.Since(start),
+			RequestID:  requestID,
+			Service:    p.Service,
+			Color:      p.Color,
+			Upstream:   upstream,
+		})
+	}()
+
 	// Check if we have required domain in received request.
-	if domainToForward != p.Domain {
-		proxiesModuleLog.Error().Str("domain", domainToForward).Msg("Invalid domain passed")
+	if domainToForward != strings.ToLower(p.Domain) || len(p.Destinations) == 0 {
+		requestLog.Error().Str("domain", domainToForward).Msg("Invalid domain passed")
 		responseCode = http.StatusBadRequest
-		http.Error(w, "Invalid domain", responseCode)
-		proxiesModuleLog.Info().Str("remote", r.RemoteAddr).Str("domain", domainToForward).Int("code", responseCode).Int64("proxified bytes", proxifiedBytesCount).TimeDiff("request time (s)", time.Now(), start).Msg("Received HTTP request")
+		span.SetAttribute("http.response.status_code", responseCode)
+		span.SetError("Invalid domain")
+		writeError(w, r, "Invalid domain", responseCode)
 		return
 	}
 
-	url := r.URL
-	url.Host = p.Destinations[c.RandomSource.Intn(len(p.Destinations))]
-	url.Scheme = "http"
-
-	proxiesModuleLog.Debug().Str("domain", domainToForward).Msgf("Proxy request catched. Will go to %s", url.String())
+	clientIP := access.ClientIP(r, p.trustedProxies)
+	clientAddress := r.RemoteAddr
+	if clientIP != nil {
+		clientAddress = clientIP.String()
+	}
+	if !p.accessRules.Allowed(clientIP) {
+		requestLog.Warn().Str("domain", domainToForward).Str("remote", r.RemoteAddr).Str("client", clientAddress).Msg("Request denied by access rules")
+		deniedCounter.With(p.ListenOn, p.Domain).Inc()
+		responseCode = http.StatusForbidden
+		span.SetAttribute("http.response.status_code", responseCode)
+		span.SetError("Access denied")
+		writeError(w, r, "Forbidden", responseCode)
+		return
+	}
 
-	proxyReq, err := http.NewRequest(r.Method, url.String(), r.Body)
+	clientCertificate, err := p.clientAuth.verify(r)
 	if err != nil {
-		proxiesModuleLog.Error().Str("domain", domainToForward).Err(err).Msg("Failed to create new HTTP request to downstream")
-		responseCode = http.StatusInternalServerError
-		http.Error(w, "Internal error", responseCode)
-		proxiesModuleLog.Info().Str("remote", r.RemoteAddr).Str("domain", domainToForward).Int("code", responseCode).Int64("proxified bytes", proxifiedBytesCount).TimeDiff("request time (s)", time.Now(), start).Msg("Received HTTP request")
+		requestLog.Warn().Str("domain", domainToForward).Str("remote", r.RemoteAddr).Str("client", clientAddress).Err(err).Msg("Request denied by client certificate authentication")
+		deniedCounter.With(p.ListenOn, p.Domain).Inc()
+		responseCode = http.StatusForbidden
+		span.SetAttribute("http.response.status_code", responseCode)
+		span.SetError("Client certificate denied")
+		writeError(w, r, "Forbidden", responseCode)
+		return
+	}
+
+	allowed, wait := allowRequest(p.rateLimiters, r, clientAddress, time.Now())
+	if !allowed {
+		requestLog.Warn().Str("domain", domainToForward).Str("remote", r.RemoteAddr).Str("client", clientAddress).Msg("Request rate limit exceeded")
+		rateLimitedCounter.With(p.ListenOn, p.Domain).Inc()
+		responseCode = http.StatusTooManyRequests
+		span.SetAttribute("http.response.status_code", responseCode)
+		span.SetError("Rate limit exceeded")
+		w.Header().Set("Retry-After", retryAfterSeconds(wait))
+		writeError(w, r, "Too many requests", responseCode)
+		return
+	}
+
+	// gRPC calls may go to destinations of their route and be retried
+	destinations := p.Destinations
+	var retry *config.GRPCRetry
+	if route := p.grpcRoute(r); route != nil {
+		if len(route.Destinations) > 0 {
+			destinations = route.Destinations
+		}
+		retry = route.Retry
+	}
+	body := newGRPCBody(r, retry)
+	retries := 0
+	if body != nil {
+		retries = retry.Attempts
+	}
+
+	var tried []string
+	for attempt := 0; ; attempt++ {
+		address, requestContext, release, err := p.acquire(r.Context(), untriedDestinations(destinations, tried))
+		if err != nil {
+			requestLog.Error().Str("domain", domainToForward).Err(err).Msg("There is no destination for request")
+			responseCode = http.StatusServiceUnavailable
+			span.SetAttribute("http.response.status_code", responseCode)
+			span.SetError(err.Error())
+			w.Header().Set("Retry-After", retryAfterSeconds(p.RetryAfter))
+			p.writeUnavailable(w, r)
+			return
+		}
+		tried = append(tried, address)
+		upstream = address
+
+		// Request is aborted when destination gets disabled
+		upstreamContext := requestContext
+		if p.SendProxyProtocol != "" {
+			upstreamContext = withProxyProtocolHeader(requestContext, p.SendProxyProtocol, r, clientIP)
+		}
+		requestBody := r.Body
+		if body != nil {
+			requestBody = body.attempt()
+		}
+		proxyReq, err := p.newUpstreamRequest(upstreamContext, r, address, requestBody)
+		if err != nil {
+			release()
+			requestLog.Error().Str("domain", domainToForward).Err(err).Msg("Failed to create new HTTP request to downstream")
+			responseCode = http.StatusInternalServerError
+			span.SetAttribute("http.response.status_code", responseCode)
+			span.SetError(err.Error())
+			writeError(w, r, "Internal error", responseCode)
+			return
+		}
+		setForwardingHeaders(proxyReq.Header, r, p.trustedProxies, clientIP, p.Headers.Forwarded)
+		p.clientAuth.setIdentityHeaders(proxyReq.Header, clientCertificate)
+		applyHeaderChanges(proxyReq.Header, &p.Headers.Request)
+		proxyReq.Header.Set(requestIDHeader(), requestID)
+
+		requestLog.Debug().Str("domain", domainToForward).Msgf("Proxy request catched. Will go to %s", proxyReq.URL.String())
+
+		// Client span represents single upstream attempt
+		attemptSpan := span.StartClientSpan(r.Method + " " + address)
+		attemptSpan.SetAttribute("http.request.method", r.Method)
+		attemptSpan.SetAttribute("server.address", address)
+		attemptSpan.SetAttribute("lbtds.color", p.Color)
+		attemptSpan.SetAttribute("lbtds.retry_count", attempt)
+		// Replace incoming trace context with ours, so upstream spans will
+		// be children of attempt span
+		attemptSpan.Inject(proxyReq.Header)
+
+		client := &http.Client{Transport: p.upstreamTransport()}
+		proxyRsp, err := client.Do(proxyReq)
+		// Requests, aborted by client or by disabling destination, say
+		// nothing about destination health
+		if requestContext.Err() == nil {
+			reportDestinationResult(address, err != nil, p.PassiveDownTime)
+		}
+		if err != nil {
+			attemptSpan.SetError(err.Error())
+		} else {
+			attemptSpan.SetAttribute("http.response.status_code", proxyRsp.StatusCode)
+		}
+		attemptSpan.End()
+
+		if attempt < retries && r.Context().Err() == nil && shouldRetry(retry, body, proxyRsp, err) {
+			requestLog.Warn().Str("domain", domainToForward).Str("destination", address).Int("attempt", attempt+1).Msg("gRPC call failed, retrying it")
+			if proxyRsp != nil {
+				proxyRsp.Body.Close()
+			}
+			release()
+			continue
+		}
+		defer release()
+
+		if err != nil {
+			reason := describeUpstreamError(err)
+			requestLog.Error().Str("domain", domainToForward).Str("destination", address).Str("reason", reason).Err(err).Msg("Can't connect to downstream")
+			responseCode = http.StatusBadGateway
+			span.SetAttribute("http.response.status_code", responseCode)
+			span.SetError("Can't connect to downstream: " + reason)
+			writeError(w, r, "Can't connect to downstream: "+reason, responseCode)
+			return
+		}
+		defer proxyRsp.Body.Close()
+
+		p.writeResponse(w, proxyRsp, requestID, span, requestLog)
+		return
+	}
+}
+
+// writeUnavailable writes configured 503 response. Reason is logged, but
+// clients aren't told about it.
+func (p *HTTPProxy) writeUnavailable(w http.ResponseWriter, r *http.Request) {
+	if isGRPCRequest(r) {
+		writeError(w, r, "Service unavailable", http.StatusServiceUnavailable)
 		return
 	}
-	defer proxyReq.Body.Close()
+	w.Header().Set("Content-Type", p.Unavailable.EffectiveContentType())
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	io.WriteString(w, p.Unavailable.EffectiveBody())
+}
 
-	//proxyReq.Header.Set("Host", domainToForward)
-	proxyReq.Host = domainToForward
-	proxyReq.Header.Set("X-Forwarded-For", r.RemoteAddr)
+// newUpstreamRequest creates request to destination, which carries
+// headers of client request
+func (p *HTTPProxy) newUpstreamRequest(upstreamContext ctx.Context, r *http.Request, address string, body io.ReadCloser) (*http.Request, error) {
+	url := *r.URL
+	url.Host = address
+	url.Scheme = p.upstreamScheme()
+
+	proxyReq, err := http.NewRequestWithContext(upstreamContext, r.Method, url.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	proxyReq.Host = requestDomain(r)
+	if strings.Contains(proxyReq.Host, ":") {
+		// IPv6 address
+		proxyReq.Host = "[" + proxyReq.Host + "]"
+	}
 
 	for header, values := range r.Header {
 		for _, value := range values {
 			proxyReq.Header.Add(header, value)
 		}
 	}
+	removeHopByHopHeaders(proxyReq.Header)
+	// Body is streamed, so trailers are known only when it's read
+	proxyReq.ContentLength = r.ContentLength
+	proxyReq.Trailer = r.Trailer
+	return proxyReq, nil
+}
 
-	client := &http.Client{}
-	proxyRsp, err := client.Do(proxyReq)
-	if err != nil {
-		proxiesModuleLog.Error().Str("domain", domainToForward).Err(err).Msg("Can't connect to downstream")
-		responseCode = http.StatusBadGateway
-		http.Error(w, "Can't connect to downstream", responseCode)
-		proxiesModuleLog.Info().Str("remote", r.RemoteAddr).Str("domain", domainToForward).Int("code", responseCode).Int64("proxified bytes", proxifiedBytesCount).TimeDiff("request time (s)", time.Now(), start).Msg("Received HTTP request")
-		return
+// writeResponse passes response of destination to client
+func (p *HTTPProxy) writeResponse(w http.ResponseWriter, proxyRsp *http.Response, requestID string, span *tracingv1.Span, requestLog zerolog.Logger) {
+	span.SetAttribute("http.response.status_code", proxyRsp.StatusCode)
+	if proxyRsp.StatusCode >= 500 {
+		span.SetError(proxyRsp.Status)
 	}
-	defer proxyRsp.Body.Close()
 
 	for header, values := range proxyRsp.Header {
 		for _, value := range values {
 			w.Header().Add(header, value)
 		}
 	}
-	proxifiedBytesCount, err = io.Copy(w, proxyRsp.Body)
+	removeHopByHopHeaders(w.Header())
+	announcedTrailers := len(proxyRsp.Trailer)
+	for trailer := range proxyRsp.Trailer {
+		w.Header().Add("Trailer", trailer)
+	}
+	applyHeaderChanges(w.Header(), &p.Headers.Response)
+	w.Header().Set(requestIDHeader(), requestID)
+	w.WriteHeader(proxyRsp.StatusCode)
+	err := copyResponseBody(w, proxyRsp)
 	if err != nil {
-		proxiesModuleLog.Error().Err(err).Msg("Can't write response to upstream")
-		http.Error(w, "Can't write response to upstream", 502)
+		requestLog.Error().Err(err).Msg("Can't write response to upstream")
+		span.SetError(err.Error())
 		return
 	}
 
-	proxiesModuleLog.Info().Str("remote", r.RemoteAddr).Str("domain", domainToForward).Str("URI", r.URL.String()).Int64("proxified bytes", proxifiedBytesCount).TimeDiff("request time (s)", time.Now(), start).Msg("Received HTTP request")
+	// Trailers, which weren't announced before body, are still sent by
+	// HTTP/2, e.g. gRPC status
+	for trailer, values := range proxyRsp.Trailer {
+		if len(proxyRsp.Trailer) != announcedTrailers {
+			trailer = http.TrailerPrefix + trailer
+		}
+		w.Header()[trailer] = values
+	}
+}
+
+// copyResponseBody copies response of destination to client. Responses of
+// unknown length, such as streams of gRPC messages or server-sent events,
+// are flushed after every read, so client gets data as soon as it comes.
+func copyResponseBody(w http.ResponseWriter, response *http.Response) error {
+	flusher, streaming := w.(http.Flusher)
+	streaming = streaming && response.ContentLength == -1
+	if !streaming {
+		_, err := io.Copy(w, response.Body)
+		return err
+	}
+
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := response.Body.Read(buffer)
+		if n > 0 {
+			_, writeErr := w.Write(buffer[:n])
+			if writeErr != nil {
+				return writeErr
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
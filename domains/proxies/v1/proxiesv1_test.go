@@ -5,18 +5,40 @@ package proxiesv1
 
 import (
 	ctx "context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	// "github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"lab.wtfteam.pro/wtfteam/lbtds/domains/colors/v1"
+	"lab.wtfteam.pro/wtfteam/lbtds/domains/tracing/v1"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/access"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
 	"lab.wtfteam.pro/wtfteam/lbtds/internal/testshelpers"
 )
 
+func plainDestinations(addresses ...string) []config.Destination {
+	result := make([]config.Destination, 0, len(addresses))
+	for _, address := range addresses {
+		result = append(result, config.Destination{Address: address})
+	}
+	return result
+}
+
 /* exported.go */
 
 func TestInitialize(t *testing.T) {
@@ -81,6 +103,94 @@ func TestDispatchChangeTwice(t *testing.T) {
 	testshelpers.FlushConfiguration("lbtds-different-backends")
 }
 
+func TestDispatchChangeKeepsListenersOnReload(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	// Color may be left from previous tests, so set it explicitly
+	err := colorsv1.SetCurrentColor("green")
+	require.Nil(t, err)
+	time.Sleep(1 * time.Second)
+	require.Equal(t, 2, len(httpProxies))
+	listenerBeforeReload := httpProxies["127.0.0.1:8100"]
+
+	testshelpers.RewriteConfiguration("lbtds-valid", func(configuration string) string {
+		configuration = strings.Replace(configuration, `"127.0.0.1:8124"`, `"127.0.0.1:8125"`, 1)
+		// Second listener of every color is moved
+		return strings.Replace(configuration, `"127.0.0.1:8200"`, `"127.0.0.1:8300"`, -1)
+	})
+	_, err = colorsv1.ReloadConfiguration()
+	require.Nil(t, err)
+	time.Sleep(1 * time.Second)
+
+	httpProxiesMutex.Lock()
+	require.Equal(t, 2, len(httpProxies))
+	require.True(t, listenerBeforeReload == httpProxies["127.0.0.1:8100"])
+	require.Equal(t, []string{"127.0.0.1:8123", "127.0.0.1:8125"}, config.DestinationAddresses(httpProxies["127.0.0.1:8100"].routes.Load().(map[string]*HTTPProxy)["web.host"].Destinations))
+	require.NotNil(t, httpProxies["127.0.0.1:8300"])
+	require.Nil(t, httpProxies["127.0.0.1:8200"])
+	httpProxiesMutex.Unlock()
+
+	Shutdown()
+
+	err = os.Remove(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+func TestDispatchChangeRoutesServicesByDomain(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-services")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	colorsv1.GetCurrentColor()
+	err := colorsv1.SetServiceColor("api", "blue")
+	require.Nil(t, err)
+	dispatchChange()
+
+	// Both services share single listener
+	httpProxiesMutex.Lock()
+	require.Equal(t, 1, len(httpProxies))
+	listener := httpProxies["127.0.0.1:8100"]
+	httpProxiesMutex.Unlock()
+	routes := listener.routes.Load().(map[string]*HTTPProxy)
+	require.Equal(t, "green", routes["web.host"].Color)
+	require.Equal(t, []string{"127.0.0.1:8123"}, config.DestinationAddresses(routes["web.host"].Destinations))
+	require.Equal(t, "api", routes["api.host"].Service)
+	require.Equal(t, "blue", routes["api.host"].Color)
+	require.Equal(t, []string{"127.0.0.1:8124"}, config.DestinationAddresses(routes["api.host"].Destinations))
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1:8100/", nil)
+	req.Host = "admin.host"
+	rec := httptest.NewRecorder()
+	listener.ServeHTTP(rec, req)
+	require.Equal(t, 400, rec.Code)
+	require.Equal(t, "Invalid domain\n", rec.Body.String())
+
+	// Hostnames are case insensitive, destination doesn't work
+	req.Host = "WEB.Host:8100"
+	rec = httptest.NewRecorder()
+	listener.ServeHTTP(rec, req)
+	require.Equal(t, 502, rec.Code)
+	require.Equal(t, "web.host", requestDomain(&http.Request{Host: "Web.HOST"}))
+	require.Equal(t, "2001:db8::1", requestDomain(&http.Request{Host: "[2001:DB8::1]:8100"}))
+	require.Equal(t, "2001:db8::1", requestDomain(&http.Request{Host: "[2001:db8::1]"}))
+
+	Shutdown()
+	colorsv1.Shutdown()
+
+	err = os.Remove(c.Config().Proxy.ColorFile)
+	require.Nil(t, err)
+	err = os.Remove(c.Config().Proxy.ColorFile + ".api")
+	require.Nil(t, err)
+
+	testshelpers.FlushConfiguration("lbtds-services")
+}
+
 /* http_proxies.go */
 
 func TestServeHTTPRequestWithoutWorkingDownstream(t *testing.T) {
@@ -89,7 +199,7 @@ func TestServeHTTPRequestWithoutWorkingDownstream(t *testing.T) {
 	colorsv1.Initialize(c)
 	Initialize(c)
 
-	httpProxy := newHTTPProxy("web.host", []string{"127.0.0.1:8123", "127.0.0.1:8124"})
+	httpProxy := newHTTPProxy("web.host", plainDestinations("127.0.0.1:8123", "127.0.0.1:8124"))
 	httpProxyServer := &http.Server{
 		Addr:    "127.0.0.1:8100",
 		Handler: httpProxy,
@@ -107,7 +217,7 @@ func TestServeHTTPRequestWithoutWorkingDownstream(t *testing.T) {
 	replyBody, replyCode := testshelpers.HTTPClearTestRequest(t, "http://127.0.0.1:8100/", "web.host", nil, nil, "GET", httpProxy.ServeHTTP)
 	require.NotEmpty(t, replyBody)
 	require.Equal(t, 502, replyCode)
-	require.Equal(t, "Can't connect to downstream\n", string(replyBody))
+	require.Equal(t, "Can't connect to downstream: connection refused\n", string(replyBody))
 
 	err := httpProxyServer.Shutdown(closedownContext)
 	if err != nil {
@@ -124,7 +234,7 @@ func TestServeHTTPValidRequest(t *testing.T) {
 	colorsv1.Initialize(c)
 	Initialize(c)
 
-	httpProxy := newHTTPProxy("web.host", []string{"127.0.0.1:8123", "127.0.0.1:8124"})
+	httpProxy := newHTTPProxy("web.host", plainDestinations("127.0.0.1:8123", "127.0.0.1:8124"))
 	httpProxyServer := &http.Server{
 		Addr:    "127.0.0.1:8100",
 		Handler: httpProxy,
@@ -168,7 +278,7 @@ func TestServeHTTPRequestWithInvalidDomain(t *testing.T) {
 	colorsv1.Initialize(c)
 	Initialize(c)
 
-	httpProxy := newHTTPProxy("web.host", []string{"127.0.0.1:8123", "127.0.0.1:8124"})
+	httpProxy := newHTTPProxy("web.host", plainDestinations("127.0.0.1:8123", "127.0.0.1:8124"))
 	httpProxyServer := &http.Server{
 		Addr:    "127.0.0.1:8100",
 		Handler: httpProxy,
@@ -204,3 +314,1335 @@ func TestServeHTTPRequestWithInvalidDomain(t *testing.T) {
 
 	testshelpers.FlushConfiguration("lbtds-valid")
 }
+
+func TestServeHTTPPropagatesTraceContext(t *testing.T) {
+	collectedSpans := make(chan []byte, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		collectedSpans <- body
+	}))
+	defer collector.Close()
+
+	testshelpers.InitializeConfiguration("../../../", "lbtds-tracing")
+	c := testshelpers.InitializeContext()
+	c.Config().Tracing.Endpoint = collector.URL
+	tracingv1.Initialize(c)
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	c1 := testshelpers.CreateHTTPEchoServer("8125")
+	// Get some time for test backend to start
+	time.Sleep(1 * time.Second)
+
+	httpProxy := newHTTPProxy("web.host", plainDestinations("127.0.0.1:8125"))
+	httpProxy.Color = "green"
+
+	headers := map[string]string{
+		"Traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"Tracestate":  "congo=t61rcWkgMzE",
+	}
+	replyBody, replyCode := testshelpers.HTTPClearTestRequest(t, "http://127.0.0.1:8100/", "web.host", nil, headers, "GET", httpProxy.ServeHTTP)
+	require.Equal(t, 200, replyCode)
+	// Trace is continued, but parent span is ours now
+	require.Contains(t, string(replyBody), "Traceparent: 00-0af7651916cd43dd8448eb211c80319c-")
+	require.NotContains(t, string(replyBody), "b7ad6b7169203331")
+	require.Contains(t, string(replyBody), "Tracestate: congo=t61rcWkgMzE")
+
+	tracingv1.Shutdown()
+	spans := string(<-collectedSpans)
+	require.Contains(t, spans, "lbtds.retry_count")
+	require.Contains(t, spans, "127.0.0.1:8125")
+	require.Contains(t, spans, "green")
+
+	c1 <- true
+
+	testshelpers.FlushConfiguration("lbtds-tracing")
+}
+
+func TestServeHTTPPassesUpstreamStatusAndAbortedBody(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("no such page"))
+			return
+		}
+		// Destination promises more than it sends and drops connection
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer upstream.Close()
+	httpProxy := newHTTPProxy("web.host", plainDestinations(strings.TrimPrefix(upstream.URL, "http://")))
+
+	// Status of destination is passed to client as is
+	req := httptest.NewRequest("GET", "http://web.host/missing", nil)
+	rec := httptest.NewRecorder()
+	httpProxy.ServeHTTP(rec, req)
+	require.Equal(t, 404, rec.Code)
+	require.Equal(t, "no such page", rec.Body.String())
+
+	// Headers are already sent when body breaks, so error can't be reported
+	// to client and nothing is appended to body
+	req = httptest.NewRequest("GET", "http://web.host/aborted", nil)
+	rec = httptest.NewRecorder()
+	httpProxy.ServeHTTP(rec, req)
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "partial", rec.Body.String())
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+func TestAccessRules(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	rules, err := access.NewRules(config.AccessRules{Allow: []string{"192.0.2.0/24", "2001:db8::/32"}, Deny: []string{"192.0.2.13", "2001:db8:bad::/48"}})
+	require.Nil(t, err)
+	trustedProxies, err := access.ParseNetworks([]string{"127.0.0.1", "fd00::/8"})
+	require.Nil(t, err)
+
+	httpProxy := newHTTPProxy("internal.host", plainDestinations("127.0.0.1:9021"))
+	httpProxy.accessRules = rules
+	httpProxy.trustedProxies = trustedProxies
+	proxyRequest := func(remoteAddr string, forwardedFor string) int {
+		req := httptest.NewRequest("GET", "http://127.0.0.1:8100/", nil)
+		req.Host = "internal.host"
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		rec := httptest.NewRecorder()
+		httpProxy.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Allowed requests get to destination, which doesn't work
+	require.Equal(t, 502, proxyRequest("192.0.2.1:40000", ""))
+	require.Equal(t, 502, proxyRequest("[2001:db8::1]:40000", ""))
+	require.Equal(t, 403, proxyRequest("192.0.2.13:40000", ""))
+	require.Equal(t, 403, proxyRequest("[2001:db8:bad::1]:40000", ""))
+	require.Equal(t, 403, proxyRequest("198.51.100.1:40000", ""))
+
+	// Client address is the rightmost untrusted one
+	require.Equal(t, 502, proxyRequest("127.0.0.1:40000", "198.51.100.1, 192.0.2.1, fd00::1"))
+	require.Equal(t, 403, proxyRequest("127.0.0.1:40000", "192.0.2.1, 198.51.100.1"))
+	require.Equal(t, 403, proxyRequest("[fd00::1]:40000", "192.0.2.1, garbage"))
+	// Untrusted client can't forge its address
+	require.Equal(t, 403, proxyRequest("198.51.100.1:40000", "192.0.2.1"))
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+func TestServeHTTPOverTLSWithHTTP2(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Host: " + r.Host))
+	}))
+	defer upstream.Close()
+
+	ca := testshelpers.CreateCertificate("ca", nil)
+	webCertificate := testshelpers.CreateCertificate("web.host", ca, "web.host")
+	otherCertificate := testshelpers.CreateCertificate("other.host", ca, "other.host")
+	routes := make(map[string]*HTTPProxy)
+	for domain, certificate := range map[string]*testshelpers.Certificate{"web.host": webCertificate, "other.host": otherCertificate} {
+		tlsCertificate := certificate.TLSCertificate()
+		routes[domain] = newHTTPProxy(domain, plainDestinations(strings.TrimPrefix(upstream.URL, "http://")))
+		routes[domain].certificate = &tlsCertificate
+	}
+	httpProxiesMutex.Lock()
+	startHTTPProxy("127.0.0.1:8301", routes)
+	listener := httpProxies["127.0.0.1:8301"]
+	delete(httpProxies, "127.0.0.1:8301")
+	httpProxiesMutex.Unlock()
+	defer stopHTTPProxy(listener)
+	time.Sleep(500 * time.Millisecond)
+
+	// Certificate is chosen by SNI, HTTP/2 is negotiated with ALPN
+	for _, domain := range []string{"web.host", "other.host"} {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: ca.CertPool(), ServerName: domain},
+			ForceAttemptHTTP2: true,
+		}}
+		req, err := http.NewRequest("GET", "https://127.0.0.1:8301/", nil)
+		require.Nil(t, err)
+		req.Host = domain
+		rsp, err := client.Do(req)
+		require.Nil(t, err)
+		body, err := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		require.Nil(t, err)
+		require.Equal(t, 2, rsp.ProtoMajor)
+		require.Equal(t, "Host: "+domain, string(body))
+		require.Equal(t, domain, rsp.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+
+	// Broken certificates are refused by validation, not by dispatcher
+	configuration := *c.Config()
+	backend := config.BackendConfig{Type: "http", ListenOn: "127.0.0.1:8301", Source: "web.host", Destinations: plainDestinations("127.0.0.1:9001")}
+	for _, files := range []struct{ cert, key, path string }{
+		{webCertificate.CertFile, webCertificate.KeyFile, ""},
+		{webCertificate.KeyFile, webCertificate.KeyFile, "colors[0].backends[0].tls.cert_file"},
+		{webCertificate.CertFile, webCertificate.CertFile, "colors[0].backends[0].tls.key_file"},
+		{webCertificate.CertFile, otherCertificate.KeyFile, "colors[0].backends[0].tls.key_file"},
+	} {
+		backend.TLS = &config.FrontendTLS{CertFile: files.cert, KeyFile: files.key}
+		configuration.Colors = []config.Color{{Name: "green", Backends: []config.BackendConfig{backend}}}
+		errors := configuration.Validate().Errors()
+		if files.path == "" {
+			require.Empty(t, errors)
+			continue
+		}
+		require.Equal(t, 1, len(errors))
+		require.Equal(t, files.path, errors[0].Path)
+	}
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+func TestServeHTTPStreamsH2CWithTrailers(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	// Destination speaks h2c only and behaves like gRPC server: streams
+	// messages and sends status in trailers it didn't announce
+	proceed := make(chan bool)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write([]byte(fmt.Sprintf("%s %s %s|", r.Proto, r.Header.Get("Te"), requestBody)))
+		w.(http.Flusher).Flush()
+		<-proceed
+		w.Write([]byte("second"))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+
+	httpProxy := newHTTPProxy("grpc.host", plainDestinations(strings.TrimPrefix(upstream.URL, "http://")))
+	httpProxy.H2C = true
+	httpProxy.UpstreamH2C = true
+	httpProxiesMutex.Lock()
+	startHTTPProxy("127.0.0.1:8301", map[string]*HTTPProxy{"grpc.host": httpProxy})
+	listener := httpProxies["127.0.0.1:8301"]
+	delete(httpProxies, "127.0.0.1:8301")
+	httpProxiesMutex.Unlock()
+	defer stopHTTPProxy(listener)
+	time.Sleep(500 * time.Millisecond)
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	req, err := http.NewRequest("POST", "http://127.0.0.1:8301/grpc.health.v1.Health/Check", strings.NewReader("request"))
+	require.Nil(t, err)
+	req.Host = "grpc.host"
+	req.Header.Set("Te", "trailers")
+	rsp, err := (&http.Client{Transport: transport}).Do(req)
+	require.Nil(t, err)
+	defer rsp.Body.Close()
+	require.Equal(t, 2, rsp.ProtoMajor)
+
+	// First message comes before destination finishes response
+	buffer := make([]byte, 64)
+	n, err := rsp.Body.Read(buffer)
+	require.Nil(t, err)
+	require.Equal(t, "HTTP/2.0 trailers request|", string(buffer[:n]))
+	proceed <- true
+	rest, err := ioutil.ReadAll(rsp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "second", string(rest))
+	require.Equal(t, "0", rsp.Trailer.Get("Grpc-Status"))
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* client_auth.go */
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	c1 := testshelpers.CreateHTTPEchoServer("8125")
+	defer func() { c1 <- true }()
+	// Get some time for test backend to start
+	time.Sleep(1 * time.Second)
+
+	ca := testshelpers.CreateCertificate("clients-ca", nil)
+	otherCA := testshelpers.CreateCertificate("other-ca", nil)
+	serverCertificate := testshelpers.CreateCertificate("secure.host", ca, "secure.host", "open.host")
+	billing := testshelpers.CreateCertificate("billing", ca, "billing.internal")
+	intruder := testshelpers.CreateCertificate("intruder", ca, "intruder.example.com")
+	stranger := testshelpers.CreateCertificate("stranger", otherCA, "stranger.internal")
+	certificate := serverCertificate.TLSCertificate()
+
+	secure := newHTTPProxy("secure.host", plainDestinations("127.0.0.1:8125"))
+	secure.certificate = &certificate
+	var err error
+	secure.clientAuth, err = loadClientAuth(&config.ClientAuth{
+		Mode:   "require",
+		CAFile: ca.CertFile,
+		Allow:  []config.ClientCertificateRule{{Subject: "CN=*,O=LBTDS tests", SAN: "*.internal"}},
+		Headers: config.ClientIdentityHeaders{
+			Subject:     "X-Client-Subject",
+			SAN:         "X-Client-San",
+			Fingerprint: "X-Client-Fingerprint",
+		},
+	})
+	require.Nil(t, err)
+	open := newHTTPProxy("open.host", plainDestinations("127.0.0.1:8125"))
+	open.certificate = &certificate
+	httpProxiesMutex.Lock()
+	startHTTPProxy("127.0.0.1:8301", map[string]*HTTPProxy{"secure.host": secure, "open.host": open})
+	listener := httpProxies["127.0.0.1:8301"]
+	delete(httpProxies, "127.0.0.1:8301")
+	httpProxiesMutex.Unlock()
+	defer stopHTTPProxy(listener)
+	time.Sleep(500 * time.Millisecond)
+
+	proxyRequest := func(serverName string, host string, client *testshelpers.Certificate) (int, string, error) {
+		tlsConfig := &tls.Config{ServerName: serverName, RootCAs: ca.CertPool()}
+		if client != nil {
+			tlsConfig.Certificates = []tls.Certificate{client.TLSCertificate()}
+		}
+		transport := &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}
+		defer transport.CloseIdleConnections()
+		req, err := http.NewRequest("GET", "https://127.0.0.1:8301/", nil)
+		require.Nil(t, err)
+		req.Host = host
+		req.Header.Set("X-Client-Subject", "CN=admin")
+		rsp, err := (&http.Client{Transport: transport}).Do(req)
+		if err != nil {
+			return 0, "", err
+		}
+		defer rsp.Body.Close()
+		body, err := ioutil.ReadAll(rsp.Body)
+		return rsp.StatusCode, string(body), err
+	}
+
+	// Identity of allowed client replaces headers, which it sent
+	code, body, err := proxyRequest("secure.host", "secure.host", billing)
+	require.Nil(t, err)
+	require.Equal(t, 200, code)
+	require.Contains(t, body, "X-Client-Subject: CN=billing,O=LBTDS tests\n")
+	require.Contains(t, body, "X-Client-San: billing.internal\n")
+	fingerprint := sha256.Sum256(billing.Certificate.Raw)
+	require.Contains(t, body, "X-Client-Fingerprint: "+hex.EncodeToString(fingerprint[:])+"\n")
+	require.NotContains(t, body, "CN=admin")
+
+	// Clients without valid certificate can't complete handshake
+	_, _, err = proxyRequest("secure.host", "secure.host", nil)
+	require.NotNil(t, err)
+	_, _, err = proxyRequest("secure.host", "secure.host", stranger)
+	require.NotNil(t, err)
+
+	// Verified certificate should match rules
+	code, _, err = proxyRequest("secure.host", "secure.host", intruder)
+	require.Nil(t, err)
+	require.Equal(t, 403, code)
+
+	// Connection for other source doesn't pass authentication
+	code, _, err = proxyRequest("open.host", "secure.host", nil)
+	require.Nil(t, err)
+	require.Equal(t, 403, code)
+	code, body, err = proxyRequest("open.host", "open.host", nil)
+	require.Nil(t, err)
+	require.Equal(t, 200, code)
+	require.Contains(t, body, "X-Client-Subject: CN=admin\n")
+
+	// Requested certificate is optional, but identity can't be forged
+	secure.clientAuth.required = false
+	code, body, err = proxyRequest("secure.host", "secure.host", nil)
+	require.Nil(t, err)
+	require.Equal(t, 200, code)
+	require.NotContains(t, body, "X-Client-Subject")
+
+	// Broken CA bundle is refused by validation, not by dispatcher
+	configuration := *c.Config()
+	backend := config.BackendConfig{Type: "http", ListenOn: "127.0.0.1:8301", Source: "secure.host", Destinations: plainDestinations("127.0.0.1:8125")}
+	for _, caFile := range []string{ca.CertFile, ca.KeyFile} {
+		backend.TLS = &config.FrontendTLS{
+			CertFile:   serverCertificate.CertFile,
+			KeyFile:    serverCertificate.KeyFile,
+			ClientAuth: &config.ClientAuth{Mode: "require", CAFile: caFile},
+		}
+		configuration.Colors = []config.Color{{Name: "green", Backends: []config.BackendConfig{backend}}}
+		errors := configuration.Validate().Errors()
+		if caFile == ca.CertFile {
+			require.Empty(t, errors)
+			continue
+		}
+		require.Equal(t, 1, len(errors))
+		require.Equal(t, "colors[0].backends[0].tls.client_auth.ca_file", errors[0].Path)
+	}
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* forwarding.go */
+
+func TestForwardingHeaders(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	c1 := testshelpers.CreateHTTPEchoServer("8125")
+	// Get some time for test backend to start
+	time.Sleep(1 * time.Second)
+
+	httpProxy := newHTTPProxy("web.host", plainDestinations("127.0.0.1:8125"))
+	httpProxy.Headers = config.HeaderRules{
+		Forwarded: true,
+		Request: config.HeaderChanges{
+			Remove: []string{"Cookie"},
+			Set:    map[string]string{"X-Environment": "staging"},
+		},
+		Response: config.HeaderChanges{
+			Set: map[string]string{"Strict-Transport-Security": "max-age=31536000"},
+			Add: map[string]string{"X-Served-By": "lbtds"},
+		},
+	}
+	proxyRequest := func(forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://127.0.0.1:8100/", nil)
+		req.Host = "web.host:8100"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("Cookie", "session=secret")
+		req.Header.Set("X-Environment", "production")
+		rec := httptest.NewRecorder()
+		httpProxy.ServeHTTP(rec, req)
+		require.Equal(t, 200, rec.Code)
+		return rec
+	}
+
+	// Headers from untrusted client are replaced
+	rec := proxyRequest("10.0.0.1")
+	body := rec.Body.String()
+	require.Contains(t, body, "X-Forwarded-For: 192.0.2.1\n")
+	require.Contains(t, body, "X-Forwarded-Proto: http\n")
+	require.Contains(t, body, "X-Forwarded-Host: web.host:8100\n")
+	require.Contains(t, body, "X-Real-Ip: 192.0.2.1\n")
+	require.Contains(t, body, `Forwarded: for=192.0.2.1;host="web.host:8100";proto=http`)
+	require.Contains(t, body, "X-Environment: staging\n")
+	require.NotContains(t, body, "Cookie")
+	require.Equal(t, "max-age=31536000", rec.Header().Get("Strict-Transport-Security"))
+	require.Equal(t, "lbtds", rec.Header().Get("X-Served-By"))
+
+	// Chain from trusted proxy is continued
+	httpProxy.trustedProxies, _ = access.ParseNetworks([]string{"192.0.2.1"})
+	body = proxyRequest("10.0.0.1").Body.String()
+	require.Contains(t, body, "X-Forwarded-For: 10.0.0.1, 192.0.2.1\n")
+	require.Contains(t, body, "X-Forwarded-Proto: https\n")
+	require.Contains(t, body, "X-Real-Ip: 10.0.0.1\n")
+
+	c1 <- true
+
+	// IPv6 addresses are quoted in Forwarded
+	req := httptest.NewRequest("GET", "http://web.host/", nil)
+	req.RemoteAddr = "[2001:db8::1]:40000"
+	header := http.Header{}
+	setForwardingHeaders(header, req, nil, access.ClientIP(req, nil), true)
+	require.Equal(t, `for="[2001:db8::1]";host=web.host;proto=http`, header.Get("Forwarded"))
+	require.Equal(t, "2001:db8::1", header.Get("X-Forwarded-For"))
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* grpc.go */
+
+func TestServeHTTPGRPCRoutesRetriesAndErrors(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	// First destination of route is overloaded, backup one responds
+	var unavailableCalls, workingCalls int32
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&unavailableCalls, 1)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "14")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer unavailable.Close()
+	working := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&workingCalls, 1)
+		requestBody, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(requestBody)
+	}))
+	defer working.Close()
+
+	httpProxy := newHTTPProxy("grpc.host", plainDestinations("127.0.0.1:9022"))
+	httpProxy.GRPC = &config.GRPC{
+		Routes: []config.GRPCRoute{{
+			Service: "shop.Orders",
+			Method:  "Create",
+			Destinations: []config.Destination{
+				{Address: strings.TrimPrefix(unavailable.URL, "http://")},
+				{Address: strings.TrimPrefix(working.URL, "http://"), Backup: true},
+			},
+			Retry: &config.GRPCRetry{Attempts: 1},
+		}},
+	}
+	call := func(path string, contentType string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://grpc.host"+path, strings.NewReader("order"))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		httpProxy.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Call of route is retried with the same body
+	rec := call("/shop.Orders/Create", "application/grpc")
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "order", rec.Body.String())
+	require.Equal(t, int32(1), atomic.LoadInt32(&unavailableCalls))
+	require.Equal(t, int32(1), atomic.LoadInt32(&workingCalls))
+
+	// Other methods go to backend destinations, errors are gRPC statuses
+	rec = call("/shop.Orders/List", "application/grpc")
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "14", rec.Header().Get("Grpc-Status"))
+	require.Equal(t, "Can't connect to downstream: connection refused", rec.Header().Get("Grpc-Message"))
+	require.Equal(t, "", rec.Body.String())
+
+	// Plain HTTP requests aren't routed and get usual errors
+	rec = call("/shop.Orders/Create", "text/plain")
+	require.Equal(t, 502, rec.Code)
+	require.Equal(t, "", rec.Header().Get("Grpc-Status"))
+	require.Equal(t, int32(1), atomic.LoadInt32(&workingCalls))
+
+	httpProxy.accessRules, _ = access.NewRules(config.AccessRules{Deny: []string{"0.0.0.0/0"}})
+	rec = call("/shop.Orders/Create", "application/grpc+proto")
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "7", rec.Header().Get("Grpc-Status"))
+
+	// Call, which can't connect, is retried only if UNAVAILABLE is retried
+	workingAddress := strings.TrimPrefix(working.URL, "http://")
+	httpProxy.accessRules = nil
+	httpProxy.GRPC.Routes[0].Destinations = []config.Destination{{Address: "127.0.0.1:9023"}, {Address: workingAddress, Backup: true}}
+	rec = call("/shop.Orders/Create", "application/grpc")
+	require.Equal(t, "order", rec.Body.String())
+	require.Equal(t, int32(2), atomic.LoadInt32(&workingCalls))
+	httpProxy.GRPC.Routes[0].Destinations[0].Address = "127.0.0.1:9024"
+	httpProxy.GRPC.Routes[0].Retry.Statuses = []string{"RESOURCE_EXHAUSTED"}
+	rec = call("/shop.Orders/Create", "application/grpc")
+	require.Equal(t, "14", rec.Header().Get("Grpc-Status"))
+	require.Equal(t, int32(2), atomic.LoadInt32(&workingCalls))
+
+	// Call, which could reach destination, isn't sent again
+	httpProxy.GRPC.Routes[0].Retry.Statuses = nil
+	reset := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer reset.Close()
+	httpProxy.GRPC.Routes[0].Destinations[0].Address = strings.TrimPrefix(reset.URL, "http://")
+	rec = call("/shop.Orders/Create", "application/grpc")
+	require.Equal(t, "14", rec.Header().Get("Grpc-Status"))
+	require.Equal(t, int32(2), atomic.LoadInt32(&workingCalls))
+
+	// Streaming call reaches destination while client keeps stream open
+	reached := make(chan bool)
+	streaming := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		message := make([]byte, 5)
+		io.ReadFull(r.Body, message)
+		close(reached)
+		rest, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(append(message, rest...))
+	}))
+	defer streaming.Close()
+	httpProxy.GRPC.Routes[0].Destinations = []config.Destination{{Address: strings.TrimPrefix(streaming.URL, "http://")}}
+	clientStream, clientWriter := io.Pipe()
+	req := httptest.NewRequest("POST", "http://grpc.host/shop.Orders/Create", clientStream)
+	req.Header.Set("Content-Type", "application/grpc")
+	rec = httptest.NewRecorder()
+	served := make(chan bool)
+	go func() {
+		httpProxy.ServeHTTP(rec, req)
+		close(served)
+	}()
+	clientWriter.Write([]byte("first"))
+	select {
+	case <-reached:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Streaming call was held by proxy")
+	}
+	clientWriter.Write([]byte(" second"))
+	clientWriter.Close()
+	<-served
+	require.Equal(t, "first second", rec.Body.String())
+
+	// Retries of all methods of service are reported
+	configuration := *c.Config()
+	configuration.Colors = []config.Color{{Name: "green", Backends: []config.BackendConfig{{
+		Type: "http", ListenOn: "127.0.0.1:8301", Source: "grpc.host", Destinations: plainDestinations("127.0.0.1:9022"), UpstreamH2C: true,
+		GRPC: &config.GRPC{Routes: []config.GRPCRoute{{Service: "shop.Orders", Retry: &config.GRPCRetry{Attempts: 1}}}},
+	}}}}
+	var warnings []string
+	for _, problem := range configuration.Validate().Warnings() {
+		warnings = append(warnings, problem.Path)
+	}
+	require.Contains(t, warnings, "colors[0].backends[0].grpc.routes[0].method")
+
+	require.Equal(t, "100%25 done%0A", encodeGRPCMessage("100% done\n"))
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* grpc_health.go */
+
+func TestGRPCHealthChecks(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	// Destination implements grpc.health.v1.Health/Check over h2c
+	var servingStatus int32 = grpcHealthServing
+	checkedServices := make(chan string, 100)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody, _ := ioutil.ReadAll(r.Body)
+		message, err := grpcMessage(requestBody)
+		if r.ProtoMajor != 2 || r.URL.Path != "/grpc.health.v1.Health/Check" || err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		checkedServices <- string(message)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(grpcFrame([]byte{0x08, byte(atomic.LoadInt32(&servingStatus))}))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+	address := strings.TrimPrefix(upstream.URL, "http://")
+
+	backend := config.BackendConfig{
+		Source:       "grpc.host",
+		Destinations: plainDestinations(address),
+		GRPC: &config.GRPC{
+			HealthCheck: &config.GRPCHealthCheck{Service: "shop.Orders", Interval: 100 * time.Millisecond},
+		},
+	}
+	httpProxy := newHTTPProxy("grpc.host", backend.Destinations)
+	httpProxiesMutex.Lock()
+	updateHealthCheckers(healthCheckersOf("test", &backend, httpProxy))
+	httpProxiesMutex.Unlock()
+
+	require.Equal(t, string(encodeHealthCheckRequest("shop.Orders")), <-checkedServices)
+	time.Sleep(300 * time.Millisecond)
+	require.False(t, GetDestinationStatus(address).Unhealthy)
+
+	atomic.StoreInt32(&servingStatus, 2)
+	time.Sleep(300 * time.Millisecond)
+	require.True(t, GetDestinationStatus(address).Unhealthy)
+
+	atomic.StoreInt32(&servingStatus, grpcHealthServing)
+	time.Sleep(300 * time.Millisecond)
+	require.False(t, GetDestinationStatus(address).Unhealthy)
+
+	// Destination, which isn't checked anymore, isn't left unhealthy
+	atomic.StoreInt32(&servingStatus, 2)
+	time.Sleep(300 * time.Millisecond)
+	require.True(t, GetDestinationStatus(address).Unhealthy)
+	httpProxiesMutex.Lock()
+	updateHealthCheckers(make(map[string]*healthChecker))
+	httpProxiesMutex.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	require.False(t, GetDestinationStatus(address).Unhealthy)
+
+	// Unknown fields of response are skipped, malformed one isn't serving
+	require.Equal(t, uint64(grpcHealthServing), decodeHealthCheckResponse([]byte{0x12, 0x01, 'x', 0x08, 0x01}))
+	require.Equal(t, uint64(0), decodeHealthCheckResponse([]byte{0x08}))
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* proxy_protocol.go */
+
+func TestProxyProtocolHeaders(t *testing.T) {
+	source := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	destination := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 80}
+	require.Equal(t, "PROXY TCP4 192.0.2.1 192.0.2.2 40000 80\r\n", string(proxyProtocolHeader("v1", source, destination)))
+	require.Equal(t, "PROXY UNKNOWN\r\n", string(proxyProtocolHeader("v1", nil, nil)))
+
+	ipv6Source := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	ipv6Destination := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80}
+	require.Equal(t, "PROXY TCP6 2001:db8::1 2001:db8::2 40000 80\r\n", string(proxyProtocolHeader("v1", ipv6Source, ipv6Destination)))
+	// Client from X-Forwarded-For can be IPv6, while listener is IPv4. v1
+	// has no way to say it, v2 sends both as IPv6.
+	require.Equal(t, "PROXY UNKNOWN\r\n", string(proxyProtocolHeader("v1", ipv6Source, destination)))
+	require.Equal(t, "PROXY UNKNOWN\r\n", string(proxyProtocolHeader("v1", source, ipv6Destination)))
+	client, server := net.Pipe()
+	go func() {
+		client.Write(proxyProtocolHeader("v2", ipv6Source, destination))
+		client.Close()
+	}()
+	conn, err := readProxyProtocolHeader(server)
+	require.Nil(t, err)
+	require.Equal(t, ipv6Source.String(), conn.RemoteAddr().String())
+	require.Equal(t, destination.String(), conn.LocalAddr().String())
+
+	for _, version := range []string{"v1", "v2"} {
+		for _, addresses := range [][2]*net.TCPAddr{{source, destination}, {ipv6Source, ipv6Destination}} {
+			client, server := net.Pipe()
+			go func() {
+				client.Write(proxyProtocolHeader(version, addresses[0], addresses[1]))
+				client.Write([]byte("payload"))
+				client.Close()
+			}()
+			conn, err := readProxyProtocolHeader(server)
+			require.Nil(t, err)
+			require.Equal(t, addresses[0].String(), conn.RemoteAddr().String())
+			data, err := ioutil.ReadAll(conn)
+			require.Nil(t, err)
+			require.Equal(t, "payload", string(data))
+		}
+
+		// Header without addresses keeps addresses of connection
+		client, server := net.Pipe()
+		go func() {
+			client.Write(proxyProtocolHeader(version, nil, nil))
+			client.Close()
+		}()
+		conn, err := readProxyProtocolHeader(server)
+		require.Nil(t, err)
+		require.Equal(t, server.RemoteAddr(), conn.RemoteAddr())
+	}
+
+	client, server = net.Pipe()
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		client.Close()
+	}()
+	_, err = readProxyProtocolHeader(server)
+	require.Equal(t, errInvalidProxyProtocolHeader, err)
+}
+
+func TestProxyProtocolListenerAndUpstream(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	// Destination accepts PROXY protocol and replies with client address
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	upstream := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})}
+	loopback, _ := access.ParseNetworks([]string{"127.0.0.1"})
+	go upstream.Serve(newProxyProtocolListener(tcpListener, func() bool { return true }, func() access.Networks { return loopback }))
+	defer upstream.Close()
+
+	// Connection without header is closed
+	conn, err := net.Dial("tcp", tcpListener.Addr().String())
+	require.Nil(t, err)
+	conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	_, err = ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	conn.Close()
+
+	conn, err = net.Dial("tcp", tcpListener.Addr().String())
+	require.Nil(t, err)
+	conn.Write([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 40000 80\r\nGET / HTTP/1.0\r\n\r\n"))
+	response, err := ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	require.True(t, strings.HasSuffix(string(response), "[2001:db8::1]:40000"))
+	conn.Close()
+
+	// Client, which isn't trusted proxy, can't forge its address
+	untrustedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	otherNetwork, _ := access.ParseNetworks([]string{"192.0.2.0/24"})
+	untrusted := &http.Server{Handler: upstream.Handler}
+	go untrusted.Serve(newProxyProtocolListener(untrustedListener, func() bool { return true }, func() access.Networks { return otherNetwork }))
+	defer untrusted.Close()
+	conn, err = net.Dial("tcp", untrustedListener.Addr().String())
+	require.Nil(t, err)
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 40000 80\r\nGET / HTTP/1.0\r\n\r\n"))
+	response, _ = ioutil.ReadAll(conn)
+	require.Empty(t, response)
+	conn.Close()
+
+	// Header can't be accepted when no proxies are trusted
+	configuration := *c.Config()
+	configuration.Colors = []config.Color{{Name: "green", Backends: []config.BackendConfig{{Type: "http", ListenOn: "127.0.0.1:8301", Source: "web.host", Destinations: plainDestinations("127.0.0.1:9001"), AcceptProxyProtocol: true}}}}
+	configuration.Proxy.TrustedProxies = nil
+	errors := configuration.Validate().Errors()
+	require.Equal(t, 1, len(errors))
+	require.Equal(t, "colors[0].backends[0].accept_proxy_protocol", errors[0].Path)
+	configuration.Proxy.TrustedProxies = []string{"127.0.0.1"}
+	require.Empty(t, configuration.Validate().Errors())
+
+	// Proxy sends address of its client to destination
+	for _, version := range []string{"v1", "v2"} {
+		httpProxy := newHTTPProxy("web.host", plainDestinations(tcpListener.Addr().String()))
+		httpProxy.SendProxyProtocol = version
+		req := httptest.NewRequest("GET", "http://127.0.0.1:8100/", nil)
+		req.Host = "web.host"
+		req = req.WithContext(ctx.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8100}))
+		rec := httptest.NewRecorder()
+		httpProxy.ServeHTTP(rec, req)
+		require.Equal(t, 200, rec.Code)
+		require.Equal(t, "192.0.2.1:1234", rec.Body.String())
+	}
+
+	// Header isn't sent to HTTP proxy from environment
+	require.Nil(t, newUpstreamTransport(upstreamTransportOptions{proxyProtocol: true}).Proxy)
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* upstream.go */
+
+func TestUpstreamTLS(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	// Destination listens on HTTPS only and requires client certificate
+	ca := testshelpers.CreateCertificate("upstream-ca", nil)
+	serverCertificate := testshelpers.CreateCertificate("backend.internal", ca, "backend.internal")
+	clientCertificate := testshelpers.CreateCertificate("lbtds-client", ca)
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto + " " + r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCertificate.TLSCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.CertPool(),
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+
+	proxyRequest := func(options config.UpstreamTLS, destination *httptest.Server) *httptest.ResponseRecorder {
+		options.Enabled = true
+		httpProxiesMutex.Lock()
+		tlsConfig, err := loadUpstreamTLS(options)
+		httpProxiesMutex.Unlock()
+		require.Nil(t, err)
+
+		httpProxy := newHTTPProxy("web.host", plainDestinations(strings.TrimPrefix(strings.TrimPrefix(destination.URL, "https://"), "http://")))
+		httpProxy.upstreamTLS = tlsConfig
+		req := httptest.NewRequest("GET", "http://web.host/", nil)
+		rec := httptest.NewRecorder()
+		httpProxy.ServeHTTP(rec, req)
+		return rec
+	}
+	valid := config.UpstreamTLS{
+		CAFile:     ca.CertFile,
+		ServerName: "backend.internal",
+		CertFile:   clientCertificate.CertFile,
+		KeyFile:    clientCertificate.KeyFile,
+		MinVersion: "1.3",
+	}
+
+	rec := proxyRequest(valid, upstream)
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "HTTP/2.0 lbtds-client", rec.Body.String())
+
+	// Unchanged configuration is reused, so are connections
+	httpProxiesMutex.Lock()
+	first, _ := loadUpstreamTLS(valid)
+	second, _ := loadUpstreamTLS(valid)
+	require.True(t, first == second)
+	forgetUpstreamTLS(make(map[*tls.Config]bool))
+	require.Equal(t, 0, len(upstreamTLSConfigs))
+	httpProxiesMutex.Unlock()
+
+	// Failed connections are explained
+	withoutClientCertificate := valid
+	withoutClientCertificate.CertFile = ""
+	withoutClientCertificate.KeyFile = ""
+	rec = proxyRequest(withoutClientCertificate, upstream)
+	require.Equal(t, 502, rec.Code)
+	require.Contains(t, rec.Body.String(), "destination rejected TLS handshake: certificate required")
+
+	withOtherName := valid
+	withOtherName.ServerName = "other.internal"
+	rec = proxyRequest(withOtherName, upstream)
+	require.Equal(t, 502, rec.Code)
+	require.Contains(t, rec.Body.String(), "certificate of destination isn't valid for other.internal")
+
+	withSystemCAs := valid
+	withSystemCAs.CAFile = ""
+	rec = proxyRequest(withSystemCAs, upstream)
+	require.Equal(t, 502, rec.Code)
+	require.Contains(t, rec.Body.String(), "certificate of destination is signed by unknown authority")
+
+	rec = proxyRequest(valid, plain)
+	require.Equal(t, 502, rec.Code)
+	require.Contains(t, rec.Body.String(), "destination doesn't speak TLS")
+
+	httpProxiesMutex.Lock()
+	_, err := loadUpstreamTLS(config.UpstreamTLS{Enabled: true, CAFile: clientCertificate.KeyFile})
+	forgetUpstreamTLS(make(map[*tls.Config]bool))
+	httpProxiesMutex.Unlock()
+	require.Equal(t, errNoCACertificates, err)
+
+	// Broken certificates are refused by validation, not by dispatcher
+	configuration := *c.Config()
+	backend := config.BackendConfig{Type: "http", ListenOn: "127.0.0.1:8301", Source: "web.host", Destinations: plainDestinations("127.0.0.1:9001")}
+	for _, files := range []struct{ ca, cert, key, path string }{
+		{ca.CertFile, clientCertificate.CertFile, clientCertificate.KeyFile, ""},
+		{clientCertificate.KeyFile, clientCertificate.CertFile, clientCertificate.KeyFile, "colors[0].backends[0].upstream_tls.ca_file"},
+		{ca.CertFile, clientCertificate.KeyFile, clientCertificate.KeyFile, "colors[0].backends[0].upstream_tls.cert_file"},
+		{ca.CertFile, clientCertificate.CertFile, ca.KeyFile, "colors[0].backends[0].upstream_tls.key_file"},
+	} {
+		backend.UpstreamTLS = &config.UpstreamTLS{Enabled: true, CAFile: files.ca, CertFile: files.cert, KeyFile: files.key}
+		configuration.Colors = []config.Color{{Name: "green", Backends: []config.BackendConfig{backend}}}
+		errors := configuration.Validate().Errors()
+		if files.path == "" {
+			require.Empty(t, errors)
+			continue
+		}
+		require.Equal(t, 1, len(errors))
+		require.Equal(t, files.path, errors[0].Path)
+	}
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* request_id.go */
+
+func TestServeHTTPReusesRequestID(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	c1 := testshelpers.CreateHTTPEchoServer("8125")
+	// Get some time for test backend to start
+	time.Sleep(1 * time.Second)
+
+	httpProxy := newHTTPProxy("web.host", plainDestinations("127.0.0.1:8125"))
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1:8100/", nil)
+	req.Host = "web.host"
+	req.Header.Set("X-Request-ID", "deploy-42")
+	rec := httptest.NewRecorder()
+	httpProxy.ServeHTTP(rec, req)
+
+	require.Equal(t, 200, rec.Code)
+	require.Equal(t, "deploy-42", rec.Header().Get("X-Request-ID"))
+	require.Contains(t, rec.Body.String(), "X-Request-Id: deploy-42\n")
+
+	c1 <- true
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+func TestServeHTTPGeneratesRequestID(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	c.Config().Proxy.RequestIDHeader = "X-Correlation-ID"
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	httpProxy := newHTTPProxy("web.host", plainDestinations("127.0.0.1:8126"))
+
+	// Invalid IDs shouldn't be passed to logs
+	req := httptest.NewRequest("GET", "http://127.0.0.1:8100/", nil)
+	req.Host = "web.host"
+	req.Header.Set("X-Correlation-ID", "bad id\nwith newline")
+	rec := httptest.NewRecorder()
+	httpProxy.ServeHTTP(rec, req)
+
+	// There is no backend, but request ID should be returned even on errors
+	require.Equal(t, 502, rec.Code)
+	requestID := rec.Header().Get("X-Correlation-ID")
+	require.Len(t, requestID, 36)
+	require.True(t, isValidRequestID(requestID))
+	require.NotEqual(t, requestID, generateRequestID())
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* destinations.go */
+
+func TestDrainAndDisableDestinations(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	addresses := plainDestinations("127.0.0.1:8123", "127.0.0.1:8124")
+
+	// Draining destination gets no new requests
+	status := SetDestinationState("127.0.0.1:8123", DestinationDraining)
+	require.Equal(t, DestinationDraining, status.State)
+	for i := 0; i < 20; i++ {
+		address, _, release, err := acquireDestination(ctx.Background(), addresses)
+		require.Nil(t, err)
+		require.Equal(t, "127.0.0.1:8124", address)
+		release()
+	}
+
+	// ...but active requests are finished
+	_, requestContext, release, err := acquireDestination(ctx.Background(), addresses)
+	require.Nil(t, err)
+	SetDestinationState("127.0.0.1:8124", DestinationDraining)
+	_, _, _, err = acquireDestination(ctx.Background(), addresses)
+	require.Equal(t, errNoDestinations, err)
+	require.Nil(t, requestContext.Err())
+	require.Equal(t, 1, GetDestinationStatus("127.0.0.1:8124").ActiveRequests)
+
+	waitContext, cancel := ctx.WithTimeout(ctx.Background(), 100*time.Millisecond)
+	require.False(t, WaitDestinationIdle(waitContext, "127.0.0.1:8124"))
+	cancel()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		release()
+	}()
+	require.True(t, WaitDestinationIdle(ctx.Background(), "127.0.0.1:8124"))
+
+	// Request without available destinations is rejected
+	httpProxy := newHTTPProxy("web.host", addresses)
+	req := httptest.NewRequest("GET", "http://127.0.0.1:8100/", nil)
+	req.Host = "web.host"
+	rec := httptest.NewRecorder()
+	httpProxy.ServeHTTP(rec, req)
+	require.Equal(t, 503, rec.Code)
+
+	// Disabling destination aborts its active requests
+	SetDestinationState("127.0.0.1:8124", DestinationActive)
+	_, requestContext, release, err = acquireDestination(ctx.Background(), addresses)
+	require.Nil(t, err)
+	SetDestinationState("127.0.0.1:8124", DestinationDisabled)
+	require.NotNil(t, requestContext.Err())
+	release()
+
+	// State survives configuration reload
+	_, err = colorsv1.ReloadConfiguration()
+	require.Nil(t, err)
+	require.Equal(t, DestinationDraining, GetDestinationStatus("127.0.0.1:8123").State)
+	require.Equal(t, DestinationDisabled, GetDestinationStatus("127.0.0.1:8124").State)
+
+	for _, address := range config.DestinationAddresses(addresses) {
+		SetDestinationState(address, DestinationActive)
+	}
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+func countChoices(t *testing.T, destinations []config.Destination, times int) map[string]int {
+	choices := make(map[string]int)
+	for i := 0; i < times; i++ {
+		address, _, release, err := acquireDestination(ctx.Background(), destinations)
+		require.Nil(t, err)
+		release()
+		choices[address]++
+	}
+	return choices
+}
+
+func TestWeightedAndBackupDestinations(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	// Requests are shared by weight
+	choices := countChoices(t, []config.Destination{{Address: "127.0.0.1:9001", Weight: 3}, {Address: "127.0.0.1:9002"}}, 4000)
+	require.InDelta(t, 3000, choices["127.0.0.1:9001"], 300)
+
+	// Backup destination is used only when primary one is unavailable
+	withBackup := []config.Destination{{Address: "127.0.0.1:9001", MaxConns: 1}, {Address: "127.0.0.1:9002", Backup: true}}
+	choices = countChoices(t, withBackup, 100)
+	require.Equal(t, 100, choices["127.0.0.1:9001"])
+	_, _, release, err := acquireDestination(ctx.Background(), withBackup)
+	require.Nil(t, err)
+	choices = countChoices(t, withBackup, 100)
+	require.Equal(t, 100, choices["127.0.0.1:9002"])
+	release()
+
+	// Failed destination is avoided, unless there is nothing else
+	reportDestinationResult("127.0.0.1:9001", true, 10*time.Second)
+	choices = countChoices(t, withBackup, 100)
+	require.Equal(t, 100, choices["127.0.0.1:9002"])
+	choices = countChoices(t, withBackup[:1], 10)
+	require.Equal(t, 10, choices["127.0.0.1:9001"])
+	reportDestinationResult("127.0.0.1:9001", false, 10*time.Second)
+	choices = countChoices(t, withBackup, 100)
+	require.Equal(t, 100, choices["127.0.0.1:9001"])
+
+	// Failures are ignored when passive health checks are off
+	reportDestinationResult("127.0.0.1:9001", true, 0)
+	choices = countChoices(t, withBackup, 100)
+	require.Equal(t, 100, choices["127.0.0.1:9001"])
+
+	// Recovered destination starts slowly
+	slowStart := []config.Destination{{Address: "127.0.0.1:9001", SlowStart: time.Hour}, {Address: "127.0.0.1:9002"}}
+	choices = countChoices(t, slowStart, 1000)
+	require.True(t, choices["127.0.0.1:9001"] < 50)
+	SetDestinationState("127.0.0.1:9003", DestinationDisabled)
+	SetDestinationState("127.0.0.1:9003", DestinationActive)
+	choices = countChoices(t, []config.Destination{{Address: "127.0.0.1:9003", SlowStart: time.Hour}}, 10)
+	require.Equal(t, 10, choices["127.0.0.1:9003"])
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* queue.go */
+
+func TestBackendQueue(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	proxy := newHTTPProxy("queue.host", []config.Destination{{Address: "127.0.0.1:9011", MaxConns: 1}})
+	proxy.QueueLimit = 1
+	proxy.QueueTimeout = 200 * time.Millisecond
+	proxy.RetryAfter = 3 * time.Second
+	proxy.queue = getBackendQueue("127.0.0.1:8100", "queue.host")
+	queueDepth := queueDepthGauge.With("127.0.0.1:8100", "queue.host")
+
+	// Request waits for busy destination
+	_, _, release, err := proxy.acquire(ctx.Background(), proxy.Destinations)
+	require.Nil(t, err)
+	result := make(chan error)
+	go func() {
+		_, _, secondRelease, err := proxy.acquire(ctx.Background(), proxy.Destinations)
+		if err == nil {
+			secondRelease()
+		}
+		result <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 1.0, queueDepth.Get())
+
+	// ...and there is no place for another one
+	_, _, _, err = proxy.acquire(ctx.Background(), proxy.Destinations)
+	require.Equal(t, errQueueFull, err)
+
+	release()
+	require.Nil(t, <-result)
+	require.Equal(t, 0.0, queueDepth.Get())
+
+	// Request waits in queue for limited time
+	_, _, release, err = proxy.acquire(ctx.Background(), proxy.Destinations)
+	require.Nil(t, err)
+	_, _, _, err = proxy.acquire(ctx.Background(), proxy.Destinations)
+	require.Equal(t, errQueueTimeout, err)
+
+	// Without queue request is rejected at once
+	req := httptest.NewRequest("GET", "http://127.0.0.1:8100/", nil)
+	req.Host = "queue.host"
+	rec := httptest.NewRecorder()
+	proxy.QueueLimit = 0
+	proxy.ServeHTTP(rec, req)
+	require.Equal(t, 503, rec.Code)
+	require.Equal(t, "3", rec.Header().Get("Retry-After"))
+	require.Equal(t, "Service unavailable\n", rec.Body.String())
+
+	// Response body is configurable, internal reason isn't sent anyway
+	proxy.Unavailable = config.UnavailableResponse{Body: `{"error":"overloaded"}`, ContentType: "application/json"}
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	require.Equal(t, 503, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	require.Equal(t, `{"error":"overloaded"}`, rec.Body.String())
+	release()
+
+	// Released destination goes to request, which waits longer
+	proxy.QueueLimit = 3
+	proxy.QueueTimeout = 5 * time.Second
+	_, _, release, err = proxy.acquire(ctx.Background(), proxy.Destinations)
+	require.Nil(t, err)
+	order := make(chan int, 3)
+	var waiters sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		waiters.Add(1)
+		go func(i int) {
+			defer waiters.Done()
+			_, _, waiterRelease, err := proxy.acquire(ctx.Background(), proxy.Destinations)
+			if err == nil {
+				order <- i
+				time.Sleep(10 * time.Millisecond)
+				waiterRelease()
+			}
+		}(i)
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.Equal(t, 3.0, queueDepth.Get())
+	release()
+	waiters.Wait()
+	close(order)
+	var served []int
+	for i := range order {
+		served = append(served, i)
+	}
+	require.Equal(t, []int{0, 1, 2}, served)
+
+	// Backend limits requests to all destinations together
+	limited := newHTTPProxy("queue.host", plainDestinations("127.0.0.1:9012", "127.0.0.1:9013"))
+	limited.MaxConns = 1
+	limited.queue = proxy.queue
+	_, _, release, err = limited.acquire(ctx.Background(), limited.Destinations)
+	require.Nil(t, err)
+	_, _, _, err = limited.acquire(ctx.Background(), limited.Destinations)
+	require.Equal(t, errDestinationsBusy, err)
+	release()
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* rate_limit.go */
+
+func TestRateLimit(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	limiter := newRateLimiter(config.RateLimit{Rate: 1, Burst: 2, Key: "header:X-API-Key", MaxKeys: 2})
+	request := func(apiKey string) *http.Request {
+		req := httptest.NewRequest("GET", "http://127.0.0.1:8100/", nil)
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		return req
+	}
+	now := time.Now()
+
+	// Burst is allowed, then requests are limited by rate
+	allowed, _ := limiter.allow(request("first"), "192.0.2.1", now)
+	require.True(t, allowed)
+	allowed, _ = limiter.allow(request("first"), "192.0.2.1", now)
+	require.True(t, allowed)
+	allowed, wait := limiter.allow(request("first"), "192.0.2.1", now)
+	require.False(t, allowed)
+	require.Equal(t, time.Second, wait)
+	allowed, _ = limiter.allow(request("first"), "192.0.2.1", now.Add(time.Second))
+	require.True(t, allowed)
+
+	// Each key has its own bucket, requests without key are limited by
+	// client address
+	allowed, _ = limiter.allow(request("second"), "192.0.2.1", now)
+	require.True(t, allowed)
+	require.Equal(t, "remote_ip=192.0.2.1", limiter.key(request(""), "192.0.2.1"))
+
+	// Least recently used bucket is forgotten
+	allowed, _ = limiter.allow(request(""), "192.0.2.1", now)
+	require.True(t, allowed)
+	require.Equal(t, 2, len(limiter.buckets))
+	_, ok := limiter.buckets["header:X-API-Key=first"]
+	require.False(t, ok)
+
+	// Request, rejected by one limiter, doesn't drain others
+	perSource := newRateLimiter(config.RateLimit{Rate: 1, Burst: 2})
+	perKey := newRateLimiter(config.RateLimit{Rate: 1, Burst: 1, Key: "header:X-API-Key"})
+	both := []*rateLimiter{perSource, perKey}
+	allowed, _ = allowRequest(both, request("first"), "192.0.2.1", now)
+	require.True(t, allowed)
+	allowed, wait = allowRequest(both, request("first"), "192.0.2.1", now)
+	require.False(t, allowed)
+	require.Equal(t, time.Second, wait)
+	allowed, _ = allowRequest(both, request("second"), "192.0.2.1", now)
+	require.True(t, allowed)
+	allowed, _ = allowRequest(both, request("third"), "192.0.2.1", now)
+	require.False(t, allowed)
+
+	// Limiters are kept while their configuration is the same
+	backend := &config.BackendConfig{ListenOn: "127.0.0.1:8100", Source: "limited.host", RateLimits: []config.RateLimit{{Rate: 1}}}
+	limiters := getRateLimiters(backend)
+	require.Equal(t, limiters, getRateLimiters(backend))
+	backend.RateLimits[0].Burst = 5
+	require.NotEqual(t, limiters[0], getRateLimiters(backend)[0])
+
+	// Limited request gets 429
+	httpProxy := newHTTPProxy("limited.host", plainDestinations("127.0.0.1:9021"))
+	httpProxy.rateLimiters = []*rateLimiter{newRateLimiter(config.RateLimit{Rate: 0.5})}
+	req := httptest.NewRequest("GET", "http://127.0.0.1:8100/", nil)
+	req.Host = "limited.host"
+	rec := httptest.NewRecorder()
+	httpProxy.ServeHTTP(rec, req)
+	require.Equal(t, 502, rec.Code)
+	req = httptest.NewRequest("GET", "http://127.0.0.1:8100/", nil)
+	req.Host = "limited.host"
+	rec = httptest.NewRecorder()
+	httpProxy.ServeHTTP(rec, req)
+	require.Equal(t, 429, rec.Code)
+	require.Equal(t, "2", rec.Header().Get("Retry-After"))
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* api.go */
+
+func TestDestinationsAPI(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	colorsv1.Initialize(c)
+	Initialize(c)
+
+	destinationRequest := func(method string, path string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		Destinations(recorder, request)
+		return recorder
+	}
+
+	recorder := destinationRequest("POST", "/api/v1/destinations/127.0.0.1:8123?wait=1s", `{"state": "draining"}`)
+	require.Equal(t, 200, recorder.Code)
+	var status DestinationStatus
+	err := json.Unmarshal(recorder.Body.Bytes(), &status)
+	require.Nil(t, err)
+	require.Equal(t, DestinationStatus{Address: "127.0.0.1:8123", State: DestinationDraining}, status)
+
+	recorder = destinationRequest("GET", "/api/v1/destinations", "")
+	require.Equal(t, 200, recorder.Code)
+	var statuses []DestinationStatus
+	err = json.Unmarshal(recorder.Body.Bytes(), &statuses)
+	require.Nil(t, err)
+	require.Contains(t, statuses, status)
+
+	// Waiting for busy destination times out
+	_, _, release, err := acquireDestination(ctx.Background(), plainDestinations("127.0.0.1:8124"))
+	require.Nil(t, err)
+	recorder = destinationRequest("GET", "/api/v1/destinations/127.0.0.1:8124?wait=100ms", "")
+	require.Equal(t, 504, recorder.Code)
+	require.Contains(t, recorder.Body.String(), `"active_requests":1`)
+	release()
+
+	recorder = destinationRequest("POST", "/api/v1/destinations/127.0.0.1:8123", `{"state": "sleeping"}`)
+	require.Equal(t, 400, recorder.Code)
+	recorder = destinationRequest("POST", "/api/v1/destinations/127.0.0.1:8123?wait=soon", `{"state": "active"}`)
+	require.Equal(t, 400, recorder.Code)
+	recorder = destinationRequest("POST", "/api/v1/destinations/127.0.0.1:9999", `{"state": "draining"}`)
+	require.Equal(t, 404, recorder.Code)
+	require.Equal(t, "Unknown destination\n", recorder.Body.String())
+
+	recorder = destinationRequest("POST", "/api/v1/destinations/127.0.0.1:8123", `{"state": "active"}`)
+	require.Equal(t, 200, recorder.Code)
+	require.Equal(t, DestinationActive, GetDestinationStatus("127.0.0.1:8123").State)
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
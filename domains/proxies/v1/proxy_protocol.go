@@ -0,0 +1,369 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package proxiesv1
+
+import (
+	"bufio"
+	"bytes"
+	ctx "context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/access"
+)
+
+const (
+	// Client should send PROXY protocol header within this time after
+	// connection is accepted
+	proxyProtocolHeaderTimeout = 5 * time.Second
+	// Longest v1 header, including CRLF
+	proxyProtocolV1MaxLength = 107
+)
+
+var (
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errInvalidProxyProtocolHeader = errors.New("Invalid PROXY protocol header")
+)
+
+// proxyProtocolHeaderKey is a key of request context, which keeps PROXY
+// protocol header for upstream connection
+type proxyProtocolHeaderKey struct{}
+
+// proxyProtocolListener reads PROXY protocol header of every accepted
+// connection, when enabled. Header is accepted only from trusted proxies,
+// other connections are closed, so clients can't forge their addresses.
+// Headers are read in background, so slow client doesn't block others.
+type proxyProtocolListener struct {
+	net.Listener
+	enabled func() bool
+	trusted func() access.Networks
+
+	conns     chan net.Conn
+	err       chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// proxyProtocolConn is a connection with client address from PROXY
+// protocol header
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func newProxyProtocolListener(listener net.Listener, enabled func() bool, trusted func() access.Networks) *proxyProtocolListener {
+	l := &proxyProtocolListener{
+		Listener: listener,
+		enabled:  enabled,
+		trusted:  trusted,
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+		closed:   make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *proxyProtocolListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			l.err <- err
+			return
+		}
+		if !l.enabled() {
+			l.deliver(conn)
+			continue
+		}
+		peer, _ := conn.RemoteAddr().(*net.TCPAddr)
+		if peer == nil || !l.trusted().Contains(peer.IP) {
+			proxiesModuleLog.Warn().Str("remote", conn.RemoteAddr().String()).Msg("Connection from untrusted proxy is closed, PROXY protocol header is accepted only from trusted proxies")
+			conn.Close()
+			continue
+		}
+		go func() {
+			wrapped, err := readProxyProtocolHeader(conn)
+			if err != nil {
+				proxiesModuleLog.Warn().Err(err).Str("remote", conn.RemoteAddr().String()).Msg("Connection without valid PROXY protocol header is closed")
+				conn.Close()
+				return
+			}
+			l.deliver(wrapped)
+		}()
+	}
+}
+
+func (l *proxyProtocolListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+// Accept returns next connection with known client address
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.err:
+		// Error is kept for next calls
+		l.err <- err
+		return nil, err
+	}
+}
+
+// Close stops listening
+func (l *proxyProtocolListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// CloseWrite shuts down writing side of connection, if it can
+func (c *proxyProtocolConn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// RemoteAddr returns client address from header
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// LocalAddr returns address, to which client connected, from header
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// readProxyProtocolHeader reads v1 or v2 header from connection. Header
+// without addresses (UNKNOWN or LOCAL) keeps addresses of connection.
+func readProxyProtocolHeader(conn net.Conn) (net.Conn, error) {
+	err := conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	wrapped := &proxyProtocolConn{Conn: conn, reader: reader, remoteAddr: conn.RemoteAddr(), localAddr: conn.LocalAddr()}
+
+	start, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	var source, destination *net.TCPAddr
+	switch {
+	case bytes.Equal(start, proxyProtocolV2Signature):
+		source, destination, err = readProxyProtocolV2(reader)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		source, destination, err = readProxyProtocolV1(reader)
+	default:
+		err = errInvalidProxyProtocolHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	if source != nil {
+		wrapped.remoteAddr = source
+		wrapped.localAddr = destination
+	}
+
+	return wrapped, conn.SetReadDeadline(time.Time{})
+}
+
+// readProxyProtocolV1 reads human-readable header, e.g.
+// "PROXY TCP4 192.0.2.1 192.0.2.2 40000 80\r\n"
+func readProxyProtocolV1(reader *bufio.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, nil, errInvalidProxyProtocolHeader
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errInvalidProxyProtocolHeader
+	}
+	source, err := parseProxyProtocolAddress(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	destination, err := parseProxyProtocolAddress(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, destination, nil
+}
+
+func parseProxyProtocolAddress(ip string, port string) (*net.TCPAddr, error) {
+	address := &net.TCPAddr{IP: net.ParseIP(ip)}
+	number, err := strconv.ParseUint(port, 10, 16)
+	if address.IP == nil || err != nil {
+		return nil, errInvalidProxyProtocolHeader
+	}
+	address.Port = int(number)
+	return address, nil
+}
+
+// readProxyProtocolV2 reads binary header. TLVs are skipped.
+func readProxyProtocolV2(reader *bufio.Reader) (*net.TCPAddr, *net.TCPAddr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, errInvalidProxyProtocolHeader
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case command == 0:
+		// LOCAL: connection was made by proxy itself, e.g. health check
+		return nil, nil, nil
+	case command != 1:
+		return nil, nil, errInvalidProxyProtocolHeader
+	}
+
+	size := 0
+	switch family {
+	case 0x11:
+		size = net.IPv4len
+	case 0x21:
+		size = net.IPv6len
+	default:
+		// Not TCP, addresses of connection are used
+		return nil, nil, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, nil, errInvalidProxyProtocolHeader
+	}
+	source := &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+	destination := &net.TCPAddr{
+		IP:   net.IP(payload[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+	return source, destination, nil
+}
+
+// proxyProtocolHeader returns header for upstream connection of client
+// connected from source to destination. It says nothing about addresses
+// if they are unknown.
+func proxyProtocolHeader(version string, source *net.TCPAddr, destination *net.TCPAddr) []byte {
+	known := source != nil && destination != nil
+	ipv4 := known && source.IP.To4() != nil && destination.IP.To4() != nil
+
+	if version == "v1" {
+		switch {
+		// TCP6 header can't carry IPv4 address in dotted form, and mixed
+		// families can't be told apart in v1 at all
+		case !known || (source.IP.To4() != nil) != (destination.IP.To4() != nil):
+			return []byte("PROXY UNKNOWN\r\n")
+		case ipv4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", source.IP, destination.IP, source.Port, destination.Port))
+		default:
+			return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", source.IP.To16(), destination.IP.To16(), source.Port, destination.Port))
+		}
+	}
+
+	header := append([]byte(nil), proxyProtocolV2Signature...)
+	var addresses []byte
+	switch {
+	case !known:
+		header = append(header, 0x20, 0x00)
+	case ipv4:
+		header = append(header, 0x21, 0x11)
+		addresses = append(append(addresses, source.IP.To4()...), destination.IP.To4()...)
+	default:
+		header = append(header, 0x21, 0x21)
+		addresses = append(append(addresses, source.IP.To16()...), destination.IP.To16()...)
+	}
+	if known {
+		ports := make([]byte, 4)
+		binary.BigEndian.PutUint16(ports, uint16(source.Port))
+		binary.BigEndian.PutUint16(ports[2:], uint16(destination.Port))
+		addresses = append(addresses, ports...)
+	}
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addresses)))
+	return append(append(header, length...), addresses...)
+}
+
+// withProxyProtocolHeader returns request context, which makes upstream
+// connection send PROXY protocol header about client of request
+func withProxyProtocolHeader(parent ctx.Context, version string, r *http.Request, clientIP net.IP) ctx.Context {
+	var source, destination *net.TCPAddr
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err == nil && clientIP != nil {
+		source = &net.TCPAddr{IP: clientIP}
+		// Port is known only for client, which connected directly
+		if remote.IP.Equal(clientIP) {
+			source.Port = remote.Port
+		}
+	}
+	destination, _ = r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if source == nil || destination == nil {
+		source, destination = nil, nil
+	}
+	return ctx.WithValue(parent, proxyProtocolHeaderKey{}, proxyProtocolHeader(version, source, destination))
+}
+
+// dialWithProxyProtocol returns dial function, which sends PROXY protocol
+// header from context right after connection is established
+func dialWithProxyProtocol(dialer *net.Dialer) func(ctx.Context, string, string) (net.Conn, error) {
+	return func(dialContext ctx.Context, network string, address string) (net.Conn, error) {
+		conn, err := dialer.DialContext(dialContext, network, address)
+		if err != nil {
+			return nil, err
+		}
+		header, _ := dialContext.Value(proxyProtocolHeaderKey{}).([]byte)
+		if header != nil {
+			_, err = conn.Write(header)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,154 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package proxiesv1
+
+import (
+	ctx "context"
+	"errors"
+	"time"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/metrics"
+)
+
+var (
+	// Queues by backend route, guarded by destinationsMutex. Queue is
+	// shared by proxies of all colors with the same route, so requests,
+	// which are still active after color switch, are counted.
+	backendQueues = make(map[string]*backendQueue)
+	// Requests, waiting in backend queues, in order of arrival. Guarded
+	// by destinationsMutex.
+	queuedRequests []*queuedRequest
+
+	queueDepthGauge = metrics.NewGaugeVec("lbtds_backend_queue_depth", "Number of requests, waiting for free destination.", "listen_on", "source")
+
+	errDestinationsBusy = errors.New("All destinations are busy")
+	errQueueFull        = errors.New("Too many requests are waiting for destination")
+	errQueueTimeout     = errors.New("Request waited for destination for too long")
+)
+
+// backendQueue counts active and waiting requests of backend
+type backendQueue struct {
+	listenOn string
+	source   string
+	active   int
+	pending  int
+}
+
+// queuedRequest is a request, waiting for free destination
+type queuedRequest struct {
+	parent       ctx.Context
+	destinations []config.Destination
+	queue        *backendQueue
+	maxConns     int
+	// Receives destination, when request gets it, or error, which isn't
+	// solved by waiting
+	acquired chan acquiredDestination
+}
+
+type acquiredDestination struct {
+	address        string
+	requestContext ctx.Context
+	release        func()
+	err            error
+}
+
+func getBackendQueue(listenOn string, source string) *backendQueue {
+	destinationsMutex.Lock()
+	defer destinationsMutex.Unlock()
+
+	route := listenOn + " " + source
+	queue, ok := backendQueues[route]
+	if !ok {
+		queue = &backendQueue{listenOn: listenOn, source: source}
+		backendQueues[route] = queue
+	}
+	return queue
+}
+
+// notifySlotReleased gives free destinations to queued requests in order
+// of their arrival. Request, which still has no destination, keeps its
+// place, and later ones may get destinations it can't use. Caller should
+// hold destinationsMutex.
+func notifySlotReleased() {
+	waiting := queuedRequests[:0]
+	for _, request := range queuedRequests {
+		if request.parent.Err() == nil {
+			address, requestContext, release, err := acquireDestinationLocked(request.parent, request.destinations, request.queue, request.maxConns)
+			if err != errDestinationsBusy {
+				request.acquired <- acquiredDestination{address, requestContext, release, err}
+				continue
+			}
+		}
+		waiting = append(waiting, request)
+	}
+	for i := len(waiting); i < len(queuedRequests); i++ {
+		queuedRequests[i] = nil
+	}
+	queuedRequests = waiting
+}
+
+func (q *backendQueue) setPending(pending int) {
+	q.pending = pending
+	queueDepthGauge.With(q.listenOn, q.source).Set(float64(pending))
+}
+
+// acquire chooses one of destinations for request. If every destination
+// is busy, request waits in backend queue until some of them is free.
+func (p *HTTPProxy) acquire(parent ctx.Context, destinations []config.Destination) (string, ctx.Context, func(), error) {
+	destinationsMutex.Lock()
+	defer destinationsMutex.Unlock()
+
+	address, requestContext, release, err := acquireDestinationLocked(parent, destinations, p.queue, p.MaxConns)
+	if err != errDestinationsBusy {
+		return address, requestContext, release, err
+	}
+	if p.queue == nil || p.QueueLimit == 0 {
+		return "", nil, nil, err
+	}
+	if p.queue.pending >= p.QueueLimit {
+		return "", nil, nil, errQueueFull
+	}
+
+	p.queue.setPending(p.queue.pending + 1)
+	defer func() {
+		p.queue.setPending(p.queue.pending - 1)
+	}()
+	request := &queuedRequest{
+		parent:       parent,
+		destinations: destinations,
+		queue:        p.queue,
+		maxConns:     p.MaxConns,
+		acquired:     make(chan acquiredDestination, 1),
+	}
+	queuedRequests = append(queuedRequests, request)
+	timer := time.NewTimer(p.QueueTimeout)
+	defer timer.Stop()
+
+	destinationsMutex.Unlock()
+	select {
+	case result := <-request.acquired:
+		destinationsMutex.Lock()
+		return result.address, result.requestContext, result.release, result.err
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-parent.Done():
+		err = parent.Err()
+	}
+	destinationsMutex.Lock()
+
+	// Destination may be given while request gives up
+	select {
+	case result := <-request.acquired:
+		return result.address, result.requestContext, result.release, result.err
+	default:
+	}
+	for i := range queuedRequests {
+		if queuedRequests[i] == request {
+			queuedRequests = append(queuedRequests[:i], queuedRequests[i+1:]...)
+			break
+		}
+	}
+	return "", nil, nil, err
+}
@@ -0,0 +1,171 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package proxiesv1
+
+import (
+	"container/list"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/metrics"
+)
+
+var (
+	// Limiters by backend route. They are shared by proxies of all colors
+	// with the same route and kept while their configuration is the same,
+	// so neither color switch nor reload resets limits.
+	rateLimiters      = make(map[string][]*rateLimiter)
+	rateLimitersMutex sync.Mutex
+
+	rateLimitedCounter = metrics.NewCounterVec("lbtds_rate_limited_requests_total", "Number of requests, rejected by rate limits.", "listen_on", "source")
+)
+
+// rateLimiter keeps token buckets of single rate limit. Number of buckets
+// is bounded, least recently used ones are evicted.
+type rateLimiter struct {
+	config config.RateLimit
+
+	mutex   sync.Mutex
+	buckets map[string]*list.Element
+	// Buckets from most to least recently used
+	recent *list.List
+}
+
+type tokenBucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+}
+
+// getRateLimiters returns limiters of backend, creating new ones if
+// backend has no limiters yet or their configuration was changed
+func getRateLimiters(backend *config.BackendConfig) []*rateLimiter {
+	rateLimitersMutex.Lock()
+	defer rateLimitersMutex.Unlock()
+
+	route := backend.ListenOn + " " + backend.Source
+	limiters := rateLimiters[route]
+	if len(limiters) == len(backend.RateLimits) {
+		same := true
+		for i := range limiters {
+			if !reflect.DeepEqual(limiters[i].config, backend.RateLimits[i]) {
+				same = false
+			}
+		}
+		if same {
+			return limiters
+		}
+	}
+
+	limiters = make([]*rateLimiter, 0, len(backend.RateLimits))
+	for i := range backend.RateLimits {
+		limiters = append(limiters, newRateLimiter(backend.RateLimits[i]))
+	}
+	rateLimiters[route] = limiters
+	return limiters
+}
+
+func newRateLimiter(limit config.RateLimit) *rateLimiter {
+	return &rateLimiter{
+		config:  limit,
+		buckets: make(map[string]*list.Element),
+		recent:  list.New(),
+	}
+}
+
+// key returns bucket key of request from client with given address
+func (l *rateLimiter) key(r *http.Request, client string) string {
+	key := l.config.EffectiveKey()
+	switch {
+	case key == config.RateLimitKeySource:
+		return ""
+	case strings.HasPrefix(key, config.RateLimitKeyHeaderPrefix):
+		value := r.Header.Get(strings.TrimPrefix(key, config.RateLimitKeyHeaderPrefix))
+		if value != "" {
+			return key + "=" + value
+		}
+	case strings.HasPrefix(key, config.RateLimitKeyQueryPrefix):
+		value := r.URL.Query().Get(strings.TrimPrefix(key, config.RateLimitKeyQueryPrefix))
+		if value != "" {
+			return key + "=" + value
+		}
+	}
+	return config.RateLimitKeyRemoteIP + "=" + client
+}
+
+// allow takes token from bucket of request. If there is no token, it
+// returns time after which one appears.
+func (l *rateLimiter) allow(r *http.Request, client string, now time.Time) (bool, time.Duration) {
+	key := l.key(r, client)
+	burst := float64(l.config.EffectiveBurst())
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var bucket *tokenBucket
+	element, ok := l.buckets[key]
+	if ok {
+		l.recent.MoveToFront(element)
+		bucket = element.Value.(*tokenBucket)
+		bucket.tokens += now.Sub(bucket.updated).Seconds() * l.config.Rate
+		if bucket.tokens > burst {
+			bucket.tokens = burst
+		}
+	} else {
+		bucket = &tokenBucket{key: key, tokens: burst}
+		l.buckets[key] = l.recent.PushFront(bucket)
+		if l.recent.Len() > l.config.EffectiveMaxKeys() {
+			oldest := l.recent.Back()
+			l.recent.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*tokenBucket).key)
+		}
+	}
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.config.Rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// refund returns token, taken by request, which was rejected by other
+// limiter
+func (l *rateLimiter) refund(r *http.Request, client string) {
+	key := l.key(r, client)
+	burst := float64(l.config.EffectiveBurst())
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	element, ok := l.buckets[key]
+	if !ok {
+		return
+	}
+	bucket := element.Value.(*tokenBucket)
+	bucket.tokens++
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+}
+
+// allowRequest takes tokens of request from all limiters. Request, which
+// is rejected by any of them, gets its tokens back from others, so it
+// doesn't drain their buckets.
+func allowRequest(limiters []*rateLimiter, r *http.Request, client string, now time.Time) (bool, time.Duration) {
+	for i, limiter := range limiters {
+		allowed, wait := limiter.allow(r, client, now)
+		if !allowed {
+			for _, taken := range limiters[:i] {
+				taken.refund(r, client)
+			}
+			return false, wait
+		}
+	}
+	return true, 0
+}
@@ -0,0 +1,59 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package proxiesv1
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+const (
+	defaultRequestIDHeader = "X-Request-ID"
+	// Longer IDs are considered garbage and replaced with our own
+	maxRequestIDLength = 128
+)
+
+// requestIDHeader returns configured request ID header name
+func requestIDHeader() string {
+	if c.Config().Proxy.RequestIDHeader != "" {
+		return c.Config().Proxy.RequestIDHeader
+	}
+	return defaultRequestIDHeader
+}
+
+// getRequestID reuses request ID received from client or generates new one
+func getRequestID(r *http.Request) string {
+	requestID := r.Header.Get(requestIDHeader())
+	if isValidRequestID(requestID) {
+		return requestID
+	}
+
+	return generateRequestID()
+}
+
+// isValidRequestID checks that request ID is safe to pass to logs and
+// backends: it must be non-empty printable ASCII of sane length
+func isValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(requestID); i++ {
+		if requestID[i] < 0x21 || requestID[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// generateRequestID returns random UUID v4
+func generateRequestID() string {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
@@ -0,0 +1,210 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package proxiesv1
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+)
+
+var (
+	// Transports to destinations by the way they connect. Transports keep
+	// connections, so they are shared by all proxies.
+	upstreamTransports      = make(map[upstreamTransportOptions]http.RoundTripper)
+	upstreamTransportsMutex sync.Mutex
+
+	// TLS configurations of connections to destinations, guarded by
+	// httpProxiesMutex
+	upstreamTLSConfigs = make(map[config.UpstreamTLS]*loadedUpstreamTLS)
+
+	errNoCACertificates = errors.New("No certificates found in CA file")
+)
+
+// upstreamTransportOptions describe connections to destinations
+type upstreamTransportOptions struct {
+	// Connections start with PROXY protocol header, so they carry address
+	// of single client and aren't reused
+	proxyProtocol bool
+	// Cleartext HTTP/2 with prior knowledge
+	h2c bool
+	// TLS with HTTP/2 negotiation, cleartext connections if nil
+	tls *tls.Config
+}
+
+// loadedUpstreamTLS is a TLS configuration with contents of files, it
+// was loaded from
+type loadedUpstreamTLS struct {
+	files  [][]byte
+	config *tls.Config
+}
+
+// upstreamTransport returns transport for requests to destinations of proxy
+func (p *HTTPProxy) upstreamTransport() http.RoundTripper {
+	return getUpstreamTransport(upstreamTransportOptions{
+		proxyProtocol: p.SendProxyProtocol != "",
+		h2c:           p.UpstreamH2C,
+		tls:           p.upstreamTLS,
+	})
+}
+
+// healthCheckTransport returns transport for gRPC health checks of
+// destinations of proxy, which always use HTTP/2
+func (p *HTTPProxy) healthCheckTransport() http.RoundTripper {
+	return getUpstreamTransport(upstreamTransportOptions{
+		proxyProtocol: p.SendProxyProtocol != "",
+		h2c:           p.upstreamTLS == nil,
+		tls:           p.upstreamTLS,
+	})
+}
+
+// upstreamScheme returns scheme of requests to destinations of proxy
+func (p *HTTPProxy) upstreamScheme() string {
+	if p.upstreamTLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func getUpstreamTransport(options upstreamTransportOptions) http.RoundTripper {
+	if options == (upstreamTransportOptions{}) {
+		return http.DefaultTransport
+	}
+
+	upstreamTransportsMutex.Lock()
+	defer upstreamTransportsMutex.Unlock()
+
+	transport, ok := upstreamTransports[options]
+	if !ok {
+		transport = newUpstreamTransport(options)
+		upstreamTransports[options] = transport
+	}
+	return transport
+}
+
+func newUpstreamTransport(options upstreamTransportOptions) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.proxyProtocol {
+		transport.DialContext = dialWithProxyProtocol(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+		transport.DisableKeepAlives = true
+		// Header should reach destination, not HTTP proxy from environment
+		transport.Proxy = nil
+	}
+	if options.h2c {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if options.tls != nil {
+		transport.TLSClientConfig = options.tls
+	}
+	return transport
+}
+
+// loadUpstreamTLS returns TLS configuration of connections to destinations.
+// Files are read on every reload, but configuration is reused while they
+// don't change, so connections are kept. Caller should hold
+// httpProxiesMutex.
+func loadUpstreamTLS(options config.UpstreamTLS) (*tls.Config, error) {
+	files := make([][]byte, 0, 3)
+	for _, name := range []string{options.CAFile, options.CertFile, options.KeyFile} {
+		var data []byte
+		if name != "" {
+			var err error
+			data, err = ioutil.ReadFile(name)
+			if err != nil {
+				return nil, err
+			}
+		}
+		files = append(files, data)
+	}
+	loaded, ok := upstreamTLSConfigs[options]
+	if ok && reflect.DeepEqual(loaded.files, files) {
+		return loaded.config, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: options.ServerName,
+		MinVersion: options.EffectiveMinVersion(),
+	}
+	if options.CAFile != "" {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(files[0]) {
+			return nil, errNoCACertificates
+		}
+	}
+	if options.CertFile != "" {
+		certificate, err := tls.X509KeyPair(files[1], files[2])
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	upstreamTLSConfigs[options] = &loadedUpstreamTLS{files: files, config: tlsConfig}
+	return tlsConfig, nil
+}
+
+// forgetUpstreamTLS drops TLS configurations, which aren't used anymore,
+// and closes idle connections of their transports. Caller should hold
+// httpProxiesMutex.
+func forgetUpstreamTLS(used map[*tls.Config]bool) {
+	for options, loaded := range upstreamTLSConfigs {
+		if !used[loaded.config] {
+			delete(upstreamTLSConfigs, options)
+		}
+	}
+
+	upstreamTransportsMutex.Lock()
+	defer upstreamTransportsMutex.Unlock()
+	for options, transport := range upstreamTransports {
+		if options.tls != nil && !used[options.tls] {
+			transport.(*http.Transport).CloseIdleConnections()
+			delete(upstreamTransports, options)
+		}
+	}
+}
+
+// describeUpstreamError explains why request to destination failed
+func describeUpstreamError(err error) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalidCertificate x509.CertificateInvalidError
+	var verification *tls.CertificateVerificationError
+	var recordHeader tls.RecordHeaderError
+	var localAlert tls.AlertError
+	var opError *net.OpError
+	var netError net.Error
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return "certificate of destination is signed by unknown authority"
+	case errors.As(err, &hostname):
+		return "certificate of destination isn't valid for " + hostname.Host
+	case errors.As(err, &invalidCertificate):
+		return "certificate of destination is invalid: " + invalidCertificate.Error()
+	case errors.As(err, &verification):
+		return "certificate of destination can't be verified: " + verification.Err.Error()
+	case errors.As(err, &recordHeader), errors.Is(err, http.ErrSchemeMismatch):
+		return "destination doesn't speak TLS"
+	case errors.As(err, &opError) && opError.Op == "remote error":
+		// Alert of destination, e.g. when client certificate is required
+		return "destination rejected TLS handshake: " + strings.TrimPrefix(opError.Err.Error(), "tls: ")
+	case errors.As(err, &localAlert):
+		return "TLS handshake with destination failed: " + strings.TrimPrefix(localAlert.Error(), "tls: ")
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.As(err, &netError) && netError.Timeout():
+		return "connection timed out"
+	default:
+		return "connection failed"
+	}
+}
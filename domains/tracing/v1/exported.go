@@ -0,0 +1,31 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package tracingv1
+
+import (
+	"github.com/rs/zerolog"
+	"lab.wtfteam.pro/wtfteam/lbtds/context"
+)
+
+var (
+	c *context.Context
+
+	// Package-wide logger, with "domain" parameter defined
+	domainLog zerolog.Logger
+)
+
+// Initialize initializes package
+func Initialize(cc *context.Context) {
+	c = cc
+	domainLog = c.Logger.With().Str("domain", "tracing").Int("version", 1).Logger()
+
+	initExporter()
+
+	domainLog.Info().Msg("Domain «tracing» initialized")
+}
+
+// Shutdown sends all pending spans to collector and stops exporter
+func Shutdown() {
+	shutdownExporter()
+}
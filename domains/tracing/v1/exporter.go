@@ -0,0 +1,278 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package tracingv1
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"lab.wtfteam.pro/wtfteam/lbtds/context"
+)
+
+var (
+	exporterModuleLog zerolog.Logger
+
+	// Spans waiting for export. If it is full, new spans will be dropped:
+	// we shouldn't slow down proxying because of slow collector.
+	spansQueue chan *Span
+	// Closing this channel stops exporter after final flush
+	exporterStop chan bool
+	// exporterStopped fires when exporter goroutine exits
+	exporterStopped chan bool
+	exporterActive  bool
+	exporterMutex   sync.RWMutex
+
+	exporterClient *http.Client
+	endpoint       string
+	serviceName    string
+	flushInterval  time.Duration
+	batchSize      int
+)
+
+func initExporter() {
+	exporterModuleLog = domainLog.With().Str("module", "exporter").Logger()
+
+	// Initialize can be called more than once (tests do that), so make sure
+	// previous exporter goroutine is gone
+	shutdownExporter()
+
+	if !c.Config().Tracing.Enabled {
+		exporterModuleLog.Info().Msg("Tracing disabled")
+		return
+	}
+	exporterModuleLog.Info().Msgf("Initializing OTLP/HTTP exporter to %s...", c.Config().Tracing.Endpoint)
+
+	endpoint = c.Config().Tracing.Endpoint
+	serviceName = c.Config().Tracing.ServiceName
+	if serviceName == "" {
+		serviceName = "lbtds"
+	}
+	flushInterval = c.Config().Tracing.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = 5 * time.Second
+	}
+	batchSize = c.Config().Tracing.BatchSize
+	if batchSize <= 0 {
+		batchSize = 512
+	}
+
+	exporterClient = &http.Client{Timeout: 5 * time.Second}
+	spansQueue = make(chan *Span, batchSize*4)
+	exporterStop = make(chan bool)
+	exporterStopped = make(chan bool)
+
+	exporterMutex.Lock()
+	exporterActive = true
+	exporterMutex.Unlock()
+
+	go runExporter()
+}
+
+func exporterEnabled() bool {
+	exporterMutex.RLock()
+	defer exporterMutex.RUnlock()
+	return exporterActive
+}
+
+func queueSpan(span *Span) {
+	exporterMutex.RLock()
+	defer exporterMutex.RUnlock()
+	if !exporterActive {
+		return
+	}
+
+	select {
+	case spansQueue <- span:
+	default:
+		exporterModuleLog.Warn().Msg("Spans queue is full, dropping span")
+	}
+}
+
+func shutdownExporter() {
+	exporterMutex.Lock()
+	if !exporterActive {
+		exporterMutex.Unlock()
+		return
+	}
+	exporterActive = false
+	exporterMutex.Unlock()
+
+	close(exporterStop)
+	<-exporterStopped
+}
+
+func runExporter() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, batchSize)
+	for {
+		select {
+		case span := <-spansQueue:
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				exportSpans(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			exportSpans(batch)
+			batch = batch[:0]
+		case <-exporterStop:
+			// No one can queue spans anymore, so we can safely drain the queue
+			for len(spansQueue) > 0 {
+				batch = append(batch, <-spansQueue)
+			}
+			exportSpans(batch)
+			close(exporterStopped)
+			return
+		}
+	}
+}
+
+// exportSpans sends spans to collector using OTLP/HTTP JSON encoding
+func exportSpans(spans []*Span) {
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(newOTLPRequest(spans))
+	if err != nil {
+		exporterModuleLog.Error().Err(err).Msg("Failed to encode spans")
+		return
+	}
+
+	rsp, err := exporterClient.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		exporterModuleLog.Error().Err(err).Int("spans", len(spans)).Msg("Failed to send spans to collector")
+		return
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode/100 != 2 {
+		exporterModuleLog.Error().Int("code", rsp.StatusCode).Int("spans", len(spans)).Msg("Collector refused spans")
+		return
+	}
+	exporterModuleLog.Debug().Int("spans", len(spans)).Msg("Spans exported")
+}
+
+// OTLP JSON structures. See
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/docs/specification.md#json-protobuf-encoding
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func newOTLPRequest(spans []*Span) *otlpRequest {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		otlpSpans = append(otlpSpans, newOTLPSpan(span))
+	}
+
+	return &otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{newOTLPKeyValue("service.name", serviceName)},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "lbtds", Version: context.VERSION},
+				Spans: otlpSpans,
+			}},
+		}},
+	}
+}
+
+func newOTLPSpan(span *Span) otlpSpan {
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+
+	result := otlpSpan{
+		TraceID:           hex.EncodeToString(span.Context.TraceID[:]),
+		SpanID:            hex.EncodeToString(span.Context.SpanID[:]),
+		TraceState:        span.Context.TraceState,
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+	}
+	if span.ParentSpanID != [8]byte{} {
+		result.ParentSpanID = hex.EncodeToString(span.ParentSpanID[:])
+	}
+	for _, attr := range span.attributes {
+		result.Attributes = append(result.Attributes, newOTLPKeyValue(attr.key, attr.value))
+	}
+	if span.statusError {
+		// STATUS_CODE_ERROR
+		result.Status = otlpStatus{Code: 2, Message: span.statusMessage}
+	}
+
+	return result
+}
+
+func newOTLPKeyValue(key string, value interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case string:
+		kv.Value = map[string]interface{}{"stringValue": v}
+	case bool:
+		kv.Value = map[string]interface{}{"boolValue": v}
+	case int:
+		kv.Value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		kv.Value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		kv.Value = map[string]interface{}{"doubleValue": v}
+	default:
+		kv.Value = map[string]interface{}{"stringValue": ""}
+	}
+
+	return kv
+}
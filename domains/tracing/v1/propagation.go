@@ -0,0 +1,137 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package tracingv1
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// TraceParentHeader is a W3C Trace Context header with trace and parent
+	// span IDs
+	TraceParentHeader = "Traceparent"
+	// TraceStateHeader is a W3C Trace Context header with vendor-specific
+	// trace data. We're passing it as is.
+	TraceStateHeader = "Tracestate"
+
+	flagSampled = 0x01
+)
+
+// SpanContext represents W3C trace context of a span
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Flags      byte
+	TraceState string
+}
+
+// IsValid returns true if both trace and span IDs are non-zero
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// IsSampled returns true if span should be recorded
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&flagSampled != 0
+}
+
+// TraceParent returns traceparent header value for this span context
+func (sc SpanContext) TraceParent() string {
+	return fmt.Sprintf("00-%x-%x-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// Extract reads trace context from request headers. Second returned value
+// is false if there is no valid trace context in headers.
+func Extract(h http.Header) (SpanContext, bool) {
+	sc, ok := parseTraceParent(h.Get(TraceParentHeader))
+	if !ok {
+		return SpanContext{}, false
+	}
+	// Multiple tracestate headers should be combined as one list
+	sc.TraceState = strings.Join(h[TraceStateHeader], ",")
+
+	return sc, true
+}
+
+// Inject writes trace context to headers, replacing existing ones
+func Inject(sc SpanContext, h http.Header) {
+	h.Set(TraceParentHeader, sc.TraceParent())
+	if sc.TraceState != "" {
+		h.Set(TraceStateHeader, sc.TraceState)
+	} else {
+		h.Del(TraceStateHeader)
+	}
+}
+
+// parseTraceParent parses traceparent header value as described in
+// https://www.w3.org/TR/trace-context/#traceparent-header
+func parseTraceParent(value string) (SpanContext, bool) {
+	var sc SpanContext
+
+	value = strings.TrimSpace(value)
+	if len(value) < 55 {
+		return sc, false
+	}
+	version, err := decodeLowerHex(value[0:2])
+	if err != nil || version[0] == 0xff {
+		return sc, false
+	}
+	// Version 00 has fixed length, future versions may append fields
+	if version[0] == 0 && len(value) != 55 {
+		return sc, false
+	}
+	if len(value) > 55 && value[55] != '-' {
+		return sc, false
+	}
+	if value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return sc, false
+	}
+
+	traceID, err := decodeLowerHex(value[3:35])
+	if err != nil {
+		return sc, false
+	}
+	spanID, err := decodeLowerHex(value[36:52])
+	if err != nil {
+		return sc, false
+	}
+	flags, err := decodeLowerHex(value[53:55])
+	if err != nil {
+		return sc, false
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+
+	return sc, sc.IsValid()
+}
+
+// decodeLowerHex decodes hex string, refusing uppercase letters as spec says
+func decodeLowerHex(s string) ([]byte, error) {
+	if strings.ToLower(s) != s {
+		return nil, fmt.Errorf("uppercase hex in %s", s)
+	}
+	return hex.DecodeString(s)
+}
+
+func newTraceID() [16]byte {
+	var id [16]byte
+	for id == [16]byte{} {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() [8]byte {
+	var id [8]byte
+	for id == [8]byte{} {
+		_, _ = rand.Read(id[:])
+	}
+	return id
+}
@@ -0,0 +1,144 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package tracingv1
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SpanKind represents OTLP span kind
+type SpanKind int
+
+// Span kinds we're using. Values are the same as in OTLP protocol.
+const (
+	SpanKindServer SpanKind = 2
+	SpanKindClient SpanKind = 3
+)
+
+// Span represents single timed operation within trace.
+// All methods are safe to call on nil Span: it is returned when tracing is
+// disabled.
+type Span struct {
+	Name         string
+	Kind         SpanKind
+	Context      SpanContext
+	ParentSpanID [8]byte
+	StartTime    time.Time
+	EndTime      time.Time
+
+	attributes    []attribute
+	statusError   bool
+	statusMessage string
+	ended         bool
+	mutex         sync.Mutex
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// StartServerSpan starts span for incoming request. If request headers
+// contain valid trace context, span will continue that trace.
+func StartServerSpan(name string, h http.Header) *Span {
+	if !exporterEnabled() {
+		return nil
+	}
+
+	span := &Span{
+		Name:      name,
+		Kind:      SpanKindServer,
+		StartTime: time.Now(),
+	}
+
+	parent, ok := Extract(h)
+	if ok {
+		span.Context = parent
+		span.ParentSpanID = parent.SpanID
+	} else {
+		span.Context.TraceID = newTraceID()
+		span.Context.Flags = flagSampled
+	}
+	span.Context.SpanID = newSpanID()
+
+	return span
+}
+
+// StartClientSpan starts child span for outgoing request
+func (s *Span) StartClientSpan(name string) *Span {
+	if s == nil {
+		return nil
+	}
+
+	span := &Span{
+		Name:         name,
+		Kind:         SpanKindClient,
+		Context:      s.Context,
+		ParentSpanID: s.Context.SpanID,
+		StartTime:    time.Now(),
+	}
+	span.Context.SpanID = newSpanID()
+
+	return span
+}
+
+// SetAttribute sets span attribute. Supported value types are string, bool,
+// int, int64 and float64.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := range s.attributes {
+		if s.attributes[i].key == key {
+			s.attributes[i].value = value
+			return
+		}
+	}
+	s.attributes = append(s.attributes, attribute{key: key, value: value})
+}
+
+// SetError marks span as failed
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.statusError = true
+	s.statusMessage = message
+}
+
+// Inject writes span's trace context into headers of outgoing request
+func (s *Span) Inject(h http.Header) {
+	if s == nil {
+		return
+	}
+	Inject(s.Context, h)
+}
+
+// End finishes the span and queues it for export. Calling End more than
+// once has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mutex.Unlock()
+
+	if s.Context.IsSampled() {
+		queueSpan(s)
+	}
+}
@@ -0,0 +1,169 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package tracingv1
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/testshelpers"
+)
+
+func createStubCollector() (*httptest.Server, chan []byte) {
+	requests := make(chan []byte, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- body
+		w.WriteHeader(200)
+	}))
+
+	return srv, requests
+}
+
+/* exported.go */
+
+func TestInitialize(t *testing.T) {
+	testshelpers.InitializeConfiguration("../../../", "lbtds-valid")
+	c := testshelpers.InitializeContext()
+	Initialize(c)
+
+	// Tracing isn't enabled in this configuration
+	require.False(t, exporterEnabled())
+	require.Nil(t, StartServerSpan("GET web.host", http.Header{}))
+
+	testshelpers.FlushConfiguration("lbtds-valid")
+}
+
+/* propagation.go */
+
+func TestParseTraceParent(t *testing.T) {
+	sc, ok := parseTraceParent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	require.True(t, ok)
+	require.True(t, sc.IsSampled())
+	require.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", sc.TraceParent())
+
+	sc, ok = parseTraceParent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00")
+	require.True(t, ok)
+	require.False(t, sc.IsSampled())
+
+	// Future versions may contain more fields
+	_, ok = parseTraceParent("cc-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-what-the-future-will-be-like")
+	require.True(t, ok)
+
+	invalidValues := []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-0AF7651916CD43DD8448EB211C80319C-B7AD6B7169203331-01",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-00",
+		"00_0af7651916cd43dd8448eb211c80319c_b7ad6b7169203331_01",
+	}
+	for _, value := range invalidValues {
+		_, ok = parseTraceParent(value)
+		require.False(t, ok, value)
+	}
+}
+
+func TestExtractAndInject(t *testing.T) {
+	incoming := http.Header{}
+	incoming.Set(TraceParentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	incoming.Add(TraceStateHeader, "congo=t61rcWkgMzE")
+	incoming.Add(TraceStateHeader, "rojo=00f067aa0ba902b7")
+
+	sc, ok := Extract(incoming)
+	require.True(t, ok)
+	require.Equal(t, "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7", sc.TraceState)
+
+	outgoing := http.Header{}
+	Inject(sc, outgoing)
+	require.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", outgoing.Get(TraceParentHeader))
+	require.Equal(t, "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7", outgoing.Get(TraceStateHeader))
+}
+
+/* spans.go and exporter.go */
+
+func TestSpansExport(t *testing.T) {
+	collector, requests := createStubCollector()
+	defer collector.Close()
+
+	testshelpers.InitializeConfiguration("../../../", "lbtds-tracing")
+	c := testshelpers.InitializeContext()
+	c.Config().Tracing.Endpoint = collector.URL + "/v1/traces"
+	Initialize(c)
+
+	require.True(t, exporterEnabled())
+
+	incoming := http.Header{}
+	incoming.Set(TraceParentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+
+	span := StartServerSpan("GET web.host", incoming)
+	require.NotNil(t, span)
+	require.Equal(t, "0af7651916cd43dd8448eb211c80319c", hexTraceID(span))
+	require.NotEqual(t, span.ParentSpanID, span.Context.SpanID)
+
+	clientSpan := span.StartClientSpan("GET 127.0.0.1:8123")
+	clientSpan.SetAttribute("lbtds.color", "green")
+	clientSpan.SetAttribute("lbtds.retry_count", 0)
+	clientSpan.SetError("connection refused")
+	require.Equal(t, span.Context.SpanID, clientSpan.ParentSpanID)
+	clientSpan.End()
+	span.End()
+	// Second End shouldn't produce duplicate span
+	span.End()
+
+	Shutdown()
+	require.False(t, exporterEnabled())
+
+	var exported otlpRequest
+	err := json.Unmarshal(<-requests, &exported)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(exported.ResourceSpans))
+	require.Equal(t, "lbtds-test", exported.ResourceSpans[0].Resource.Attributes[0].Value["stringValue"])
+	spans := exported.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Equal(t, 2, len(spans))
+	require.Equal(t, "GET 127.0.0.1:8123", spans[0].Name)
+	require.Equal(t, SpanKindClient, spans[0].Kind)
+	require.Equal(t, 2, spans[0].Status.Code)
+	require.Equal(t, "0af7651916cd43dd8448eb211c80319c", spans[1].TraceID)
+	require.Equal(t, "b7ad6b7169203331", spans[1].ParentSpanID)
+	require.Equal(t, SpanKindServer, spans[1].Kind)
+
+	testshelpers.FlushConfiguration("lbtds-tracing")
+}
+
+func TestUnsampledSpansAreNotExported(t *testing.T) {
+	collector, requests := createStubCollector()
+	defer collector.Close()
+
+	testshelpers.InitializeConfiguration("../../../", "lbtds-tracing")
+	c := testshelpers.InitializeContext()
+	c.Config().Tracing.Endpoint = collector.URL + "/v1/traces"
+	Initialize(c)
+
+	incoming := http.Header{}
+	incoming.Set(TraceParentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00")
+
+	span := StartServerSpan("GET web.host", incoming)
+	require.NotNil(t, span)
+	// Sampling decision should be propagated further
+	outgoing := http.Header{}
+	span.StartClientSpan("GET 127.0.0.1:8123").Inject(outgoing)
+	require.Contains(t, outgoing.Get(TraceParentHeader), "-00")
+	span.End()
+
+	Shutdown()
+	require.Equal(t, 0, len(requests))
+
+	testshelpers.FlushConfiguration("lbtds-tracing")
+}
+
+func hexTraceID(span *Span) string {
+	return span.Context.TraceParent()[3:35]
+}
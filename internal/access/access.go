@@ -0,0 +1,117 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package access
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+)
+
+// Networks is a list of IPv4 and IPv6 networks
+type Networks []*net.IPNet
+
+// Rules allow or deny requests by client address
+type Rules struct {
+	allow Networks
+	deny  Networks
+}
+
+// ParseNetworks parses networks in CIDR notation and single addresses
+func ParseNetworks(values []string) (Networks, error) {
+	networks := make(Networks, 0, len(values))
+	for _, value := range values {
+		network, err := config.ParseNetwork(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Contains checks if address belongs to one of networks
+func (n Networks) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewRules parses access rules from configuration. Rules without allow
+// and deny networks are nil, which allows everything.
+func NewRules(rules config.AccessRules) (*Rules, error) {
+	if len(rules.Allow) == 0 && len(rules.Deny) == 0 {
+		return nil, nil
+	}
+	allow, err := ParseNetworks(rules.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := ParseNetworks(rules.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &Rules{allow: allow, deny: deny}, nil
+}
+
+// Allowed checks if client with given address may send requests. Unknown
+// address is allowed only if there are no allow networks.
+func (r *Rules) Allowed(ip net.IP) bool {
+	if r == nil {
+		return true
+	}
+	if r.deny.Contains(ip) {
+		return false
+	}
+	return len(r.allow) == 0 || r.allow.Contains(ip)
+}
+
+// ClientIP returns address of client, who sent request. X-Forwarded-For is
+// used only when request came from trusted proxy: its addresses are
+// checked from right to left, and first one, which isn't trusted, is
+// client's. It returns nil if address is unknown.
+func ClientIP(r *http.Request, trusted Networks) net.IP {
+	ip := parseIP(r.RemoteAddr)
+	if ip == nil || !trusted.Contains(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// Anything to the left of garbage could be forged
+			return ip
+		}
+		ip = hop
+		if !trusted.Contains(ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// parseIP parses address with or without port
+func parseIP(address string) net.IP {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
@@ -0,0 +1,90 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package access
+
+import (
+	"crypto/x509"
+	"regexp"
+	"strings"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+)
+
+// CertificateRules allow clients by their certificates
+type CertificateRules struct {
+	rules []certificateRule
+}
+
+type certificateRule struct {
+	subject *regexp.Regexp
+	san     *regexp.Regexp
+}
+
+// NewCertificateRules compiles certificate rules from configuration. No
+// rules are nil, which allows every certificate.
+func NewCertificateRules(rules []config.ClientCertificateRule) *CertificateRules {
+	if len(rules) == 0 {
+		return nil
+	}
+	result := &CertificateRules{rules: make([]certificateRule, 0, len(rules))}
+	for _, rule := range rules {
+		result.rules = append(result.rules, certificateRule{
+			subject: compilePattern(rule.Subject),
+			san:     compilePattern(rule.SAN),
+		})
+	}
+	return result
+}
+
+// Allowed checks if certificate matches any of rules
+func (c *CertificateRules) Allowed(certificate *x509.Certificate) bool {
+	if c == nil {
+		return true
+	}
+	for _, rule := range c.rules {
+		if rule.subject != nil && !rule.subject.MatchString(certificate.Subject.String()) {
+			continue
+		}
+		if rule.san != nil && !matchesAny(rule.san, SubjectAlternativeNames(certificate)) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// SubjectAlternativeNames returns DNS names, email addresses, IP addresses
+// and URIs of certificate
+func SubjectAlternativeNames(certificate *x509.Certificate) []string {
+	names := append([]string(nil), certificate.DNSNames...)
+	names = append(names, certificate.EmailAddresses...)
+	for _, ip := range certificate.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range certificate.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// compilePattern turns pattern with "*" and "?" into regular expression.
+// Empty pattern is nil, which isn't checked.
+func compilePattern(pattern string) *regexp.Regexp {
+	if pattern == "" {
+		return nil
+	}
+	expression := regexp.QuoteMeta(pattern)
+	expression = strings.Replace(expression, `\*`, ".*", -1)
+	expression = strings.Replace(expression, `\?`, ".", -1)
+	return regexp.MustCompile("^" + expression + "$")
+}
+
+func matchesAny(pattern *regexp.Regexp, values []string) bool {
+	for _, value := range values {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
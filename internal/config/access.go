@@ -0,0 +1,55 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AccessRules allow or deny requests by client address. Networks are
+// given in CIDR notation, single addresses are allowed too. Deny rules
+// win, and if there are allow rules, client should match one of them.
+type AccessRules struct {
+	Allow []string `yaml:"allow,omitempty" json:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty" json:"deny,omitempty"`
+}
+
+// ParseNetwork parses network in CIDR notation or single IPv4 or IPv6
+// address
+func ParseNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", value)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", value)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func (a *AccessRules) validate(path string, problems *Problems) {
+	checkNetworks(path+".allow", a.Allow, problems)
+	checkNetworks(path+".deny", a.Deny, problems)
+}
+
+func checkNetworks(path string, networks []string, problems *Problems) {
+	for i, network := range networks {
+		_, err := ParseNetwork(network)
+		if err != nil {
+			problems.addError(fmt.Sprintf("%s[%d]", path, i), err.Error())
+		}
+	}
+}
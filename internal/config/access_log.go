@@ -0,0 +1,20 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+// AccessLog represents proxied requests log configuration
+type AccessLog struct {
+	// Format can be "combined" (Apache combined log format, default), "json"
+	// or "template"
+	Format string `yaml:"format,omitempty"`
+	// Go text/template for "template" format, e.g.
+	// "{{.RemoteIP}} {{.Method}} {{.URI}} {{.Status}}"
+	Template string `yaml:"template,omitempty"`
+	// Where to write access log. Defaults to stdout.
+	Output Output `yaml:"output,omitempty"`
+	// Share of logged requests (from 0 to 1) per status code ("404") or
+	// status class ("2xx"). Exact code takes precedence over class. Requests
+	// with statuses not listed here are always logged.
+	Sampling map[string]float64 `yaml:"sampling,omitempty"`
+}
@@ -8,4 +8,6 @@ package config
 type API struct {
 	Address string `yaml:"address"`
 	Port    string `yaml:"port"`
+	// Clients, which may use API. Peers should be allowed too.
+	Access AccessRules `yaml:"access,omitempty"`
 }
@@ -4,20 +4,264 @@
 
 package config
 
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	defaultQueueTimeout = 10 * time.Second
+	defaultRetryAfter   = time.Second
+	// Response to requests, which got no destination, doesn't tell why
+	defaultUnavailableBody        = "Service unavailable\n"
+	defaultUnavailableContentType = "text/plain; charset=utf-8"
+	// Failed destination gets no requests for this time, unless there is
+	// nothing else to choose
+	defaultPassiveDownTime = 10 * time.Second
+)
+
 // Color represents configuration for single color
 type Color struct {
-	Name     string          `yaml:"name"`
-	Backends []BackendConfig `yaml:"backends"`
+	Name     string          `yaml:"name" json:"name"`
+	Backends []BackendConfig `yaml:"backends" json:"backends"`
 }
 
 // BackendConfig represents configuration for single backend endpoint
 type BackendConfig struct {
 	// Type can be HTTP or TCP.
-	Type string `yaml:"type"`
+	Type string `yaml:"type" json:"type"`
 	// IP and port this proxy will listen on.
-	ListenOn string `yaml:"listen_on"`
+	ListenOn string `yaml:"listen_on" json:"listen_on"`
 	// For HTTP source is a HTTP hostname for which request was received.
-	Source string `yaml:"source"`
+	Source string `yaml:"source" json:"source"`
 	// Backend servers.
-	Destinations []string `yaml:"destinations"`
+	Destinations []Destination `yaml:"destinations" json:"destinations"`
+	// Maximum number of simultaneous requests to all destinations,
+	// unlimited by default
+	MaxConns int `yaml:"max_conns,omitempty" json:"max_conns,omitempty"`
+	// Maximum number of requests, waiting for free destination when all of
+	// them are busy. Defaults to sum of max_pending of destinations.
+	// Requests aren't queued if it's zero.
+	MaxPending int `yaml:"max_pending,omitempty" json:"max_pending,omitempty"`
+	// How long request may wait in queue. Defaults to 10s.
+	QueueTimeout time.Duration `yaml:"queue_timeout,omitempty" json:"-"`
+	// Retry-After of 503 response to requests, which can't be queued or
+	// waited for too long. Defaults to 1s.
+	RetryAfter time.Duration `yaml:"retry_after,omitempty" json:"-"`
+	// Body of that 503 response
+	Unavailable UnavailableResponse `yaml:"unavailable,omitempty" json:"unavailable,omitempty"`
+	// How long destination, which failed to respond, gets no requests,
+	// unless there is nothing else to choose. Defaults to 10s, zero turns
+	// passive health checks off.
+	PassiveDownTime *time.Duration `yaml:"passive_down_time,omitempty" json:"-"`
+	// Request rate limits, request should pass all of them
+	RateLimits []RateLimit `yaml:"rate_limits,omitempty" json:"rate_limits,omitempty"`
+	// Clients, which may send requests to backend
+	Access AccessRules `yaml:"access,omitempty" json:"access,omitempty"`
+	// Changes of request and response headers
+	Headers HeaderRules `yaml:"headers,omitempty" json:"headers,omitempty"`
+	// Listener expects PROXY protocol header (v1 or v2) in every
+	// connection. All backends on listener should agree on it.
+	AcceptProxyProtocol bool `yaml:"accept_proxy_protocol,omitempty" json:"accept_proxy_protocol,omitempty"`
+	// PROXY protocol version, "v1" or "v2", sent to destinations. Such
+	// connections aren't reused. Not sent by default.
+	SendProxyProtocol string `yaml:"send_proxy_protocol,omitempty" json:"send_proxy_protocol,omitempty"`
+	// Listener serves HTTPS with HTTP/2 and HTTP/1.1. All backends on
+	// listener should either have TLS configuration or not.
+	TLS *FrontendTLS `yaml:"tls,omitempty" json:"tls,omitempty"`
+	// Listener accepts cleartext HTTP/2 (h2c) with prior knowledge in
+	// addition to HTTP/1.1
+	H2C bool `yaml:"h2c,omitempty" json:"h2c,omitempty"`
+	// Requests are sent to destinations with cleartext HTTP/2 (h2c)
+	UpstreamH2C bool `yaml:"upstream_h2c,omitempty" json:"upstream_h2c,omitempty"`
+	// Requests are sent to destinations with TLS, HTTP/2 is negotiated
+	UpstreamTLS *UpstreamTLS `yaml:"upstream_tls,omitempty" json:"upstream_tls,omitempty"`
+	// gRPC health checks, routing and retries
+	GRPC *GRPC `yaml:"grpc,omitempty" json:"grpc,omitempty"`
+}
+
+// UnavailableResponse is a body of 503 response to requests, which got no
+// destination. gRPC calls get UNAVAILABLE status instead.
+type UnavailableResponse struct {
+	// Defaults to "Service unavailable"
+	Body string `yaml:"body,omitempty" json:"body,omitempty"`
+	// Defaults to "text/plain; charset=utf-8"
+	ContentType string `yaml:"content_type,omitempty" json:"content_type,omitempty"`
+}
+
+// plainBackendConfig has no custom marshaling
+type plainBackendConfig BackendConfig
+
+// backendConfigJSON is a JSON form of backend: durations are written as
+// strings, like in configuration file
+type backendConfigJSON struct {
+	plainBackendConfig
+	QueueTimeout string `json:"queue_timeout,omitempty"`
+	RetryAfter   string `json:"retry_after,omitempty"`
+	// Empty if not configured, unlike "0s"
+	PassiveDownTime string `json:"passive_down_time,omitempty"`
+}
+
+// MarshalJSON writes backend with durations as strings
+func (b BackendConfig) MarshalJSON() ([]byte, error) {
+	result := backendConfigJSON{plainBackendConfig: plainBackendConfig(b)}
+	if b.QueueTimeout != 0 {
+		result.QueueTimeout = b.QueueTimeout.String()
+	}
+	if b.RetryAfter != 0 {
+		result.RetryAfter = b.RetryAfter.String()
+	}
+	if b.PassiveDownTime != nil {
+		result.PassiveDownTime = b.PassiveDownTime.String()
+	}
+	return json.Marshal(&result)
+}
+
+// UnmarshalJSON reads backend with durations as strings
+func (b *BackendConfig) UnmarshalJSON(data []byte) error {
+	var parsed backendConfigJSON
+	err := unmarshalJSONStrictly(data, &parsed)
+	if err != nil {
+		return err
+	}
+	*b = BackendConfig(parsed.plainBackendConfig)
+	if parsed.QueueTimeout != "" {
+		b.QueueTimeout, err = time.ParseDuration(parsed.QueueTimeout)
+		if err != nil {
+			return err
+		}
+	}
+	if parsed.RetryAfter != "" {
+		b.RetryAfter, err = time.ParseDuration(parsed.RetryAfter)
+		if err != nil {
+			return err
+		}
+	}
+	if parsed.PassiveDownTime != "" {
+		var downTime time.Duration
+		downTime, err = time.ParseDuration(parsed.PassiveDownTime)
+		b.PassiveDownTime = &downTime
+	}
+	return err
+}
+
+// unmarshalJSONStrictly decodes JSON and refuses unknown keys, like
+// configuration file parser does. Decoder options don't reach custom
+// unmarshalers, so they should use it themselves.
+func unmarshalJSONStrictly(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// QueueLimit returns maximum number of requests, waiting for free
+// destination
+func (b *BackendConfig) QueueLimit() int {
+	if b.MaxPending > 0 {
+		return b.MaxPending
+	}
+	limit := 0
+	for i := range b.Destinations {
+		limit += b.Destinations[i].MaxPending
+	}
+	return limit
+}
+
+// EffectiveQueueTimeout returns configured queue timeout or default one
+func (b *BackendConfig) EffectiveQueueTimeout() time.Duration {
+	if b.QueueTimeout == 0 {
+		return defaultQueueTimeout
+	}
+	return b.QueueTimeout
+}
+
+// EffectiveRetryAfter returns configured Retry-After or default one
+func (b *BackendConfig) EffectiveRetryAfter() time.Duration {
+	if b.RetryAfter == 0 {
+		return defaultRetryAfter
+	}
+	return b.RetryAfter
+}
+
+// EffectiveBody returns configured body or default one
+func (u *UnavailableResponse) EffectiveBody() string {
+	if u.Body == "" {
+		return defaultUnavailableBody
+	}
+	return u.Body
+}
+
+// EffectiveContentType returns configured content type or default one
+func (u *UnavailableResponse) EffectiveContentType() string {
+	if u.ContentType == "" {
+		return defaultUnavailableContentType
+	}
+	return u.ContentType
+}
+
+// EffectivePassiveDownTime returns configured passive down time or default
+// one
+func (b *BackendConfig) EffectivePassiveDownTime() time.Duration {
+	if b.PassiveDownTime == nil {
+		return defaultPassiveDownTime
+	}
+	return *b.PassiveDownTime
+}
+
+// route identifies backend among others: listener can serve several
+// hostnames, which are case insensitive
+func (b *BackendConfig) route() string {
+	return b.ListenOn + " " + strings.ToLower(b.Source)
+}
+
+// Copy returns deep copy of color, which can be modified without touching
+// running configuration
+func (c *Color) Copy() Color {
+	return deepCopy(reflect.ValueOf(*c)).Interface().(Color)
+}
+
+// deepCopy copies value with everything its pointers, slices and maps
+// refer to, so backend options of any depth aren't shared
+func deepCopy(value reflect.Value) reflect.Value {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if value.IsNil() {
+			return value
+		}
+		result := reflect.New(value.Type().Elem())
+		result.Elem().Set(deepCopy(value.Elem()))
+		return result
+	case reflect.Slice:
+		if value.IsNil() {
+			return value
+		}
+		result := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+		for i := 0; i < value.Len(); i++ {
+			result.Index(i).Set(deepCopy(value.Index(i)))
+		}
+		return result
+	case reflect.Map:
+		if value.IsNil() {
+			return value
+		}
+		result := reflect.MakeMapWithSize(value.Type(), value.Len())
+		for _, key := range value.MapKeys() {
+			result.SetMapIndex(key, deepCopy(value.MapIndex(key)))
+		}
+		return result
+	case reflect.Struct:
+		result := reflect.New(value.Type()).Elem()
+		result.Set(value)
+		for i := 0; i < value.NumField(); i++ {
+			if result.Field(i).CanSet() {
+				result.Field(i).Set(deepCopy(value.Field(i)))
+			}
+		}
+		return result
+	default:
+		return value
+	}
 }
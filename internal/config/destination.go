@@ -0,0 +1,109 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Destination is a single backend server. In configuration it's either
+// plain address or mapping with address and balancing options.
+type Destination struct {
+	Address string `yaml:"address"`
+	// Share of requests relative to other destinations of backend.
+	// Defaults to 1.
+	Weight int `yaml:"weight,omitempty"`
+	// Backup destination gets requests only when none of primary ones is
+	// available
+	Backup bool `yaml:"backup,omitempty"`
+	// Maximum number of simultaneous requests, unlimited by default
+	MaxConns int `yaml:"max_conns,omitempty"`
+	// Number of places in backend queue, which destination adds, unless
+	// backend has its own max_pending
+	MaxPending int `yaml:"max_pending,omitempty"`
+	// Time, during which weight grows from zero to configured one after
+	// destination becomes available: when color is switched to it, when
+	// it's enabled or when it recovers from failure
+	SlowStart time.Duration `yaml:"slow_start,omitempty"`
+}
+
+// destinationJSON is a JSON form of destination: durations are written as
+// strings, like in configuration file
+type destinationJSON struct {
+	Address    string `json:"address"`
+	Weight     int    `json:"weight,omitempty"`
+	Backup     bool   `json:"backup,omitempty"`
+	MaxConns   int    `json:"max_conns,omitempty"`
+	MaxPending int    `json:"max_pending,omitempty"`
+	SlowStart  string `json:"slow_start,omitempty"`
+}
+
+// plainDestination has no custom marshaling, so it can be used for
+// mapping form
+type plainDestination Destination
+
+// UnmarshalYAML accepts both plain address and mapping
+func (d *Destination) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var address string
+	if unmarshal(&address) == nil {
+		*d = Destination{Address: address}
+		return nil
+	}
+	return unmarshal((*plainDestination)(d))
+}
+
+// MarshalYAML writes destination without options as plain address
+func (d Destination) MarshalYAML() (interface{}, error) {
+	if d == (Destination{Address: d.Address}) {
+		return d.Address, nil
+	}
+	return plainDestination(d), nil
+}
+
+// MarshalJSON writes destination as object
+func (d Destination) MarshalJSON() ([]byte, error) {
+	result := destinationJSON{Address: d.Address, Weight: d.Weight, Backup: d.Backup, MaxConns: d.MaxConns, MaxPending: d.MaxPending}
+	if d.SlowStart != 0 {
+		result.SlowStart = d.SlowStart.String()
+	}
+	return json.Marshal(&result)
+}
+
+// UnmarshalJSON accepts both plain address and object
+func (d *Destination) UnmarshalJSON(data []byte) error {
+	var address string
+	if json.Unmarshal(data, &address) == nil {
+		*d = Destination{Address: address}
+		return nil
+	}
+
+	var parsed destinationJSON
+	err := unmarshalJSONStrictly(data, &parsed)
+	if err != nil {
+		return err
+	}
+	*d = Destination{Address: parsed.Address, Weight: parsed.Weight, Backup: parsed.Backup, MaxConns: parsed.MaxConns, MaxPending: parsed.MaxPending}
+	if parsed.SlowStart != "" {
+		d.SlowStart, err = time.ParseDuration(parsed.SlowStart)
+	}
+	return err
+}
+
+// EffectiveWeight returns configured weight or default one
+func (d *Destination) EffectiveWeight() int {
+	if d.Weight == 0 {
+		return 1
+	}
+	return d.Weight
+}
+
+// DestinationAddresses returns addresses of destinations
+func DestinationAddresses(destinations []Destination) []string {
+	addresses := make([]string, 0, len(destinations))
+	for i := range destinations {
+		addresses = append(addresses, destinations[i].Address)
+	}
+	return addresses
+}
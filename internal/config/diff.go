@@ -0,0 +1,172 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+import (
+	"reflect"
+)
+
+// Kinds of changes in Diff
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+// Diff describes difference in colors between two configurations
+type Diff struct {
+	Colors []ColorDiff `json:"colors"`
+}
+
+// ColorDiff describes added, removed or changed color. Service is empty for
+// colors from top level of configuration.
+type ColorDiff struct {
+	Service  string        `json:"service,omitempty"`
+	Name     string        `json:"name"`
+	Change   string        `json:"change"`
+	Backends []BackendDiff `json:"backends,omitempty"`
+}
+
+// BackendDiff describes added, removed or changed backend. Backends are
+// identified by address they listen on and source hostname.
+type BackendDiff struct {
+	ListenOn            string   `json:"listen_on"`
+	Source              string   `json:"source"`
+	Change              string   `json:"change"`
+	AddedDestinations   []string `json:"added_destinations,omitempty"`
+	RemovedDestinations []string `json:"removed_destinations,omitempty"`
+}
+
+// DiffColors computes difference between colors of old and new
+// configurations. Colors of added or removed services are reported as
+// added or removed.
+func DiffColors(oldConfig *Struct, newConfig *Struct) *Diff {
+	diff := &Diff{Colors: []ColorDiff{}}
+
+	oldServices := oldConfig.AllServices()
+	newServices := newConfig.AllServices()
+	oldColors := make(map[string][]Color)
+	for i := range oldServices {
+		oldColors[oldServices[i].Name] = oldServices[i].Colors
+	}
+	newColors := make(map[string][]Color)
+	for i := range newServices {
+		newColors[newServices[i].Name] = newServices[i].Colors
+		diff.Colors = append(diff.Colors, diffServiceColors(newServices[i].Name, oldColors[newServices[i].Name], newServices[i].Colors)...)
+	}
+	for i := range oldServices {
+		if _, ok := newColors[oldServices[i].Name]; !ok {
+			diff.Colors = append(diff.Colors, diffServiceColors(oldServices[i].Name, oldServices[i].Colors, nil)...)
+		}
+	}
+
+	return diff
+}
+
+func diffServiceColors(service string, oldColors []Color, newColors []Color) []ColorDiff {
+	var result []ColorDiff
+	if service == DefaultService {
+		service = ""
+	}
+
+	oldByName := make(map[string]*Color)
+	for i := range oldColors {
+		oldByName[oldColors[i].Name] = &oldColors[i]
+	}
+	newByName := make(map[string]*Color)
+	for i := range newColors {
+		newByName[newColors[i].Name] = &newColors[i]
+	}
+
+	for i := range newColors {
+		newColor := &newColors[i]
+		oldColor, ok := oldByName[newColor.Name]
+		if !ok {
+			result = append(result, ColorDiff{Service: service, Name: newColor.Name, Change: ChangeAdded})
+			continue
+		}
+		backends := diffBackends(oldColor.Backends, newColor.Backends)
+		if len(backends) > 0 {
+			result = append(result, ColorDiff{Service: service, Name: newColor.Name, Change: ChangeChanged, Backends: backends})
+		}
+	}
+	for i := range oldColors {
+		if _, ok := newByName[oldColors[i].Name]; !ok {
+			result = append(result, ColorDiff{Service: service, Name: oldColors[i].Name, Change: ChangeRemoved})
+		}
+	}
+
+	return result
+}
+
+// IsEmpty returns true if there are no changes
+func (d *Diff) IsEmpty() bool {
+	return len(d.Colors) == 0
+}
+
+func diffBackends(oldBackends []BackendConfig, newBackends []BackendConfig) []BackendDiff {
+	var result []BackendDiff
+
+	oldByRoute := make(map[string]*BackendConfig)
+	for i := range oldBackends {
+		oldByRoute[oldBackends[i].route()] = &oldBackends[i]
+	}
+	newByRoute := make(map[string]*BackendConfig)
+	for i := range newBackends {
+		newByRoute[newBackends[i].route()] = &newBackends[i]
+	}
+
+	for i := range newBackends {
+		newBackend := &newBackends[i]
+		oldBackend, ok := oldByRoute[newBackend.route()]
+		if !ok {
+			result = append(result, BackendDiff{
+				ListenOn:          newBackend.ListenOn,
+				Source:            newBackend.Source,
+				Change:            ChangeAdded,
+				AddedDestinations: DestinationAddresses(newBackend.Destinations),
+			})
+			continue
+		}
+		if reflect.DeepEqual(oldBackend, newBackend) {
+			continue
+		}
+		result = append(result, BackendDiff{
+			ListenOn:            newBackend.ListenOn,
+			Source:              newBackend.Source,
+			Change:              ChangeChanged,
+			AddedDestinations:   subtractStrings(DestinationAddresses(newBackend.Destinations), DestinationAddresses(oldBackend.Destinations)),
+			RemovedDestinations: subtractStrings(DestinationAddresses(oldBackend.Destinations), DestinationAddresses(newBackend.Destinations)),
+		})
+	}
+	for i := range oldBackends {
+		if _, ok := newByRoute[oldBackends[i].route()]; !ok {
+			result = append(result, BackendDiff{
+				ListenOn:            oldBackends[i].ListenOn,
+				Source:              oldBackends[i].Source,
+				Change:              ChangeRemoved,
+				RemovedDestinations: DestinationAddresses(oldBackends[i].Destinations),
+			})
+		}
+	}
+
+	return result
+}
+
+// subtractStrings returns items of a which are absent in b
+func subtractStrings(a []string, b []string) []string {
+	present := make(map[string]bool)
+	for _, item := range b {
+		present[item] = true
+	}
+
+	var result []string
+	for _, item := range a {
+		if !present[item] {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
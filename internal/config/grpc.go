@@ -0,0 +1,229 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultGRPCHealthCheckInterval = 5 * time.Second
+	defaultGRPCHealthCheckTimeout  = time.Second
+	defaultGRPCRetryMaxBodySize    = 64 * 1024
+)
+
+// GRPCStatusCodes are gRPC status codes by name
+var GRPCStatusCodes = map[string]int{
+	"OK":                  0,
+	"CANCELLED":           1,
+	"UNKNOWN":             2,
+	"INVALID_ARGUMENT":    3,
+	"DEADLINE_EXCEEDED":   4,
+	"NOT_FOUND":           5,
+	"ALREADY_EXISTS":      6,
+	"PERMISSION_DENIED":   7,
+	"RESOURCE_EXHAUSTED":  8,
+	"FAILED_PRECONDITION": 9,
+	"ABORTED":             10,
+	"OUT_OF_RANGE":        11,
+	"UNIMPLEMENTED":       12,
+	"INTERNAL":            13,
+	"UNAVAILABLE":         14,
+	"DATA_LOSS":           15,
+	"UNAUTHENTICATED":     16,
+}
+
+// GRPC is a gRPC-specific behavior of backend. Destinations should speak
+// HTTP/2, see upstream_h2c.
+type GRPC struct {
+	// Destinations are checked with grpc.health.v1.Health/Check
+	HealthCheck *GRPCHealthCheck `yaml:"health_check,omitempty" json:"health_check,omitempty"`
+	// Requests are routed by gRPC service and method, first matching route
+	// is used. Requests, which match no route, go to backend destinations.
+	Routes []GRPCRoute `yaml:"routes,omitempty" json:"routes,omitempty"`
+}
+
+// GRPCHealthCheck is an active health check of destinations. Destination,
+// which isn't serving, gets requests only if there is nothing else.
+type GRPCHealthCheck struct {
+	// Service to ask about, whole server by default
+	Service string `yaml:"service,omitempty"`
+	// Defaults to 5s
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Defaults to 1s
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// grpcHealthCheckJSON is a JSON form of health check: durations are
+// written as strings, like in configuration file
+type grpcHealthCheckJSON struct {
+	Service  string `json:"service,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+}
+
+// GRPCRoute chooses destinations and retry policy for calls of gRPC service
+type GRPCRoute struct {
+	// Full service name, e.g. "helloworld.Greeter"
+	Service string `yaml:"service" json:"service"`
+	// Method name, all methods of service by default
+	Method string `yaml:"method,omitempty" json:"method,omitempty"`
+	// Destinations of calls, backend ones by default
+	Destinations []Destination `yaml:"destinations,omitempty" json:"destinations,omitempty"`
+	// Retries of failed calls. Request body is kept while destination
+	// reads it, and call is retried only if client sent all of it, so
+	// retries suit unary and server streaming methods only.
+	Retry *GRPCRetry `yaml:"retry,omitempty" json:"retry,omitempty"`
+}
+
+// GRPCRetry is a retry policy of gRPC calls. Calls are retried when
+// connection to destination fails, which counts as UNAVAILABLE, or
+// destination responds with one of statuses without any message, so
+// nothing was sent to client yet.
+type GRPCRetry struct {
+	// Number of retries
+	Attempts int `yaml:"attempts" json:"attempts"`
+	// Status names, e.g. "UNAVAILABLE", which is the only one by default
+	Statuses []string `yaml:"statuses,omitempty" json:"statuses,omitempty"`
+	// Calls with bigger request bodies aren't retried. Defaults to 64 KiB.
+	MaxBodySize int `yaml:"max_body_size,omitempty" json:"max_body_size,omitempty"`
+}
+
+// MarshalJSON writes health check with durations as strings
+func (h GRPCHealthCheck) MarshalJSON() ([]byte, error) {
+	result := grpcHealthCheckJSON{Service: h.Service}
+	if h.Interval != 0 {
+		result.Interval = h.Interval.String()
+	}
+	if h.Timeout != 0 {
+		result.Timeout = h.Timeout.String()
+	}
+	return json.Marshal(&result)
+}
+
+// UnmarshalJSON reads health check with durations as strings
+func (h *GRPCHealthCheck) UnmarshalJSON(data []byte) error {
+	var parsed grpcHealthCheckJSON
+	err := unmarshalJSONStrictly(data, &parsed)
+	if err != nil {
+		return err
+	}
+	*h = GRPCHealthCheck{Service: parsed.Service}
+	if parsed.Interval != "" {
+		h.Interval, err = time.ParseDuration(parsed.Interval)
+		if err != nil {
+			return err
+		}
+	}
+	if parsed.Timeout != "" {
+		h.Timeout, err = time.ParseDuration(parsed.Timeout)
+	}
+	return err
+}
+
+// EffectiveInterval returns configured interval or default one
+func (h *GRPCHealthCheck) EffectiveInterval() time.Duration {
+	if h.Interval == 0 {
+		return defaultGRPCHealthCheckInterval
+	}
+	return h.Interval
+}
+
+// EffectiveTimeout returns configured timeout or default one
+func (h *GRPCHealthCheck) EffectiveTimeout() time.Duration {
+	if h.Timeout == 0 {
+		return defaultGRPCHealthCheckTimeout
+	}
+	return h.Timeout
+}
+
+// EffectiveStatuses returns codes of statuses, which are retried
+func (r *GRPCRetry) EffectiveStatuses() []int {
+	if len(r.Statuses) == 0 {
+		return []int{GRPCStatusCodes["UNAVAILABLE"]}
+	}
+	codes := make([]int, 0, len(r.Statuses))
+	for _, status := range r.Statuses {
+		codes = append(codes, GRPCStatusCodes[status])
+	}
+	return codes
+}
+
+// EffectiveMaxBodySize returns configured body size limit or default one
+func (r *GRPCRetry) EffectiveMaxBodySize() int {
+	if r.MaxBodySize == 0 {
+		return defaultGRPCRetryMaxBodySize
+	}
+	return r.MaxBodySize
+}
+
+// AllDestinations returns destinations of backend and of its gRPC routes
+func (b *BackendConfig) AllDestinations() []Destination {
+	if b.GRPC == nil {
+		return b.Destinations
+	}
+	destinations := append([]Destination(nil), b.Destinations...)
+	for i := range b.GRPC.Routes {
+		destinations = append(destinations, b.GRPC.Routes[i].Destinations...)
+	}
+	return destinations
+}
+
+func (g *GRPC) validate(path string, backend *BackendConfig, problems *Problems) {
+	if !backend.UpstreamH2C && !backend.UpstreamTLSEnabled() {
+		problems.addWarning(path, "gRPC requires HTTP/2, but neither upstream_h2c nor upstream_tls is on")
+	}
+
+	if g.HealthCheck != nil {
+		if g.HealthCheck.Interval < 0 {
+			problems.addError(path+".health_check.interval", "interval can't be negative")
+		}
+		if g.HealthCheck.Timeout < 0 {
+			problems.addError(path+".health_check.timeout", "timeout can't be negative")
+		}
+	}
+
+	for i := range g.Routes {
+		route := &g.Routes[i]
+		routePath := fmt.Sprintf("%s.routes[%d]", path, i)
+		if route.Service == "" || strings.Contains(route.Service, "/") {
+			problems.addError(routePath+".service", "full service name is required, e.g. helloworld.Greeter")
+		}
+		if strings.Contains(route.Method, "/") {
+			problems.addError(routePath+".method", "method name can't contain /")
+		}
+		for k := range route.Destinations {
+			validateDestination(fmt.Sprintf("%s.destinations[%d]", routePath, k), &route.Destinations[k], problems)
+		}
+		if route.Retry != nil {
+			route.Retry.validate(routePath+".retry", problems)
+			if route.Method == "" && route.Retry.Attempts > 0 {
+				problems.addWarning(routePath+".method", "retries suit unary methods only, but route has all methods of service")
+			}
+		}
+	}
+}
+
+func (r *GRPCRetry) validate(path string, problems *Problems) {
+	if r.Attempts < 0 {
+		problems.addError(path+".attempts", "number of retries can't be negative")
+	}
+	if r.MaxBodySize < 0 {
+		problems.addError(path+".max_body_size", "body size can't be negative")
+	}
+	names := make([]string, 0, len(GRPCStatusCodes))
+	for name := range GRPCStatusCodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, status := range r.Statuses {
+		if _, ok := GRPCStatusCodes[status]; !ok {
+			problems.addError(fmt.Sprintf("%s.statuses[%d]", path, i), unsupportedValue(status, names))
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HeaderRules change headers of requests to destinations and of responses
+// to clients
+type HeaderRules struct {
+	// Send RFC 7239 Forwarded header in addition to X-Forwarded-* ones
+	Forwarded bool          `yaml:"forwarded,omitempty" json:"forwarded,omitempty"`
+	Request   HeaderChanges `yaml:"request,omitempty" json:"request,omitempty"`
+	Response  HeaderChanges `yaml:"response,omitempty" json:"response,omitempty"`
+}
+
+// HeaderChanges are applied in order: headers are removed, then set, then
+// added
+type HeaderChanges struct {
+	// Headers to remove
+	Remove []string `yaml:"remove,omitempty" json:"remove,omitempty"`
+	// Headers, which replace existing ones with the same name
+	Set map[string]string `yaml:"set,omitempty" json:"set,omitempty"`
+	// Headers, which are added to existing ones with the same name
+	Add map[string]string `yaml:"add,omitempty" json:"add,omitempty"`
+}
+
+// empty tells if there are no changes at all
+func (h *HeaderRules) empty() bool {
+	return !h.Forwarded && h.Request.empty() && h.Response.empty()
+}
+
+func (h *HeaderChanges) empty() bool {
+	return len(h.Remove) == 0 && len(h.Set) == 0 && len(h.Add) == 0
+}
+
+func (h *HeaderRules) validate(path string, problems *Problems) {
+	h.Request.validate(path+".request", problems)
+	h.Response.validate(path+".response", problems)
+}
+
+func (h *HeaderChanges) validate(path string, problems *Problems) {
+	for i, name := range h.Remove {
+		checkHeaderName(fmt.Sprintf("%s.remove[%d]", path, i), name, problems)
+	}
+	for name, value := range h.Set {
+		checkHeaderName(path+".set."+name, name, problems)
+		checkHeaderValue(path+".set."+name, value, problems)
+	}
+	for name, value := range h.Add {
+		checkHeaderName(path+".add."+name, name, problems)
+		checkHeaderValue(path+".add."+name, value, problems)
+	}
+}
+
+// checkHeaderName checks that name is a token, as required by RFC 7230
+func checkHeaderName(path string, name string, problems *Problems) {
+	if name == "" {
+		problems.addError(path, "header name is required")
+		return
+	}
+	for _, r := range name {
+		if r > 0x7e || r <= 0x20 || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			problems.addError(path, fmt.Sprintf("invalid header name %q", name))
+			return
+		}
+	}
+}
+
+func checkHeaderValue(path string, value string, problems *Problems) {
+	if strings.ContainsAny(value, "\r\n\x00") {
+		problems.addError(path, "header value can't contain line breaks")
+	}
+}
@@ -0,0 +1,15 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+// Log represents application log configuration
+type Log struct {
+	// Level can be "debug" (default), "info", "warn", "error", "fatal" or
+	// "panic"
+	Level string `yaml:"level,omitempty"`
+	// Format can be "console" (human-readable, default) or "json"
+	Format string `yaml:"format,omitempty"`
+	// Where to write log. Defaults to stdout.
+	Output Output `yaml:"output,omitempty"`
+}
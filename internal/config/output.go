@@ -0,0 +1,52 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+// Output represents destination for log-like data
+type Output struct {
+	// Type can be "stdout", "stderr", "file" or "syslog"
+	Type string `yaml:"type"`
+	// Path to file for "file" output type
+	Path string `yaml:"path,omitempty"`
+	// Syslog server parameters for "syslog" output type
+	Syslog Syslog `yaml:"syslog,omitempty"`
+}
+
+// SyslogFacilities are codes of syslog facilities by their names, as
+// defined in RFC 5424
+var SyslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// Syslog represents syslog server configuration. Messages are sent in
+// RFC 5424 format.
+type Syslog struct {
+	// Network can be "udp", "tcp" or "unix"
+	Network string `yaml:"network"`
+	// Address is host:port for network sockets or path for unix socket
+	Address string `yaml:"address"`
+	// Tag is sent as APP-NAME. Defaults to "lbtds".
+	Tag string `yaml:"tag,omitempty"`
+	// Facility name, e.g. "daemon" or "local0". Defaults to "daemon".
+	Facility string `yaml:"facility,omitempty"`
+}
@@ -0,0 +1,240 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+	// Line numbers of values decoded one by one are meaningless
+	yamlLinePrefix = regexp.MustCompile(`^line \d+: `)
+)
+
+// Parse parses configuration file contents and checks them. Configuration
+// is nil only if YAML itself is broken. Configuration shouldn't be used if
+// problems contain errors.
+func Parse(data []byte) (*Struct, Problems) {
+	var problems Problems
+
+	configuration := &Struct{}
+	err := yaml.Unmarshal(data, configuration)
+	typeError, hasTypeErrors := err.(*yaml.TypeError)
+	if err != nil && !hasTypeErrors {
+		problems.addError("", "failed to parse configuration: "+err.Error())
+		return nil, problems
+	}
+
+	var raw interface{}
+	err = yaml.Unmarshal(data, &raw)
+	if err == nil {
+		checkUnknownKeys("", raw, reflect.TypeOf(configuration), &problems)
+	}
+
+	// Values of wrong types are skipped, the rest of file is parsed. yaml
+	// reports them with line numbers only, so they are found again to get
+	// their paths.
+	if hasTypeErrors {
+		found := 0
+		if err == nil {
+			found = checkValueTypes("", raw, reflect.TypeOf(configuration), &problems)
+		}
+		if found == 0 {
+			for _, message := range typeError.Errors {
+				problems.addError("", message)
+			}
+		}
+	}
+
+	problems = append(problems, configuration.Validate()...)
+
+	return configuration, problems
+}
+
+// checkUnknownKeys walks raw YAML document along with configuration
+// structure type and reports keys, which structure doesn't have. These are
+// usually typos, which would be silently ignored otherwise.
+func checkUnknownKeys(path string, raw interface{}, t reflect.Type, problems *Problems) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// Types with custom unmarshaling know their format better, but their
+	// mapping form is still checked against structure fields
+	if reflect.PtrTo(t).Implements(unmarshalerType) {
+		if _, ok := raw.(map[interface{}]interface{}); !ok || t.Kind() != reflect.Struct {
+			return
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		rawMap, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+		fields := make(map[string]reflect.Type)
+		collectYAMLFields(t, fields)
+		for _, item := range sortedItems(rawMap) {
+			fieldType, ok := fields[item.key]
+			if !ok {
+				problems.addError(joinPath(path, item.key), "unknown key")
+				continue
+			}
+			checkUnknownKeys(joinPath(path, item.key), item.value, fieldType, problems)
+		}
+	case reflect.Slice:
+		rawSlice, ok := raw.([]interface{})
+		if !ok {
+			return
+		}
+		for i, item := range rawSlice {
+			checkUnknownKeys(fmt.Sprintf("%s[%d]", path, i), item, t.Elem(), problems)
+		}
+	case reflect.Map:
+		rawMap, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+		for _, item := range sortedItems(rawMap) {
+			checkUnknownKeys(joinPath(path, item.key), item.value, t.Elem(), problems)
+		}
+	}
+}
+
+// checkValueTypes walks raw YAML document along with configuration
+// structure type and reports values, which can't be decoded into their
+// fields. It returns count of reported values.
+func checkValueTypes(path string, raw interface{}, t reflect.Type, problems *Problems) int {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if raw == nil {
+		return 0
+	}
+
+	// Types with custom unmarshaling are decoded as a whole, unless they
+	// are structures in mapping form
+	_, isMap := raw.(map[interface{}]interface{})
+	if reflect.PtrTo(t).Implements(unmarshalerType) && (!isMap || t.Kind() != reflect.Struct) {
+		return checkValueType(path, raw, t, problems)
+	}
+
+	found := 0
+	switch t.Kind() {
+	case reflect.Struct:
+		rawMap, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			return checkValueType(path, raw, t, problems)
+		}
+		fields := make(map[string]reflect.Type)
+		collectYAMLFields(t, fields)
+		for _, item := range sortedItems(rawMap) {
+			// Unknown keys are reported by checkUnknownKeys
+			if fieldType, ok := fields[item.key]; ok {
+				found += checkValueTypes(joinPath(path, item.key), item.value, fieldType, problems)
+			}
+		}
+	case reflect.Slice:
+		rawSlice, ok := raw.([]interface{})
+		if !ok {
+			return checkValueType(path, raw, t, problems)
+		}
+		for i, item := range rawSlice {
+			found += checkValueTypes(fmt.Sprintf("%s[%d]", path, i), item, t.Elem(), problems)
+		}
+	case reflect.Map:
+		rawMap, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			return checkValueType(path, raw, t, problems)
+		}
+		for _, item := range sortedItems(rawMap) {
+			found += checkValueTypes(joinPath(path, item.key), item.value, t.Elem(), problems)
+		}
+	default:
+		return checkValueType(path, raw, t, problems)
+	}
+	return found
+}
+
+// checkValueType decodes single raw value into given type and reports it,
+// if it fails
+func checkValueType(path string, raw interface{}, t reflect.Type, problems *Problems) int {
+	data, err := yaml.Marshal(raw)
+	if err == nil {
+		err = yaml.Unmarshal(data, reflect.New(t).Interface())
+	}
+	if err == nil {
+		return 0
+	}
+
+	message := err.Error()
+	if typeError, ok := err.(*yaml.TypeError); ok && len(typeError.Errors) > 0 {
+		message = typeError.Errors[0]
+	}
+	problems.addError(path, yamlLinePrefix.ReplaceAllString(message, ""))
+	return 1
+}
+
+// collectYAMLFields maps YAML keys of structure to field types the same way
+// yaml.v2 does
+func collectYAMLFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := field.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		tagParts := strings.Split(tag, ",")
+		inline := false
+		for _, flag := range tagParts[1:] {
+			if flag == "inline" {
+				inline = true
+			}
+		}
+		if inline {
+			collectYAMLFields(field.Type, fields)
+			continue
+		}
+		name := tagParts[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+}
+
+type rawItem struct {
+	key   string
+	value interface{}
+}
+
+// sortedItems returns YAML mapping items sorted by key, so problems are
+// always reported in the same order
+func sortedItems(rawMap map[interface{}]interface{}) []rawItem {
+	items := make([]rawItem, 0, len(rawMap))
+	for key, value := range rawMap {
+		items = append(items, rawItem{key: fmt.Sprint(key), value: value})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].key < items[j].key
+	})
+	return items
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
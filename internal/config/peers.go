@@ -0,0 +1,23 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+import (
+	"time"
+)
+
+// Peers configures current color synchronization between several LBTDS
+// instances. Synchronization is enabled when addresses are set.
+type Peers struct {
+	// Name of this instance. Defaults to hostname.
+	NodeID string `yaml:"node_id,omitempty"`
+	// Shared secret, requests between peers are signed with it
+	Secret string `yaml:"secret"`
+	// Management API URLs of other instances, e.g. http://10.0.0.2:4800
+	Addresses []string `yaml:"addresses"`
+	// How often color state is compared with peers. Defaults to 5s.
+	SyncInterval time.Duration `yaml:"sync_interval,omitempty"`
+	// Timeout of requests to peers. Defaults to 2s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
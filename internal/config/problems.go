@@ -0,0 +1,82 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+import (
+	"strings"
+)
+
+// Problem severities
+const (
+	// SeverityError means configuration can't be used
+	SeverityError = "error"
+	// SeverityWarning means configuration works, but may lead to surprises
+	SeverityWarning = "warning"
+)
+
+// Problem is a single configuration problem
+type Problem struct {
+	// YAML path to problematic value, e.g. colors[1].backends[0].listen_on
+	Path     string `json:"path"`
+	Message  string `json:"message"`
+	Severity string `json:"severity"`
+}
+
+// Problems is a list of configuration problems. As an error it describes
+// only problems with error severity.
+type Problems []Problem
+
+func (p Problem) String() string {
+	if p.Path == "" {
+		return p.Message
+	}
+	return p.Path + ": " + p.Message
+}
+
+// HasErrors returns true if there is at least one problem with error
+// severity
+func (p Problems) HasErrors() bool {
+	for i := range p {
+		if p[i].Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// Errors returns only problems with error severity
+func (p Problems) Errors() Problems {
+	return p.filter(SeverityError)
+}
+
+// Warnings returns only problems with warning severity
+func (p Problems) Warnings() Problems {
+	return p.filter(SeverityWarning)
+}
+
+func (p Problems) Error() string {
+	messages := make([]string, 0, len(p))
+	for _, problem := range p.Errors() {
+		messages = append(messages, problem.String())
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (p Problems) filter(severity string) Problems {
+	var result Problems
+	for i := range p {
+		if p[i].Severity == severity {
+			result = append(result, p[i])
+		}
+	}
+	return result
+}
+
+func (p *Problems) addError(path string, message string) {
+	*p = append(*p, Problem{Path: path, Message: message, Severity: SeverityError})
+}
+
+func (p *Problems) addWarning(path string, message string) {
+	*p = append(*p, Problem{Path: path, Message: message, Severity: SeverityWarning})
+}
@@ -4,9 +4,40 @@
 
 package config
 
+import (
+	"time"
+)
+
 // Proxy tells LBTDS where to seek colors config
 type Proxy struct {
+	// Where current color is kept: "file" (default), "kv" (embedded
+	// key-value database) or "http" (remote key-value storage)
 	StorageType string `yaml:"storage_type"`
-	ColorFile   string `yaml:"color_file"`
-	PIDFile     string `yaml:"pid_file,omitempty"`
+	// Path to color file for "file" storage or database for "kv" storage
+	ColorFile string `yaml:"color_file"`
+	// Key of current color in "kv" and "http" storages. Defaults to
+	// "current_color".
+	StorageKey string `yaml:"storage_key,omitempty"`
+	// Base URL of HTTP key-value storage. Value is read with GET and
+	// written with PUT to <storage_url>/<storage_key>.
+	StorageURL string `yaml:"storage_url,omitempty"`
+	// Timeout of HTTP storage requests. Defaults to 5s.
+	StorageTimeout time.Duration `yaml:"storage_timeout,omitempty"`
+	// Minimal interval between HTTP storage checks for changes. Storage
+	// may hold check request until value changes. Defaults to 5s.
+	StoragePollInterval time.Duration `yaml:"storage_poll_interval,omitempty"`
+	PIDFile             string        `yaml:"pid_file,omitempty"`
+	// File where colors, created or changed with API, are kept. Colors
+	// from it are applied on top of configuration file. Colors can't be
+	// changed with API unless it's set.
+	StateFile string `yaml:"state_file,omitempty"`
+	// Header which carries request ID. Defaults to X-Request-ID.
+	RequestIDHeader string `yaml:"request_id_header,omitempty"`
+	// Proxies and load balancers in front of LBTDS. Client address is
+	// taken from X-Forwarded-For only if request came from one of them.
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
+	// Allow colors of service to listen on different addresses. Switching
+	// between such colors stops some listeners and starts others, so it's
+	// a configuration error by default.
+	AllowDifferentListeners bool `yaml:"allow_different_listeners,omitempty"`
 }
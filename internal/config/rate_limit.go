@@ -0,0 +1,90 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+import (
+	"strings"
+)
+
+// Rate limit keys
+const (
+	// RateLimitKeySource limits all requests of backend together
+	RateLimitKeySource = "source"
+	// RateLimitKeyRemoteIP limits requests of each client address
+	RateLimitKeyRemoteIP = "remote_ip"
+	// RateLimitKeyHeaderPrefix followed by header name limits requests
+	// with each value of header, e.g. header:X-API-Key
+	RateLimitKeyHeaderPrefix = "header:"
+	// RateLimitKeyQueryPrefix followed by parameter name limits requests
+	// with each value of query parameter, e.g. query:api_key
+	RateLimitKeyQueryPrefix = "query:"
+
+	defaultRateLimitMaxKeys = 10000
+)
+
+// RateLimit is a token bucket limit of request rate. Requests without
+// header or query parameter, which is a key, are limited by client
+// address.
+type RateLimit struct {
+	// Requests per second
+	Rate float64 `yaml:"rate" json:"rate"`
+	// Number of requests, which can be made at once after pause. Defaults
+	// to rate rounded up.
+	Burst int `yaml:"burst,omitempty" json:"burst,omitempty"`
+	// What requests share bucket: "source" (default), "remote_ip",
+	// "header:<name>" or "query:<name>"
+	Key string `yaml:"key,omitempty" json:"key,omitempty"`
+	// Maximum number of buckets kept, least recently used ones are
+	// forgotten. Defaults to 10000.
+	MaxKeys int `yaml:"max_keys,omitempty" json:"max_keys,omitempty"`
+}
+
+// EffectiveBurst returns configured burst or default one
+func (l *RateLimit) EffectiveBurst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	burst := int(l.Rate)
+	if float64(burst) < l.Rate {
+		burst++
+	}
+	return burst
+}
+
+// EffectiveKey returns configured key or default one
+func (l *RateLimit) EffectiveKey() string {
+	if l.Key == "" {
+		return RateLimitKeySource
+	}
+	return l.Key
+}
+
+// EffectiveMaxKeys returns configured number of buckets or default one
+func (l *RateLimit) EffectiveMaxKeys() int {
+	if l.MaxKeys > 0 {
+		return l.MaxKeys
+	}
+	return defaultRateLimitMaxKeys
+}
+
+func (l *RateLimit) validate(path string, problems *Problems) {
+	if l.Rate <= 0 {
+		problems.addError(path+".rate", "rate should be positive")
+	}
+	if l.Burst < 0 {
+		problems.addError(path+".burst", "burst can't be negative")
+	}
+	if l.MaxKeys < 0 {
+		problems.addError(path+".max_keys", "number of keys can't be negative")
+	}
+
+	key := l.EffectiveKey()
+	switch {
+	case key == RateLimitKeySource || key == RateLimitKeyRemoteIP:
+	case strings.HasPrefix(key, RateLimitKeyHeaderPrefix) && len(key) > len(RateLimitKeyHeaderPrefix):
+	case strings.HasPrefix(key, RateLimitKeyQueryPrefix) && len(key) > len(RateLimitKeyQueryPrefix):
+	default:
+		problems.addError(path+".key", `key should be "source", "remote_ip", "header:<name>" or "query:<name>"`)
+	}
+}
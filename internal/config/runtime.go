@@ -0,0 +1,156 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+import (
+	"gopkg.in/yaml.v2"
+)
+
+// RuntimeColors are changes of colors, made with API. They are kept in
+// state file and applied on top of configuration file: color from state
+// file replaces configured color with the same name or is added after
+// configured ones, deleted colors are removed even if configuration file
+// still has them.
+type RuntimeColors struct {
+	Services []RuntimeServiceColors `yaml:"services"`
+}
+
+// RuntimeServiceColors are runtime changes of colors of single service
+type RuntimeServiceColors struct {
+	Name    string   `yaml:"name"`
+	Colors  []Color  `yaml:"colors,omitempty"`
+	Deleted []string `yaml:"deleted,omitempty"`
+}
+
+// ParseRuntimeColors parses state file contents
+func ParseRuntimeColors(data []byte) (*RuntimeColors, error) {
+	runtimeColors := &RuntimeColors{}
+	err := yaml.UnmarshalStrict(data, runtimeColors)
+	if err != nil {
+		return nil, err
+	}
+	return runtimeColors, nil
+}
+
+// Marshal returns state file contents
+func (r *RuntimeColors) Marshal() ([]byte, error) {
+	return yaml.Marshal(r)
+}
+
+// Apply applies runtime changes to configuration. Colors slices of
+// configuration are replaced, not modified in place. Names of services,
+// which configuration doesn't have, are returned.
+func (r *RuntimeColors) Apply(configuration *Struct) []string {
+	var unknown []string
+
+	configuration.Services = append([]Service(nil), configuration.Services...)
+	for i := range r.Services {
+		changes := &r.Services[i]
+		switch {
+		case changes.Name == DefaultService && len(configuration.Colors) > 0:
+			configuration.Colors = changes.apply(configuration.Colors)
+		case configuration.findNamedService(changes.Name) != nil:
+			service := configuration.findNamedService(changes.Name)
+			service.Colors = changes.apply(service.Colors)
+		default:
+			unknown = append(unknown, changes.Name)
+		}
+	}
+
+	return unknown
+}
+
+// SetColor adds color to service or replaces its color with the same name
+func (r *RuntimeColors) SetColor(serviceName string, color Color) {
+	changes := r.service(serviceName)
+	changes.Deleted = withoutString(changes.Deleted, color.Name)
+	for i := range changes.Colors {
+		if changes.Colors[i].Name == color.Name {
+			changes.Colors[i] = color
+			return
+		}
+	}
+	changes.Colors = append(changes.Colors, color)
+}
+
+// DeleteColor removes color of service
+func (r *RuntimeColors) DeleteColor(serviceName string, name string) {
+	changes := r.service(serviceName)
+	colors := make([]Color, 0, len(changes.Colors))
+	for i := range changes.Colors {
+		if changes.Colors[i].Name != name {
+			colors = append(colors, changes.Colors[i])
+		}
+	}
+	changes.Colors = colors
+	changes.Deleted = append(withoutString(changes.Deleted, name), name)
+}
+
+// Copy returns deep copy of runtime changes
+func (r *RuntimeColors) Copy() *RuntimeColors {
+	result := &RuntimeColors{Services: make([]RuntimeServiceColors, len(r.Services))}
+	for i := range r.Services {
+		result.Services[i].Name = r.Services[i].Name
+		result.Services[i].Deleted = append([]string(nil), r.Services[i].Deleted...)
+		for j := range r.Services[i].Colors {
+			result.Services[i].Colors = append(result.Services[i].Colors, r.Services[i].Colors[j].Copy())
+		}
+	}
+	return result
+}
+
+func (r *RuntimeColors) service(name string) *RuntimeServiceColors {
+	for i := range r.Services {
+		if r.Services[i].Name == name {
+			return &r.Services[i]
+		}
+	}
+	r.Services = append(r.Services, RuntimeServiceColors{Name: name})
+	return &r.Services[len(r.Services)-1]
+}
+
+func (r *RuntimeServiceColors) apply(colors []Color) []Color {
+	result := make([]Color, 0, len(colors)+len(r.Colors))
+	applied := make(map[string]bool)
+	for i := range colors {
+		if isOneOf(colors[i].Name, r.Deleted) {
+			continue
+		}
+		color := colors[i]
+		for j := range r.Colors {
+			if r.Colors[j].Name == color.Name {
+				color = r.Colors[j]
+				applied[color.Name] = true
+			}
+		}
+		result = append(result, color)
+	}
+	for i := range r.Colors {
+		if !applied[r.Colors[i].Name] {
+			result = append(result, r.Colors[i])
+		}
+	}
+	return result
+}
+
+// findNamedService returns service from services section of configuration
+// or nil. Unlike FindService, it returns pointer into configuration itself.
+func (s *Struct) findNamedService(name string) *Service {
+	for i := range s.Services {
+		if s.Services[i].Name == name {
+			return &s.Services[i]
+		}
+	}
+	return nil
+}
+
+func withoutString(values []string, value string) []string {
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != value {
+			result = append(result, v)
+		}
+	}
+	return result
+}
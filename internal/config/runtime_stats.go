@@ -0,0 +1,18 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+import (
+	"time"
+)
+
+// RuntimeStats represents Go runtime statistics collection configuration
+type RuntimeStats struct {
+	// How often statistics are collected. Collecting requires short
+	// stop-the-world pause, so it shouldn't be too often. Defaults to 10s.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Whether last collected memory usage is attached to every log event.
+	// Defaults to true.
+	LogHook *bool `yaml:"log_hook,omitempty"`
+}
@@ -0,0 +1,70 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+const (
+	// DefaultService is a name of service, formed by colors from top level
+	// of configuration
+	DefaultService = "default"
+
+	// Storage key of default service, unless configured otherwise
+	defaultStorageKey = "current_color"
+)
+
+// Service is a set of colors with its own current color. Services are
+// switched independently, but may share listeners: requests are routed to
+// service by hostname.
+type Service struct {
+	Name string `yaml:"name"`
+	// Key, under which current color of service is stored. Defaults to
+	// service name.
+	StorageKey string `yaml:"storage_key,omitempty"`
+	// Color file for file storage or database for kv storage. Defaults to
+	// proxy color file with storage key appended, e.g.
+	// /var/lib/lbtds/current.api. Services of kv storage can share database.
+	ColorFile string  `yaml:"color_file,omitempty"`
+	Colors    []Color `yaml:"colors"`
+}
+
+// AllServices returns every configured service with storage defaults
+// filled in. Colors from top level of configuration form the default
+// service, which goes first.
+func (s *Struct) AllServices() []Service {
+	services := make([]Service, 0, len(s.Services)+1)
+	if len(s.Colors) > 0 {
+		services = append(services, Service{
+			Name:       DefaultService,
+			StorageKey: s.Proxy.StorageKey,
+			ColorFile:  s.Proxy.ColorFile,
+			Colors:     s.Colors,
+		})
+		if services[0].StorageKey == "" {
+			services[0].StorageKey = defaultStorageKey
+		}
+	}
+
+	for _, service := range s.Services {
+		if service.StorageKey == "" {
+			service.StorageKey = service.Name
+		}
+		if service.ColorFile == "" && s.Proxy.ColorFile != "" {
+			service.ColorFile = s.Proxy.ColorFile + "." + service.StorageKey
+		}
+		services = append(services, service)
+	}
+
+	return services
+}
+
+// FindService returns service with given name or nil
+func (s *Struct) FindService(name string) *Service {
+	services := s.AllServices()
+	for i := range services {
+		if services[i].Name == name {
+			return &services[i]
+		}
+	}
+
+	return nil
+}
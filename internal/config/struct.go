@@ -7,7 +7,13 @@ package config
 // Struct is a main configuration structure that holds all other
 // structs within.
 type Struct struct {
-	API    API     `yaml:"api"`
-	Proxy  Proxy   `yaml:"proxy"`
-	Colors []Color `yaml:"colors"`
+	API          API          `yaml:"api"`
+	Proxy        Proxy        `yaml:"proxy"`
+	Log          Log          `yaml:"log,omitempty"`
+	RuntimeStats RuntimeStats `yaml:"runtime_stats,omitempty"`
+	AccessLog    AccessLog    `yaml:"access_log,omitempty"`
+	Tracing      Tracing      `yaml:"tracing,omitempty"`
+	Peers        Peers        `yaml:"peers,omitempty"`
+	Colors       []Color      `yaml:"colors,omitempty"`
+	Services     []Service    `yaml:"services,omitempty"`
 }
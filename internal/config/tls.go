@@ -0,0 +1,206 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// TLSVersions are names of TLS versions, supported in configuration
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsVersionNames returns names of TLS versions from oldest to newest
+func tlsVersionNames() []string {
+	names := make([]string, 0, len(TLSVersions))
+	for name := range TLSVersions {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return TLSVersions[names[i]] < TLSVersions[names[j]]
+	})
+	return names
+}
+
+// FrontendTLS is a TLS configuration of backend listener. Listener, which
+// serves several sources, chooses certificate by SNI.
+type FrontendTLS struct {
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+	// Client certificates, which source asks for
+	ClientAuth *ClientAuth `yaml:"client_auth,omitempty" json:"client_auth,omitempty"`
+}
+
+// ClientAuth is a client certificate authentication of source
+type ClientAuth struct {
+	// "request" lets clients without certificate in, "require" doesn't
+	Mode string `yaml:"mode" json:"mode"`
+	// Certificate authorities, which client certificates are verified with
+	CAFile string `yaml:"ca_file" json:"ca_file"`
+	// Certificate should match any of rules, every verified one is
+	// allowed by default
+	Allow []ClientCertificateRule `yaml:"allow,omitempty" json:"allow,omitempty"`
+	// Headers, which pass verified identity to destinations
+	Headers ClientIdentityHeaders `yaml:"headers,omitempty" json:"headers,omitempty"`
+}
+
+// ClientCertificateRule matches certificate, which matches all of its
+// patterns. In patterns "*" is any string and "?" is any character.
+type ClientCertificateRule struct {
+	// Subject, e.g. "CN=billing,OU=Services,O=Example"
+	Subject string `yaml:"subject,omitempty" json:"subject,omitempty"`
+	// Any of DNS names, email addresses, IP addresses and URIs
+	SAN string `yaml:"san,omitempty" json:"san,omitempty"`
+}
+
+// ClientIdentityHeaders are names of headers with identity of client.
+// Headers with such names, which come from clients, are removed.
+type ClientIdentityHeaders struct {
+	// Subject of certificate
+	Subject string `yaml:"subject,omitempty" json:"subject,omitempty"`
+	// Subject alternative names, separated by comma
+	SAN string `yaml:"san,omitempty" json:"san,omitempty"`
+	// SHA-256 fingerprint of certificate in hex
+	Fingerprint string `yaml:"fingerprint,omitempty" json:"fingerprint,omitempty"`
+}
+
+func (t *FrontendTLS) validate(path string, problems *Problems) {
+	checkKeyPair(path, t.CertFile, t.KeyFile, problems)
+	if t.ClientAuth != nil {
+		t.ClientAuth.validate(path+".client_auth", problems)
+	}
+}
+
+func (a *ClientAuth) validate(path string, problems *Problems) {
+	if !isOneOf(a.Mode, supportedClientAuthModes) {
+		problems.addError(path+".mode", unsupportedValue(a.Mode, supportedClientAuthModes))
+	}
+	checkCAFile(path+".ca_file", a.CAFile, problems)
+	for i, rule := range a.Allow {
+		if rule.Subject == "" && rule.SAN == "" {
+			problems.addError(fmt.Sprintf("%s.allow[%d]", path, i), "subject or san pattern is required")
+		}
+	}
+	for name, header := range map[string]string{"subject": a.Headers.Subject, "san": a.Headers.SAN, "fingerprint": a.Headers.Fingerprint} {
+		if header != "" {
+			checkHeaderName(path+".headers."+name, header, problems)
+		}
+	}
+}
+
+// UpstreamTLS is a TLS configuration of connections to destinations
+type UpstreamTLS struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Certificate authorities, which destination certificates are
+	// verified with. System ones by default.
+	CAFile string `yaml:"ca_file,omitempty" json:"ca_file,omitempty"`
+	// Name, which destination certificates are verified for, instead of
+	// destination host
+	ServerName string `yaml:"server_name,omitempty" json:"server_name,omitempty"`
+	// Client certificate for destinations, which require it
+	CertFile string `yaml:"cert_file,omitempty" json:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty" json:"key_file,omitempty"`
+	// Minimum TLS version: 1.0, 1.1, 1.2 or 1.3. Defaults to 1.2.
+	MinVersion string `yaml:"min_version,omitempty" json:"min_version,omitempty"`
+}
+
+// EffectiveMinVersion returns configured minimum TLS version or default
+// one
+func (t *UpstreamTLS) EffectiveMinVersion() uint16 {
+	if t.MinVersion == "" {
+		return tls.VersionTLS12
+	}
+	return TLSVersions[t.MinVersion]
+}
+
+// UpstreamTLSEnabled checks if requests are sent to destinations with TLS
+func (b *BackendConfig) UpstreamTLSEnabled() bool {
+	return b.UpstreamTLS != nil && b.UpstreamTLS.Enabled
+}
+
+func (t *UpstreamTLS) validate(path string, problems *Problems) {
+	if !t.Enabled {
+		return
+	}
+	if t.CAFile != "" {
+		checkCAFile(path+".ca_file", t.CAFile, problems)
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		checkKeyPair(path, t.CertFile, t.KeyFile, problems)
+	}
+	if t.MinVersion != "" && !isOneOf(t.MinVersion, supportedTLSVersions) {
+		problems.addError(path+".min_version", unsupportedValue(t.MinVersion, supportedTLSVersions))
+	}
+}
+
+// readFile returns contents of file or nil, if it can't be read
+func readFile(path string, filePath string, problems *Problems) []byte {
+	if filePath == "" {
+		problems.addError(path, "file is required")
+		return nil
+	}
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		problems.addError(path, err.Error())
+		return nil
+	}
+	return data
+}
+
+// checkCAFile checks that file has certificate authorities, which can be
+// added to certificate pool
+func checkCAFile(path string, filePath string, problems *Problems) {
+	data := readFile(path, filePath, problems)
+	if data != nil && !x509.NewCertPool().AppendCertsFromPEM(data) {
+		problems.addError(path, "no valid PEM encoded certificates found")
+	}
+}
+
+// checkKeyPair checks that certificate and key are loaded the same way
+// proxies load them, so broken files are refused before configuration is
+// applied
+func checkKeyPair(path string, certFile string, keyFile string, problems *Problems) {
+	certData := readFile(path+".cert_file", certFile, problems)
+	keyData := readFile(path+".key_file", keyFile, problems)
+	if certData == nil || keyData == nil {
+		return
+	}
+	if !hasCertificates(certData) {
+		problems.addError(path+".cert_file", "no valid PEM encoded certificates found")
+		return
+	}
+	if _, err := tls.X509KeyPair(certData, keyData); err != nil {
+		problems.addError(path+".key_file", strings.TrimPrefix(err.Error(), "tls: "))
+	}
+}
+
+// hasCertificates checks that PEM data has certificates and all of them
+// can be parsed
+func hasCertificates(data []byte) bool {
+	found := false
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return found
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return false
+		}
+		found = true
+	}
+}
@@ -0,0 +1,23 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+import (
+	"time"
+)
+
+// Tracing represents distributed tracing configuration. Spans are exported
+// over OTLP/HTTP (JSON encoding) to local collector.
+type Tracing struct {
+	Enabled bool `yaml:"enabled"`
+	// Full URL of collector traces endpoint, e.g.
+	// http://127.0.0.1:4318/v1/traces
+	Endpoint string `yaml:"endpoint"`
+	// Service name reported to collector. Defaults to "lbtds".
+	ServiceName string `yaml:"service_name,omitempty"`
+	// How often collected spans are sent to collector. Defaults to 5s.
+	FlushInterval time.Duration `yaml:"flush_interval,omitempty"`
+	// Maximum count of spans in one export request. Defaults to 512.
+	BatchSize int `yaml:"batch_size,omitempty"`
+}
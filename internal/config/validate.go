@@ -0,0 +1,548 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	supportedBackendTypes    = []string{"http"}
+	supportedStorageTypes    = []string{"file", "kv", "http"}
+	supportedLogLevels       = []string{"debug", "info", "warn", "error", "fatal", "panic"}
+	supportedLogFormats      = []string{"console", "json"}
+	supportedAccessFormats   = []string{"combined", "json", "template"}
+	supportedOutputTypes     = []string{"stdout", "stderr", "file", "syslog"}
+	supportedSyslogNets      = []string{"udp", "tcp", "unix"}
+	supportedProxyProtocol   = []string{"v1", "v2"}
+	supportedTLSVersions     = tlsVersionNames()
+	supportedClientAuthModes = []string{"request", "require"}
+
+	serviceNamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+)
+
+// Validate checks configuration and returns every problem found
+func (s *Struct) Validate() Problems {
+	var problems Problems
+
+	s.validateAPI(&problems)
+	s.validateProxy(&problems)
+	s.validateLog(&problems)
+	s.validatePeers(&problems)
+	s.validateServices(&problems)
+
+	return problems
+}
+
+func (s *Struct) validateAPI(problems *Problems) {
+	if s.API.Port == "" {
+		problems.addError("api.port", "port is required")
+		return
+	}
+	checkPort("api.port", s.API.Port, problems)
+	s.API.Access.validate("api.access", problems)
+}
+
+func (s *Struct) validateProxy(problems *Problems) {
+	if s.Proxy.StorageType != "" && !isOneOf(s.Proxy.StorageType, supportedStorageTypes) {
+		problems.addError("proxy.storage_type", unsupportedValue(s.Proxy.StorageType, supportedStorageTypes))
+		return
+	}
+
+	switch s.Proxy.StorageType {
+	case "http":
+		storageURL, err := url.Parse(s.Proxy.StorageURL)
+		if err != nil || (storageURL.Scheme != "http" && storageURL.Scheme != "https") || storageURL.Host == "" {
+			problems.addError("proxy.storage_url", fmt.Sprintf("invalid storage URL %q", s.Proxy.StorageURL))
+		}
+		if s.Proxy.StorageTimeout < 0 {
+			problems.addError("proxy.storage_timeout", "timeout can't be negative")
+		}
+		if s.Proxy.StoragePollInterval < 0 {
+			problems.addError("proxy.storage_poll_interval", "interval can't be negative")
+		}
+	default:
+		if s.Proxy.ColorFile == "" {
+			problems.addError("proxy.color_file", "color file path is required")
+		} else {
+			checkWritableDirectory("proxy.color_file", s.Proxy.ColorFile, problems)
+		}
+	}
+
+	checkNetworks("proxy.trusted_proxies", s.Proxy.TrustedProxies, problems)
+
+	if s.Proxy.StateFile != "" {
+		checkWritableDirectory("proxy.state_file", s.Proxy.StateFile, problems)
+	}
+}
+
+func (s *Struct) validateLog(problems *Problems) {
+	if s.Log.Level != "" && !isOneOf(s.Log.Level, supportedLogLevels) {
+		problems.addError("log.level", unsupportedValue(s.Log.Level, supportedLogLevels))
+	}
+	if s.Log.Format != "" && !isOneOf(s.Log.Format, supportedLogFormats) {
+		problems.addError("log.format", unsupportedValue(s.Log.Format, supportedLogFormats))
+	}
+	checkOutput("log.output", &s.Log.Output, problems)
+
+	if s.AccessLog.Format != "" && !isOneOf(s.AccessLog.Format, supportedAccessFormats) {
+		problems.addError("access_log.format", unsupportedValue(s.AccessLog.Format, supportedAccessFormats))
+	}
+	if s.AccessLog.Format == "template" && s.AccessLog.Template == "" {
+		problems.addError("access_log.template", "template is required for template format")
+	}
+	for key, ratio := range s.AccessLog.Sampling {
+		if ratio < 0 || ratio > 1 {
+			problems.addError("access_log.sampling."+key, "ratio should be between 0 and 1")
+		}
+	}
+	checkOutput("access_log.output", &s.AccessLog.Output, problems)
+
+	if s.Tracing.Enabled {
+		endpoint, err := url.Parse(s.Tracing.Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			problems.addError("tracing.endpoint", fmt.Sprintf("invalid collector URL %q", s.Tracing.Endpoint))
+		}
+	}
+}
+
+func (s *Struct) validatePeers(problems *Problems) {
+	if len(s.Peers.Addresses) == 0 {
+		return
+	}
+
+	if s.Peers.Secret == "" {
+		problems.addError("peers.secret", "secret is required to sign requests between peers")
+	}
+	for i, address := range s.Peers.Addresses {
+		peerURL, err := url.Parse(address)
+		if err != nil || (peerURL.Scheme != "http" && peerURL.Scheme != "https") || peerURL.Host == "" {
+			problems.addError(fmt.Sprintf("peers.addresses[%d]", i), fmt.Sprintf("invalid peer API URL %q", address))
+		}
+	}
+	if s.Peers.SyncInterval < 0 {
+		problems.addError("peers.sync_interval", "interval can't be negative")
+	}
+	if s.Peers.Timeout < 0 {
+		problems.addError("peers.timeout", "timeout can't be negative")
+	}
+}
+
+func (s *Struct) validateServices(problems *Problems) {
+	if len(s.Colors) == 0 && len(s.Services) == 0 {
+		problems.addError("colors", "there is no colors or services in configuration")
+		return
+	}
+	if len(s.Colors) > 0 {
+		validateColors("colors", s.Colors, s.Proxy.AllowDifferentListeners, problems)
+	}
+
+	serviceNames := make(map[string]int)
+	for i := range s.Services {
+		service := &s.Services[i]
+		servicePath := fmt.Sprintf("services[%d]", i)
+
+		switch {
+		case service.Name == "":
+			problems.addError(servicePath+".name", "service name is required")
+		case !serviceNamePattern.MatchString(service.Name):
+			problems.addError(servicePath+".name", fmt.Sprintf("invalid service name %q, only letters, digits, dots, dashes and underscores are allowed", service.Name))
+		case service.Name == DefaultService && len(s.Colors) > 0:
+			problems.addError(servicePath+".name", fmt.Sprintf("service name %q is reserved for colors from top level of configuration", service.Name))
+		default:
+			if first, ok := serviceNames[service.Name]; ok {
+				problems.addError(servicePath+".name", fmt.Sprintf("duplicate service name %q, already used by services[%d]", service.Name, first))
+			} else {
+				serviceNames[service.Name] = i
+			}
+		}
+
+		if service.ColorFile != "" && s.Proxy.StorageType != "http" {
+			checkWritableDirectory(servicePath+".color_file", service.ColorFile, problems)
+		}
+
+		if len(service.Colors) == 0 {
+			problems.addError(servicePath+".colors", "service has no colors")
+			continue
+		}
+		validateColors(servicePath+".colors", service.Colors, s.Proxy.AllowDifferentListeners, problems)
+	}
+
+	s.checkServicesConflicts(problems)
+	s.checkSharedListeners(problems)
+}
+
+func validateColors(path string, colors []Color, allowDifferentListeners bool, problems *Problems) {
+	colorNames := make(map[string]int)
+	for i := range colors {
+		color := &colors[i]
+		colorPath := fmt.Sprintf("%s[%d]", path, i)
+
+		if color.Name == "" {
+			problems.addError(colorPath+".name", "color name is required")
+		} else if first, ok := colorNames[color.Name]; ok {
+			problems.addError(colorPath+".name", fmt.Sprintf("duplicate color name %q, already used by %s[%d]", color.Name, path, first))
+		} else {
+			colorNames[color.Name] = i
+		}
+
+		if len(color.Backends) == 0 {
+			problems.addError(colorPath+".backends", "color has no backends")
+		}
+
+		// Listener can serve several hostnames, but each of them only once
+		routes := make(map[string]int)
+		for j := range color.Backends {
+			backend := &color.Backends[j]
+			backendPath := fmt.Sprintf("%s.backends[%d]", colorPath, j)
+			validateBackend(backendPath, backend, problems)
+
+			route := backend.route()
+			if first, ok := routes[route]; ok && backend.ListenOn != "" {
+				problems.addError(backendPath+".listen_on", fmt.Sprintf("duplicate listener %s for source %s, already used by %s.backends[%d]", backend.ListenOn, backend.Source, colorPath, first))
+				continue
+			}
+			routes[route] = j
+		}
+	}
+
+	checkListenersConsistency(path, colors, allowDifferentListeners, problems)
+}
+
+// checkServicesConflicts makes sure that services don't intercept requests
+// of each other and don't overwrite stored colors of each other
+func (s *Struct) checkServicesConflicts(problems *Problems) {
+	services := s.AllServices()
+	// Top level colors have no services[] path
+	offset := len(services) - len(s.Services)
+
+	routeOwners := make(map[string]string)
+	storageOwners := make(map[string]string)
+	for i := range services {
+		service := &services[i]
+		servicePath := ""
+		if i >= offset {
+			servicePath = fmt.Sprintf("services[%d].", i-offset)
+		}
+
+		storageID := service.StorageKey
+		switch s.Proxy.StorageType {
+		case "", "file":
+			storageID = service.ColorFile
+		case "kv":
+			storageID = service.ColorFile + " " + service.StorageKey
+		}
+		if owner, ok := storageOwners[storageID]; ok {
+			problems.addError(servicePath+"storage_key", fmt.Sprintf("service %q would share stored color with service %q", service.Name, owner))
+		} else {
+			storageOwners[storageID] = service.Name
+		}
+
+		routes := make(map[string]string)
+		for j := range service.Colors {
+			for k := range service.Colors[j].Backends {
+				backend := &service.Colors[j].Backends[k]
+				route := backend.route()
+				if _, ok := routes[route]; ok {
+					continue
+				}
+				routes[route] = fmt.Sprintf("%scolors[%d].backends[%d].source", servicePath, j, k)
+
+				if owner, ok := routeOwners[route]; ok && owner != service.Name {
+					problems.addError(routes[route], fmt.Sprintf("source %s on %s is already served by service %q", backend.Source, backend.ListenOn, owner))
+					continue
+				}
+				routeOwners[route] = service.Name
+			}
+		}
+	}
+}
+
+func validateBackend(path string, backend *BackendConfig, problems *Problems) {
+	if !isOneOf(backend.Type, supportedBackendTypes) {
+		problems.addError(path+".type", unsupportedValue(backend.Type, supportedBackendTypes))
+	}
+
+	if backend.ListenOn == "" {
+		problems.addError(path+".listen_on", "listen address is required")
+	} else {
+		checkAddress(path+".listen_on", backend.ListenOn, true, problems)
+	}
+
+	if backend.Source == "" {
+		problems.addError(path+".source", "source hostname is required")
+	}
+
+	if len(backend.Destinations) == 0 {
+		problems.addError(path+".destinations", "there is no destinations")
+	}
+	primary := 0
+	limited := 0
+	for k := range backend.Destinations {
+		destination := &backend.Destinations[k]
+		validateDestination(fmt.Sprintf("%s.destinations[%d]", path, k), destination, problems)
+		if destination.MaxConns > 0 {
+			limited++
+		}
+		if !destination.Backup {
+			primary++
+		}
+	}
+	if len(backend.Destinations) > 0 && primary == 0 {
+		problems.addWarning(path+".destinations", "all destinations are backup ones, they will be used as primary")
+	}
+
+	if backend.MaxConns < 0 {
+		problems.addError(path+".max_conns", "connections limit can't be negative")
+	}
+	if backend.MaxPending < 0 {
+		problems.addError(path+".max_pending", "queue size can't be negative")
+	}
+	if backend.QueueTimeout < 0 {
+		problems.addError(path+".queue_timeout", "timeout can't be negative")
+	}
+	if backend.RetryAfter < 0 {
+		problems.addError(path+".retry_after", "duration can't be negative")
+	}
+	if backend.Unavailable.ContentType != "" {
+		_, _, err := mime.ParseMediaType(backend.Unavailable.ContentType)
+		if err != nil {
+			problems.addError(path+".unavailable.content_type", "invalid content type: "+err.Error())
+		}
+	}
+	if backend.PassiveDownTime != nil && *backend.PassiveDownTime < 0 {
+		problems.addError(path+".passive_down_time", "duration can't be negative")
+	}
+	for k := range backend.RateLimits {
+		backend.RateLimits[k].validate(fmt.Sprintf("%s.rate_limits[%d]", path, k), problems)
+	}
+	backend.Access.validate(path+".access", problems)
+	backend.Headers.validate(path+".headers", problems)
+	if backend.SendProxyProtocol != "" && !isOneOf(backend.SendProxyProtocol, supportedProxyProtocol) {
+		problems.addError(path+".send_proxy_protocol", unsupportedValue(backend.SendProxyProtocol, supportedProxyProtocol))
+	}
+	if backend.UpstreamTLS != nil {
+		backend.UpstreamTLS.validate(path+".upstream_tls", problems)
+		if backend.UpstreamTLSEnabled() && backend.UpstreamH2C {
+			problems.addError(path+".upstream_h2c", "h2c is cleartext HTTP/2, HTTP/2 is negotiated with TLS destinations")
+		}
+	}
+	if backend.GRPC != nil {
+		backend.GRPC.validate(path+".grpc", backend, problems)
+	}
+	if backend.TLS != nil {
+		backend.TLS.validate(path+".tls", problems)
+		if backend.H2C {
+			problems.addError(path+".h2c", "h2c is cleartext HTTP/2, listener with TLS negotiates HTTP/2 itself")
+		}
+	}
+
+	if backend.QueueLimit() > 0 && backend.MaxConns == 0 && limited < len(backend.Destinations) {
+		problems.addWarning(path+".max_pending", "requests are queued only when every destination is busy, but some destinations have no max_conns")
+	}
+}
+
+// checkSharedListeners makes sure that all backends on listener, of any
+// service and color, agree on options of listener itself, and that
+// listeners, which accept PROXY protocol, have proxies to accept it from
+func (s *Struct) checkSharedListeners(problems *Problems) {
+	services := s.AllServices()
+	offset := len(services) - len(s.Services)
+
+	options := []struct {
+		key   string
+		value func(backend *BackendConfig) bool
+	}{
+		{"accept_proxy_protocol", func(backend *BackendConfig) bool { return backend.AcceptProxyProtocol }},
+		{"tls", func(backend *BackendConfig) bool { return backend.TLS != nil }},
+		{"h2c", func(backend *BackendConfig) bool { return backend.H2C }},
+	}
+	first := make(map[string]*BackendConfig)
+	for i := range services {
+		servicePath := ""
+		if i >= offset {
+			servicePath = fmt.Sprintf("services[%d].", i-offset)
+		}
+		for j := range services[i].Colors {
+			for k := range services[i].Colors[j].Backends {
+				backend := &services[i].Colors[j].Backends[k]
+				other, ok := first[backend.ListenOn]
+				if !ok {
+					first[backend.ListenOn] = backend
+					if backend.AcceptProxyProtocol && len(s.Proxy.TrustedProxies) == 0 {
+						problems.addError(
+							fmt.Sprintf("%scolors[%d].backends[%d].accept_proxy_protocol", servicePath, j, k),
+							"PROXY protocol header is accepted only from proxy.trusted_proxies, but there are none",
+						)
+					}
+					continue
+				}
+				for _, option := range options {
+					if option.value(backend) != option.value(other) {
+						problems.addError(
+							fmt.Sprintf("%scolors[%d].backends[%d].%s", servicePath, j, k, option.key),
+							fmt.Sprintf("other backends on %s disagree on %s", backend.ListenOn, option.key),
+						)
+					}
+				}
+			}
+		}
+	}
+}
+
+func validateDestination(path string, destination *Destination, problems *Problems) {
+	checkAddress(path, destination.Address, false, problems)
+	if destination.Weight < 0 {
+		problems.addError(path+".weight", "weight can't be negative")
+	}
+	if destination.MaxConns < 0 {
+		problems.addError(path+".max_conns", "connections limit can't be negative")
+	}
+	if destination.MaxPending < 0 {
+		problems.addError(path+".max_pending", "queue size can't be negative")
+	}
+	if destination.SlowStart < 0 {
+		problems.addError(path+".slow_start", "slow start duration can't be negative")
+	}
+}
+
+// checkListenersConsistency reports colors, which listen on different sets
+// of addresses. Switching between such colors stops some listeners and
+// starts others, which is rarely what anyone wants, so it's an error unless
+// explicitly allowed.
+func checkListenersConsistency(path string, colors []Color, allowed bool, problems *Problems) {
+	first := listenersOf(&colors[0])
+	for i := 1; i < len(colors); i++ {
+		current := listenersOf(&colors[i])
+		missing := subtractStrings(first, current)
+		extra := subtractStrings(current, first)
+		if len(missing) == 0 && len(extra) == 0 {
+			continue
+		}
+
+		var differences []string
+		if len(missing) > 0 {
+			differences = append(differences, "missing "+strings.Join(missing, ", "))
+		}
+		if len(extra) > 0 {
+			differences = append(differences, "extra "+strings.Join(extra, ", "))
+		}
+		message := fmt.Sprintf("listeners differ from color %q (%s), switching between these colors is unsafe", colors[0].Name, strings.Join(differences, "; "))
+		if allowed {
+			problems.addWarning(fmt.Sprintf("%s[%d].backends", path, i), message)
+		} else {
+			problems.addError(fmt.Sprintf("%s[%d].backends", path, i), message+"; set proxy.allow_different_listeners to allow it")
+		}
+	}
+}
+
+func listenersOf(color *Color) []string {
+	listeners := make([]string, 0, len(color.Backends))
+	seen := make(map[string]bool)
+	for i := range color.Backends {
+		if !seen[color.Backends[i].ListenOn] {
+			seen[color.Backends[i].ListenOn] = true
+			listeners = append(listeners, color.Backends[i].ListenOn)
+		}
+	}
+	sort.Strings(listeners)
+	return listeners
+}
+
+func checkOutput(path string, output *Output, problems *Problems) {
+	if output.Type != "" && !isOneOf(output.Type, supportedOutputTypes) {
+		problems.addError(path+".type", unsupportedValue(output.Type, supportedOutputTypes))
+		return
+	}
+
+	switch output.Type {
+	case "file":
+		if output.Path == "" {
+			problems.addError(path+".path", "file path is required")
+			return
+		}
+		checkWritableDirectory(path+".path", output.Path, problems)
+	case "syslog":
+		if !isOneOf(output.Syslog.Network, supportedSyslogNets) {
+			problems.addError(path+".syslog.network", unsupportedValue(output.Syslog.Network, supportedSyslogNets))
+		}
+		if output.Syslog.Address == "" {
+			problems.addError(path+".syslog.address", "syslog address is required")
+		}
+		if output.Syslog.Facility != "" {
+			if _, ok := SyslogFacilities[output.Syslog.Facility]; !ok {
+				problems.addError(path+".syslog.facility", fmt.Sprintf("unknown syslog facility %q", output.Syslog.Facility))
+			}
+		}
+	}
+}
+
+// checkAddress checks host:port address. Listen addresses may omit host.
+func checkAddress(path string, address string, listen bool, problems *Problems) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		problems.addError(path, fmt.Sprintf("invalid address %q: %s", address, err.Error()))
+		return
+	}
+	if host == "" && !listen {
+		problems.addError(path, fmt.Sprintf("invalid address %q: missing host", address))
+		return
+	}
+	checkPort(path, port, problems)
+}
+
+func checkPort(path string, port string, problems *Problems) {
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber < 1 || portNumber > 65535 {
+		problems.addError(path, fmt.Sprintf("invalid port %q", port))
+	}
+}
+
+// checkWritableDirectory checks that file can be created in directory
+// where file at given path should be
+func checkWritableDirectory(path string, filePath string, problems *Problems) {
+	normalizedPath, _ := filepath.Abs(filePath)
+	directory := filepath.Dir(normalizedPath)
+
+	info, err := os.Stat(directory)
+	if err != nil {
+		problems.addError(path, fmt.Sprintf("directory %s is not accessible: %s", directory, err.Error()))
+		return
+	}
+	if !info.IsDir() {
+		problems.addError(path, fmt.Sprintf("%s is not a directory", directory))
+		return
+	}
+
+	probe, err := ioutil.TempFile(directory, ".lbtds-check-")
+	if err != nil {
+		problems.addError(path, fmt.Sprintf("directory %s is not writable: %s", directory, err.Error()))
+		return
+	}
+	_ = probe.Close()
+	_ = os.Remove(probe.Name())
+}
+
+func isOneOf(value string, values []string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func unsupportedValue(value string, supported []string) string {
+	return fmt.Sprintf("unsupported value %q, should be one of: %s", value, strings.Join(supported, ", "))
+}
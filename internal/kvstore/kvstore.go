@@ -0,0 +1,287 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package kvstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Record layout: CRC32 of the rest of record, key length, value length,
+// key and value. Value length of deletedValue marks deleted key.
+const (
+	headerSize   = 12
+	deletedValue = ^uint32(0)
+	// Limit for key or value size, protects from allocating garbage sizes
+	maxEntrySize = 1 << 20
+)
+
+var (
+	// ErrLocked is returned when database is opened by another process
+	ErrLocked = errors.New("database is locked by another process")
+	// ErrClosed is returned on operations with closed database
+	ErrClosed = errors.New("database is closed")
+	// ErrTooLarge is returned when key or value exceeds size limit
+	ErrTooLarge = errors.New("key or value is too large")
+)
+
+// DB is an embedded key-value database, kept in single file. Every change
+// is appended to file as checksummed record and synced to disk, so crash
+// in the middle of write loses only this write. File is compacted on open.
+// Only one process can have database opened at a time.
+type DB struct {
+	path  string
+	file  *os.File
+	data  map[string][]byte
+	mutex sync.RWMutex
+}
+
+// Open opens database at given path, creating it if it doesn't exist
+func Open(path string) (*DB, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFile(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	db := &DB{
+		path: path,
+		file: file,
+		data: make(map[string][]byte),
+	}
+
+	records, validSize, err := db.replay()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if records > len(db.data) {
+		err = db.compact()
+	} else {
+		// Drop torn record at the end, if any
+		err = file.Truncate(validSize)
+	}
+	if err != nil {
+		db.file.Close()
+		return nil, err
+	}
+
+	_, err = db.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		db.file.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Get returns value for key. Second return value is false, if there is no
+// such key.
+func (db *DB) Get(key string) ([]byte, bool) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	value, ok := db.data[key]
+	if !ok {
+		return nil, false
+	}
+	result := make([]byte, len(value))
+	copy(result, value)
+	return result, true
+}
+
+// Put sets value for key
+func (db *DB) Put(key string, value []byte) error {
+	if len(key) > maxEntrySize || len(value) > maxEntrySize {
+		return ErrTooLarge
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	err := db.append(key, value, false)
+	if err != nil {
+		return err
+	}
+
+	stored := make([]byte, len(value))
+	copy(stored, value)
+	db.data[key] = stored
+	return nil
+}
+
+// Delete removes key from database
+func (db *DB) Delete(key string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if _, ok := db.data[key]; !ok {
+		return nil
+	}
+
+	err := db.append(key, nil, true)
+	if err != nil {
+		return err
+	}
+
+	delete(db.data, key)
+	return nil
+}
+
+// Close closes database and releases its lock
+func (db *DB) Close() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.file == nil {
+		return ErrClosed
+	}
+	err := db.file.Close()
+	db.file = nil
+	return err
+}
+
+func (db *DB) append(key string, value []byte, deleted bool) error {
+	if db.file == nil {
+		return ErrClosed
+	}
+
+	_, err := db.file.Write(encodeRecord(key, value, deleted))
+	if err != nil {
+		return err
+	}
+	return db.file.Sync()
+}
+
+// replay reads all records from file into memory. It returns count of
+// records read and size of file part, which contains valid records.
+func (db *DB) replay() (int, int64, error) {
+	reader := bufio.NewReader(db.file)
+	header := make([]byte, headerSize)
+	records := 0
+	var validSize int64
+
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return records, validSize, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		checksum := binary.BigEndian.Uint32(header[0:4])
+		keySize := binary.BigEndian.Uint32(header[4:8])
+		valueSize := binary.BigEndian.Uint32(header[8:12])
+		deleted := valueSize == deletedValue
+		if deleted {
+			valueSize = 0
+		}
+		if keySize > maxEntrySize || valueSize > maxEntrySize {
+			return records, validSize, nil
+		}
+
+		body := make([]byte, keySize+valueSize)
+		_, err = io.ReadFull(reader, body)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return records, validSize, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		hash := crc32.NewIEEE()
+		hash.Write(header[4:])
+		hash.Write(body)
+		if hash.Sum32() != checksum {
+			return records, validSize, nil
+		}
+
+		key := string(body[:keySize])
+		if deleted {
+			delete(db.data, key)
+		} else {
+			db.data[key] = body[keySize:]
+		}
+		records++
+		validSize += int64(headerSize) + int64(len(body))
+	}
+}
+
+// compact rewrites database file with live keys only. New file replaces
+// old one atomically.
+func (db *DB) compact() error {
+	temporaryPath := db.path + ".compact"
+	temporary, err := os.OpenFile(temporaryPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(temporary)
+	for key, value := range db.data {
+		_, err = writer.Write(encodeRecord(key, value, false))
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = temporary.Sync()
+	}
+	if err == nil {
+		err = lockFile(temporary)
+	}
+	if err == nil {
+		err = os.Rename(temporaryPath, db.path)
+	}
+	if err != nil {
+		temporary.Close()
+		os.Remove(temporaryPath)
+		return err
+	}
+
+	syncDirectory(filepath.Dir(db.path))
+
+	db.file.Close()
+	db.file = temporary
+	return nil
+}
+
+func encodeRecord(key string, value []byte, deleted bool) []byte {
+	record := make([]byte, headerSize+len(key)+len(value))
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(key)))
+	if deleted {
+		binary.BigEndian.PutUint32(record[8:12], deletedValue)
+	} else {
+		binary.BigEndian.PutUint32(record[8:12], uint32(len(value)))
+	}
+	copy(record[headerSize:], key)
+	copy(record[headerSize+len(key):], value)
+	binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+// syncDirectory makes rename durable
+func syncDirectory(path string) {
+	directory, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	directory.Sync()
+	directory.Close()
+}
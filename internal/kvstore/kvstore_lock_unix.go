@@ -0,0 +1,21 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+//go:build !windows
+// +build !windows
+
+package kvstore
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes exclusive lock on file without waiting for it
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrLocked
+	}
+	return err
+}
@@ -0,0 +1,42 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+//go:build windows
+// +build windows
+
+package kvstore
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	lockfileFailImmediately = 0x00000001
+	lockfileExclusiveLock   = 0x00000002
+	errorLockViolation      = syscall.Errno(33)
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// lockFile takes exclusive lock on file without waiting for it. Whole file
+// is locked, lock is released when file is closed.
+func lockFile(file *os.File) error {
+	overlapped := new(syscall.Overlapped)
+	result, _, err := procLockFileEx.Call(
+		file.Fd(),
+		uintptr(lockfileExclusiveLock|lockfileFailImmediately),
+		0,
+		^uintptr(0)&0xFFFFFFFF,
+		^uintptr(0)&0xFFFFFFFF,
+		uintptr(unsafe.Pointer(overlapped)),
+	)
+	if result != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return ErrLocked
+	}
+	return err
+}
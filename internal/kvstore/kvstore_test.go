@@ -0,0 +1,161 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package kvstore
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testDatabasePath = "/tmp/lbtds-test-kvstore.db"
+
+func openTestDatabase(t *testing.T) *DB {
+	db, err := Open(testDatabasePath)
+	require.Nil(t, err)
+	return db
+}
+
+func appendToDatabase(t *testing.T, data []byte) {
+	file, err := os.OpenFile(testDatabasePath, os.O_WRONLY|os.O_APPEND, 0644)
+	require.Nil(t, err)
+	_, err = file.Write(data)
+	require.Nil(t, err)
+	file.Close()
+}
+
+func databaseSize(t *testing.T) int64 {
+	info, err := os.Stat(testDatabasePath)
+	require.Nil(t, err)
+	return info.Size()
+}
+
+/* kvstore.go */
+
+func TestPutGetDelete(t *testing.T) {
+	os.Remove(testDatabasePath)
+	defer os.Remove(testDatabasePath)
+
+	db := openTestDatabase(t)
+	require.Nil(t, db.Put("color", []byte("green")))
+	require.Nil(t, db.Put("service", []byte("web")))
+	require.Nil(t, db.Delete("service"))
+	// Missing key is deleted without writes
+	size := databaseSize(t)
+	require.Nil(t, db.Delete("missing"))
+	require.Equal(t, size, databaseSize(t))
+
+	// Returned value is a copy
+	value, ok := db.Get("color")
+	require.True(t, ok)
+	value[0] = 'G'
+	value, _ = db.Get("color")
+	require.Equal(t, "green", string(value))
+
+	require.Equal(t, ErrTooLarge, db.Put("color", make([]byte, maxEntrySize+1)))
+	require.Nil(t, db.Close())
+
+	// Deletion survives restart
+	db = openTestDatabase(t)
+	_, ok = db.Get("service")
+	require.False(t, ok)
+	value, ok = db.Get("color")
+	require.True(t, ok)
+	require.Equal(t, "green", string(value))
+	require.Nil(t, db.Close())
+}
+
+func TestLockAndClose(t *testing.T) {
+	os.Remove(testDatabasePath)
+	defer os.Remove(testDatabasePath)
+
+	db := openTestDatabase(t)
+	_, err := Open(testDatabasePath)
+	require.Equal(t, ErrLocked, err)
+
+	require.Nil(t, db.Close())
+	require.Equal(t, ErrClosed, db.Close())
+	require.Equal(t, ErrClosed, db.Put("color", []byte("green")))
+
+	// Lock is released on close
+	db = openTestDatabase(t)
+	require.Nil(t, db.Close())
+}
+
+func TestTornAndTruncatedRecords(t *testing.T) {
+	os.Remove(testDatabasePath)
+	defer os.Remove(testDatabasePath)
+
+	db := openTestDatabase(t)
+	require.Nil(t, db.Put("color", []byte("green")))
+	require.Nil(t, db.Close())
+	validSize := databaseSize(t)
+
+	torn := [][]byte{
+		// Header is cut
+		{0, 1, 2, 3, 4},
+		// Body is cut
+		encodeRecord("color", []byte("blue"), false)[:headerSize+3],
+		// Checksum doesn't match
+		append(encodeRecord("color", []byte("blue"), false)[:headerSize+5], 'B', 'L', 'U', 'E'),
+		// Sizes are garbage
+		{0, 0, 0, 0, 0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 1},
+	}
+	for _, record := range torn {
+		appendToDatabase(t, record)
+
+		// Last good value is kept and torn record is dropped
+		db = openTestDatabase(t)
+		value, ok := db.Get("color")
+		require.True(t, ok)
+		require.Equal(t, "green", string(value))
+		require.Equal(t, validSize, databaseSize(t))
+		require.Nil(t, db.Close())
+	}
+
+	// Writes after recovery aren't lost behind garbage
+	appendToDatabase(t, []byte{0, 1, 2})
+	db = openTestDatabase(t)
+	require.Nil(t, db.Put("color", []byte("blue")))
+	require.Nil(t, db.Close())
+	db = openTestDatabase(t)
+	value, _ := db.Get("color")
+	require.Equal(t, "blue", string(value))
+	require.Nil(t, db.Close())
+}
+
+func TestCompaction(t *testing.T) {
+	os.Remove(testDatabasePath)
+	defer os.Remove(testDatabasePath)
+
+	db := openTestDatabase(t)
+	for _, color := range []string{"green", "blue", "green", "blue"} {
+		require.Nil(t, db.Put("color", []byte(color)))
+	}
+	require.Nil(t, db.Put("service", []byte("web")))
+	require.Nil(t, db.Delete("service"))
+	require.Nil(t, db.Close())
+
+	// Only live keys are left after reopening
+	db = openTestDatabase(t)
+	require.Equal(t, int64(len(encodeRecord("color", []byte("blue"), false))), databaseSize(t))
+	_, err := os.Stat(testDatabasePath + ".compact")
+	require.True(t, os.IsNotExist(err))
+	value, ok := db.Get("color")
+	require.True(t, ok)
+	require.Equal(t, "blue", string(value))
+	_, ok = db.Get("service")
+	require.False(t, ok)
+
+	// Compacted file is still locked and written to
+	_, err = Open(testDatabasePath)
+	require.Equal(t, ErrLocked, err)
+	require.Nil(t, db.Put("color", []byte("green")))
+	require.Nil(t, db.Close())
+	db = openTestDatabase(t)
+	value, _ = db.Get("color")
+	require.Equal(t, "green", string(value))
+	require.Nil(t, db.Close())
+}
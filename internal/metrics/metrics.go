@@ -0,0 +1,253 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric types in Prometheus text exposition format
+const (
+	typeGauge   = "gauge"
+	typeCounter = "counter"
+)
+
+var (
+	families      = make(map[string]*family)
+	familiesMutex sync.RWMutex
+)
+
+// family is a group of metrics with the same name, but different labels
+type family struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+
+	values      map[string]*Value
+	valuesMutex sync.RWMutex
+}
+
+// Value is a single float64 metric value, safe for concurrent use
+type Value struct {
+	labelValues []string
+	bits        uint64
+}
+
+// Gauge is a metric which can go up and down
+type Gauge struct {
+	*Value
+}
+
+// Counter is a metric which can only go up
+type Counter struct {
+	*Value
+}
+
+// GaugeVec is a gauge family partitioned by labels
+type GaugeVec struct {
+	family *family
+}
+
+// CounterVec is a counter family partitioned by labels
+type CounterVec struct {
+	family *family
+}
+
+// NewGauge registers gauge without labels. Registering the same name twice
+// returns the same gauge.
+func NewGauge(name string, help string) Gauge {
+	return Gauge{getFamily(name, help, typeGauge, nil).get(nil)}
+}
+
+// NewGaugeVec registers gauge family with given label names
+func NewGaugeVec(name string, help string, labelNames ...string) GaugeVec {
+	return GaugeVec{getFamily(name, help, typeGauge, labelNames)}
+}
+
+// NewCounter registers counter without labels. Registering the same name
+// twice returns the same counter.
+func NewCounter(name string, help string) Counter {
+	return Counter{getFamily(name, help, typeCounter, nil).get(nil)}
+}
+
+// NewCounterVec registers counter family with given label names
+func NewCounterVec(name string, help string, labelNames ...string) CounterVec {
+	return CounterVec{getFamily(name, help, typeCounter, labelNames)}
+}
+
+// With returns gauge for given label values, in order of label names
+func (v GaugeVec) With(labelValues ...string) Gauge {
+	return Gauge{v.family.get(labelValues)}
+}
+
+// Delete removes gauge with given label values
+func (v GaugeVec) Delete(labelValues ...string) {
+	v.family.delete(labelValues)
+}
+
+// With returns counter for given label values, in order of label names
+func (v CounterVec) With(labelValues ...string) Counter {
+	return Counter{v.family.get(labelValues)}
+}
+
+// Set sets gauge value
+func (g Gauge) Set(value float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(value))
+}
+
+// Add adds delta (possibly negative) to gauge value
+func (g Gauge) Add(delta float64) {
+	g.add(delta)
+}
+
+// Inc increments counter by one
+func (c Counter) Inc() {
+	c.add(1)
+}
+
+// Add adds non-negative delta to counter value
+func (c Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.add(delta)
+}
+
+// Get returns current metric value
+func (v *Value) Get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+func (v *Value) add(delta float64) {
+	for {
+		oldBits := atomic.LoadUint64(&v.bits)
+		newBits := math.Float64bits(math.Float64frombits(oldBits) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, oldBits, newBits) {
+			return
+		}
+	}
+}
+
+func getFamily(name string, help string, metricType string, labelNames []string) *family {
+	familiesMutex.Lock()
+	defer familiesMutex.Unlock()
+
+	f, ok := families[name]
+	if !ok {
+		f = &family{
+			name:       name,
+			help:       help,
+			metricType: metricType,
+			labelNames: labelNames,
+			values:     make(map[string]*Value),
+		}
+		families[name] = f
+	}
+
+	return f
+}
+
+func (f *family) get(labelValues []string) *Value {
+	key := strings.Join(labelValues, "\xff")
+
+	f.valuesMutex.RLock()
+	v, ok := f.values[key]
+	f.valuesMutex.RUnlock()
+	if ok {
+		return v
+	}
+
+	f.valuesMutex.Lock()
+	defer f.valuesMutex.Unlock()
+	v, ok = f.values[key]
+	if !ok {
+		v = &Value{labelValues: labelValues}
+		f.values[key] = v
+	}
+
+	return v
+}
+
+func (f *family) delete(labelValues []string) {
+	f.valuesMutex.Lock()
+	defer f.valuesMutex.Unlock()
+	delete(f.values, strings.Join(labelValues, "\xff"))
+}
+
+// WriteText writes all registered metrics in Prometheus text format
+func WriteText(w io.Writer) error {
+	familiesMutex.RLock()
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	familiesMutex.RUnlock()
+	sort.Strings(names)
+
+	buf := bufio.NewWriter(w)
+	for _, name := range names {
+		familiesMutex.RLock()
+		f := families[name]
+		familiesMutex.RUnlock()
+		f.writeText(buf)
+	}
+
+	return buf.Flush()
+}
+
+func (f *family) writeText(w io.Writer) {
+	f.valuesMutex.RLock()
+	defer f.valuesMutex.RUnlock()
+
+	if len(f.values) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.metricType)
+
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v := f.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", f.name, f.formatLabels(v.labelValues), strconv.FormatFloat(v.Get(), 'g', -1, 64))
+	}
+}
+
+func (f *family) formatLabels(labelValues []string) string {
+	if len(f.labelNames) == 0 {
+		return ""
+	}
+
+	labels := make([]string, 0, len(f.labelNames))
+	for i, labelName := range f.labelNames {
+		value := ""
+		if i < len(labelValues) {
+			value = labelValues[i]
+		}
+		labels = append(labels, labelName+"="+strconv.Quote(value))
+	}
+
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// Handler serves metrics in Prometheus text format
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = WriteText(w)
+}
@@ -0,0 +1,126 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package output
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+)
+
+// Writer is a destination for log-like data, which can be reopened (e.g.
+// after logrotate moved the file away). It is safe for concurrent use.
+type Writer struct {
+	config config.Output
+
+	out    io.Writer
+	file   *os.File
+	syslog *SyslogWriter
+	mutex  sync.Mutex
+}
+
+// Open opens output described by configuration. Empty output type means
+// stdout.
+func Open(cfg config.Output) (*Writer, error) {
+	w := &Writer{config: cfg}
+
+	switch cfg.Type {
+	case "", "stdout":
+		w.out = os.Stdout
+	case "stderr":
+		w.out = os.Stderr
+	case "file":
+		if cfg.Path == "" {
+			return nil, errors.New("file output requires path")
+		}
+		err := w.openFile()
+		if err != nil {
+			return nil, err
+		}
+	case "syslog":
+		syslogWriter, err := NewSyslogWriter(cfg.Syslog)
+		if err != nil {
+			return nil, err
+		}
+		w.syslog = syslogWriter
+		w.out = syslogWriter
+	default:
+		return nil, errors.New("unsupported output type: " + cfg.Type)
+	}
+
+	return w, nil
+}
+
+func (w *Writer) openFile() error {
+	normalizedPath, _ := filepath.Abs(w.config.Path)
+	file, err := os.OpenFile(normalizedPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.out = file
+
+	return nil
+}
+
+// Write writes p to output. Every Write call is expected to carry exactly
+// one log record.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.out.Write(p)
+}
+
+// SyslogWriter returns underlying syslog writer or nil, if output isn't
+// syslog
+func (w *Writer) SyslogWriter() *SyslogWriter {
+	return w.syslog
+}
+
+// IsStandardStream returns true if output is stdout or stderr, where colored
+// output makes sense
+func (w *Writer) IsStandardStream() bool {
+	return w.file == nil && w.syslog == nil
+}
+
+// Reopen reopens output file or reconnects to syslog. It does nothing for
+// standard streams.
+func (w *Writer) Reopen() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	switch {
+	case w.file != nil:
+		// Old file is kept for writes until new one is opened
+		oldFile := w.file
+		err := w.openFile()
+		if err != nil {
+			return err
+		}
+		return oldFile.Close()
+	case w.syslog != nil:
+		return w.syslog.Reconnect()
+	}
+
+	return nil
+}
+
+// Close closes output. Standard streams are left open.
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	switch {
+	case w.file != nil:
+		return w.file.Close()
+	case w.syslog != nil:
+		return w.syslog.Close()
+	}
+
+	return nil
+}
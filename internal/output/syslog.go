@@ -0,0 +1,227 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package output
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"lab.wtfteam.pro/wtfteam/lbtds/internal/config"
+)
+
+// Syslog severities as defined in RFC 5424
+const (
+	SeverityEmergency = 0
+	SeverityCritical  = 2
+	SeverityError     = 3
+	SeverityWarning   = 4
+	SeverityInfo      = 6
+	SeverityDebug     = 7
+)
+
+// SyslogWriter sends messages to syslog server in RFC 5424 format. Over
+// stream sockets messages are framed with octet counting (RFC 6587).
+// Its method set matches zerolog.SyslogWriter.
+type SyslogWriter struct {
+	network  string
+	address  string
+	tag      string
+	hostname string
+	facility int
+
+	conn net.Conn
+	// Stream sockets need framing, datagram ones don't
+	framed bool
+	mutex  sync.Mutex
+}
+
+// NewSyslogWriter connects to syslog server
+func NewSyslogWriter(cfg config.Syslog) (*SyslogWriter, error) {
+	s := &SyslogWriter{
+		network: cfg.Network,
+		address: cfg.Address,
+		tag:     cfg.Tag,
+	}
+	if s.tag == "" {
+		s.tag = "lbtds"
+	}
+
+	facility := cfg.Facility
+	if facility == "" {
+		facility = "daemon"
+	}
+	var ok bool
+	s.facility, ok = config.SyslogFacilities[facility]
+	if !ok {
+		return nil, errors.New("unknown syslog facility: " + facility)
+	}
+
+	switch s.network {
+	case "udp", "tcp", "unix":
+	default:
+		return nil, errors.New("unsupported syslog network: " + s.network)
+	}
+
+	s.hostname, _ = os.Hostname()
+	if s.hostname == "" {
+		s.hostname = "-"
+	}
+
+	err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *SyslogWriter) connect() error {
+	var err error
+	switch s.network {
+	case "unix":
+		// Local syslog daemons usually listen on datagram socket, but some
+		// of them use stream one
+		s.conn, err = net.DialTimeout("unixgram", s.address, 5*time.Second)
+		s.framed = false
+		if err != nil {
+			s.conn, err = net.DialTimeout("unix", s.address, 5*time.Second)
+			s.framed = true
+		}
+	default:
+		s.conn, err = net.DialTimeout(s.network, s.address, 5*time.Second)
+		s.framed = s.network == "tcp"
+	}
+
+	return err
+}
+
+// Reconnect closes current connection to syslog server and opens new one
+func (s *SyslogWriter) Reconnect() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+	return s.connect()
+}
+
+// Close closes connection to syslog server
+func (s *SyslogWriter) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// WriteWithSeverity sends single message with given severity
+func (s *SyslogWriter) WriteWithSeverity(severity int, message string) error {
+	message = strings.TrimRight(message, "\n")
+	record := fmt.Sprintf(
+		"<%d>1 %s %s %s %d - - %s",
+		s.facility*8+severity,
+		time.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname,
+		s.tag,
+		os.Getpid(),
+		message,
+	)
+	if s.framed {
+		record = fmt.Sprintf("%d %s", len(record), record)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conn == nil {
+		err := s.connect()
+		if err != nil {
+			return err
+		}
+	}
+	_, err := s.conn.Write([]byte(record))
+	if err != nil {
+		// Server may be restarted, try once more with new connection
+		_ = s.conn.Close()
+		err = s.connect()
+		if err != nil {
+			return err
+		}
+		_, err = s.conn.Write([]byte(record))
+	}
+
+	return err
+}
+
+// Write sends message with informational severity
+func (s *SyslogWriter) Write(p []byte) (int, error) {
+	err := s.WriteWithSeverity(SeverityInfo, string(p))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteLevel sends message with severity matching zerolog level
+func (s *SyslogWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	severity := SeverityInfo
+	switch level {
+	case zerolog.DebugLevel:
+		severity = SeverityDebug
+	case zerolog.WarnLevel:
+		severity = SeverityWarning
+	case zerolog.ErrorLevel:
+		severity = SeverityError
+	case zerolog.FatalLevel:
+		severity = SeverityEmergency
+	case zerolog.PanicLevel:
+		severity = SeverityCritical
+	}
+	err := s.WriteWithSeverity(severity, string(p))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Debug sends message with debug severity
+func (s *SyslogWriter) Debug(m string) error {
+	return s.WriteWithSeverity(SeverityDebug, m)
+}
+
+// Info sends message with informational severity
+func (s *SyslogWriter) Info(m string) error {
+	return s.WriteWithSeverity(SeverityInfo, m)
+}
+
+// Warning sends message with warning severity
+func (s *SyslogWriter) Warning(m string) error {
+	return s.WriteWithSeverity(SeverityWarning, m)
+}
+
+// Err sends message with error severity
+func (s *SyslogWriter) Err(m string) error {
+	return s.WriteWithSeverity(SeverityError, m)
+}
+
+// Emerg sends message with emergency severity
+func (s *SyslogWriter) Emerg(m string) error {
+	return s.WriteWithSeverity(SeverityEmergency, m)
+}
+
+// Crit sends message with critical severity
+func (s *SyslogWriter) Crit(m string) error {
+	return s.WriteWithSeverity(SeverityCritical, m)
+}
@@ -0,0 +1,113 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+package testshelpers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Certificate is a certificate for TLS testing, written to
+// /tmp/lbtds-test-<name>.pem and /tmp/lbtds-test-<name>-key.pem
+type Certificate struct {
+	CertFile    string
+	KeyFile     string
+	Certificate *x509.Certificate
+	PrivateKey  *ecdsa.PrivateKey
+}
+
+// CreateCertificate creates certificate with given common name for
+// hosts, which are DNS names or IP addresses. Certificate is signed by CA,
+// or it's self-signed CA itself if CA is nil. Certificates can be used by
+// both servers and clients.
+func CreateCertificate(name string, ca *Certificate, hosts ...string) *Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		panic(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"LBTDS tests"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	parent := template
+	signer := key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent = ca.Certificate
+		signer = ca.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		panic(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+
+	result := &Certificate{
+		CertFile:    "/tmp/lbtds-test-" + name + ".pem",
+		KeyFile:     "/tmp/lbtds-test-" + name + "-key.pem",
+		Certificate: certificate,
+		PrivateKey:  key,
+	}
+	err = ioutil.WriteFile(result.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err == nil {
+		err = ioutil.WriteFile(result.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	}
+	if err != nil {
+		fmt.Println("Failed to write certificate: " + err.Error())
+	}
+	return result
+}
+
+// TLSCertificate returns certificate for use in tls.Config
+func (c *Certificate) TLSCertificate() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{c.Certificate.Raw},
+		PrivateKey:  c.PrivateKey,
+		Leaf:        c.Certificate,
+	}
+}
+
+// CertPool returns pool, which trusts certificate
+func (c *Certificate) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.Certificate)
+	return pool
+}
@@ -46,3 +46,24 @@ func FlushConfiguration(templateName string) bool {
 	os.Unsetenv("LBTDS_CONFIG")
 	return true
 }
+
+// RewriteConfiguration changes temporary configuration, created by
+// InitializeConfiguration, with given function. Useful for configuration
+// reload testing.
+func RewriteConfiguration(templateName string, rewrite func(string) string) bool {
+	configPath := "/tmp/lbtds-test-" + templateName + ".yaml"
+
+	configData, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		fmt.Println("Failed to read configuration file: " + err.Error())
+		return false
+	}
+
+	err = ioutil.WriteFile(configPath, []byte(rewrite(string(configData))), 0644)
+	if err != nil {
+		fmt.Println("Failed to write configuration file: " + err.Error())
+		return false
+	}
+
+	return true
+}
@@ -20,7 +20,7 @@ import (
 func HTTPTestRequest(t *testing.T, c *context.Context, reqBody []byte, reqHeaders map[string]string, method string, version string, path string, handler func(w http.ResponseWriter, r *http.Request)) ([]byte, int) {
 	req := httptest.NewRequest(
 		method,
-		"http://"+c.Config.API.Address+":"+c.Config.API.Port+"/api/"+version+"/"+path+"/",
+		"http://"+c.Config().API.Address+":"+c.Config().API.Port+"/api/"+version+"/"+path+"/",
 		bytes.NewBuffer(reqBody),
 	)
 	req.Header.Set("Content-Type", "application/json")
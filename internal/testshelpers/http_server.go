@@ -51,3 +51,48 @@ func CreateHTTPServer(port string, host string, color string, number string) cha
 
 	return closeChan
 }
+
+// CreateHTTPEchoServer creates HTTP server on selected port, which replies
+// with received request headers, one "Name: value" per line. Useful for
+// checking which headers proxy passes to backends.
+func CreateHTTPEchoServer(port string) chan bool {
+	listenAddress := "127.0.0.1:" + port
+	srv := &http.Server{
+		Addr: listenAddress,
+	}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		for header, values := range r.Header {
+			for _, value := range values {
+				_, err := w.Write([]byte(header + ": " + value + "\n"))
+				if err != nil {
+					fmt.Println(err.Error())
+				}
+			}
+		}
+	})
+
+	srv.Handler = mux
+	closeChan := make(chan bool, 1)
+
+	go func() {
+		fmt.Println("Listening on " + listenAddress + " for echoing headers")
+		err := srv.ListenAndServe()
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+	}()
+	go func() {
+		<-closeChan
+		closedownContext, closedownCancel := ctx.WithTimeout(ctx.Background(), 5*time.Second)
+		defer closedownCancel()
+		err := srv.Shutdown(closedownContext)
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+	}()
+
+	return closeChan
+}
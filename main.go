@@ -10,8 +10,11 @@ import (
 	"syscall"
 
 	"lab.wtfteam.pro/wtfteam/lbtds/context"
+	"lab.wtfteam.pro/wtfteam/lbtds/domains/accesslog/v1"
 	"lab.wtfteam.pro/wtfteam/lbtds/domains/colors/v1"
+	"lab.wtfteam.pro/wtfteam/lbtds/domains/peers/v1"
 	"lab.wtfteam.pro/wtfteam/lbtds/domains/proxies/v1"
+	"lab.wtfteam.pro/wtfteam/lbtds/domains/tracing/v1"
 )
 
 func checkStartupState(goodStartupState bool) {
@@ -21,41 +24,71 @@ func checkStartupState(goodStartupState bool) {
 }
 
 func main() {
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+// serve runs load balancer until it receives SIGTERM or SIGINT
+func serve(configPath string) {
 	// Before any real work - lock to OS thread. We shouldn't leave it until
 	// shutdown
 	runtime.LockOSThread()
 
 	// And here is the rock'n'roll starts
 	c := context.NewContext()
+	c.ConfigPath = configPath
 	c.Init()
 
 	checkStartupState(c.InitConfiguration())
+	checkStartupState(c.InitLogger())
+	c.StartRuntimeStats()
 	checkStartupState(c.CheckPIDFile())
 	c.InitAPIServer()
 
-	colorsv1.Initialize(c)
+	checkStartupState(accesslogv1.Initialize(c))
+	tracingv1.Initialize(c)
+	checkStartupState(colorsv1.Initialize(c))
 	proxiesv1.Initialize(c)
+	peersv1.Initialize(c)
 
 	c.StartAPIServer()
 
 	colorsv1.GetCurrentColor()
+	peersv1.Start()
 
 	// CTRL+C handler.
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt)
+	signal.Notify(interrupt, append([]os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP}, reopenSignals...)...)
 	shutdownDone := make(chan bool, 1)
 	go func() {
-		signalThing := <-interrupt
-		if signalThing == syscall.SIGTERM || signalThing == syscall.SIGINT {
-			c.Logger.Info().Msg("Got " + signalThing.String() + " signal, shutting down...")
-			c.SetShutdown()
-			c.Logger.Info().Msg("Shutting down proxy streams...")
-			proxiesv1.Shutdown()
-			c.Shutdown()
-			shutdownDone <- true
+		for signalThing := range interrupt {
+			switch signalThing {
+			case syscall.SIGTERM, syscall.SIGINT:
+				c.Logger.Info().Msg("Got " + signalThing.String() + " signal, shutting down...")
+				c.SetShutdown()
+				peersv1.Shutdown()
+				c.Logger.Info().Msg("Shutting down proxy streams...")
+				proxiesv1.Shutdown()
+				c.Logger.Info().Msg("Flushing traces...")
+				tracingv1.Shutdown()
+				accesslogv1.Shutdown()
+				colorsv1.Shutdown()
+				c.Shutdown()
+				shutdownDone <- true
+				return
+			case syscall.SIGHUP:
+				c.Logger.Info().Msg("Got " + signalThing.String() + " signal, reloading configuration...")
+				_, err := colorsv1.ReloadConfiguration()
+				if err != nil {
+					c.Logger.Error().Err(err).Msg("Configuration reload failed")
+				}
+			default:
+				// Only reopen signals are left. logrotate moved files away, we need to write to new ones
+				c.Logger.Info().Msg("Got " + signalThing.String() + " signal, reopening log files...")
+				c.ReopenLogOutput()
+				accesslogv1.Reopen()
+			}
 		}
 	}()
 
 	<-shutdownDone
-	os.Exit(0)
 }
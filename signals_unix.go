@@ -0,0 +1,15 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reopenSignals make lbtds reopen log files after logrotate
+var reopenSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,14 @@
+// LBTDS — Load balancer that doesn't suck
+// Copyright (c) 2018 Vladimir "fat0troll" Hodakov
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// reopenSignals is empty: there is no logrotate and no SIGUSR1 on Windows
+var reopenSignals []os.Signal